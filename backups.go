@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ------------------- COPIAS DE SEGURIDAD -------------------------
+
+// BACKUP_DIR es la carpeta donde se guardan las copias del censo.
+const BACKUP_DIR = "backups"
+
+// Cuántas copias se conservan: las de los últimos guardados y una por día.
+const BACKUPS_GUARDADOS = 20
+const BACKUPS_DIARIOS = 30
+
+// BackupInfo describe una copia de seguridad para /api/backups.
+type BackupInfo struct {
+	Nombre string    `json:"nombre"`
+	Tipo   string    `json:"tipo"` // "guardado" o "diario"
+	Fecha  time.Time `json:"fecha"`
+	Tamano int64     `json:"tamano"`
+}
+
+// BackupStore permite ver y restaurar las copias de seguridad del censo.
+type BackupStore interface {
+	// Backups devuelve las copias, de la más nueva a la más vieja.
+	Backups() ([]BackupInfo, error)
+	// ReadBackup lee las cabeceras y personas de una copia sin restaurarla.
+	ReadBackup(nombre string) ([]string, []CensusRecord, error)
+	// RestoreBackup reemplaza el censo con una copia. Antes guarda una copia
+	// del censo actual, así la restauración también se puede deshacer.
+	RestoreBackup(nombre string) error
+}
+
+var backups BackupStore
+
+var errBackupNotFound = fmt.Errorf("la copia de seguridad no existe")
+
+// writeFileAtomic escribe primero un archivo temporal en la misma carpeta y
+// después lo renombra encima del original. Si el programa se corta a la mitad,
+// el archivo original queda intacto.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	dir, name := filepath.Split(path)
+	if dir == "" {
+		dir = "."
+	}
+	tmp, err := ioutil.TempFile(dir, "."+name+".tmp-")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), perm)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// backupRotation guarda copias en Dir con nombres como
+// "guardado-20240131-154500.000.xlsx" y "diario-20240131.xlsx". Se conservan
+// las últimas Keep copias de guardado y las últimas KeepDaily diarias. Con
+// Cipher las copias se guardan cifradas.
+type backupRotation struct {
+	Dir       string
+	Ext       string
+	Keep      int
+	KeepDaily int
+	Cipher    *Cipher
+}
+
+const backupTimeFormat = "20060102-150405.000"
+const backupDayFormat = "20060102"
+
+// snapshot crea una copia nueva. write debe escribir la copia en la ruta que
+// recibe, que todavía no existe. Si la copia es igual a la última se descarta,
+// así leer varias veces el mismo archivo no llena la carpeta.
+func (b *backupRotation) snapshot(write func(path string) error) error {
+	if err := os.MkdirAll(b.Dir, 0755); err != nil {
+		return err
+	}
+	now := time.Now()
+	tmp := filepath.Join(b.Dir, ".nueva"+b.Ext)
+	os.Remove(tmp)
+	if err := write(tmp); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	// Se comparan los contenidos descifrados: cifrar dos veces lo mismo no da
+	// los mismos bytes
+	data, err := readEncryptedFile(tmp, b.Cipher)
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	saves := b.names("guardado-")
+	if len(saves) > 0 {
+		last, err := readEncryptedFile(filepath.Join(b.Dir, saves[len(saves)-1]), b.Cipher)
+		if err == nil && bytes.Equal(last, data) {
+			os.Remove(tmp)
+			return nil
+		}
+	}
+	if b.Cipher != nil {
+		if data, err = b.Cipher.Encrypt(data); err == nil {
+			err = ioutil.WriteFile(tmp, data, 0644)
+		}
+		if err != nil {
+			os.Remove(tmp)
+			return err
+		}
+	}
+
+	daily := filepath.Join(b.Dir, "diario-"+now.Format(backupDayFormat)+b.Ext)
+	if _, err := os.Stat(daily); os.IsNotExist(err) {
+		if err := ioutil.WriteFile(daily, data, 0644); err != nil {
+			os.Remove(tmp)
+			return err
+		}
+	}
+	if err := os.Rename(tmp, filepath.Join(b.Dir, "guardado-"+now.Format(backupTimeFormat)+b.Ext)); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	b.prune("guardado-", b.Keep)
+	b.prune("diario-", b.KeepDaily)
+	return nil
+}
+
+// names devuelve los archivos de un tipo ordenados del más viejo al más nuevo.
+func (b *backupRotation) names(prefix string) []string {
+	files, err := ioutil.ReadDir(b.Dir)
+	if err != nil {
+		return nil
+	}
+	var names []string
+	for _, f := range files {
+		if !f.IsDir() && strings.HasPrefix(f.Name(), prefix) && strings.HasSuffix(f.Name(), b.Ext) {
+			names = append(names, f.Name())
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (b *backupRotation) prune(prefix string, keep int) {
+	names := b.names(prefix)
+	for len(names) > keep {
+		if err := os.Remove(filepath.Join(b.Dir, names[0])); err != nil {
+			fmt.Printf("--- ERROR: No se pudo borrar la copia vieja %s: %v ---\n", names[0], err)
+		}
+		names = names[1:]
+	}
+}
+
+func (b *backupRotation) list() ([]BackupInfo, error) {
+	list := []BackupInfo{}
+	for _, tipo := range []string{"guardado", "diario"} {
+		for _, name := range b.names(tipo + "-") {
+			info, err := os.Stat(filepath.Join(b.Dir, name))
+			if err != nil {
+				return nil, err
+			}
+			stamp := strings.TrimSuffix(strings.TrimPrefix(name, tipo+"-"), b.Ext)
+			layout := backupTimeFormat
+			if tipo == "diario" {
+				layout = backupDayFormat
+			}
+			fecha, err := time.ParseInLocation(layout, stamp, time.Local)
+			if err != nil {
+				fecha = info.ModTime()
+			}
+			list = append(list, BackupInfo{Nombre: name, Tipo: tipo, Fecha: fecha, Tamano: info.Size()})
+		}
+	}
+	sort.SliceStable(list, func(i, j int) bool { return list[i].Fecha.After(list[j].Fecha) })
+	return list, nil
+}
+
+// path devuelve la ruta de una copia, sin aceptar nombres que salgan de Dir.
+func (b *backupRotation) path(nombre string) (string, error) {
+	if nombre != filepath.Base(nombre) || !strings.HasSuffix(nombre, b.Ext) ||
+		!(strings.HasPrefix(nombre, "guardado-") || strings.HasPrefix(nombre, "diario-")) {
+		return "", errBackupNotFound
+	}
+	path := filepath.Join(b.Dir, nombre)
+	if _, err := os.Stat(path); err != nil {
+		return "", errBackupNotFound
+	}
+	return path, nil
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeBackup devuelve un write para snapshot que guarda content.
+func writeBackup(content string) func(string) error {
+	return func(path string) error { return ioutil.WriteFile(path, []byte(content), 0644) }
+}
+
+// backupContents devuelve el contenido de las copias de un tipo, de la más
+// vieja a la más nueva.
+func backupContents(t *testing.T, b *backupRotation, prefix string) string {
+	t.Helper()
+	var contents []string
+	for _, name := range b.names(prefix) {
+		data, err := readEncryptedFile(filepath.Join(b.Dir, name), b.Cipher)
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents = append(contents, string(data))
+	}
+	return strings.Join(contents, ",")
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "censo.xlsx")
+	for _, content := range []string{"primero", "segundo"} {
+		if err := writeFileAtomic(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if data, err := ioutil.ReadFile(path); err != nil || string(data) != content {
+			t.Fatalf("el archivo tiene %q, %v; se esperaba %q", data, err, content)
+		}
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("el archivo quedó con permisos %v, %v", info.Mode().Perm(), err)
+	}
+
+	// Si no se puede reemplazar, no queda el temporal
+	target := filepath.Join(dir, "carpeta")
+	if err := os.Mkdir(target, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(target, "dentro"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeFileAtomic(target, []byte("no"), 0644); err == nil {
+		t.Error("writeFileAtomic encima de una carpeta no devolvió un error")
+	}
+	if err := writeFileAtomic(filepath.Join(dir, "no-existe", "censo.xlsx"), []byte("no"), 0644); err == nil {
+		t.Error("writeFileAtomic en una carpeta que no existe no devolvió un error")
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, f := range files {
+		names = append(names, f.Name())
+	}
+	if strings.Join(names, ",") != "carpeta,censo.xlsx" {
+		t.Errorf("la carpeta quedó con %v", names)
+	}
+
+	// Sin carpeta escribe en la actual
+	chdirTemp(t)
+	if err := writeFileAtomic("suelto.json", []byte("[]"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ioutil.ReadFile("suelto.json"); err != nil || string(data) != "[]" {
+		t.Errorf("suelto.json tiene %q, %v", data, err)
+	}
+}
+
+func TestBackupRotationDedupe(t *testing.T) {
+	b := &backupRotation{Dir: filepath.Join(t.TempDir(), "backups"), Ext: ".xlsx", Keep: 5, KeepDaily: 5}
+	for _, content := range []string{"uno", "uno", "dos", "dos", "uno"} {
+		if err := b.snapshot(writeBackup(content)); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(2 * time.Millisecond)
+	}
+	// Solo se descarta la copia igual a la última
+	if got := backupContents(t, b, "guardado-"); got != "uno,dos,uno" {
+		t.Errorf("las copias de guardado son %s, se esperaba uno,dos,uno", got)
+	}
+	// La diaria es la primera del día
+	if got := backupContents(t, b, "diario-"); got != "uno" {
+		t.Errorf("las copias diarias son %s, se esperaba uno", got)
+	}
+	if _, err := os.Stat(filepath.Join(b.Dir, ".nueva.xlsx")); !os.IsNotExist(err) {
+		t.Errorf("quedó el temporal de la copia: %v", err)
+	}
+
+	// Si write falla no queda nada
+	if err := b.snapshot(func(string) error { return os.ErrPermission }); err != os.ErrPermission {
+		t.Errorf("snapshot devolvió %v, se esperaba el error de write", err)
+	}
+	if got := backupContents(t, b, "guardado-"); got != "uno,dos,uno" {
+		t.Errorf("las copias de guardado quedaron %s", got)
+	}
+}
+
+func TestBackupRotationPrune(t *testing.T) {
+	b := &backupRotation{Dir: t.TempDir(), Ext: ".xlsx", Keep: 3, KeepDaily: 2}
+	// Copias diarias de otros días y archivos que no son copias
+	for _, name := range []string{"diario-20240101.xlsx", "diario-20240102.xlsx", "diario-20240103.xlsx", "otro.xlsx", "diario-20240101.db"} {
+		if err := ioutil.WriteFile(filepath.Join(b.Dir, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 1; i <= 5; i++ {
+		if err := b.snapshot(writeBackup(strings.Repeat("x", i))); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(2 * time.Millisecond)
+	}
+	if got := backupContents(t, b, "guardado-"); got != "xxx,xxxx,xxxxx" {
+		t.Errorf("las copias de guardado son %s, se esperaban las 3 últimas", got)
+	}
+	today := "diario-" + time.Now().Format(backupDayFormat) + ".xlsx"
+	if got := strings.Join(b.names("diario-"), ","); got != "diario-20240103.xlsx,"+today {
+		t.Errorf("las copias diarias son %s, se esperaban las 2 últimas", got)
+	}
+	for _, name := range []string{"otro.xlsx", "diario-20240101.db"} {
+		if _, err := os.Stat(filepath.Join(b.Dir, name)); err != nil {
+			t.Errorf("se borró %s, que no es una copia: %v", name, err)
+		}
+	}
+
+	list, err := b.list()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 5 || list[len(list)-1].Nombre != "diario-20240103.xlsx" || list[len(list)-1].Tipo != "diario" {
+		t.Fatalf("list devolvió %+v", list)
+	}
+	for i := 1; i < len(list); i++ {
+		if list[i].Fecha.After(list[i-1].Fecha) {
+			t.Errorf("list no está de la más nueva a la más vieja: %+v", list)
+		}
+	}
+}
+
+func TestBackupRotationPath(t *testing.T) {
+	dir := t.TempDir()
+	b := &backupRotation{Dir: filepath.Join(dir, "backups"), Ext: ".xlsx", Keep: 5, KeepDaily: 5}
+	if err := b.snapshot(writeBackup("copia")); err != nil {
+		t.Fatal(err)
+	}
+	// Archivos que existen pero no son copias de esta rotación
+	for _, name := range []string{filepath.Join(dir, "guardado-fuera.xlsx"), filepath.Join(b.Dir, "otro.xlsx"), filepath.Join(b.Dir, "guardado-1.db")} {
+		if err := ioutil.WriteFile(name, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	name := b.names("guardado-")[0]
+	if path, err := b.path(name); err != nil || path != filepath.Join(b.Dir, name) {
+		t.Errorf("path(%q) = %q, %v", name, path, err)
+	}
+	for _, nombre := range []string{
+		"",
+		"../guardado-fuera.xlsx",
+		"../backups/" + name,
+		"./" + name,
+		"otro.xlsx",
+		"guardado-1.db",
+		"diario-19990101.xlsx",
+		filepath.Join(b.Dir, name),
+		`..\` + name,
+	} {
+		if path, err := b.path(nombre); err != errBackupNotFound {
+			t.Errorf("path(%q) = %q, %v; se esperaba errBackupNotFound", nombre, path, err)
+		}
+	}
+}
+
+func TestExcelStoreRestoreBackup(t *testing.T) {
+	store := newTestExcelStore(t, 3)
+	store.Rotation = &backupRotation{Dir: filepath.Join(t.TempDir(), "backups"), Ext: ".xlsx", Keep: 10, KeepDaily: 10}
+	if err := store.Update(CensusRecord{ID: "p00001", Fields: map[string]string{"Edad": "50"}}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(2 * time.Millisecond)
+	list, err := store.Backups()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// La copia de antes de guardar tiene el censo original
+	if len(list) != 2 || list[0].Tipo != "guardado" {
+		t.Fatalf("Backups devolvió %+v", list)
+	}
+	original := list[0].Nombre
+	_, records, err := store.ReadBackup(original)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 3 || records[1].Fields["Edad"] != "1" {
+		t.Fatalf("la copia tiene %+v", records)
+	}
+
+	if err := store.RestoreBackup(original); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := store.Get("p00001"); got.Fields["Edad"] != "1" {
+		t.Errorf("después de restaurar p00001 tiene Edad %s", got.Fields["Edad"])
+	}
+	// Antes de restaurar se guardó una copia del censo que se reemplazó, así
+	// la restauración también se puede deshacer
+	list, err = store.Backups()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 3 || list[0].Nombre == original {
+		t.Fatalf("después de restaurar Backups devolvió %+v", list)
+	}
+	_, records, err = store.ReadBackup(list[0].Nombre)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if records[1].Fields["Edad"] != "50" {
+		t.Errorf("la copia de antes de restaurar tiene Edad %s, se esperaba 50", records[1].Fields["Edad"])
+	}
+
+	if err := store.RestoreBackup("../censo.xlsx"); err != errBackupNotFound {
+		t.Errorf("restaurar una copia fuera de la carpeta devolvió %v", err)
+	}
+	store.Rotation = nil
+	if _, _, err := store.ReadBackup(original); err != errBackupNotFound {
+		t.Errorf("leer una copia sin copias de seguridad devolvió %v", err)
+	}
+}
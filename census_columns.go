@@ -0,0 +1,205 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ------------------- TIPOS DE LAS COLUMNAS -------------------------
+
+// Tipos de columna para filtrar por rango. Las columnas que no están en
+// censusColumnTypes son texto.
+const (
+	COLUMNA_NUMERO = "numero"
+	// Fechas escritas a mano: 20/11/1985 es día/mes/año
+	COLUMNA_FECHA = "fecha"
+	// Fechas que el libro guarda como fecha de Excel, que se leen mes/día/año
+	// (3/15/2024). Los valores que no pueden ser así se leen día/mes/año.
+	COLUMNA_FECHA_EXCEL = "fecha_excel"
+)
+
+// Asegúrate de que los nombres aquí coincidan EXACTAMENTE con las cabeceras de
+// tu Excel (después de limpiar espacios).
+var censusColumnTypes = map[string]string{
+	"Edad":                COLUMNA_NUMERO,
+	"Fecha de nacimiento": COLUMNA_FECHA,
+	"Marca temporal":      COLUMNA_FECHA_EXCEL,
+	"Fecha de ingreso":    COLUMNA_FECHA_EXCEL,
+	"Fecha de egreso":     COLUMNA_FECHA_EXCEL,
+	"Fecha de re-ingreso": COLUMNA_FECHA_EXCEL,
+}
+
+// compareCell compara una celda con un valor de un filtro: -1 si la celda es
+// menor, 0 si es igual y 1 si es mayor. ok es false si la celda no es del
+// tipo de la columna (una edad vacía, una fecha mal escrita).
+//
+// Las fechas del filtro pueden ser solo un año o un año y un mes: la celda es
+// "igual" si cae dentro, así nacimiento>=2000 empieza el 1 de enero y
+// nacimiento<=2005 termina el 31 de diciembre. En las columnas de texto se
+// compara como números si los dos lo son y si no como texto.
+func compareCell(column, cell, value string) (int, bool) {
+	switch kind := censusColumnTypes[column]; kind {
+	case COLUMNA_NUMERO:
+		a, errA := parseFilterNumber(cell)
+		b, errB := parseFilterNumber(value)
+		if errA != nil || errB != nil {
+			return 0, false
+		}
+		return compareRange(a, b, b), true
+	case COLUMNA_FECHA, COLUMNA_FECHA_EXCEL:
+		day, err := parseCellDate(cell, kind == COLUMNA_FECHA_EXCEL)
+		if err != nil {
+			return 0, false
+		}
+		lo, hi, err := parseFilterDate(value)
+		if err != nil {
+			return 0, false
+		}
+		return compareRange(float64(day), float64(lo), float64(hi)), true
+	}
+
+	a, errA := parseFilterNumber(cell)
+	b, errB := parseFilterNumber(value)
+	if errA == nil && errB == nil {
+		return compareRange(a, b, b), true
+	}
+	return strings.Compare(foldText(cell), foldText(value)), true
+}
+
+func compareRange(v, lo, hi float64) int {
+	switch {
+	case v < lo:
+		return -1
+	case v > hi:
+		return 1
+	}
+	return 0
+}
+
+// checkFilterValue revisa que el valor de un filtro sirva para comparar con
+// la columna, para responder con el error en lugar de no encontrar a nadie.
+func checkFilterValue(column, value string) error {
+	switch censusColumnTypes[column] {
+	case COLUMNA_NUMERO:
+		if _, err := parseFilterNumber(value); err != nil {
+			return fmt.Errorf("%s es un número y %q no lo es", column, value)
+		}
+	case COLUMNA_FECHA, COLUMNA_FECHA_EXCEL:
+		if _, _, err := parseFilterDate(value); err != nil {
+			return fmt.Errorf("%s es una fecha: %v", column, err)
+		}
+	}
+	return nil
+}
+
+func parseFilterNumber(s string) (float64, error) {
+	return strconv.ParseFloat(strings.Replace(strings.TrimSpace(s), ",", ".", 1), 64)
+}
+
+// Las fechas se comparan como números AAAAMMDD.
+func dateNumber(year, month, day int) int {
+	return year*10000 + month*100 + day
+}
+
+// parseFilterDate lee la fecha de un filtro y devuelve el primer y el último
+// día que abarca. Acepta 2005-12-31, 31/12/2005 (día primero), 2005-12 y 2005.
+func parseFilterDate(s string) (int, int, error) {
+	s = strings.TrimSpace(s)
+	if strings.Contains(s, "/") {
+		day, err := parseCellDate(s, false)
+		return day, day, err
+	}
+	parts := strings.Split(s, "-")
+	if len(parts) > 3 {
+		return 0, 0, fmt.Errorf("%q no es una fecha", s)
+	}
+	nums := make([]int, len(parts))
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			return 0, 0, fmt.Errorf("%q no es una fecha (use 2005-12-31, 31/12/2005, 2005-12 o 2005)", s)
+		}
+		nums[i] = n
+	}
+	switch len(nums) {
+	case 1:
+		return dateNumber(nums[0], 1, 1), dateNumber(nums[0], 12, 31), nil
+	case 2:
+		if nums[1] < 1 || nums[1] > 12 {
+			return 0, 0, fmt.Errorf("%q no es un mes", s)
+		}
+		return dateNumber(nums[0], nums[1], 1), dateNumber(nums[0], nums[1], 31), nil
+	}
+	if !validDate(nums[0], nums[1], nums[2]) {
+		return 0, 0, fmt.Errorf("%q no es una fecha", s)
+	}
+	day := dateNumber(nums[0], nums[1], nums[2])
+	return day, day, nil
+}
+
+// parseCellDate lee una fecha del libro, sin la hora si la tiene, o el número
+// con que Excel guarda las fechas. Con
+// monthFirst, 4/5/2024 es el 5 de abril; si uno de los dos números pasa de 12
+// no hay duda de cuál es el día. Los años de dos cifras son de este siglo
+// hasta el 69.
+func parseCellDate(s string, monthFirst bool) (int, error) {
+	s = strings.TrimSpace(s)
+	if i := strings.IndexAny(s, " T"); i >= 0 {
+		s = s[:i]
+	}
+	if serial, err := strconv.ParseFloat(s, 64); err == nil && serial >= 10000 && serial < 100000 {
+		// Fecha guardada como número de Excel (días desde el 30/12/1899). Solo
+		// los de cinco cifras (1927 a 2173): un año suelto como 1985 no lo es.
+		t := time.Date(1899, 12, 30, 0, 0, 0, 0, time.UTC).AddDate(0, 0, int(serial))
+		return dateNumber(t.Year(), int(t.Month()), t.Day()), nil
+	}
+	sep := "/"
+	if !strings.Contains(s, sep) {
+		sep = "-"
+	}
+	parts := strings.Split(s, sep)
+	if len(parts) != 3 {
+		return 0, fmt.Errorf("%q no es una fecha", s)
+	}
+	var nums [3]int
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			return 0, fmt.Errorf("%q no es una fecha", s)
+		}
+		nums[i] = n
+	}
+
+	var year, month, day int
+	switch {
+	case len(parts[0]) == 4:
+		year, month, day = nums[0], nums[1], nums[2]
+	case nums[0] > 12 || !monthFirst && nums[1] <= 12:
+		day, month, year = nums[0], nums[1], nums[2]
+	default:
+		month, day, year = nums[0], nums[1], nums[2]
+	}
+	if len(parts[2]) == 2 && len(parts[0]) != 4 {
+		if year < 70 {
+			year += 2000
+		} else {
+			year += 1900
+		}
+	}
+	if !validDate(year, month, day) {
+		return 0, fmt.Errorf("%q no es una fecha", s)
+	}
+	return dateNumber(year, month, day), nil
+}
+
+// validDate dice si el día existe en ese mes: el 31/02 o el 29/02 de un año
+// que no es bisiesto no.
+func validDate(year, month, day int) bool {
+	if month < 1 || month > 12 || day < 1 {
+		return false
+	}
+	t := time.Date(year, time.Month(month), day, 0, 0, 0, 0, time.UTC)
+	return t.Day() == day
+}
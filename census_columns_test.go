@@ -0,0 +1,156 @@
+package main
+
+import "testing"
+
+func TestParseCellDate(t *testing.T) {
+	tests := []struct {
+		cell       string
+		monthFirst bool
+		want       int // 0 si no es una fecha
+	}{
+		{"20/11/1985", false, 19851120},
+		{"4/5/2024", false, 20240504},
+		{"4/5/2024", true, 20240405},
+		// Si uno de los dos pasa de 12 no hay duda de cuál es el día
+		{"13/5/2024", true, 20240513},
+		{"5/13/2024", false, 20240513},
+		{"15-03-2024", false, 20240315},
+		{"2024-03-15", true, 20240315},
+		{"2024/03/15", false, 20240315},
+		{" 3/15/2024 10:30:00 ", true, 20240315},
+		{"2024-03-15T10:30:00", false, 20240315},
+		// Números con que Excel guarda las fechas
+		{"45366", true, 20240315},
+		{"45366.75", false, 20240315},
+		{"36526", false, 20000101},
+		// Años de dos cifras
+		{"20/11/85", false, 19851120},
+		{"01/02/05", false, 20050201},
+		{"01/02/69", false, 20690201},
+		{"01/02/70", false, 19700201},
+		{"29/02/2024", false, 20240229},
+		// Fechas que no existen
+		{"31/02/2024", false, 0},
+		{"29/02/2023", false, 0},
+		{"31/04/2024", false, 0},
+		{"2/31/2024", true, 0},
+		{"13/13/2024", false, 0},
+		{"00/01/2024", false, 0},
+		{"2024-00-10", false, 0},
+		// Lo que no es una fecha
+		{"1985", false, 0},
+		{"", false, 0},
+		{"1/2", false, 0},
+		{"ayer", false, 0},
+		{"1/2/3/4", false, 0},
+	}
+	for _, tt := range tests {
+		got, err := parseCellDate(tt.cell, tt.monthFirst)
+		if tt.want == 0 {
+			if err == nil {
+				t.Errorf("parseCellDate(%q, %v) = %d, se esperaba un error", tt.cell, tt.monthFirst, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("parseCellDate(%q, %v) = %d, %v; se esperaba %d", tt.cell, tt.monthFirst, got, err, tt.want)
+		}
+	}
+}
+
+func TestParseFilterDate(t *testing.T) {
+	tests := []struct {
+		value  string
+		lo, hi int // 0 si no es una fecha
+	}{
+		{"2005", 20050101, 20051231},
+		{"2005-02", 20050201, 20050231},
+		{"2005-12-31", 20051231, 20051231},
+		{"31/12/2005", 20051231, 20051231},
+		{"4/5/2005", 20050504, 20050504},
+		{" 2005 ", 20050101, 20051231},
+		{"2005-13", 0, 0},
+		{"2005-02-30", 0, 0},
+		{"31/02/2005", 0, 0},
+		{"2005-1-2-3", 0, 0},
+		{"dos mil", 0, 0},
+		{"", 0, 0},
+	}
+	for _, tt := range tests {
+		lo, hi, err := parseFilterDate(tt.value)
+		if tt.lo == 0 {
+			if err == nil {
+				t.Errorf("parseFilterDate(%q) = %d, %d; se esperaba un error", tt.value, lo, hi)
+			}
+			continue
+		}
+		if err != nil || lo != tt.lo || hi != tt.hi {
+			t.Errorf("parseFilterDate(%q) = %d, %d, %v; se esperaba %d, %d", tt.value, lo, hi, err, tt.lo, tt.hi)
+		}
+	}
+}
+
+func TestFilterRanges(t *testing.T) {
+	between := func(column, min, max string) FilterCondition {
+		return FilterCondition{Column: column, Op: FILTRO_ENTRE, Min: min, Max: max}
+	}
+	tests := []struct {
+		cond FilterCondition
+		in   []string
+		out  []string
+	}{
+		{between("Edad", "0", "5"), []string{"0", "5", "3", "4,0", " 2 "}, []string{"6", "-1", "", "cinco", "5,5"}},
+		{between("Edad", "60", ""), []string{"60", "101"}, []string{"59", ""}},
+		{between("Edad", "", "17"), []string{"0", "17"}, []string{"18", ""}},
+		// Un año solo abarca del 1 de enero al 31 de diciembre
+		{between("Fecha de nacimiento", "2000", "2005"),
+			[]string{"01/01/2000", "31/12/2005", "15/06/2003", "2004-02-29", "3/4/05"},
+			[]string{"31/12/1999", "01/01/2006", "", "31/02/2003", "sin fecha"}},
+		{between("Fecha de nacimiento", "2005-02", "2005-02"),
+			[]string{"01/02/2005", "28/02/2005"}, []string{"31/01/2005", "01/03/2005"}},
+		// Las fechas de Excel se leen mes/día/año si pueden
+		{between("Fecha de ingreso", "2024-03", "2024-03"),
+			[]string{"3/15/2024", "15/3/2024", "3/4/2024", "45366"},
+			[]string{"4/3/2024", "45400"}},
+	}
+	for _, tt := range tests {
+		for _, cell := range tt.in {
+			if !matchFilterCell(tt.cond, cell) {
+				t.Errorf("%s no incluye %q", tt.cond, cell)
+			}
+		}
+		for _, cell := range tt.out {
+			if matchFilterCell(tt.cond, cell) {
+				t.Errorf("%s incluye %q", tt.cond, cell)
+			}
+		}
+	}
+}
+
+func TestCompareCell(t *testing.T) {
+	tests := []struct {
+		column, cell, value string
+		want                int
+		ok                  bool
+	}{
+		{"Edad", "9", "10", -1, true},
+		{"Edad", "10", "9", 1, true},
+		{"Edad", "7,5", "7.5", 0, true},
+		{"Edad", "", "10", 0, false},
+		// nacimiento>=2000 empieza el 1 de enero y nacimiento<=2005 termina el 31 de diciembre
+		{"Fecha de nacimiento", "01/01/2000", "2000", 0, true},
+		{"Fecha de nacimiento", "31/12/2005", "2005", 0, true},
+		{"Fecha de nacimiento", "31/12/1999", "2000", -1, true},
+		{"Fecha de nacimiento", "31/02/2000", "2000", 0, false},
+		// En las columnas de texto los números se comparan como números
+		{"TORRE", "9", "10", -1, true},
+		{"TORRE", "B", "a", 1, true},
+		{"COMUNIDAD", "Río Aro", "rio aro", 0, true},
+	}
+	for _, tt := range tests {
+		got, ok := compareCell(tt.column, tt.cell, tt.value)
+		if ok != tt.ok || ok && got != tt.want {
+			t.Errorf("compareCell(%q, %q, %q) = %d, %v; se esperaba %d, %v", tt.column, tt.cell, tt.value, got, ok, tt.want, tt.ok)
+		}
+	}
+}
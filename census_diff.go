@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ------------------- DIFERENCIAS ENTRE VERSIONES DEL CENSO -------------------------
+
+// FieldDiff es un campo que cambia entre las dos versiones.
+type FieldDiff struct {
+	Campo  string `json:"campo"`
+	Actual string `json:"actual"`
+	Nuevo  string `json:"nuevo"`
+}
+
+// RecordDiff es una persona que está en las dos versiones con valores distintos.
+type RecordDiff struct {
+	Clave   string      `json:"clave"`
+	ID      string      `json:"id"`
+	Nombre  string      `json:"nombre"`
+	Cambios []FieldDiff `json:"cambios"`
+}
+
+// CensusDiff compara el censo actual con otra versión (una copia o un libro
+// que se quiere subir). Agregados son las personas que solo están en la otra
+// versión y Eliminados las que solo están en el censo actual.
+type CensusDiff struct {
+	Clave       string              `json:"clave"`
+	Agregados   []map[string]string `json:"agregados"`
+	Eliminados  []map[string]string `json:"eliminados"`
+	Modificados []RecordDiff        `json:"modificados"`
+	SinCambios  int                 `json:"sin_cambios"`
+}
+
+// diffKey devuelve la clave con la que se empareja a una persona. Por cédula,
+// las personas sin cédula (niños, por ejemplo) o con una cédula repetida se
+// emparejan por ID. Una persona sin ID (un libro que nunca pasó por el
+// programa) o con un ID repetido no se empareja con nadie.
+func diffKey(rec CensusRecord, byCedula bool, seen map[string]bool, n int) string {
+	if byCedula {
+		if cedula := strings.TrimSpace(rec.Value(CEDULA_HEADER)); cedula != "" && !seen["cedula:"+cedula] {
+			seen["cedula:"+cedula] = true
+			return "cedula:" + cedula
+		}
+	}
+	if rec.ID != "" && !seen["id:"+rec.ID] {
+		seen["id:"+rec.ID] = true
+		return "id:" + rec.ID
+	}
+	return fmt.Sprintf("fila:%d", n)
+}
+
+// diffCensus compara dos versiones del censo. Las cabeceras que solo tiene una
+// de las dos también se comparan.
+func diffCensus(currentHeaders []string, current []CensusRecord, otherHeaders []string, other []CensusRecord, byCedula bool) CensusDiff {
+	headers := append([]string{}, currentHeaders...)
+	for _, h := range otherHeaders {
+		if indexOf(headers, h) == -1 {
+			headers = append(headers, h)
+		}
+	}
+
+	diff := CensusDiff{Clave: "id", Agregados: []map[string]string{}, Eliminados: []map[string]string{}, Modificados: []RecordDiff{}}
+	if byCedula {
+		diff.Clave = "cedula"
+	}
+
+	seen := make(map[string]bool)
+	otherByKey := make(map[string]CensusRecord, len(other))
+	var otherKeys []string
+	for i, rec := range other {
+		key := diffKey(rec, byCedula, seen, i)
+		otherByKey[key] = rec
+		otherKeys = append(otherKeys, key)
+	}
+
+	seen = make(map[string]bool)
+	matched := make(map[string]bool, len(current))
+	for i, rec := range current {
+		// Las claves "fila:" del censo actual nunca coinciden con las de la otra versión
+		key := diffKey(rec, byCedula, seen, -1-i)
+		newer, ok := otherByKey[key]
+		if !ok {
+			diff.Eliminados = append(diff.Eliminados, recordJSON(rec))
+			continue
+		}
+		matched[key] = true
+		changes := fieldChanges("", rec.ID, headers, rec.Fields, newer.Fields)
+		if len(changes) == 0 {
+			diff.SinCambios++
+			continue
+		}
+		rd := RecordDiff{Clave: strings.SplitN(key, ":", 2)[1], ID: rec.ID, Nombre: rec.Value("Nombre completo")}
+		for _, c := range changes {
+			rd.Cambios = append(rd.Cambios, FieldDiff{Campo: c.Field, Actual: c.Old, Nuevo: c.New})
+		}
+		diff.Modificados = append(diff.Modificados, rd)
+	}
+
+	for _, key := range otherKeys {
+		if !matched[key] {
+			diff.Agregados = append(diff.Agregados, recordJSON(otherByKey[key]))
+		}
+	}
+	return diff
+}
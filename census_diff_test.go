@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// diffPerson es una persona con nombre, cédula y edad; sin cédula si cedula
+// está vacía.
+func diffPerson(id, nombre, cedula, edad string) CensusRecord {
+	fields := map[string]string{"Nombre completo": nombre, "Edad": edad}
+	if cedula != "" {
+		fields[CEDULA_HEADER] = cedula
+	}
+	return CensusRecord{ID: id, Fields: fields}
+}
+
+// describeDiff resume una diferencia como "+agregados -eliminados
+// ~modificados =sin cambios", con los nombres de las personas.
+func describeDiff(diff CensusDiff) string {
+	names := func(list []map[string]string) string {
+		var out []string
+		for _, rec := range list {
+			out = append(out, rec["Nombre completo"])
+		}
+		return strings.Join(out, ",")
+	}
+	var modified []string
+	for _, rd := range diff.Modificados {
+		var changes []string
+		for _, c := range rd.Cambios {
+			changes = append(changes, fmt.Sprintf("%s:%s>%s", c.Campo, c.Actual, c.Nuevo))
+		}
+		modified = append(modified, rd.Nombre+"("+strings.Join(changes, ";")+")")
+	}
+	return fmt.Sprintf("+%s -%s ~%s =%d", names(diff.Agregados), names(diff.Eliminados), strings.Join(modified, ","), diff.SinCambios)
+}
+
+func TestDiffCensus(t *testing.T) {
+	headers := []string{"Nombre completo", CEDULA_HEADER, "Edad"}
+	current := []CensusRecord{
+		diffPerson("p1", "Ana", "V-1", "30"),
+		diffPerson("p2", "Luis", "V-2", "40"),
+		diffPerson("p3", "Niño", "", "5"),
+		diffPerson("p4", "Eva", "V-4", "70"),
+	}
+	tests := []struct {
+		name     string
+		other    []CensusRecord
+		byCedula bool
+		want     string
+	}{
+		{"iguales", current, false, "+ - ~ =4"},
+		{"por ID", []CensusRecord{
+			diffPerson("p1", "Ana", "V-1", "30"),
+			diffPerson("p2", "Luis", "V-2", "41"),
+			diffPerson("p3", "Niño", "", "5"),
+			diffPerson("p5", "Nueva", "V-5", "20"),
+		}, false, "+Nueva -Eva ~Luis(Edad:40>41) =2"},
+		// El mismo libro bajado de otra computadora tiene otros IDs
+		{"otros IDs por ID", []CensusRecord{
+			diffPerson("x1", "Ana", "V-1", "30"),
+			diffPerson("x2", "Luis", "V-2", "41"),
+		}, false, "+Ana,Luis -Ana,Luis,Niño,Eva ~ =0"},
+		{"otros IDs por cédula", []CensusRecord{
+			diffPerson("x1", "Ana", "V-1", "30"),
+			diffPerson("x2", "Luis", "V-2", "41"),
+		}, true, "+ -Niño,Eva ~Luis(Edad:40>41) =1"},
+		// Sin cédula se empareja por ID
+		{"sin cédula por cédula", []CensusRecord{
+			diffPerson("p3", "Niño", "", "6"),
+			diffPerson("x9", "Otro niño", "", "2"),
+		}, true, "+Otro niño -Ana,Luis,Eva ~Niño(Edad:5>6) =0"},
+		// Por cédula una persona que cambió de ID sigue siendo la misma
+		{"cédula con otro ID", []CensusRecord{diffPerson("p2", "Ana", "V-1", "30")}, true, "+ -Luis,Niño,Eva ~ =1"},
+		// Un libro que nunca pasó por el programa no tiene IDs
+		{"sin ID por ID", []CensusRecord{diffPerson("", "Ana", "V-1", "30")}, false, "+Ana -Ana,Luis,Niño,Eva ~ =0"},
+		{"sin ID por cédula", []CensusRecord{
+			diffPerson("", "Ana", "V-1", "31"),
+			diffPerson("", "Niño", "", "5"),
+		}, true, "+Niño -Luis,Niño,Eva ~Ana(Edad:30>31) =0"},
+		// Un ID repetido se empareja una sola vez
+		{"ID repetido", []CensusRecord{
+			diffPerson("p1", "Ana", "V-1", "30"),
+			diffPerson("p1", "Copia de Ana", "V-1", "30"),
+		}, false, "+Copia de Ana -Luis,Niño,Eva ~ =1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			diff := diffCensus(headers, current, headers, tt.other, tt.byCedula)
+			if got := describeDiff(diff); got != tt.want {
+				t.Errorf("quedó %s, se esperaba %s", got, tt.want)
+			}
+			wantClave := "id"
+			if tt.byCedula {
+				wantClave = "cedula"
+			}
+			if diff.Clave != wantClave {
+				t.Errorf("la clave es %q, se esperaba %q", diff.Clave, wantClave)
+			}
+		})
+	}
+}
+
+func TestDiffCensusRepeatedCedula(t *testing.T) {
+	headers := []string{"Nombre completo", CEDULA_HEADER, "Edad"}
+	// Dos personas con la misma cédula (un error de carga): la primera se
+	// empareja por cédula y la segunda por ID
+	current := []CensusRecord{
+		diffPerson("p1", "Ana", "V-1", "30"),
+		diffPerson("p2", "Ana hija", "V-1", "8"),
+	}
+	other := []CensusRecord{
+		diffPerson("p1", "Ana", "V-1", "30"),
+		diffPerson("p2", "Ana hija", "V-1", "9"),
+	}
+	diff := diffCensus(headers, current, headers, other, true)
+	if got := describeDiff(diff); got != "+ - ~Ana hija(Edad:8>9) =1" {
+		t.Fatalf("quedó %s", got)
+	}
+	if rd := diff.Modificados[0]; rd.Clave != "p2" || rd.ID != "p2" {
+		t.Errorf("Ana hija se emparejó por %q (ID %q), se esperaba su ID", rd.Clave, rd.ID)
+	}
+
+	// La cédula se corrigió en la otra versión: la primera sigue por cédula
+	other[1] = diffPerson("p2", "Ana hija", "V-9", "8")
+	diff = diffCensus(headers, current, headers, other, true)
+	if got := describeDiff(diff); got != "+Ana hija -Ana hija ~ =1" {
+		t.Errorf("con la cédula corregida quedó %s", got)
+	}
+	if diff.Agregados[0]["__id"] != "p2" || diff.Eliminados[0]["__id"] != "p2" {
+		t.Errorf("la diferencia quedó %+v", diff)
+	}
+}
+
+func TestDiffCensusHeaders(t *testing.T) {
+	current := []CensusRecord{
+		{ID: "p1", Fields: map[string]string{"Nombre completo": "Ana", "Edad": "30", "Viejo": "x"}},
+		{ID: "p2", Fields: map[string]string{"Nombre completo": "Luis", "Edad": "40"}},
+	}
+	other := []CensusRecord{
+		{ID: "p1", Fields: map[string]string{"Nombre completo": "Ana", "Edad": "30", "Telefono": "0414"}},
+		{ID: "p2", Fields: map[string]string{"Nombre completo": "Luis", "Edad": "40", "Telefono": ""}},
+	}
+	// Viejo solo está en el censo actual y Telefono solo en la otra versión
+	diff := diffCensus([]string{"Nombre completo", "Edad", "Viejo"}, current, []string{"Nombre completo", "Telefono", "Edad"}, other, false)
+	if got := describeDiff(diff); got != "+ - ~Ana(Viejo:x>;Telefono:>0414) =1" {
+		t.Errorf("quedó %s", got)
+	}
+	// Las listas vacías salen como [] en el JSON
+	if diff.Agregados == nil || diff.Eliminados == nil {
+		t.Errorf("las listas vacías quedaron en nil: %+v", diff)
+	}
+}
+
+func TestDiffKey(t *testing.T) {
+	seen := make(map[string]bool)
+	tests := []struct {
+		rec      CensusRecord
+		byCedula bool
+		n        int
+		want     string
+	}{
+		{diffPerson("p1", "Ana", " V-1 ", ""), true, 0, "cedula:V-1"},
+		{diffPerson("p2", "Otra", "V-1", ""), true, 1, "id:p2"},
+		{diffPerson("p3", "Niño", "", ""), true, 2, "id:p3"},
+		{diffPerson("p1", "Ana", "V-7", ""), false, 3, "id:p1"},
+		{diffPerson("p1", "Repetida", "", ""), false, 4, "fila:4"},
+		{diffPerson("", "Sin ID", "", ""), true, 5, "fila:5"},
+		// La cédula se busca aunque la columna tenga otro nombre
+		{CensusRecord{ID: "p9", Fields: map[string]string{"CEDULA DE IDENTIDAD": "V-2"}}, true, 6, "cedula:V-2"},
+	}
+	for _, tt := range tests {
+		if got := diffKey(tt.rec, tt.byCedula, seen, tt.n); got != tt.want {
+			t.Errorf("diffKey(%s, %v) = %s, se esperaba %s", tt.rec.ID, tt.byCedula, got, tt.want)
+		}
+	}
+}
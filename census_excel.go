@@ -0,0 +1,746 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/360EntSecGroup-Skylar/excelize/v2"
+)
+
+// ExcelStore guarda el censo en una hoja de un archivo Excel. Cada persona
+// tiene un ID fijo en la columna ID_HEADER, que no cambia al borrar o
+// insertar filas.
+//
+// Todas las escrituras pasan por mu: cada una abre, modifica y guarda el libro
+// sin que otra escritura se meta en el medio, así no se pierden cambios. Las
+// lecturas esperan a que termine la escritura en curso y nunca ven un archivo
+// guardado a medias.
+//
+// Cada guardado escribe un archivo nuevo y lo renombra encima del anterior, y
+// antes deja una copia del libro anterior en Rotation (si no es nil). Con
+// Cipher el archivo se guarda cifrado.
+//
+// Las consultas no vuelven a leer el libro mientras no cambie: usan el censo
+// en memoria que arma snapshot.
+type ExcelStore struct {
+	Path     string
+	Sheet    string
+	Rotation *backupRotation
+	Cipher   *Cipher
+
+	mu sync.RWMutex
+
+	// revision cuenta los guardados hechos desde este programa (también los
+	// de la sincronización); cacheMu protege cache.
+	revision uint32
+	cacheMu  sync.Mutex
+	cache    *censusIndex
+}
+
+// open abre el libro y devuelve las filas de la hoja del censo.
+func (s *ExcelStore) open() (*excelize.File, [][]string, error) {
+	data, err := readEncryptedFile(s.Path, s.Cipher)
+	if err != nil {
+		return nil, nil, err
+	}
+	f, err := excelize.OpenReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, nil, err
+	}
+	rows, err := f.GetRows(s.Sheet)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(rows) == 0 {
+		return nil, nil, errCensusEmpty
+	}
+	return f, rows, nil
+}
+
+func cleanHeaders(headers []string) []string {
+	clean := make([]string, len(headers))
+	for i, h := range headers {
+		clean[i] = strings.TrimSpace(h)
+	}
+	return clean
+}
+
+// idColumn devuelve el índice de la columna ID, o -1 si el libro no la tiene.
+func idColumn(headers []string) int {
+	for i, h := range headers {
+		if h == ID_HEADER {
+			return i
+		}
+	}
+	return -1
+}
+
+// dataHeaders quita la columna ID de las cabeceras.
+func dataHeaders(headers []string, idCol int) []string {
+	out := make([]string, 0, len(headers))
+	for i, h := range headers {
+		if i != idCol {
+			out = append(out, h)
+		}
+	}
+	return out
+}
+
+func cellAt(row []string, i int) string {
+	if i >= 0 && i < len(row) {
+		return row[i]
+	}
+	return ""
+}
+
+func emptyRow(row []string) bool {
+	for _, c := range row {
+		if strings.TrimSpace(c) != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// recordFromRow convierte una fila del Excel en un registro. headers son las
+// cabeceras limpias de la hoja, incluida la de ID si existe.
+func recordFromRow(headers []string, idCol int, row []string) CensusRecord {
+	rec := CensusRecord{ID: strings.TrimSpace(cellAt(row, idCol)), Fields: make(map[string]string, len(headers))}
+	for j, h := range headers {
+		if j != idCol {
+			rec.Fields[h] = cellAt(row, j)
+		}
+	}
+	return rec
+}
+
+// recordsFromRows convierte las filas de la hoja en registros, sin las filas vacías.
+func recordsFromRows(rows [][]string) ([]string, []CensusRecord) {
+	headers := cleanHeaders(rows[0])
+	idCol := idColumn(headers)
+	records := make([]CensusRecord, 0, len(rows)-1)
+	for _, row := range rows[1:] {
+		if emptyRow(row) {
+			continue
+		}
+		records = append(records, recordFromRow(headers, idCol, row))
+	}
+	return dataHeaders(headers, idCol), records
+}
+
+// findRow devuelve el número de fila del Excel (base 1) de la persona con ese ID.
+func findRow(rows [][]string, idCol int, id string) (int, error) {
+	if id != "" {
+		for i := 1; i < len(rows); i++ {
+			if strings.TrimSpace(cellAt(rows[i], idCol)) == id {
+				return i + 1, nil
+			}
+		}
+	}
+	return 0, errRecordNotFound
+}
+
+// needsIDs indica si falta la columna ID o hay personas sin ID o con un ID
+// repetido (por ejemplo, una fila copiada y pegada a mano en Excel).
+func needsIDs(rows [][]string) bool {
+	idCol := idColumn(cleanHeaders(rows[0]))
+	if idCol == -1 {
+		return true
+	}
+	seen := make(map[string]bool)
+	for _, row := range rows[1:] {
+		if emptyRow(row) {
+			continue
+		}
+		id := strings.TrimSpace(cellAt(row, idCol))
+		if id == "" || seen[id] {
+			return true
+		}
+		seen[id] = true
+	}
+	return false
+}
+
+// ensureIDs agrega la columna ID si no existe y le da un ID nuevo a cada
+// persona que no tenga uno o lo tenga repetido. Modifica f y rows en memoria;
+// quien llama decide cuándo guardar.
+func (s *ExcelStore) ensureIDs(f *excelize.File, rows [][]string) {
+	idCol := idColumn(cleanHeaders(rows[0]))
+	if idCol == -1 {
+		idCol = len(rows[0])
+		name, _ := excelize.CoordinatesToCellName(idCol+1, 1)
+		f.SetCellValue(s.Sheet, name, ID_HEADER)
+		rows[0] = append(rows[0], ID_HEADER)
+		fmt.Println("--- LOG: El censo no tenía columna de ID. Se agregará en la columna", columnLetter(idCol))
+	}
+
+	seen := make(map[string]bool)
+	for i := 1; i < len(rows); i++ {
+		if emptyRow(rows[i]) {
+			continue
+		}
+		id := strings.TrimSpace(cellAt(rows[i], idCol))
+		if id != "" && !seen[id] {
+			seen[id] = true
+			continue
+		}
+		id = newRecordID()
+		seen[id] = true
+		for len(rows[i]) <= idCol {
+			rows[i] = append(rows[i], "")
+		}
+		rows[i][idCol] = id
+		name, _ := excelize.CoordinatesToCellName(idCol+1, i+1)
+		f.SetCellValue(s.Sheet, name, id)
+	}
+}
+
+// openForWrite abre el libro para modificarlo, con los IDs ya completos.
+// Hay que tener tomado s.mu.Lock.
+func (s *ExcelStore) openForWrite() (*excelize.File, [][]string, error) {
+	f, rows, err := s.open()
+	if err != nil {
+		return nil, nil, err
+	}
+	s.ensureIDs(f, rows)
+	return f, rows, nil
+}
+
+// read devuelve las filas del censo para consultarlas. Si el libro tiene
+// personas sin ID (un libro viejo o filas agregadas a mano), primero se los
+// asigna y guarda, para que los IDs que ve el frontend ya sean los definitivos.
+func (s *ExcelStore) read() ([][]string, error) {
+	s.mu.RLock()
+	_, rows, err := s.open()
+	s.mu.RUnlock()
+	if err != nil || !needsIDs(rows) {
+		return rows, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, rows, err := s.openForWrite()
+	if err != nil {
+		return nil, err
+	}
+	if err := s.save(f); err != nil {
+		return nil, err
+	}
+	return rows, nil
+}
+
+// snapshot devuelve el censo en memoria. Lo vuelve a leer del libro solo si
+// el archivo cambió (otra fecha de modificación o tamaño, por ejemplo porque
+// alguien lo editó en Excel) o si se guardó desde aquí después de leerlo.
+func (s *ExcelStore) snapshot() (*censusIndex, error) {
+	s.cacheMu.Lock()
+	defer s.cacheMu.Unlock()
+
+	// La marca se toma antes de leer: si el archivo cambia mientras tanto, la
+	// próxima consulta lo vuelve a leer en lugar de quedarse con lo viejo
+	revision := atomic.LoadUint32(&s.revision)
+	stamp, err := statFile(s.Path)
+	if err == nil && s.cache != nil && s.cache.stamp == stamp && s.cache.revision == revision {
+		return s.cache, nil
+	}
+	rows, err := s.read()
+	if err != nil {
+		return nil, err
+	}
+	idx := newCensusIndex(rows)
+	idx.stamp, idx.revision = stamp, revision
+	s.cache = idx
+	return idx, nil
+}
+
+func (s *ExcelStore) Headers() ([]string, error) {
+	idx, err := s.snapshot()
+	if err != nil {
+		return nil, err
+	}
+	return idx.Headers(), nil
+}
+
+func (s *ExcelStore) List() ([]CensusRecord, error) {
+	idx, err := s.snapshot()
+	if err != nil {
+		return nil, err
+	}
+	return idx.List(), nil
+}
+
+func (s *ExcelStore) Get(id string) (CensusRecord, error) {
+	idx, err := s.snapshot()
+	if err != nil {
+		return CensusRecord{}, err
+	}
+	return idx.Get(id)
+}
+
+func (s *ExcelStore) FindByCedula(cedula string) (CensusRecord, error) {
+	idx, err := s.snapshot()
+	if err != nil {
+		return CensusRecord{}, err
+	}
+	return idx.FindByCedula(cedula)
+}
+
+func (s *ExcelStore) Households() ([]Household, error) {
+	idx, err := s.snapshot()
+	if err != nil {
+		return nil, err
+	}
+	return idx.Households()
+}
+
+func (s *ExcelStore) FindHousehold(comunidad, torre, casa string) (Household, error) {
+	idx, err := s.snapshot()
+	if err != nil {
+		return Household{}, err
+	}
+	return idx.FindHousehold(comunidad, torre, casa)
+}
+
+// writeFields escribe en una fila los campos cuyas claves coinciden con una
+// cabecera. La columna ID nunca se escribe desde aquí.
+func (s *ExcelStore) writeFields(f *excelize.File, headers []string, rowNum int, fields map[string]string) {
+	for colIndex, key := range headers {
+		if key == ID_HEADER {
+			continue
+		}
+		if val, ok := fields[key]; ok {
+			name, _ := excelize.CoordinatesToCellName(colIndex+1, rowNum)
+			f.SetCellValue(s.Sheet, name, val)
+		}
+	}
+}
+
+func (s *ExcelStore) Insert(records ...map[string]string) ([]string, error) {
+	return s.Save(nil, records)
+}
+
+func (s *ExcelStore) Update(records ...CensusRecord) error {
+	_, err := s.Save(records, nil)
+	return err
+}
+
+// Save revisa las versiones, escribe los cambios y agrega las personas nuevas
+// al final, y guarda el libro una sola vez.
+func (s *ExcelStore) Save(updates []CensusRecord, inserts []map[string]string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, rows, err := s.openForWrite()
+	if err != nil {
+		return nil, err
+	}
+	headers := cleanHeaders(rows[0])
+	idCol := idColumn(headers)
+
+	// Primero se revisan todas las versiones, para no guardar la mitad de los cambios
+	rowNums := make([]int, len(updates))
+	var conflicts []CensusRecord
+	for i, rec := range updates {
+		rowNum, err := findRow(rows, idCol, rec.ID)
+		if err != nil {
+			return nil, err
+		}
+		if current := recordFromRow(headers, idCol, rows[rowNum-1]); staleVersion(current, rec.IfVersion) {
+			conflicts = append(conflicts, current)
+		}
+		rowNums[i] = rowNum
+	}
+	if len(conflicts) > 0 {
+		return nil, &ConflictError{Current: conflicts}
+	}
+
+	for i, rec := range updates {
+		s.writeFields(f, headers, rowNums[i], rec.Fields)
+	}
+	taken := make(map[string]bool, len(rows))
+	for _, row := range rows[1:] {
+		taken[strings.TrimSpace(cellAt(row, idCol))] = true
+	}
+	nextRow := len(rows) + 1
+	ids := make([]string, 0, len(inserts))
+	for _, fields := range inserts {
+		id := insertID(fields)
+		if taken[id] {
+			return nil, errDuplicateID
+		}
+		taken[id] = true
+		s.writeFields(f, headers, nextRow, fields)
+		name, _ := excelize.CoordinatesToCellName(idCol+1, nextRow)
+		f.SetCellValue(s.Sheet, name, id)
+		ids = append(ids, id)
+		nextRow++
+	}
+	if err := s.save(f); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+// Delete mueve las filas a la hoja de la papelera, con quién, cuándo y por qué.
+func (s *ExcelStore) Delete(info DeleteInfo, refs ...RecordRef) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, rows, err := s.openForWrite()
+	if err != nil {
+		return err
+	}
+	headers := cleanHeaders(rows[0])
+	idCol := idColumn(headers)
+	rowNums := make([]int, 0, len(refs))
+	var conflicts []CensusRecord
+	for _, ref := range refs {
+		n, err := findRow(rows, idCol, ref.ID)
+		if err != nil {
+			return err
+		}
+		if current := recordFromRow(headers, idCol, rows[n-1]); staleVersion(current, ref.IfVersion) {
+			conflicts = append(conflicts, current)
+		}
+		rowNums = append(rowNums, n)
+	}
+	if len(conflicts) > 0 {
+		return &ConflictError{Current: conflicts}
+	}
+
+	trashHeaders, trashRows := trashSheet(f, dataHeaders(headers, idCol))
+	now := time.Now().Format(time.RFC3339)
+	for i, n := range rowNums {
+		rec := recordFromRow(headers, idCol, rows[n-1])
+		values := make(map[string]string, len(rec.Fields)+4)
+		for key, val := range rec.Fields {
+			values[key] = val
+		}
+		values[ID_HEADER] = rec.ID
+		values[DELETED_BY_HEADER] = info.By
+		values[DELETED_AT_HEADER] = now
+		values[DELETE_REASON_HEADER] = info.Reason
+		writeRow(f, TRASH_SHEET, trashHeaders, len(trashRows)+i+1, values)
+	}
+
+	if err := removeRows(f, s.Sheet, rowNums); err != nil {
+		return err
+	}
+	return s.save(f)
+}
+
+// removeRows borra filas de abajo hacia arriba, porque RemoveRow corre las
+// filas siguientes.
+func removeRows(f *excelize.File, sheet string, rowNums []int) error {
+	sorted := append([]int(nil), rowNums...)
+	sort.Sort(sort.Reverse(sort.IntSlice(sorted)))
+	for _, n := range sorted {
+		if err := f.RemoveRow(sheet, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeRow escribe en una fila los valores según el nombre de cada cabecera.
+func writeRow(f *excelize.File, sheet string, headers []string, rowNum int, values map[string]string) {
+	for colIndex, key := range headers {
+		if val, ok := values[key]; ok {
+			name, _ := excelize.CoordinatesToCellName(colIndex+1, rowNum)
+			f.SetCellValue(sheet, name, val)
+		}
+	}
+}
+
+// trashSheet crea la hoja de la papelera si no existe y le agrega las columnas
+// del censo que le falten, por si el censo ganó columnas desde el último
+// borrado. Devuelve sus cabeceras y sus filas.
+func trashSheet(f *excelize.File, censusHeaders []string) ([]string, [][]string) {
+	f.NewSheet(TRASH_SHEET)
+	rows, _ := f.GetRows(TRASH_SHEET)
+	var headers []string
+	if len(rows) > 0 {
+		headers = cleanHeaders(rows[0])
+	}
+	want := append(append([]string{}, censusHeaders...), ID_HEADER, DELETED_BY_HEADER, DELETED_AT_HEADER, DELETE_REASON_HEADER)
+	for _, h := range want {
+		if indexOf(headers, h) == -1 {
+			headers = append(headers, h)
+			name, _ := excelize.CoordinatesToCellName(len(headers), 1)
+			f.SetCellValue(TRASH_SHEET, name, h)
+		}
+	}
+	if len(rows) == 0 {
+		rows = [][]string{headers}
+	}
+	return headers, rows
+}
+
+func indexOf(list []string, value string) int {
+	for i, v := range list {
+		if v == value {
+			return i
+		}
+	}
+	return -1
+}
+
+// deletedFromRow convierte una fila de la papelera en un registro borrado.
+func deletedFromRow(headers []string, row []string) DeletedRecord {
+	rec := DeletedRecord{CensusRecord: CensusRecord{Fields: make(map[string]string, len(headers))}}
+	for j, h := range headers {
+		val := cellAt(row, j)
+		switch h {
+		case ID_HEADER:
+			rec.ID = strings.TrimSpace(val)
+		case DELETED_BY_HEADER:
+			rec.DeletedBy = val
+		case DELETED_AT_HEADER:
+			rec.DeletedAt, _ = time.Parse(time.RFC3339, val)
+		case DELETE_REASON_HEADER:
+			rec.Reason = val
+		default:
+			rec.Fields[h] = val
+		}
+	}
+	return rec
+}
+
+func (s *ExcelStore) Trash() ([]DeletedRecord, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	f, _, err := s.open()
+	if err != nil {
+		return nil, err
+	}
+	return trashRecords(f)
+}
+
+// trashRecords lee la hoja de la papelera de f, si la tiene.
+func trashRecords(f *excelize.File) ([]DeletedRecord, error) {
+	list := []DeletedRecord{}
+	if f.GetSheetIndex(TRASH_SHEET) == -1 {
+		return list, nil
+	}
+	rows, err := f.GetRows(TRASH_SHEET)
+	if err != nil || len(rows) == 0 {
+		return list, err
+	}
+	headers := cleanHeaders(rows[0])
+	for _, row := range rows[1:] {
+		if !emptyRow(row) {
+			list = append(list, deletedFromRow(headers, row))
+		}
+	}
+	return list, nil
+}
+
+// Restore agrega las personas al final del censo y las saca de la papelera.
+func (s *ExcelStore) Restore(ids ...string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, rows, err := s.openForWrite()
+	if err != nil {
+		return err
+	}
+	if f.GetSheetIndex(TRASH_SHEET) == -1 {
+		return errRecordNotFound
+	}
+	trashRows, err := f.GetRows(TRASH_SHEET)
+	if err != nil || len(trashRows) == 0 {
+		return errRecordNotFound
+	}
+	headers := cleanHeaders(rows[0])
+	idCol := idColumn(headers)
+	trashHeaders := cleanHeaders(trashRows[0])
+	trashID := indexOf(trashHeaders, ID_HEADER)
+
+	nextRow := len(rows) + 1
+	var restored []int
+	for _, id := range uniqueIDs(ids) {
+		n, err := findRow(trashRows, trashID, id)
+		if err != nil {
+			return err
+		}
+		// Una persona agregada después con el mismo ID (por ejemplo, desde
+		// otra computadora) quedaría repetida
+		if _, err := findRow(rows, idCol, id); err == nil {
+			return errDuplicateID
+		}
+		rec := deletedFromRow(trashHeaders, trashRows[n-1])
+		s.writeFields(f, headers, nextRow, rec.Fields)
+		name, _ := excelize.CoordinatesToCellName(idCol+1, nextRow)
+		f.SetCellValue(s.Sheet, name, rec.ID)
+		restored = append(restored, n)
+		nextRow++
+	}
+	if err := removeRows(f, TRASH_SHEET, restored); err != nil {
+		return err
+	}
+	return s.save(f)
+}
+
+func (s *ExcelStore) Purge(before time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, _, err := s.openForWrite()
+	if err != nil {
+		return 0, err
+	}
+	if f.GetSheetIndex(TRASH_SHEET) == -1 {
+		return 0, nil
+	}
+	trashRows, err := f.GetRows(TRASH_SHEET)
+	if err != nil || len(trashRows) == 0 {
+		return 0, err
+	}
+	trashHeaders := cleanHeaders(trashRows[0])
+	var old []int
+	for i, row := range trashRows[1:] {
+		// Las filas sin fecha válida se dejan: no sabemos cuándo se borraron
+		rec := deletedFromRow(trashHeaders, row)
+		if !emptyRow(row) && !rec.DeletedAt.IsZero() && rec.DeletedAt.Before(before) {
+			old = append(old, i+2)
+		}
+	}
+	if len(old) == 0 {
+		return 0, nil
+	}
+	if err := removeRows(f, TRASH_SHEET, old); err != nil {
+		return 0, err
+	}
+	return len(old), s.save(f)
+}
+
+// ExportWorkbook copia el archivo tal cual, con sus formatos y otras hojas.
+// Si está cifrado lo entrega descifrado.
+func (s *ExcelStore) ExportWorkbook(w io.Writer) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	data, err := readEncryptedFile(s.Path, s.Cipher)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// ImportWorkbook revisa que el libro tenga la hoja del censo antes de reemplazar
+// el archivo. Si le faltan IDs se asignan en la próxima lectura o escritura.
+func (s *ExcelStore) ImportWorkbook(r io.Reader) error {
+	return s.ImportWorkbookIf(r, "")
+}
+
+func (s *ExcelStore) ImportWorkbookIf(r io.Reader, ifVersion string) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if _, _, err := readWorkbook(bytes.NewReader(data), s.Sheet); err != nil {
+		return fmt.Errorf("el libro no tiene una hoja %q válida: %v", s.Sheet, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if ifVersion != "" {
+		var current []CensusRecord
+		_, rows, err := s.open()
+		switch {
+		case err == nil:
+			_, current = recordsFromRows(rows)
+		case !os.IsNotExist(err) && err != errCensusEmpty:
+			return err
+		}
+		if censusVersion(current) != ifVersion {
+			return errCensusChanged
+		}
+	}
+	return s.replaceFile(data)
+}
+
+// save guarda el libro. Hay que tener tomado s.mu.Lock.
+func (s *ExcelStore) save(f *excelize.File) error {
+	var buf bytes.Buffer
+	if err := f.Write(&buf); err != nil {
+		return err
+	}
+	return s.replaceFile(buf.Bytes())
+}
+
+// replaceFile reemplaza el libro completo, dejando antes una copia del actual.
+// Si la copia falla igual se guarda: perder el cambio sería peor. Hay que
+// tener tomado s.mu.Lock.
+func (s *ExcelStore) replaceFile(data []byte) error {
+	if current, err := readEncryptedFile(s.Path, s.Cipher); err == nil && bytes.Equal(current, data) {
+		return nil
+	}
+	sealed, err := s.Cipher.Encrypt(data)
+	if err != nil {
+		return err
+	}
+	// Lo que esté en memoria ya no sirve, aunque el archivo quede con la misma
+	// fecha y tamaño
+	atomic.AddUint32(&s.revision, 1)
+	if s.Rotation != nil {
+		err := s.Rotation.snapshot(func(path string) error { return copyFile(s.Path, path) })
+		if err != nil && !os.IsNotExist(err) {
+			fmt.Printf("--- ERROR: No se pudo guardar la copia de seguridad del censo: %v ---\n", err)
+		}
+	}
+	return writeFileAtomic(s.Path, sealed, 0644)
+}
+
+func (s *ExcelStore) Backups() ([]BackupInfo, error) {
+	if s.Rotation == nil {
+		return []BackupInfo{}, nil
+	}
+	return s.Rotation.list()
+}
+
+// backupData lee una copia y revisa que tenga la hoja del censo.
+func (s *ExcelStore) backupData(nombre string) ([]byte, []string, []CensusRecord, error) {
+	if s.Rotation == nil {
+		return nil, nil, nil, errBackupNotFound
+	}
+	path, err := s.Rotation.path(nombre)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	data, err := readEncryptedFile(path, s.Cipher)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	headers, records, err := readWorkbook(bytes.NewReader(data), s.Sheet)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("la copia %s no tiene una hoja %q válida: %v", nombre, s.Sheet, err)
+	}
+	return data, headers, records, nil
+}
+
+func (s *ExcelStore) ReadBackup(nombre string) ([]string, []CensusRecord, error) {
+	_, headers, records, err := s.backupData(nombre)
+	return headers, records, err
+}
+
+func (s *ExcelStore) RestoreBackup(nombre string) error {
+	data, _, _, err := s.backupData(nombre)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.replaceFile(data)
+}
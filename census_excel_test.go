@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// newTestExcelStore crea un libro con n personas en una carpeta temporal.
+func newTestExcelStore(t testing.TB, n int) *ExcelStore {
+	t.Helper()
+	headers, records := testCensus(n)
+	return newTestExcelStoreWith(t, headers, records)
+}
+
+// newTestExcelStoreWith crea un libro con esas personas en una carpeta temporal.
+func newTestExcelStoreWith(t testing.TB, headers []string, records []CensusRecord) *ExcelStore {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "censo.xlsx")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeWorkbook(f, "Sheet1", headers, records); err != nil {
+		f.Close()
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &ExcelStore{Path: path, Sheet: "Sheet1"}
+}
+
+// testCensus genera n personas repartidas en hogares, con IDs p00000,
+// p00001... y cédulas V-00000000, V-00000001...
+func testCensus(n int) ([]string, []CensusRecord) {
+	headers := []string{"Nombre completo", CEDULA_HEADER, "COMUNIDAD", "TORRE", "CASA O APTO", "Edad"}
+	records := make([]CensusRecord, n)
+	for i := range records {
+		records[i] = CensusRecord{ID: fmt.Sprintf("p%05d", i), Fields: map[string]string{
+			"Nombre completo": fmt.Sprintf("Persona %d", i),
+			CEDULA_HEADER:     fmt.Sprintf("V-%08d", i),
+			"COMUNIDAD":       fmt.Sprintf("Comunidad %d", i%5),
+			"TORRE":           fmt.Sprint(i % 20),
+			"CASA O APTO":     fmt.Sprintf("%d-%d", i%20, i%4),
+			"Edad":            fmt.Sprint(i % 90),
+		}}
+	}
+	return headers, records
+}
+
+func TestExcelStoreConcurrentWrites(t *testing.T) {
+	store := newTestExcelStore(t, 20)
+	records, err := store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 2*len(records))
+	for i, rec := range records {
+		wg.Add(2)
+		go func(rec CensusRecord) {
+			defer wg.Done()
+			errs <- store.Update(CensusRecord{
+				ID:        rec.ID,
+				Fields:    map[string]string{"Edad": "editada " + rec.ID},
+				IfVersion: rec.Version(),
+			})
+		}(rec)
+		go func(i int) {
+			defer wg.Done()
+			_, err := store.Insert(map[string]string{"Nombre completo": fmt.Sprintf("Nueva %d", i)})
+			errs <- err
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	after, err := store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(after) != 2*len(records) {
+		t.Fatalf("quedaron %d personas, se esperaban %d", len(after), 2*len(records))
+	}
+	for _, rec := range records {
+		got, err := store.Get(rec.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Fields["Edad"] != "editada "+rec.ID {
+			t.Errorf("se perdió la edición de %s: Edad = %q", rec.ID, got.Fields["Edad"])
+		}
+	}
+	nuevas := make(map[string]bool)
+	ids := make(map[string]bool)
+	for _, rec := range after {
+		if ids[rec.ID] {
+			t.Errorf("ID repetido %s", rec.ID)
+		}
+		ids[rec.ID] = true
+		nuevas[rec.Fields["Nombre completo"]] = true
+	}
+	for i := range records {
+		if !nuevas[fmt.Sprintf("Nueva %d", i)] {
+			t.Errorf("se perdió la persona agregada Nueva %d", i)
+		}
+	}
+}
+
+func TestExcelStoreSameRecordConflict(t *testing.T) {
+	store := newTestExcelStore(t, 3)
+	rec, err := store.Get("p00001")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Todos leyeron la misma versión: solo uno puede guardar
+	const writers = 8
+	var wg sync.WaitGroup
+	results := make(chan error, writers)
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results <- store.Update(CensusRecord{
+				ID:        rec.ID,
+				Fields:    map[string]string{"Edad": fmt.Sprint(100 + i)},
+				IfVersion: rec.Version(),
+			})
+		}(i)
+	}
+	wg.Wait()
+	close(results)
+
+	saved := 0
+	for err := range results {
+		switch err.(type) {
+		case nil:
+			saved++
+		case *ConflictError:
+		default:
+			t.Fatalf("error inesperado: %v", err)
+		}
+	}
+	if saved != 1 {
+		t.Fatalf("guardaron %d escrituras con la misma versión, se esperaba 1", saved)
+	}
+}
+
+func TestExcelStoreStaleVersion(t *testing.T) {
+	store := newTestExcelStore(t, 3)
+	old, err := store.Get("p00002")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Update(CensusRecord{ID: old.ID, Fields: map[string]string{"Edad": "50"}, IfVersion: old.Version()}); err != nil {
+		t.Fatal(err)
+	}
+
+	err = store.Update(
+		CensusRecord{ID: "p00000", Fields: map[string]string{"Edad": "1"}},
+		CensusRecord{ID: old.ID, Fields: map[string]string{"Edad": "60"}, IfVersion: old.Version()},
+	)
+	conflict, ok := err.(*ConflictError)
+	if !ok {
+		t.Fatalf("Update con una versión vieja devolvió %v, se esperaba *ConflictError", err)
+	}
+	if len(conflict.Current) != 1 || conflict.Current[0].Fields["Edad"] != "50" {
+		t.Errorf("el conflicto trae %+v, se esperaba la persona con Edad 50", conflict.Current)
+	}
+	// Con conflicto no se aplica ningún cambio de la operación
+	if rec, _ := store.Get("p00000"); rec.Fields["Edad"] == "1" {
+		t.Error("se guardó parte de una operación con conflicto")
+	}
+	if err := store.Delete(DeleteInfo{}, RecordRef{ID: old.ID, IfVersion: old.Version()}); err == nil {
+		t.Error("Delete con una versión vieja no devolvió error")
+	} else if _, ok := err.(*ConflictError); !ok {
+		t.Errorf("Delete con una versión vieja devolvió %v, se esperaba *ConflictError", err)
+	}
+}
+
+func TestExcelStoreInsertDuplicateID(t *testing.T) {
+	store := newTestExcelStore(t, 3)
+	if _, err := store.Insert(map[string]string{ID_HEADER: "p00001", "Nombre completo": "Otra"}); err != errDuplicateID {
+		t.Fatalf("Insert con un ID que ya existe devolvió %v, se esperaba errDuplicateID", err)
+	}
+	_, err := store.Insert(
+		map[string]string{ID_HEADER: "nuevo", "Nombre completo": "Una"},
+		map[string]string{ID_HEADER: "nuevo", "Nombre completo": "Dos"},
+	)
+	if err != errDuplicateID {
+		t.Fatalf("Insert con dos personas del mismo ID devolvió %v, se esperaba errDuplicateID", err)
+	}
+	if records, _ := store.List(); len(records) != 3 {
+		t.Errorf("quedaron %d personas, no se debía agregar ninguna", len(records))
+	}
+}
+
+func TestExcelStoreRestore(t *testing.T) {
+	store := newTestExcelStore(t, 4)
+	if err := store.Delete(DeleteInfo{By: "prueba"}, RecordRef{ID: "p00001"}, RecordRef{ID: "p00002"}, RecordRef{ID: "p00003"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Un ID repetido se restaura una sola vez y no saca a otra persona de la papelera
+	if err := store.Restore("p00001", "p00001"); err != nil {
+		t.Fatal(err)
+	}
+	records, _ := store.List()
+	if len(records) != 2 {
+		t.Fatalf("quedaron %d personas en el censo, se esperaban 2", len(records))
+	}
+	trash, _ := store.Trash()
+	if len(trash) != 2 || trash[0].ID != "p00002" || trash[1].ID != "p00003" {
+		t.Fatalf("la papelera quedó con %+v, se esperaban p00002 y p00003", trash)
+	}
+
+	// Una persona agregada con el mismo ID impide restaurar la borrada
+	if _, err := store.Insert(map[string]string{ID_HEADER: "p00002", "Nombre completo": "Otra"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Restore("p00003", "p00002"); err != errDuplicateID {
+		t.Fatalf("Restore de un ID que ya está en el censo devolvió %v, se esperaba errDuplicateID", err)
+	}
+	if trash, _ := store.Trash(); len(trash) != 2 {
+		t.Errorf("la papelera quedó con %d personas, no se debía restaurar ninguna", len(trash))
+	}
+}
+
+func TestExcelStoreImportWorkbookIf(t *testing.T) {
+	store := newTestExcelStore(t, 3)
+	records, err := store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var other bytes.Buffer
+	if err := writeWorkbook(&other, "Sheet1", []string{"Nombre completo"}, []CensusRecord{{ID: "x", Fields: map[string]string{"Nombre completo": "Otra"}}}); err != nil {
+		t.Fatal(err)
+	}
+	version := censusVersion(records)
+
+	// Una edición entre la lectura y el reemplazo no se pierde
+	rec := records[0]
+	if err := store.Update(CensusRecord{ID: rec.ID, Fields: map[string]string{"Edad": "77"}, IfVersion: rec.Version()}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.ImportWorkbookIf(bytes.NewReader(other.Bytes()), version); err != errCensusChanged {
+		t.Fatalf("ImportWorkbookIf con una versión vieja devolvió %v, se esperaba errCensusChanged", err)
+	}
+	if got, err := store.Get(rec.ID); err != nil || got.Fields["Edad"] != "77" {
+		t.Fatalf("se perdió la edición: %+v, %v", got, err)
+	}
+
+	after, _ := store.List()
+	if err := store.ImportWorkbookIf(bytes.NewReader(other.Bytes()), censusVersion(after)); err != nil {
+		t.Fatal(err)
+	}
+	if list, _ := store.List(); len(list) != 1 || list[0].ID != "x" {
+		t.Fatalf("el censo quedó con %+v, se esperaba solo x", list)
+	}
+}
@@ -0,0 +1,578 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// ------------------- FILTROS DEL CENSO -------------------------
+
+// Operadores de una condición del filtro.
+const (
+	FILTRO_IGUAL       = "igual"
+	FILTRO_CONTIENE    = "contiene"
+	FILTRO_EMPIEZA     = "empieza"
+	FILTRO_VACIO       = "vacio"
+	FILTRO_MAYOR       = "mayor"
+	FILTRO_MAYOR_IGUAL = "mayor_igual"
+	FILTRO_MENOR       = "menor"
+	FILTRO_MENOR_IGUAL = "menor_igual"
+	FILTRO_ENTRE       = "entre"
+	FILTRO_PARECIDO    = "parecido"
+)
+
+// Cómo se escribe cada operador en la consulta. ":" no está porque depende
+// de la columna (ver defaultFilterOp).
+var filterOpSymbols = map[string]string{
+	FILTRO_IGUAL:       "=",
+	FILTRO_CONTIENE:    "~",
+	FILTRO_EMPIEZA:     "^",
+	FILTRO_MAYOR:       ">",
+	FILTRO_MAYOR_IGUAL: ">=",
+	FILTRO_MENOR:       "<",
+	FILTRO_MENOR_IGUAL: "<=",
+	FILTRO_PARECIDO:    "%",
+}
+
+// Palabras que, después de ":", piden las celdas vacías.
+var filterEmptyWords = map[string]bool{"vacio": true, "vacia": true, "empty": true}
+
+// FilterCondition es una condición sobre una columna. Con Column vacío busca
+// Value en todas las columnas, como el buscador de la tabla. Not la invierte.
+// FILTRO_ENTRE usa Min y Max, incluidos; sin uno de los dos el rango queda
+// abierto de ese lado.
+type FilterCondition struct {
+	Column string `json:"column"`
+	Op     string `json:"op"`
+	Value  string `json:"value"`
+	Min    string `json:"min"`
+	Max    string `json:"max"`
+	Not    bool   `json:"not"`
+}
+
+// CensusFilter decide qué personas entran en la tabla y en las exportaciones.
+// Groups se combinan con OR y las condiciones de cada grupo con AND; sin
+// grupos entran todas las personas.
+type CensusFilter struct {
+	Groups [][]FilterCondition
+}
+
+// and agrega condiciones que tienen que cumplirse siempre, sea cual sea el
+// grupo que coincida.
+func (f *CensusFilter) and(conds ...FilterCondition) {
+	if len(conds) == 0 {
+		return
+	}
+	if len(f.Groups) == 0 {
+		f.Groups = [][]FilterCondition{nil}
+	}
+	for i := range f.Groups {
+		f.Groups[i] = append(f.Groups[i], conds...)
+	}
+}
+
+// Match dice si la persona cumple el filtro.
+func (f *CensusFilter) Match(rec CensusRecord) bool {
+	if len(f.Groups) == 0 {
+		return true
+	}
+	for _, group := range f.Groups {
+		ok := true
+		for _, cond := range group {
+			if !cond.match(rec) {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Apply devuelve las personas que cumplen el filtro. Si el filtro busca por
+// parecido (ver Ranked) van primero las que más se parecen; si no, o si se
+// parecen igual, quedan en el orden del censo.
+func (f *CensusFilter) Apply(records []CensusRecord) []CensusRecord {
+	filtered := make([]CensusRecord, 0)
+	var scores []float64
+	for _, rec := range records {
+		if f.Match(rec) {
+			filtered = append(filtered, rec)
+			if f.Ranked() {
+				scores = append(scores, f.Score(rec))
+			}
+		}
+	}
+	if scores != nil {
+		sort.Stable(byScore{filtered, scores})
+	}
+	return filtered
+}
+
+type byScore struct {
+	records []CensusRecord
+	scores  []float64
+}
+
+func (b byScore) Len() int           { return len(b.records) }
+func (b byScore) Less(i, j int) bool { return b.scores[i] > b.scores[j] }
+func (b byScore) Swap(i, j int) {
+	b.records[i], b.records[j] = b.records[j], b.records[i]
+	b.scores[i], b.scores[j] = b.scores[j], b.scores[i]
+}
+
+// Ranked dice si el filtro busca por parecido: con el buscador de la tabla o
+// con FILTRO_PARECIDO. Solo entonces tiene sentido Score.
+func (f *CensusFilter) Ranked() bool {
+	for _, group := range f.Groups {
+		for _, cond := range group {
+			if cond.ranked() {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Score es cuánto se parece la persona a lo buscado, de 0 a 1: el puntaje más
+// bajo de las búsquedas por parecido de la alternativa que mejor le va.
+func (f *CensusFilter) Score(rec CensusRecord) float64 {
+	best := 0.0
+	for _, group := range f.Groups {
+		score := 1.0
+		for _, cond := range group {
+			if !cond.match(rec) {
+				score = 0
+				break
+			}
+			if cond.ranked() {
+				if s := cond.score(rec); s < score {
+					score = s
+				}
+			}
+		}
+		if score > best {
+			best = score
+		}
+	}
+	return best
+}
+
+// String escribe el filtro con la misma sintaxis de la consulta, para
+// mostrarlo en los reportes.
+func (f *CensusFilter) String() string {
+	groups := make([]string, 0, len(f.Groups))
+	for _, group := range f.Groups {
+		conds := make([]string, 0, len(group))
+		for _, cond := range group {
+			conds = append(conds, cond.String())
+		}
+		groups = append(groups, strings.Join(conds, " "))
+	}
+	return strings.Join(groups, " OR ")
+}
+
+func (c FilterCondition) String() string {
+	var b strings.Builder
+	if c.Not {
+		b.WriteString("-")
+	}
+	if c.Column == "" {
+		b.WriteString(quoteFilterWord(c.Value))
+		return b.String()
+	}
+	b.WriteString(quoteFilterWord(c.Column))
+	switch c.Op {
+	case FILTRO_VACIO:
+		b.WriteString(":vacio")
+		return b.String()
+	case FILTRO_ENTRE:
+		b.WriteString(":")
+		if c.Min != "" {
+			b.WriteString(quoteFilterWord(c.Min))
+		}
+		b.WriteString("..")
+		if c.Max != "" {
+			b.WriteString(quoteFilterWord(c.Max))
+		}
+		return b.String()
+	}
+	b.WriteString(filterOpSymbols[c.Op])
+	b.WriteString(quoteFilterWord(c.Value))
+	return b.String()
+}
+
+// quoteFilterWord pone entre comillas lo que sin ellas se leería distinto:
+// espacios, operadores, un OR o un "-" al principio.
+func quoteFilterWord(s string) string {
+	if s == "" || strings.ContainsAny(s, " \t\":=~^<>%") || strings.Contains(s, "..") ||
+		s == "OR" || s == "|" || strings.HasPrefix(s, "-") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+func (c FilterCondition) match(rec CensusRecord) bool {
+	var ok bool
+	if c.Column == "" || c.Op == FILTRO_PARECIDO {
+		ok = c.score(rec) >= FUZZY_MIN
+	} else {
+		ok = matchFilterCell(c, strings.TrimSpace(rec.Fields[c.Column]))
+	}
+	return ok != c.Not
+}
+
+func (c FilterCondition) ranked() bool {
+	return !c.Not && (c.Column == "" || c.Op == FILTRO_PARECIDO)
+}
+
+func (c FilterCondition) score(rec CensusRecord) float64 {
+	if c.Column == "" {
+		return searchScore(rec, c.Value)
+	}
+	return fuzzyScore(rec.Fields[c.Column], c.Value)
+}
+
+func matchFilterCell(c FilterCondition, cell string) bool {
+	switch c.Op {
+	case FILTRO_VACIO:
+		return cell == ""
+	case FILTRO_CONTIENE:
+		return strings.Contains(foldText(cell), foldText(c.Value))
+	case FILTRO_EMPIEZA:
+		return strings.HasPrefix(foldText(cell), foldText(c.Value))
+	case FILTRO_ENTRE:
+		if cell == "" {
+			return false
+		}
+		if c.Min != "" {
+			if cmp, ok := compareCell(c.Column, cell, c.Min); !ok || cmp < 0 {
+				return false
+			}
+		}
+		if c.Max != "" {
+			if cmp, ok := compareCell(c.Column, cell, c.Max); !ok || cmp > 0 {
+				return false
+			}
+		}
+		return true
+	}
+
+	if cell == "" {
+		return false
+	}
+	cmp, ok := compareCell(c.Column, cell, c.Value)
+	if !ok {
+		// Una fecha mal escrita en el libro todavía se puede pedir tal cual
+		return c.Op == FILTRO_IGUAL && foldText(cell) == foldText(c.Value)
+	}
+	switch c.Op {
+	case FILTRO_IGUAL:
+		return cmp == 0
+	case FILTRO_MAYOR:
+		return cmp > 0
+	case FILTRO_MAYOR_IGUAL:
+		return cmp >= 0
+	case FILTRO_MENOR:
+		return cmp < 0
+	case FILTRO_MENOR_IGUAL:
+		return cmp <= 0
+	}
+	return false
+}
+
+var accentFolder = strings.NewReplacer(
+	"á", "a", "é", "e", "í", "i", "ó", "o", "ú", "u", "ü", "u", "ñ", "n",
+	"à", "a", "è", "e", "ì", "i", "ò", "o", "ù", "u",
+)
+
+// foldText pasa a minúsculas y quita los acentos, para que "Río" y "rio"
+// sean iguales al filtrar.
+func foldText(s string) string {
+	return accentFolder.Replace(strings.ToLower(strings.TrimSpace(s)))
+}
+
+// defaultFilterOp es lo que hace ":" en una columna: las de nombres
+// (fuzzySearchColumns) buscan lo que se parece, las de texto libre
+// (containsSearchColumns) lo que contiene y las demás el valor exacto.
+func defaultFilterOp(column string) string {
+	if fuzzySearchColumns[column] {
+		return FILTRO_PARECIDO
+	}
+	if containsSearchColumns[column] {
+		return FILTRO_CONTIENE
+	}
+	return FILTRO_IGUAL
+}
+
+// resolveFilterColumn busca la cabecera que nombra la consulta, sin importar
+// mayúsculas ni acentos y con "_" en lugar de espacios. Alcanza con el inicio
+// del nombre ("cedula" es "Cedula de identidad") o, si ninguna columna empieza
+// así, con el inicio de una de sus palabras ("nacimiento" es "Fecha de
+// nacimiento"), mientras no haya otra columna que también sirva.
+func resolveFilterColumn(name string, headers []string) (string, error) {
+	want := foldText(strings.Replace(name, "_", " ", -1))
+	var matches, wordMatches []string
+	for _, h := range headers {
+		folded := foldText(h)
+		if folded == want {
+			return h, nil
+		}
+		if strings.HasPrefix(folded, want) {
+			matches = append(matches, h)
+		}
+		for _, word := range strings.Fields(folded) {
+			if strings.HasPrefix(word, want) {
+				wordMatches = append(wordMatches, h)
+				break
+			}
+		}
+	}
+	if len(matches) == 0 {
+		matches = wordMatches
+	}
+	switch len(matches) {
+	case 0:
+		return "", fmt.Errorf("no existe la columna %q", name)
+	case 1:
+		return matches[0], nil
+	}
+	return "", fmt.Errorf("la columna %q puede ser %s", name, strings.Join(matches, ", "))
+}
+
+// parseCensusFilter lee una consulta como
+//
+//	comunidad:"Rio Aro" edad>=18 -cedula:vacio OR nombre^jose
+//
+// Cada palabra es una condición y todas tienen que cumplirse; OR (o "|")
+// separa alternativas. Los operadores son ":" (ver defaultFilterOp), "="
+// igual, "~" contiene, "^" empieza con, "%" se parece (ver nameScore), ">",
+// ">=", "<" y "<=". "columna:desde..hasta" pide un rango (edad:0..5,
+// edad:60.., nacimiento:2000..2005); en las columnas de censusColumnTypes los
+// rangos y las comparaciones son de números o de fechas. "columna:vacio" pide
+// las celdas vacías y "-" delante niega la condición. Una palabra sin operador
+// se busca en todas las columnas. Los valores o columnas con espacios van
+// entre comillas.
+func parseCensusFilter(query string, headers []string) (*CensusFilter, error) {
+	f := &CensusFilter{}
+	group := []FilterCondition{}
+	p := filterParser{s: []rune(query)}
+	for {
+		p.skipSpaces()
+		if p.done() {
+			break
+		}
+		cond, or, err := p.condition(headers)
+		if err != nil {
+			return nil, err
+		}
+		if or {
+			if len(group) == 0 {
+				return nil, fmt.Errorf("falta una condición antes de OR")
+			}
+			f.Groups = append(f.Groups, group)
+			group = []FilterCondition{}
+			continue
+		}
+		group = append(group, cond)
+	}
+	if len(group) == 0 && len(f.Groups) > 0 {
+		return nil, fmt.Errorf("falta una condición después de OR")
+	}
+	if len(group) > 0 {
+		f.Groups = append(f.Groups, group)
+	}
+	return f, nil
+}
+
+type filterParser struct {
+	s   []rune
+	pos int
+}
+
+func (p *filterParser) done() bool { return p.pos >= len(p.s) }
+
+func (p *filterParser) skipSpaces() {
+	for !p.done() && unicode.IsSpace(p.s[p.pos]) {
+		p.pos++
+	}
+}
+
+func isFilterOpRune(r rune) bool {
+	return strings.ContainsRune(":=~^<>%", r)
+}
+
+// word lee una palabra entre comillas o hasta un espacio. Con stopAtOp
+// también se detiene en un operador (es el nombre de una columna).
+func (p *filterParser) word(stopAtOp bool) (string, bool, error) {
+	if !p.done() && p.s[p.pos] == '"' {
+		start := p.pos
+		p.pos++
+		var b strings.Builder
+		for !p.done() && p.s[p.pos] != '"' {
+			if p.s[p.pos] == '\\' && p.pos+1 < len(p.s) {
+				p.pos++
+			}
+			b.WriteRune(p.s[p.pos])
+			p.pos++
+		}
+		if p.done() {
+			return "", true, fmt.Errorf("faltan las comillas de cierre en %q", string(p.s[start:]))
+		}
+		p.pos++
+		return b.String(), true, nil
+	}
+	start := p.pos
+	for !p.done() && !unicode.IsSpace(p.s[p.pos]) && !(stopAtOp && isFilterOpRune(p.s[p.pos])) {
+		p.pos++
+	}
+	return string(p.s[start:p.pos]), false, nil
+}
+
+// condition lee una condición. or es true si en su lugar había un OR.
+func (p *filterParser) condition(headers []string) (cond FilterCondition, or bool, err error) {
+	if p.s[p.pos] == '-' && p.pos+1 < len(p.s) && !unicode.IsSpace(p.s[p.pos+1]) {
+		cond.Not = true
+		p.pos++
+	}
+	name, quoted, err := p.word(true)
+	if err != nil {
+		return cond, false, err
+	}
+	if p.done() || !isFilterOpRune(p.s[p.pos]) {
+		if !quoted && !cond.Not && (name == "OR" || name == "|") {
+			return cond, true, nil
+		}
+		cond.Op, cond.Value = FILTRO_CONTIENE, name
+		return cond, false, nil
+	}
+
+	if name == "" {
+		return cond, false, fmt.Errorf("falta la columna antes de %q", string(p.s[p.pos]))
+	}
+	if cond.Column, err = resolveFilterColumn(name, headers); err != nil {
+		return cond, false, err
+	}
+	op := string(p.s[p.pos])
+	p.pos++
+	if (op == ">" || op == "<") && !p.done() && p.s[p.pos] == '=' {
+		op += "="
+		p.pos++
+	}
+	value, quoted, err := p.word(false)
+	if err != nil {
+		return cond, false, err
+	}
+	switch {
+	case op == ":" && !quoted && filterEmptyWords[foldText(value)]:
+		cond.Op = FILTRO_VACIO
+		return cond, false, nil
+	case op == ":" && !quoted && strings.Contains(value, ".."):
+		cond.Op = FILTRO_ENTRE
+		parts := strings.SplitN(value, "..", 2)
+		cond.Min, cond.Max = parts[0], parts[1]
+		return cond, false, checkFilterCondition(cond)
+	case op == ":":
+		cond.Op = defaultFilterOp(cond.Column)
+	default:
+		for name, symbol := range filterOpSymbols {
+			if symbol == op {
+				cond.Op = name
+			}
+		}
+	}
+	if value == "" && !quoted {
+		return cond, false, fmt.Errorf("falta el valor de %s%s", name, op)
+	}
+	cond.Value = value
+	return cond, false, checkFilterCondition(cond)
+}
+
+// checkFilterCondition revisa los valores de las comparaciones y los rangos
+// contra el tipo de la columna.
+func checkFilterCondition(cond FilterCondition) error {
+	switch cond.Op {
+	case FILTRO_ENTRE:
+		if cond.Min == "" && cond.Max == "" {
+			return fmt.Errorf("falta el rango de %s (desde..hasta)", cond.Column)
+		}
+		for _, value := range []string{cond.Min, cond.Max} {
+			if value == "" {
+				continue
+			}
+			if err := checkFilterValue(cond.Column, value); err != nil {
+				return err
+			}
+		}
+	case FILTRO_MAYOR, FILTRO_MAYOR_IGUAL, FILTRO_MENOR, FILTRO_MENOR_IGUAL:
+		return checkFilterValue(cond.Column, cond.Value)
+	}
+	return nil
+}
+
+// censusFilterFromRequest junta todo lo que puede filtrar una lista del
+// censo: el buscador de la tabla (search[value]), el filtro de una columna
+// (filterColumn y filterValue), los filtros de la ventana "Filtrar" (filters,
+// una lista JSON de FilterCondition) y la consulta q (ver parseCensusFilter).
+// Los tres primeros se suman con AND a cada alternativa de q.
+func censusFilterFromRequest(r *http.Request, headers []string) (*CensusFilter, error) {
+	query := r.URL.Query()
+	f, err := parseCensusFilter(query.Get("q"), headers)
+	if err != nil {
+		return nil, err
+	}
+
+	if search := strings.TrimSpace(query.Get("search[value]")); search != "" {
+		f.and(FilterCondition{Op: FILTRO_CONTIENE, Value: search})
+	}
+
+	// La columna ya viene limpia del frontend; si no existe se ignora, como antes
+	if column, value := query.Get("filterColumn"), query.Get("filterValue"); column != "" && value != "" {
+		if indexOf(headers, column) >= 0 {
+			f.and(FilterCondition{Column: column, Op: defaultFilterOp(column), Value: value})
+		}
+	}
+
+	if raw := query.Get("filters"); raw != "" {
+		var conds []FilterCondition
+		if err := json.Unmarshal([]byte(raw), &conds); err != nil {
+			return nil, fmt.Errorf("filters no es una lista de filtros: %v", err)
+		}
+		for _, cond := range conds {
+			if cond.Column != "" && indexOf(headers, cond.Column) < 0 {
+				if cond.Column, err = resolveFilterColumn(cond.Column, headers); err != nil {
+					return nil, err
+				}
+			}
+			switch {
+			case cond.Op == "":
+				cond.Op = defaultFilterOp(cond.Column)
+			case cond.Op == FILTRO_ENTRE:
+				// El rango también puede venir en value, como en la consulta
+				if parts := strings.SplitN(cond.Value, "..", 2); len(parts) == 2 && cond.Min == "" && cond.Max == "" {
+					cond.Min, cond.Max = strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+				}
+				if cond.Column == "" || cond.Min == "" && cond.Max == "" {
+					continue
+				}
+			case cond.Op != FILTRO_VACIO && filterOpSymbols[cond.Op] == "":
+				return nil, fmt.Errorf("operador desconocido %q", cond.Op)
+			}
+			if cond.Value == "" && cond.Op != FILTRO_VACIO && cond.Op != FILTRO_ENTRE {
+				continue
+			}
+			if err := checkFilterCondition(cond); err != nil {
+				return nil, err
+			}
+			f.and(cond)
+		}
+	}
+	return f, nil
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+var filterTestHeaders = []string{
+	"Nombre completo", "Cedula de identidad", "COMUNIDAD", "Edad",
+	"Fecha de nacimiento", "Fecha de ingreso", "Telefono celular", "Telefono fijo",
+}
+
+// filterTestCensus tiene una persona de cada caso: una niña, una adulta sin
+// cédula, un adulto mayor y alguien sin edad ni fecha de nacimiento.
+func filterTestCensus() []CensusRecord {
+	person := func(id, nombre, cedula, comunidad, edad, nacimiento string) CensusRecord {
+		return CensusRecord{ID: id, Fields: map[string]string{
+			"Nombre completo": nombre, "Cedula de identidad": cedula, "COMUNIDAD": comunidad,
+			"Edad": edad, "Fecha de nacimiento": nacimiento,
+		}}
+	}
+	return []CensusRecord{
+		person("p1", "José Pérez", "V-123", "Rio Aro", "4", "20/11/2020"),
+		person("p2", "María  López", "", "Río Aro", "35", "01/02/1989"),
+		person("p3", "Pedro Gómez", "V-999", "El Valle", "70", "15/06/1954"),
+		person("p4", "Ana", "V-555", "El Valle", "", ""),
+	}
+}
+
+func filteredIDs(f *CensusFilter, records []CensusRecord) string {
+	var ids []string
+	for _, rec := range f.Apply(records) {
+		ids = append(ids, rec.ID)
+	}
+	return strings.Join(ids, ",")
+}
+
+func TestParseCensusFilter(t *testing.T) {
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{``, ``},
+		{`comunidad:"Rio Aro" edad>=18`, `COMUNIDAD="Rio Aro" Edad>=18`},
+		{`edad<18 OR nombre^jose`, `Edad<18 OR "Nombre completo"^jose`},
+		{`edad<18 | nombre^jose edad>1`, `Edad<18 OR "Nombre completo"^jose Edad>1`},
+		{`nombre:jose cedula:123 comunidad:aro`, `"Nombre completo"%jose "Cedula de identidad"~123 COMUNIDAD=aro`},
+		{`comunidad=aro comunidad~aro comunidad^aro nombre%jose`, `COMUNIDAD=aro COMUNIDAD~aro COMUNIDAD^aro "Nombre completo"%jose`},
+		{`edad>1 edad>=2 edad<3 edad<=4`, `Edad>1 Edad>=2 Edad<3 Edad<=4`},
+		{`edad:0..5 edad:60.. edad:..17`, `Edad:0..5 Edad:60.. Edad:..17`},
+		{`nacimiento:2000..2005`, `"Fecha de nacimiento":2000..2005`},
+		{`-cedula:vacio cedula:empty -edad:VACÍA`, `-"Cedula de identidad":vacio "Cedula de identidad":vacio -Edad:vacio`},
+		// Entre comillas "vacio" es un valor como cualquier otro
+		{`cedula:"vacio"`, `"Cedula de identidad"~vacio`},
+		{`jose -"rio aro"`, `jose -"rio aro"`},
+		{`"Nombre completo":"Ana \"la\" Pérez"`, `"Nombre completo"%"Ana \"la\" Pérez"`},
+		{`"OR" -"|" "-5"`, `"OR" -"|" "-5"`},
+		{`telefono_celular:0414 COMUNIDAD=""`, `"Telefono celular"=0414 COMUNIDAD=""`},
+	}
+	for _, tt := range tests {
+		f, err := parseCensusFilter(tt.query, filterTestHeaders)
+		if err != nil {
+			t.Errorf("parseCensusFilter(%q) devolvió %v", tt.query, err)
+			continue
+		}
+		if got := f.String(); got != tt.want {
+			t.Errorf("parseCensusFilter(%q) = %s, se esperaba %s", tt.query, got, tt.want)
+			continue
+		}
+		// Lo que escribe String se vuelve a leer igual
+		again, err := parseCensusFilter(f.String(), filterTestHeaders)
+		if err != nil || again.String() != tt.want {
+			t.Errorf("parseCensusFilter(%q) no vuelve a leer su String: %v, %v", tt.query, again, err)
+		}
+	}
+}
+
+func TestParseCensusFilterErrors(t *testing.T) {
+	tests := []struct {
+		query string
+		err   string
+	}{
+		{`nombre:"jose`, "faltan las comillas de cierre"},
+		{`"jose`, "faltan las comillas de cierre"},
+		{`telefono:0414`, `la columna "telefono" puede ser Telefono celular, Telefono fijo`},
+		{`fecha>2000`, "puede ser"},
+		{`color:rojo`, `no existe la columna "color"`},
+		{`OR edad>1`, "falta una condición antes de OR"},
+		{`edad>1 OR OR edad<2`, "falta una condición antes de OR"},
+		{`edad>1 |`, "falta una condición después de OR"},
+		{`:jose`, "falta la columna"},
+		{`edad>`, "falta el valor de edad>"},
+		{`edad>diez`, "Edad es un número"},
+		{`edad:..`, "falta el rango de Edad"},
+		{`edad:uno..5`, "Edad es un número"},
+		{`nacimiento>=2005-13`, "Fecha de nacimiento es una fecha"},
+	}
+	for _, tt := range tests {
+		f, err := parseCensusFilter(tt.query, filterTestHeaders)
+		if err == nil {
+			t.Errorf("parseCensusFilter(%q) = %s, se esperaba un error", tt.query, f)
+			continue
+		}
+		if !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("parseCensusFilter(%q) devolvió %q, se esperaba %q", tt.query, err, tt.err)
+		}
+	}
+}
+
+func TestCensusFilterMatch(t *testing.T) {
+	records := filterTestCensus()
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{``, "p1,p2,p3,p4"},
+		{`comunidad:"rio aro"`, "p1,p2"},
+		{`comunidad:"rio aro" edad>=18`, "p2"},
+		{`edad<18 OR comunidad:"el valle"`, "p1,p3,p4"},
+		{`edad<18 OR edad<18`, "p1"},
+		{`cedula:vacio`, "p2"},
+		{`-cedula:vacio`, "p1,p3,p4"},
+		{`edad:vacio`, "p4"},
+		{`edad:0..5`, "p1"},
+		{`edad:60..`, "p3"},
+		{`edad:..35`, "p1,p2"},
+		{`-edad:0..5`, "p2,p3,p4"},
+		{`edad=4`, "p1"},
+		{`edad>35`, "p3"},
+		{`edad<=35`, "p1,p2"},
+		{`cedula:99`, "p3"},
+		{`cedula=v-123`, "p1"},
+		{`comunidad~valle`, "p3,p4"},
+		{`nombre^maria`, "p2"},
+		{`-nombre^maria`, "p1,p3,p4"},
+		{`nacimiento>=2000`, "p1"},
+		{`nacimiento:1950..1990`, "p2,p3"},
+		{`lopez`, "p2"},
+		{`"rio aro"`, "p1,p2"},
+		{`-"rio aro"`, "p3,p4"},
+	}
+	for _, tt := range tests {
+		f, err := parseCensusFilter(tt.query, filterTestHeaders)
+		if err != nil {
+			t.Errorf("parseCensusFilter(%q) devolvió %v", tt.query, err)
+			continue
+		}
+		if got := filteredIDs(f, records); got != tt.want {
+			t.Errorf("%q encontró %q, se esperaba %q", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestCensusFilterFromRequest(t *testing.T) {
+	records := filterTestCensus()
+	tests := []struct {
+		name   string
+		params url.Values
+		want   string
+		err    string
+	}{
+		{"sin filtros", url.Values{}, "p1,p2,p3,p4", ""},
+		{"buscador en cada alternativa",
+			url.Values{"q": {`edad<18 OR comunidad:"el valle"`}, "search[value]": {"pedro"}}, "p3", ""},
+		{"filtro de una columna", url.Values{"filterColumn": {"COMUNIDAD"}, "filterValue": {"Rio Aro"}}, "p1,p2", ""},
+		{"columna que no existe", url.Values{"filterColumn": {"Color"}, "filterValue": {"rojo"}}, "p1,p2,p3,p4", ""},
+		{"rango en value con la columna abreviada",
+			url.Values{"filters": {`[{"column":"edad","op":"entre","value":"0 .. 5"}]`}}, "p1", ""},
+		{"rango en min y max",
+			url.Values{"filters": {`[{"column":"Edad","op":"entre","min":"30","max":"80"}]`}}, "p2,p3", ""},
+		{"rango sin límites se ignora",
+			url.Values{"filters": {`[{"column":"Edad","op":"entre","value":""}]`}}, "p1,p2,p3,p4", ""},
+		{"vacío y negado",
+			url.Values{"filters": {`[{"column":"Cedula de identidad","op":"vacio","not":true}]`}}, "p1,p3,p4", ""},
+		{"sin operador usa el de la columna",
+			url.Values{"filters": {`[{"column":"Nombre completo","value":"jose perez"}]`}}, "p1", ""},
+		{"sin valor se ignora",
+			url.Values{"filters": {`[{"column":"COMUNIDAD","op":"igual","value":""}]`}}, "p1,p2,p3,p4", ""},
+		{"se suman con AND a q",
+			url.Values{"q": {"edad>18"}, "filters": {`[{"column":"COMUNIDAD","op":"contiene","value":"valle"}]`}}, "p3", ""},
+		{"operador desconocido",
+			url.Values{"filters": {`[{"column":"Edad","op":"raro","value":"1"}]`}}, "", `operador desconocido "raro"`},
+		{"valor que no es del tipo de la columna",
+			url.Values{"filters": {`[{"column":"Edad","op":"mayor","value":"diez"}]`}}, "", "Edad es un número"},
+		{"columna ambigua",
+			url.Values{"filters": {`[{"column":"telefono","value":"1"}]`}}, "", "puede ser"},
+		{"filters que no es JSON", url.Values{"filters": {`edad>1`}}, "", "filters no es una lista de filtros"},
+		{"consulta con error", url.Values{"q": {`nombre:"jose`}}, "", "faltan las comillas de cierre"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/api/data?"+tt.params.Encode(), nil)
+			f, err := censusFilterFromRequest(r, filterTestHeaders)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("devolvió %v, se esperaba %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := filteredIDs(f, records); got != tt.want {
+				t.Errorf("encontró %q, se esperaba %q", got, tt.want)
+			}
+		})
+	}
+}
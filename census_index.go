@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ------------------- CENSO EN MEMORIA -------------------------
+
+// fileStamp identifica una versión del archivo del censo sin leerlo.
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+func statFile(path string) (fileStamp, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fileStamp{}, err
+	}
+	return fileStamp{info.ModTime(), info.Size()}, nil
+}
+
+// censusIndex es el censo ya leído del libro, con índices para no recorrerlo
+// en cada consulta. No se modifica después de armarlo: un cambio arma otro.
+// Las personas se comparten entre todas las consultas, así que quien las
+// recibe no debe modificar sus Fields.
+type censusIndex struct {
+	stamp    fileStamp
+	revision uint32
+
+	headers []string
+	records []CensusRecord
+	byID    map[string]int
+	// byCedula tiene la primera persona con cada cédula; cedulaHeader queda
+	// vacío si el libro no tiene esa columna.
+	cedulaHeader string
+	byCedula     map[string]int
+
+	// Los hogares se agrupan la primera vez que se piden.
+	householdsOnce sync.Once
+	households     []Household
+	householdsErr  error
+	byHouse        map[[3]string]int
+}
+
+// newCensusIndex arma el índice con las filas de la hoja del censo.
+func newCensusIndex(rows [][]string) *censusIndex {
+	headers, records := recordsFromRows(rows)
+	idx := &censusIndex{
+		headers:  headers,
+		records:  records,
+		byID:     make(map[string]int, len(records)),
+		byCedula: make(map[string]int, len(records)),
+	}
+	for _, h := range headers {
+		if normalizeHeader(h) == normalizeHeader(CEDULA_HEADER) {
+			idx.cedulaHeader = h
+			break
+		}
+	}
+	for i, rec := range records {
+		if _, ok := idx.byID[rec.ID]; !ok {
+			idx.byID[rec.ID] = i
+		}
+		if idx.cedulaHeader != "" {
+			if _, ok := idx.byCedula[rec.Fields[idx.cedulaHeader]]; !ok {
+				idx.byCedula[rec.Fields[idx.cedulaHeader]] = i
+			}
+		}
+	}
+	return idx
+}
+
+func (idx *censusIndex) Headers() []string {
+	return append([]string(nil), idx.headers...)
+}
+
+func (idx *censusIndex) List() []CensusRecord {
+	return append([]CensusRecord(nil), idx.records...)
+}
+
+func (idx *censusIndex) Get(id string) (CensusRecord, error) {
+	if i, ok := idx.byID[id]; ok && id != "" {
+		return idx.records[i], nil
+	}
+	return CensusRecord{}, errRecordNotFound
+}
+
+func (idx *censusIndex) FindByCedula(cedula string) (CensusRecord, error) {
+	if idx.cedulaHeader == "" {
+		return CensusRecord{}, fmt.Errorf("No se encontró la columna de Cedula")
+	}
+	if i, ok := idx.byCedula[cedula]; ok {
+		return idx.records[i], nil
+	}
+	return CensusRecord{}, errRecordNotFound
+}
+
+func (idx *censusIndex) groupHouseholds() {
+	idx.householdsOnce.Do(func() {
+		idx.households, idx.householdsErr = groupHouseholds(idx.headers, idx.records)
+		idx.byHouse = make(map[[3]string]int, len(idx.households))
+		for i, h := range idx.households {
+			idx.byHouse[[3]string{h.Comunidad, h.Torre, h.Casa}] = i
+		}
+	})
+}
+
+func (idx *censusIndex) Households() ([]Household, error) {
+	idx.groupHouseholds()
+	return append([]Household(nil), idx.households...), idx.householdsErr
+}
+
+func (idx *censusIndex) FindHousehold(comunidad, torre, casa string) (Household, error) {
+	idx.groupHouseholds()
+	if idx.householdsErr != nil {
+		return Household{}, idx.householdsErr
+	}
+	key := [3]string{strings.TrimSpace(comunidad), strings.TrimSpace(torre), strings.TrimSpace(casa)}
+	if i, ok := idx.byHouse[key]; ok {
+		return idx.households[i], nil
+	}
+	return Household{}, errRecordNotFound
+}
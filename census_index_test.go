@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+)
+
+// Los benchmarks usan un libro de 20.000 personas, como un censo grande. El
+// primer List lee el libro; después todas las consultas usan la copia en
+// memoria mientras el archivo no cambie. Los que terminan en Uncached vuelven
+// a leer el libro en cada consulta, como antes de la copia en memoria, para
+// comparar.
+const benchmarkPersonas = 20000
+
+func newBenchmarkExcelStore(b *testing.B) *ExcelStore {
+	store := newTestExcelStore(b, benchmarkPersonas)
+	if _, err := store.List(); err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	return store
+}
+
+// forgetSnapshot hace que la próxima consulta vuelva a leer el libro, como
+// después de un guardado.
+func forgetSnapshot(s *ExcelStore) {
+	atomic.AddUint32(&s.revision, 1)
+}
+
+func BenchmarkList(b *testing.B) {
+	store := newBenchmarkExcelStore(b)
+	for i := 0; i < b.N; i++ {
+		records, err := store.List()
+		if err != nil || len(records) != benchmarkPersonas {
+			b.Fatalf("List devolvió %d personas, %v", len(records), err)
+		}
+	}
+}
+
+func BenchmarkGet(b *testing.B) {
+	store := newBenchmarkExcelStore(b)
+	for i := 0; i < b.N; i++ {
+		id := fmt.Sprintf("p%05d", i%benchmarkPersonas)
+		if rec, err := store.Get(id); err != nil || rec.ID != id {
+			b.Fatalf("Get(%s) devolvió %+v, %v", id, rec, err)
+		}
+	}
+}
+
+func BenchmarkFindByCedula(b *testing.B) {
+	store := newBenchmarkExcelStore(b)
+	for i := 0; i < b.N; i++ {
+		n := i % benchmarkPersonas
+		if rec, err := store.FindByCedula(fmt.Sprintf("V-%08d", n)); err != nil || rec.ID != fmt.Sprintf("p%05d", n) {
+			b.Fatalf("FindByCedula de la persona %d devolvió %+v, %v", n, rec, err)
+		}
+	}
+}
+
+func BenchmarkFindHousehold(b *testing.B) {
+	store := newBenchmarkExcelStore(b)
+	for i := 0; i < b.N; i++ {
+		n := i % benchmarkPersonas
+		household, err := store.FindHousehold(fmt.Sprintf("Comunidad %d", n%5), fmt.Sprint(n%20), fmt.Sprintf("%d-%d", n%20, n%4))
+		if err != nil || len(household.Members) == 0 {
+			b.Fatalf("FindHousehold de la persona %d devolvió %+v, %v", n, household, err)
+		}
+	}
+}
+
+func BenchmarkListUncached(b *testing.B) {
+	store := newBenchmarkExcelStore(b)
+	for i := 0; i < b.N; i++ {
+		forgetSnapshot(store)
+		records, err := store.List()
+		if err != nil || len(records) != benchmarkPersonas {
+			b.Fatalf("List devolvió %d personas, %v", len(records), err)
+		}
+	}
+}
+
+func BenchmarkGetUncached(b *testing.B) {
+	store := newBenchmarkExcelStore(b)
+	for i := 0; i < b.N; i++ {
+		forgetSnapshot(store)
+		id := fmt.Sprintf("p%05d", i%benchmarkPersonas)
+		if rec, err := store.Get(id); err != nil || rec.ID != id {
+			b.Fatalf("Get(%s) devolvió %+v, %v", id, rec, err)
+		}
+	}
+}
+
+func BenchmarkFindByCedulaUncached(b *testing.B) {
+	store := newBenchmarkExcelStore(b)
+	for i := 0; i < b.N; i++ {
+		forgetSnapshot(store)
+		n := i % benchmarkPersonas
+		if rec, err := store.FindByCedula(fmt.Sprintf("V-%08d", n)); err != nil || rec.ID != fmt.Sprintf("p%05d", n) {
+			b.Fatalf("FindByCedula de la persona %d devolvió %+v, %v", n, rec, err)
+		}
+	}
+}
+
+func BenchmarkFindHouseholdUncached(b *testing.B) {
+	store := newBenchmarkExcelStore(b)
+	for i := 0; i < b.N; i++ {
+		forgetSnapshot(store)
+		n := i % benchmarkPersonas
+		household, err := store.FindHousehold(fmt.Sprintf("Comunidad %d", n%5), fmt.Sprint(n%20), fmt.Sprintf("%d-%d", n%20, n%4))
+		if err != nil || len(household.Members) == 0 {
+			b.Fatalf("FindHousehold de la persona %d devolvió %+v, %v", n, household, err)
+		}
+	}
+}
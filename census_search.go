@@ -0,0 +1,136 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+)
+
+// ------------------- BÚSQUEDA POR PARECIDO -------------------------
+
+// Columnas de nombres, donde el buscador y ":" encuentran también lo que se
+// parece (acentos, mayúsculas, espacios de más, palabras en otro orden o
+// alguna letra equivocada).
+var fuzzySearchColumns = map[string]bool{
+	"Nombre completo": true,
+}
+
+// FUZZY_MIN es el parecido mínimo (de 0 a 1) para que un nombre, o una de
+// sus palabras, cuente. Con 0.75 se acepta una letra equivocada en una
+// palabra de cuatro.
+const FUZZY_MIN = 0.75
+
+// searchWords pasa un texto a palabras sin acentos ni mayúsculas, sin signos
+// y sin espacios de más.
+func searchWords(s string) []string {
+	return strings.FieldsFunc(foldText(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// searchText es el texto de searchWords, separado por un espacio.
+func searchText(s string) string {
+	return strings.Join(searchWords(s), " ")
+}
+
+// nameScore dice cuánto se parece lo buscado a un nombre, de 0 a 1. Cada
+// palabra buscada se compara con la palabra del nombre que más se le parece,
+// así no importa el orden, y el resultado es el promedio. Una palabra que es el
+// inicio de otra ("jos" en "jose") cuenta casi como igual, y una que no llega a
+// FUZZY_MIN cuenta como 0.
+func nameScore(query, name string) float64 {
+	want, words := searchWords(query), searchWords(name)
+	if len(want) == 0 || len(words) == 0 {
+		return 0
+	}
+	var total float64
+	for _, w := range want {
+		best := 0.0
+		for _, word := range words {
+			if s := wordScore(w, word); s > best {
+				best = s
+			}
+		}
+		// Una palabra que no se parece a ninguna no suma nada
+		if best >= FUZZY_MIN {
+			total += best
+		}
+	}
+	return total / float64(len(want))
+}
+
+func wordScore(want, word string) float64 {
+	switch {
+	case want == word:
+		return 1
+	case len([]rune(want)) >= 2 && strings.HasPrefix(word, want):
+		return 0.9
+	}
+	a, b := []rune(want), []rune(word)
+	longest := len(a)
+	if len(b) > longest {
+		longest = len(b)
+	}
+	// Las palabras cortas tienen que ser iguales: "ana" no es "ala"
+	if longest < 4 {
+		return 0
+	}
+	return 1 - float64(editDistance(a, b))/float64(longest)
+}
+
+// editDistance es la cantidad de letras que hay que cambiar, agregar o quitar
+// para pasar de a a b (distancia de Levenshtein).
+func editDistance(a, b []rune) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = minInt(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+func minInt(first int, rest ...int) int {
+	for _, n := range rest {
+		if n < first {
+			first = n
+		}
+	}
+	return first
+}
+
+// searchScore es el puntaje de una persona para lo que se escribió en el
+// buscador: 1 si alguna columna lo contiene tal cual (sin contar acentos,
+// mayúsculas ni espacios de más) y si no, cuánto se parece a su nombre.
+func searchScore(rec CensusRecord, value string) float64 {
+	folded, want := foldText(value), searchText(value)
+	for _, cell := range rec.Fields {
+		if strings.Contains(foldText(cell), folded) || want != "" && strings.Contains(searchText(cell), want) {
+			return 1
+		}
+	}
+	best := 0.0
+	for column := range fuzzySearchColumns {
+		if s := nameScore(value, rec.Fields[column]); s > best {
+			best = s
+		}
+	}
+	return best
+}
+
+// fuzzyScore es el puntaje de una celda de nombre para FILTRO_PARECIDO.
+func fuzzyScore(cell, value string) float64 {
+	if strings.Contains(searchText(cell), searchText(value)) {
+		return 1
+	}
+	return nameScore(value, cell)
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestNameScore(t *testing.T) {
+	tests := []struct {
+		query, name string
+		min, max    float64
+	}{
+		{"Jose Perez", "José  Pérez", 1, 1},
+		{"JOSE perez", "José Pérez", 1, 1},
+		{"Perez Jose", "José Pérez", 1, 1},
+		{"Perez, José", "José Pérez", 1, 1},
+		// Una letra equivocada
+		{"Jose Peres", "José Pérez", 0.9, 0.9},
+		{"Josue", "José Pérez", 0.8, 0.8},
+		// El inicio de una palabra cuenta casi como igual
+		{"jos per", "José Pérez", 0.9, 0.9},
+		{"Ana", "Anabel Ruiz", 0.9, 0.9},
+		// Las palabras cortas tienen que ser iguales
+		{"Ana", "Ala Ruiz", 0, 0},
+		{"Eli", "Ela", 0, 0},
+		{"Ana", "Ana", 1, 1},
+		// Una palabra que no se parece a nada no suma
+		{"Jose Rodriguez", "José Pérez", 0.5, 0.5},
+		{"Carlos", "José Pérez", 0, 0},
+		{"", "José Pérez", 0, 0},
+		{"Jose", "", 0, 0},
+	}
+	for _, tt := range tests {
+		got := nameScore(tt.query, tt.name)
+		if got < tt.min-1e-9 || got > tt.max+1e-9 {
+			t.Errorf("nameScore(%q, %q) = %.2f, se esperaba entre %.2f y %.2f", tt.query, tt.name, got, tt.min, tt.max)
+		}
+	}
+}
+
+func TestEditDistance(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"", "", 0},
+		{"perez", "perez", 0},
+		{"perez", "peres", 1},
+		{"jose", "josue", 1},
+		{"maria", "mria", 1},
+		{"jose", "jsoe", 2},
+		{"", "ana", 3},
+	}
+	for _, tt := range tests {
+		if got := editDistance([]rune(tt.a), []rune(tt.b)); got != tt.want {
+			t.Errorf("editDistance(%q, %q) = %d, se esperaba %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestSearchFuzzy(t *testing.T) {
+	records := filterTestCensus()
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{`"Jose Perez"`, "p1"},
+		{`"perez jose"`, "p1"},
+		{`"jose peres"`, "p1"},
+		{`"maria lopez"`, "p2"},
+		{`nombre:"maria lopes"`, "p2"},
+		{`nombre%"gomez pedro"`, "p3"},
+		{`nombre:ana`, "p4"},
+		{`nombre:ala`, ""},
+		{`"Jose Rodriguez"`, ""},
+		{`-nombre:"jose perez"`, "p2,p3,p4"},
+	}
+	for _, tt := range tests {
+		f, err := parseCensusFilter(tt.query, filterTestHeaders)
+		if err != nil {
+			t.Errorf("parseCensusFilter(%q) devolvió %v", tt.query, err)
+			continue
+		}
+		if got := filteredIDs(f, records); got != tt.want {
+			t.Errorf("%s encontró %q, se esperaba %q", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestGetDataRanksBySimilarity(t *testing.T) {
+	person := func(id, nombre string) CensusRecord {
+		return CensusRecord{ID: id, Fields: map[string]string{"Nombre completo": nombre, "COMUNIDAD": "Rio Aro"}}
+	}
+	headers := []string{"Nombre completo", "COMUNIDAD"}
+	store := newTestExcelStoreWith(t, headers, []CensusRecord{
+		person("p1", "José Peres"),
+		person("p2", "Pedro Ruiz"),
+		person("p3", "Pérez José"),
+		person("p4", "José  Pérez"),
+	})
+	old := census
+	census = store
+	t.Cleanup(func() { census = old })
+
+	get := func(params url.Values) DTResponse {
+		t.Helper()
+		w := httptest.NewRecorder()
+		getData(w, httptest.NewRequest("GET", "/api/data?"+params.Encode(), nil))
+		if w.Code != 200 {
+			t.Fatalf("getData respondió %d: %s", w.Code, w.Body)
+		}
+		var resp DTResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	// Los que tienen las dos palabras, en cualquier orden, van primero y
+	// empatados quedan en el orden del censo; después, el de la letra equivocada
+	resp := get(url.Values{"draw": {"1"}, "start": {"0"}, "length": {"10"}, "search[value]": {"Jose Perez"}})
+	want := []struct{ id, score string }{{"p3", "1.00"}, {"p4", "1.00"}, {"p1", "0.90"}}
+	if resp.RecordsTotal != 4 || resp.RecordsFiltered != len(want) || len(resp.Data) != len(want) {
+		t.Fatalf("getData devolvió %d de %d: %+v", resp.RecordsFiltered, resp.RecordsTotal, resp.Data)
+	}
+	for i, w := range want {
+		if resp.Data[i]["__id"] != w.id || resp.Data[i]["__score"] != w.score {
+			t.Errorf("la fila %d es %s con __score %s, se esperaba %s con %s",
+				i, resp.Data[i]["__id"], resp.Data[i]["__score"], w.id, w.score)
+		}
+	}
+
+	// Sin búsqueda por parecido no hay __score
+	resp = get(url.Values{"start": {"0"}, "length": {"10"}, "q": {`comunidad:"rio aro"`}})
+	if len(resp.Data) != 4 {
+		t.Fatalf("getData devolvió %+v", resp.Data)
+	}
+	if _, ok := resp.Data[0]["__score"]; ok {
+		t.Errorf("la fila trae __score sin buscar por parecido: %v", resp.Data[0])
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// ------------------- ORDEN DEL CENSO -------------------------
+
+// SortKey es una columna por la que se ordena.
+type SortKey struct {
+	Column string
+	Desc   bool
+}
+
+// censusSortFromRequest lee el orden pedido. La tabla manda el de DataTables
+// (order[i][column] con el número de columna, order[i][dir] con asc o desc y
+// columns[n][data] con el nombre de cada columna); las exportaciones mandan
+// orden, con las columnas separadas por comas y "-" delante de las que van de
+// mayor a menor (orden=COMUNIDAD,TORRE,-Edad). Sin orden queda el del filtro.
+func censusSortFromRequest(r *http.Request, headers []string) ([]SortKey, error) {
+	query := r.URL.Query()
+	var keys []SortKey
+	for i := 0; ; i++ {
+		index := query.Get(fmt.Sprintf("order[%d][column]", i))
+		if index == "" {
+			break
+		}
+		column := query.Get("columns[" + index + "][data]")
+		if column == "" {
+			if n, err := strconv.Atoi(index); err == nil && n >= 0 && n < len(headers) {
+				column = headers[n]
+			}
+		}
+		// Las columnas que no son del censo (el ID escondido) no ordenan
+		if indexOf(headers, column) < 0 {
+			continue
+		}
+		keys = append(keys, SortKey{Column: column, Desc: query.Get(fmt.Sprintf("order[%d][dir]", i)) == "desc"})
+	}
+
+	for _, name := range strings.Split(query.Get("orden"), ",") {
+		name = strings.TrimSpace(name)
+		key := SortKey{Desc: strings.HasPrefix(name, "-")}
+		name = strings.TrimPrefix(name, "-")
+		if name == "" {
+			continue
+		}
+		column, err := resolveFilterColumn(name, headers)
+		if err != nil {
+			return nil, err
+		}
+		key.Column = column
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// sortValue es una celda preparada para comparar: un número (las edades, las
+// fechas como AAAAMMDD) o el texto sin acentos ni mayúsculas.
+type sortValue struct {
+	empty bool
+	isNum bool
+	num   float64
+	text  string
+}
+
+func newSortValue(column, cell string) sortValue {
+	cell = strings.TrimSpace(cell)
+	if cell == "" {
+		return sortValue{empty: true}
+	}
+	switch kind := censusColumnTypes[column]; kind {
+	case COLUMNA_NUMERO:
+		if n, err := parseFilterNumber(cell); err == nil {
+			return sortValue{isNum: true, num: n}
+		}
+	case COLUMNA_FECHA, COLUMNA_FECHA_EXCEL:
+		if day, err := parseCellDate(cell, kind == COLUMNA_FECHA_EXCEL); err == nil {
+			return sortValue{isNum: true, num: float64(day)}
+		}
+	}
+	return sortValue{text: foldText(cell)}
+}
+
+// compareSortValues compara dos números o dos textos, estos en orden natural.
+func compareSortValues(a, b sortValue) int {
+	if a.isNum {
+		return compareRange(a.num, b.num, b.num)
+	}
+	return naturalCompare(a.text, b.text)
+}
+
+// sortCensus ordena las personas por las columnas pedidas, en ese orden de
+// prioridad. Las celdas vacías, y en las columnas de números o fechas las que
+// no lo son, quedan al final en los dos sentidos. Las personas que empatan en
+// todo conservan el orden que tenían.
+func sortCensus(records []CensusRecord, keys []SortKey) {
+	if len(keys) == 0 {
+		return
+	}
+	rows := make([][]sortValue, len(records))
+	for i, rec := range records {
+		rows[i] = make([]sortValue, len(keys))
+		for k, key := range keys {
+			rows[i][k] = newSortValue(key.Column, rec.Fields[key.Column])
+		}
+	}
+	sort.Stable(censusSorter{records, rows, keys})
+}
+
+type censusSorter struct {
+	records []CensusRecord
+	rows    [][]sortValue
+	keys    []SortKey
+}
+
+func (s censusSorter) Len() int { return len(s.records) }
+
+func (s censusSorter) Swap(i, j int) {
+	s.records[i], s.records[j] = s.records[j], s.records[i]
+	s.rows[i], s.rows[j] = s.rows[j], s.rows[i]
+}
+
+func (s censusSorter) Less(i, j int) bool {
+	for k, key := range s.keys {
+		a, b := s.rows[i][k], s.rows[j][k]
+		if a.empty || b.empty {
+			if a.empty != b.empty {
+				return b.empty
+			}
+			continue
+		}
+		// Una edad o una fecha mal escrita va después de las demás
+		if a.isNum != b.isNum {
+			return a.isNum
+		}
+		cmp := compareSortValues(a, b)
+		if key.Desc {
+			cmp = -cmp
+		}
+		if cmp != 0 {
+			return cmp < 0
+		}
+	}
+	return false
+}
+
+// naturalCompare compara textos tomando los números que tienen adentro como
+// números, así "A-2" va antes que "A-10" y la torre "2" antes que la "10".
+func naturalCompare(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	i, j := 0, 0
+	for i < len(ra) && j < len(rb) {
+		if unicode.IsDigit(ra[i]) && unicode.IsDigit(rb[j]) {
+			si, sj := i, j
+			for i < len(ra) && unicode.IsDigit(ra[i]) {
+				i++
+			}
+			for j < len(rb) && unicode.IsDigit(rb[j]) {
+				j++
+			}
+			na := strings.TrimLeft(string(ra[si:i]), "0")
+			nb := strings.TrimLeft(string(rb[sj:j]), "0")
+			if len(na) != len(nb) {
+				return compareRange(float64(len(na)), float64(len(nb)), float64(len(nb)))
+			}
+			if cmp := strings.Compare(na, nb); cmp != 0 {
+				return cmp
+			}
+			continue
+		}
+		if ra[i] != rb[j] {
+			if ra[i] < rb[j] {
+				return -1
+			}
+			return 1
+		}
+		i++
+		j++
+	}
+	return compareRange(float64(len(ra)-i), float64(len(rb)-j), float64(len(rb)-j))
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestNaturalCompare(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"a-2", "a-10", -1},
+		{"a-10", "a-2", 1},
+		{"2", "10", -1},
+		{"torre 9", "torre 10", -1},
+		// Los ceros a la izquierda no cuentan
+		{"a-02", "a-2", 0},
+		{"007", "7", 0},
+		{"a-010", "a-9", 1},
+		{"a-2b", "a-2c", -1},
+		{"a", "a-1", -1},
+		{"b", "a-10", 1},
+		{"", "a", -1},
+		{"", "", 0},
+	}
+	for _, tt := range tests {
+		if got := naturalCompare(tt.a, tt.b); got != tt.want {
+			t.Errorf("naturalCompare(%q, %q) = %d, se esperaba %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+// sortTestCensus tiene una persona por cada valor de column, en ese orden, con
+// IDs r0, r1...
+func sortTestCensus(column string, values ...string) []CensusRecord {
+	records := make([]CensusRecord, len(values))
+	for i, v := range values {
+		records[i] = CensusRecord{ID: "r" + string(rune('0'+i)), Fields: map[string]string{column: v}}
+	}
+	return records
+}
+
+func sortedValues(records []CensusRecord, column string) string {
+	values := make([]string, len(records))
+	for i, rec := range records {
+		values[i] = rec.Fields[column]
+	}
+	return strings.Join(values, "|")
+}
+
+func TestSortCensus(t *testing.T) {
+	tests := []struct {
+		column string
+		values []string
+		asc    string
+		desc   string
+	}{
+		{"CASA O APTO", []string{"A-10", "A-2", "", "a-3", "A-1", "A-02"},
+			"A-1|A-2|A-02|a-3|A-10|", "A-10|a-3|A-2|A-02|A-1|"},
+		{"TORRE", []string{"10", "9", "007", "1"}, "1|007|9|10", "10|9|007|1"},
+		// Las edades son números: 9 va antes que 10, y lo que no es un número
+		// va después, como las celdas vacías
+		{"Edad", []string{"10", "", "9", "100", "no sabe", "9,5"},
+			"9|9,5|10|100|no sabe|", "100|10|9,5|9|no sabe|"},
+		{"Fecha de nacimiento", []string{"20/11/1985", "", "15/06/1954", "31/02/1990", "01/02/89"},
+			"15/06/1954|20/11/1985|01/02/89|31/02/1990|", "01/02/89|20/11/1985|15/06/1954|31/02/1990|"},
+		// Mes/día/año en las fechas de Excel
+		{"Fecha de ingreso", []string{"3/15/2024", "45292", "4/3/2024"},
+			"45292|3/15/2024|4/3/2024", "4/3/2024|3/15/2024|45292"},
+		{"COMUNIDAD", []string{"río aro", "El Valle", "Rio Aro", "el valle"},
+			"El Valle|el valle|río aro|Rio Aro", "río aro|Rio Aro|El Valle|el valle"},
+	}
+	for _, tt := range tests {
+		for _, desc := range []bool{false, true} {
+			records := sortTestCensus(tt.column, tt.values...)
+			sortCensus(records, []SortKey{{Column: tt.column, Desc: desc}})
+			want := tt.asc
+			if desc {
+				want = tt.desc
+			}
+			if got := sortedValues(records, tt.column); got != want {
+				t.Errorf("%s (desc %v) quedó %s, se esperaba %s", tt.column, desc, got, want)
+			}
+		}
+	}
+}
+
+func TestSortCensusKeys(t *testing.T) {
+	person := func(id, comunidad, edad string) CensusRecord {
+		return CensusRecord{ID: id, Fields: map[string]string{"COMUNIDAD": comunidad, "Edad": edad}}
+	}
+	records := []CensusRecord{
+		person("a", "Rio Aro", "30"),
+		person("b", "El Valle", "5"),
+		person("c", "Rio Aro", "70"),
+		person("d", "El Valle", "5"),
+		person("e", "", "90"),
+		person("f", "Rio Aro", "30"),
+	}
+	sortCensus(records, []SortKey{{Column: "COMUNIDAD"}, {Column: "Edad", Desc: true}})
+	var ids []string
+	for _, rec := range records {
+		ids = append(ids, rec.ID)
+	}
+	// Los que empatan en todo (b y d, a y f) conservan su orden
+	if got := strings.Join(ids, ""); got != "bdcafe" {
+		t.Errorf("quedó %s, se esperaba bdcafe", got)
+	}
+
+	// Sin columnas no se toca nada, así queda el orden del filtro
+	sortCensus(records, nil)
+	ids = ids[:0]
+	for _, rec := range records {
+		ids = append(ids, rec.ID)
+	}
+	if got := strings.Join(ids, ""); got != "bdcafe" {
+		t.Errorf("sin columnas quedó %s", got)
+	}
+}
+
+func TestCensusSortFromRequest(t *testing.T) {
+	headers := []string{"Nombre completo", "COMUNIDAD", "Edad", "Telefono celular", "Telefono fijo"}
+	tests := []struct {
+		name   string
+		params url.Values
+		want   string
+		err    string
+	}{
+		{"sin orden", url.Values{}, "", ""},
+		{"DataTables", url.Values{
+			"order[0][column]": {"2"}, "order[0][dir]": {"desc"},
+			"order[1][column]": {"1"}, "order[1][dir]": {"asc"},
+			"columns[1][data]": {"COMUNIDAD"}, "columns[2][data]": {"Edad"},
+		}, "-Edad,COMUNIDAD", ""},
+		{"DataTables sin el nombre de la columna", url.Values{
+			"order[0][column]": {"0"},
+		}, "Nombre completo", ""},
+		{"la columna escondida del ID no ordena", url.Values{
+			"order[0][column]": {"5"}, "columns[5][data]": {"__id"},
+			"order[1][column]": {"2"}, "columns[2][data]": {"Edad"},
+		}, "Edad", ""},
+		{"número de columna que no existe", url.Values{"order[0][column]": {"9"}}, "", ""},
+		// Se corta en el primer order[i] que falta
+		{"order salteado", url.Values{"order[1][column]": {"2"}}, "", ""},
+		{"exportación", url.Values{"orden": {"comunidad, -edad,,nombre"}}, "COMUNIDAD,-Edad,Nombre completo", ""},
+		{"las dos cosas", url.Values{"order[0][column]": {"2"}, "orden": {"-comunidad"}}, "Edad,-COMUNIDAD", ""},
+		{"columna ambigua", url.Values{"orden": {"telefono"}}, "", "puede ser"},
+		{"columna que no existe", url.Values{"orden": {"-color"}}, "", `no existe la columna "color"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/api/data?"+tt.params.Encode(), nil)
+			keys, err := censusSortFromRequest(r, headers)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("devolvió %v, se esperaba %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, key := range keys {
+				if key.Desc {
+					got = append(got, "-"+key.Column)
+				} else {
+					got = append(got, key.Column)
+				}
+			}
+			if strings.Join(got, ",") != tt.want {
+				t.Errorf("devolvió %v, se esperaba %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,913 @@
+//go:build sqlite
+// +build sqlite
+
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// SQLiteStore guarda el censo, el historial y las actividades en una base SQLite.
+// El Excel queda solo como formato de importación y exportación.
+//
+// SQLite ya guarda cada transacción de forma atómica; las copias en rotation
+// se hacen al abrir la base y antes de reemplazar el censo completo.
+type SQLiteStore struct {
+	db       *sql.DB
+	rotation *backupRotation
+}
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS ajustes (
+	clave TEXT PRIMARY KEY,
+	valor TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS cabeceras (
+	posicion INTEGER PRIMARY KEY,
+	nombre   TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS personas (
+	id        INTEGER PRIMARY KEY AUTOINCREMENT,
+	uid       TEXT NOT NULL DEFAULT '',
+	cedula    TEXT NOT NULL DEFAULT '',
+	comunidad TEXT NOT NULL DEFAULT '',
+	torre     TEXT NOT NULL DEFAULT '',
+	casa      TEXT NOT NULL DEFAULT '',
+	datos     TEXT NOT NULL,
+	eliminado_por TEXT NOT NULL DEFAULT '',
+	eliminado_en  TEXT NOT NULL DEFAULT '',
+	motivo        TEXT NOT NULL DEFAULT ''
+);
+CREATE INDEX IF NOT EXISTS personas_cedula ON personas(cedula);
+CREATE INDEX IF NOT EXISTS personas_hogar ON personas(comunidad, torre, casa);
+CREATE TABLE IF NOT EXISTS historial (
+	posicion    INTEGER PRIMARY KEY,
+	usuario     TEXT NOT NULL,
+	descripcion TEXT NOT NULL,
+	fecha       TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS diario (
+	seq       INTEGER PRIMARY KEY AUTOINCREMENT,
+	cambio    TEXT NOT NULL,
+	fecha     TEXT NOT NULL,
+	operador  TEXT NOT NULL,
+	operacion TEXT NOT NULL,
+	persona   TEXT NOT NULL,
+	campo     TEXT NOT NULL,
+	anterior  TEXT NOT NULL,
+	nuevo     TEXT NOT NULL,
+	revierte  INTEGER NOT NULL DEFAULT 0,
+	instancia TEXT NOT NULL DEFAULT ''
+);
+CREATE INDEX IF NOT EXISTS diario_persona ON diario(persona);
+CREATE INDEX IF NOT EXISTS diario_cambio ON diario(cambio);
+CREATE TABLE IF NOT EXISTS actividades (
+	id           INTEGER PRIMARY KEY,
+	titulo       TEXT NOT NULL,
+	descripcion  TEXT NOT NULL,
+	fecha_inicio TEXT NOT NULL,
+	fecha_fin    TEXT NOT NULL,
+	hora         TEXT NOT NULL,
+	lugar        TEXT NOT NULL,
+	imagen       TEXT NOT NULL,
+	posicion     INTEGER NOT NULL
+);
+`
+
+// Las transacciones toman el bloqueo de escritura al empezar (_txlock=immediate):
+// dos ediciones a la vez se esperan en vez de leer lo mismo y pisarse.
+func openSQLiteStore(path string, rotation *backupRotation) (SQLStorage, error) {
+	db, err := sql.Open("sqlite3", "file:"+path+"?_busy_timeout=5000&_journal_mode=WAL&_foreign_keys=on&_txlock=immediate")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := migrateSQLiteSchema(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	s := &SQLiteStore{db: db, rotation: rotation}
+	s.snapshot()
+	return s, nil
+}
+
+// migrateSQLiteSchema actualiza bases creadas por versiones anteriores.
+// personas.id solo da el orden; el ID que ve el frontend es uid. Las personas
+// en la papelera tienen eliminado_en con la fecha en que se borraron.
+func migrateSQLiteSchema(db *sql.DB) error {
+	columns := []struct{ table, column, def string }{
+		{"personas", "uid", "TEXT NOT NULL DEFAULT ''"},
+		{"personas", "eliminado_por", "TEXT NOT NULL DEFAULT ''"},
+		{"personas", "eliminado_en", "TEXT NOT NULL DEFAULT ''"},
+		{"personas", "motivo", "TEXT NOT NULL DEFAULT ''"},
+		{"diario", "revierte", "INTEGER NOT NULL DEFAULT 0"},
+		{"diario", "instancia", "TEXT NOT NULL DEFAULT ''"},
+	}
+	for _, c := range columns {
+		var exists int
+		err := db.QueryRow(`SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?`, c.table, c.column).Scan(&exists)
+		if err != nil {
+			return err
+		}
+		if exists == 0 {
+			if _, err := db.Exec(`ALTER TABLE ` + c.table + ` ADD COLUMN ` + c.column + ` ` + c.def); err != nil {
+				return err
+			}
+		}
+	}
+
+	rows, err := db.Query(`SELECT id FROM personas WHERE uid = ''`)
+	if err != nil {
+		return err
+	}
+	var pending []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		pending = append(pending, id)
+	}
+	rows.Close()
+	for _, id := range pending {
+		if _, err := db.Exec(`UPDATE personas SET uid = ? WHERE id = ?`, newRecordID(), id); err != nil {
+			return err
+		}
+	}
+
+	_, err = db.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS personas_uid ON personas(uid)`)
+	return err
+}
+
+// queryer es lo que tienen en común *sql.DB y *sql.Tx.
+type queryer interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+func (s *SQLiteStore) headers(q queryer) ([]string, error) {
+	rows, err := q.Query(`SELECT nombre FROM cabeceras ORDER BY posicion`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var headers []string
+	for rows.Next() {
+		var h string
+		if err := rows.Scan(&h); err != nil {
+			return nil, err
+		}
+		headers = append(headers, h)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(headers) == 0 {
+		return nil, errCensusEmpty
+	}
+	return headers, nil
+}
+
+func (s *SQLiteStore) Headers() ([]string, error) {
+	return s.headers(s.db)
+}
+
+// recordFromJSON arma un registro desde la columna datos y completa las
+// columnas que falten con "".
+func recordFromJSON(headers []string, id, datos string) (CensusRecord, error) {
+	fields := make(map[string]string, len(headers))
+	if err := json.Unmarshal([]byte(datos), &fields); err != nil {
+		return CensusRecord{}, err
+	}
+	for _, h := range headers {
+		if _, ok := fields[h]; !ok {
+			fields[h] = ""
+		}
+	}
+	return CensusRecord{ID: id, Fields: fields}, nil
+}
+
+// scanRecords lee filas (uid, datos).
+func scanRecords(headers []string, rows *sql.Rows) ([]CensusRecord, error) {
+	defer rows.Close()
+	var records []CensusRecord
+	for rows.Next() {
+		var id string
+		var datos string
+		if err := rows.Scan(&id, &datos); err != nil {
+			return nil, err
+		}
+		rec, err := recordFromJSON(headers, id, datos)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, rec)
+	}
+	return records, rows.Err()
+}
+
+func (s *SQLiteStore) List() ([]CensusRecord, error) {
+	return s.list(s.db)
+}
+
+func (s *SQLiteStore) list(q queryer) ([]CensusRecord, error) {
+	headers, err := s.headers(q)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := q.Query(`SELECT uid, datos FROM personas WHERE eliminado_en = '' ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	records, err := scanRecords(headers, rows)
+	if records == nil && err == nil {
+		records = []CensusRecord{}
+	}
+	return records, err
+}
+
+func (s *SQLiteStore) queryOne(query string, args ...interface{}) (CensusRecord, error) {
+	headers, err := s.Headers()
+	if err != nil {
+		return CensusRecord{}, err
+	}
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return CensusRecord{}, err
+	}
+	records, err := scanRecords(headers, rows)
+	if err != nil {
+		return CensusRecord{}, err
+	}
+	if len(records) == 0 {
+		return CensusRecord{}, errRecordNotFound
+	}
+	return records[0], nil
+}
+
+func (s *SQLiteStore) Get(id string) (CensusRecord, error) {
+	return s.queryOne(`SELECT uid, datos FROM personas WHERE uid = ? AND eliminado_en = ''`, id)
+}
+
+func (s *SQLiteStore) FindByCedula(cedula string) (CensusRecord, error) {
+	return s.queryOne(`SELECT uid, datos FROM personas WHERE cedula = ? AND eliminado_en = '' ORDER BY id LIMIT 1`, cedula)
+}
+
+func (s *SQLiteStore) Households() ([]Household, error) {
+	headers, err := s.Headers()
+	if err != nil {
+		return nil, err
+	}
+	records, err := s.List()
+	if err != nil {
+		return nil, err
+	}
+	return groupHouseholds(headers, records)
+}
+
+func (s *SQLiteStore) FindHousehold(comunidad, torre, casa string) (Household, error) {
+	headers, err := s.Headers()
+	if err != nil {
+		return Household{}, err
+	}
+	h := Household{Comunidad: strings.TrimSpace(comunidad), Torre: strings.TrimSpace(torre), Casa: strings.TrimSpace(casa)}
+	rows, err := s.db.Query(`SELECT uid, datos FROM personas WHERE comunidad = ? AND torre = ? AND casa = ? AND eliminado_en = '' ORDER BY id`, h.Comunidad, h.Torre, h.Casa)
+	if err != nil {
+		return Household{}, err
+	}
+	if h.Members, err = scanRecords(headers, rows); err != nil {
+		return Household{}, err
+	}
+	if len(h.Members) == 0 {
+		return Household{}, errRecordNotFound
+	}
+	return h, nil
+}
+
+// indexColumns saca de los campos los valores que van en columnas con índice.
+func indexColumns(fields map[string]string) []interface{} {
+	rec := CensusRecord{Fields: fields}
+	return []interface{}{
+		rec.Value(CEDULA_HEADER),
+		strings.TrimSpace(rec.Value("COMUNIDAD")),
+		strings.TrimSpace(rec.Value("TORRE")),
+		strings.TrimSpace(firstNonEmpty(rec.Value("CASA O APTO"), rec.Value("CASA"), rec.Value("APTO"))),
+	}
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// onlyKnown deja solo los campos que corresponden a una cabecera del censo.
+func onlyKnown(headers []string, fields map[string]string) map[string]string {
+	out := make(map[string]string, len(headers))
+	for _, h := range headers {
+		if val, ok := fields[h]; ok {
+			out[h] = val
+		}
+	}
+	return out
+}
+
+func insertPersona(q queryer, uid string, fields map[string]string) error {
+	datos, err := json.Marshal(fields)
+	if err != nil {
+		return err
+	}
+	args := append([]interface{}{uid}, indexColumns(fields)...)
+	args = append(args, string(datos))
+	_, err = q.Exec(`INSERT INTO personas (uid, cedula, comunidad, torre, casa, datos) VALUES (?, ?, ?, ?, ?, ?)`, args...)
+	return err
+}
+
+func (s *SQLiteStore) Insert(records ...map[string]string) ([]string, error) {
+	return s.Save(nil, records)
+}
+
+func (s *SQLiteStore) Update(records ...CensusRecord) error {
+	_, err := s.Save(records, nil)
+	return err
+}
+
+// Save escribe los cambios y agrega las personas nuevas en una sola transacción.
+func (s *SQLiteStore) Save(updates []CensusRecord, inserts []map[string]string) ([]string, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	headers, err := s.headers(tx)
+	if err != nil {
+		return nil, err
+	}
+	var conflicts []CensusRecord
+	for _, rec := range updates {
+		current, err := s.current(tx, headers, rec.ID)
+		if err != nil {
+			return nil, err
+		}
+		if staleVersion(current, rec.IfVersion) {
+			conflicts = append(conflicts, current)
+			continue
+		}
+		fields := current.Fields
+		for key, val := range onlyKnown(headers, rec.Fields) {
+			fields[key] = val
+		}
+		nuevos, err := json.Marshal(fields)
+		if err != nil {
+			return nil, err
+		}
+		args := append(indexColumns(fields), string(nuevos), rec.ID)
+		if _, err := tx.Exec(`UPDATE personas SET cedula = ?, comunidad = ?, torre = ?, casa = ?, datos = ? WHERE uid = ?`, args...); err != nil {
+			return nil, err
+		}
+	}
+	if len(conflicts) > 0 {
+		// El Rollback diferido deshace lo que ya se escribió
+		return nil, &ConflictError{Current: conflicts}
+	}
+
+	ids := make([]string, 0, len(inserts))
+	for _, fields := range inserts {
+		id := insertID(fields)
+		// uid es único también con la papelera
+		var taken int
+		if err := tx.QueryRow(`SELECT COUNT(*) FROM personas WHERE uid = ?`, id).Scan(&taken); err != nil {
+			return nil, err
+		}
+		if taken > 0 {
+			return nil, errDuplicateID
+		}
+		if err := insertPersona(tx, id, onlyKnown(headers, fields)); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, tx.Commit()
+}
+
+// current lee una persona dentro de una transacción.
+func (s *SQLiteStore) current(q queryer, headers []string, id string) (CensusRecord, error) {
+	var datos string
+	err := q.QueryRow(`SELECT datos FROM personas WHERE uid = ? AND eliminado_en = ''`, id).Scan(&datos)
+	if err == sql.ErrNoRows {
+		return CensusRecord{}, errRecordNotFound
+	}
+	if err != nil {
+		return CensusRecord{}, err
+	}
+	return recordFromJSON(headers, id, datos)
+}
+
+func (s *SQLiteStore) Delete(info DeleteInfo, refs ...RecordRef) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	headers, err := s.headers(tx)
+	if err != nil {
+		return err
+	}
+	var conflicts []CensusRecord
+	for _, ref := range refs {
+		current, err := s.current(tx, headers, ref.ID)
+		if err != nil {
+			return err
+		}
+		if staleVersion(current, ref.IfVersion) {
+			conflicts = append(conflicts, current)
+			continue
+		}
+		_, err = tx.Exec(`UPDATE personas SET eliminado_por = ?, eliminado_en = ?, motivo = ? WHERE uid = ?`,
+			info.By, time.Now().Format(time.RFC3339Nano), info.Reason, ref.ID)
+		if err != nil {
+			return err
+		}
+	}
+	if len(conflicts) > 0 {
+		return &ConflictError{Current: conflicts}
+	}
+	return tx.Commit()
+}
+
+// ExportWorkbook genera el libro al momento con los datos de la base.
+func (s *SQLiteStore) ExportWorkbook(w io.Writer) error {
+	headers, err := s.Headers()
+	if err != nil {
+		return err
+	}
+	records, err := s.List()
+	if err != nil {
+		return err
+	}
+	return writeWorkbook(w, PRIMERA_HOJA, headers, records)
+}
+
+// ImportWorkbook reemplaza cabeceras y personas en una sola transacción.
+// Se conservan los IDs del libro; las personas sin ID o con uno repetido
+// reciben uno nuevo. La papelera se conserva y se le agregan las personas de
+// la hoja PAPELERA del libro que le falten, así un libro combinado por la
+// sincronización trae también lo que se borró en las otras computadoras.
+func (s *SQLiteStore) ImportWorkbook(r io.Reader) error {
+	return s.ImportWorkbookIf(r, "")
+}
+
+func (s *SQLiteStore) ImportWorkbookIf(r io.Reader, ifVersion string) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	headers, records, err := readWorkbook(bytes.NewReader(data), PRIMERA_HOJA)
+	if err != nil {
+		return err
+	}
+	trash, err := readWorkbookTrash(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	s.snapshot()
+	return s.replaceCensus(headers, records, trash, ifVersion)
+}
+
+// replaceCensus reemplaza las cabeceras y las personas del censo por estas y
+// agrega a la papelera las de trash que le falten. Las personas sin ID o con
+// un ID repetido reciben uno nuevo; una persona que estaba en la papelera y
+// llega en el censo sale de la papelera (la restauraron en otra computadora).
+// Con ifVersion funciona como en ImportWorkbookIf.
+func (s *SQLiteStore) replaceCensus(headers []string, records []CensusRecord, trash []DeletedRecord, ifVersion string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if ifVersion != "" {
+		current, err := s.list(tx)
+		if err != nil && err != errCensusEmpty {
+			return err
+		}
+		if censusVersion(current) != ifVersion {
+			return errCensusChanged
+		}
+	}
+	if _, err := tx.Exec(`DELETE FROM cabeceras`); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM personas WHERE eliminado_en = ''`); err != nil {
+		return err
+	}
+	for i, h := range headers {
+		if _, err := tx.Exec(`INSERT INTO cabeceras (posicion, nombre) VALUES (?, ?)`, i, h); err != nil {
+			return err
+		}
+	}
+	seen := make(map[string]bool)
+	for _, rec := range records {
+		id := rec.ID
+		if id == "" || seen[id] {
+			id = newRecordID()
+		}
+		seen[id] = true
+		if _, err := tx.Exec(`DELETE FROM personas WHERE uid = ?`, id); err != nil {
+			return err
+		}
+		if err := insertPersona(tx, id, rec.Fields); err != nil {
+			return err
+		}
+	}
+
+	for _, rec := range trash {
+		var taken int
+		if err := tx.QueryRow(`SELECT COUNT(*) FROM personas WHERE uid = ?`, rec.ID).Scan(&taken); err != nil {
+			return err
+		}
+		if rec.ID == "" || taken > 0 {
+			continue
+		}
+		if err := insertPersona(tx, rec.ID, rec.Fields); err != nil {
+			return err
+		}
+		// Sin fecha válida cuenta desde hoy para vaciar la papelera
+		fecha := rec.DeletedAt
+		if fecha.IsZero() {
+			fecha = time.Now()
+		}
+		_, err = tx.Exec(`UPDATE personas SET eliminado_por = ?, eliminado_en = ?, motivo = ? WHERE uid = ?`,
+			rec.DeletedBy, fecha.Format(time.RFC3339Nano), rec.Reason, rec.ID)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// --- Papelera ---
+
+func (s *SQLiteStore) Trash() ([]DeletedRecord, error) {
+	headers, err := s.Headers()
+	if err == errCensusEmpty {
+		return []DeletedRecord{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	rows, err := s.db.Query(`SELECT uid, datos, eliminado_por, eliminado_en, motivo FROM personas WHERE eliminado_en != '' ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	list := []DeletedRecord{}
+	for rows.Next() {
+		var id, datos, fecha string
+		var rec DeletedRecord
+		if err := rows.Scan(&id, &datos, &rec.DeletedBy, &fecha, &rec.Reason); err != nil {
+			return nil, err
+		}
+		if rec.CensusRecord, err = recordFromJSON(headers, id, datos); err != nil {
+			return nil, err
+		}
+		rec.DeletedAt, _ = time.Parse(time.RFC3339Nano, fecha)
+		list = append(list, rec)
+	}
+	sort.SliceStable(list, func(i, j int) bool { return list[i].DeletedAt.Before(list[j].DeletedAt) })
+	return list, rows.Err()
+}
+
+// Restore devuelve las personas a su lugar original en el censo.
+func (s *SQLiteStore) Restore(ids ...string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, id := range uniqueIDs(ids) {
+		// uid es único, así que no puede estar en el censo y en la papelera a
+		// la vez; se revisa para responder lo mismo que el ExcelStore
+		var live int
+		if err := tx.QueryRow(`SELECT COUNT(*) FROM personas WHERE uid = ? AND eliminado_en = ''`, id).Scan(&live); err != nil {
+			return err
+		}
+		if live > 0 {
+			return errDuplicateID
+		}
+		res, err := tx.Exec(`UPDATE personas SET eliminado_por = '', eliminado_en = '', motivo = '' WHERE uid = ? AND eliminado_en != ''`, id)
+		if err != nil {
+			return err
+		}
+		if affected, _ := res.RowsAffected(); affected == 0 {
+			return errRecordNotFound
+		}
+	}
+	return tx.Commit()
+}
+
+// Purge compara las fechas en Go: las guardadas con RFC3339Nano no siempre
+// tienen el mismo largo y no se pueden comparar como texto.
+func (s *SQLiteStore) Purge(before time.Time) (int, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`SELECT id, eliminado_en FROM personas WHERE eliminado_en != ''`)
+	if err != nil {
+		return 0, err
+	}
+	var old []int64
+	for rows.Next() {
+		var id int64
+		var fecha string
+		if err := rows.Scan(&id, &fecha); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		if t, err := time.Parse(time.RFC3339Nano, fecha); err == nil && t.Before(before) {
+			old = append(old, id)
+		}
+	}
+	rows.Close()
+	for _, id := range old {
+		if _, err := tx.Exec(`DELETE FROM personas WHERE id = ?`, id); err != nil {
+			return 0, err
+		}
+	}
+	return len(old), tx.Commit()
+}
+
+// --- Diario de cambios ---
+
+func (s *SQLiteStore) AppendJournal(entries []JournalEntry) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for i, e := range entries {
+		res, err := tx.Exec(`INSERT INTO diario (cambio, fecha, operador, operacion, persona, campo, anterior, nuevo, revierte, instancia) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			e.Change, e.Time.Format(time.RFC3339Nano), e.Operator, e.Op, e.RecordID, e.Field, e.Old, e.New, e.Reverts, e.Instancia)
+		if err != nil {
+			return err
+		}
+		if entries[i].Seq, err = res.LastInsertId(); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *SQLiteStore) Journal(filter JournalFilter) ([]JournalEntry, error) {
+	query := `SELECT seq, cambio, fecha, operador, operacion, persona, campo, anterior, nuevo, revierte, instancia FROM diario WHERE 1 = 1`
+	var args []interface{}
+	if filter.Seq != 0 {
+		query += ` AND seq = ?`
+		args = append(args, filter.Seq)
+	}
+	if filter.RecordID != "" {
+		query += ` AND persona = ?`
+		args = append(args, filter.RecordID)
+	}
+	if filter.Change != "" {
+		query += ` AND cambio = ?`
+		args = append(args, filter.Change)
+	}
+	if filter.After != 0 {
+		query += ` AND seq > ?`
+		args = append(args, filter.After)
+	}
+	rows, err := s.db.Query(query+` ORDER BY seq`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := []JournalEntry{}
+	for rows.Next() {
+		var e JournalEntry
+		var fecha string
+		if err := rows.Scan(&e.Seq, &e.Change, &fecha, &e.Operator, &e.Op, &e.RecordID, &e.Field, &e.Old, &e.New, &e.Reverts, &e.Instancia); err != nil {
+			return nil, err
+		}
+		e.Time, _ = time.Parse(time.RFC3339Nano, fecha)
+		list = append(list, e)
+	}
+	return list, rows.Err()
+}
+
+// --- Copias de seguridad ---
+
+// snapshot guarda una copia de la base con VACUUM INTO, que es consistente
+// aunque haya otras conexiones escribiendo. Una base sin censo no se copia.
+func (s *SQLiteStore) snapshot() {
+	if s.rotation == nil {
+		return
+	}
+	if _, err := s.Headers(); err != nil {
+		return
+	}
+	err := s.rotation.snapshot(func(path string) error {
+		_, err := s.db.Exec(`VACUUM INTO ?`, path)
+		return err
+	})
+	if err != nil {
+		fmt.Printf("--- ERROR: No se pudo guardar la copia de seguridad de la base: %v ---\n", err)
+	}
+}
+
+func (s *SQLiteStore) Backups() ([]BackupInfo, error) {
+	if s.rotation == nil {
+		return []BackupInfo{}, nil
+	}
+	return s.rotation.list()
+}
+
+// ReadBackup lee el censo de una copia.
+func (s *SQLiteStore) ReadBackup(nombre string) ([]string, []CensusRecord, error) {
+	if s.rotation == nil {
+		return nil, nil, errBackupNotFound
+	}
+	path, err := s.rotation.path(nombre)
+	if err != nil {
+		return nil, nil, err
+	}
+	// Se lee una copia temporal de la copia: así se le puede aplicar
+	// migrateSQLiteSchema si es de una versión anterior sin tocar el original.
+	tmp, err := ioutil.TempFile("", "respaldo-*.db")
+	if err != nil {
+		return nil, nil, err
+	}
+	tmp.Close()
+	defer func() {
+		for _, suffix := range []string{"", "-wal", "-shm"} {
+			os.Remove(tmp.Name() + suffix)
+		}
+	}()
+	data, err := readEncryptedFile(path, s.rotation.Cipher)
+	if err != nil {
+		return nil, nil, fmt.Errorf("la copia %s no se puede leer: %v", nombre, err)
+	}
+	if err := ioutil.WriteFile(tmp.Name(), data, 0600); err != nil {
+		return nil, nil, err
+	}
+	opened, err := openSQLiteStore(tmp.Name(), nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("la copia %s no se puede leer: %v", nombre, err)
+	}
+	backup := opened.(*SQLiteStore)
+	defer backup.db.Close()
+	headers, err := backup.Headers()
+	if err != nil {
+		return nil, nil, fmt.Errorf("la copia %s no se puede leer: %v", nombre, err)
+	}
+	records, err := backup.List()
+	if err != nil {
+		return nil, nil, fmt.Errorf("la copia %s no se puede leer: %v", nombre, err)
+	}
+	return headers, records, nil
+}
+
+// RestoreBackup restaura solo el censo (cabeceras y personas) de la copia; el
+// historial y las actividades quedan como están.
+func (s *SQLiteStore) RestoreBackup(nombre string) error {
+	headers, records, err := s.ReadBackup(nombre)
+	if err != nil {
+		return err
+	}
+
+	s.snapshot()
+	return s.replaceCensus(headers, records, nil, "")
+}
+
+// --- Historial y actividades ---
+
+// saved indica si alguna vez se guardó la lista con esa clave, para distinguir
+// "nunca se guardó" (hay que migrar) de "se guardó vacía".
+func (s *SQLiteStore) saved(clave string) (bool, error) {
+	var valor string
+	err := s.db.QueryRow(`SELECT valor FROM ajustes WHERE clave = ?`, clave).Scan(&valor)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func markSaved(tx *sql.Tx, clave string) error {
+	_, err := tx.Exec(`INSERT OR REPLACE INTO ajustes (clave, valor) VALUES (?, '1')`, clave)
+	return err
+}
+
+func (s *SQLiteStore) LoadHistory() ([]HistoryEntry, error) {
+	if ok, err := s.saved("historial_guardado"); !ok || err != nil {
+		return nil, err
+	}
+	rows, err := s.db.Query(`SELECT usuario, descripcion, fecha FROM historial ORDER BY posicion`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	entries := []HistoryEntry{}
+	for rows.Next() {
+		var e HistoryEntry
+		var fecha string
+		if err := rows.Scan(&e.User, &e.Description, &fecha); err != nil {
+			return nil, err
+		}
+		e.Timestamp, _ = time.Parse(time.RFC3339Nano, fecha)
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+func (s *SQLiteStore) SaveHistory(entries []HistoryEntry) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM historial`); err != nil {
+		return err
+	}
+	for i, e := range entries {
+		_, err := tx.Exec(`INSERT INTO historial (posicion, usuario, descripcion, fecha) VALUES (?, ?, ?, ?)`,
+			i, e.User, e.Description, e.Timestamp.Format(time.RFC3339Nano))
+		if err != nil {
+			return err
+		}
+	}
+	if err := markSaved(tx, "historial_guardado"); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *SQLiteStore) LoadActivities() ([]Activity, error) {
+	if ok, err := s.saved("actividades_guardadas"); !ok || err != nil {
+		return nil, err
+	}
+	rows, err := s.db.Query(`SELECT id, titulo, descripcion, fecha_inicio, fecha_fin, hora, lugar, imagen FROM actividades ORDER BY posicion`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	list := []Activity{}
+	for rows.Next() {
+		var a Activity
+		if err := rows.Scan(&a.ID, &a.Title, &a.Description, &a.StartDate, &a.EndDate, &a.Time, &a.Location, &a.Image); err != nil {
+			return nil, err
+		}
+		list = append(list, a)
+	}
+	return list, rows.Err()
+}
+
+func (s *SQLiteStore) SaveActivities(list []Activity) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM actividades`); err != nil {
+		return err
+	}
+	for i, a := range list {
+		_, err := tx.Exec(`INSERT INTO actividades (id, titulo, descripcion, fecha_inicio, fecha_fin, hora, lugar, imagen, posicion) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			a.ID, a.Title, a.Description, a.StartDate, a.EndDate, a.Time, a.Location, a.Image, i)
+		if err != nil {
+			return err
+		}
+	}
+	if err := markSaved(tx, "actividades_guardadas"); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
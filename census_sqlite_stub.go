@@ -0,0 +1,12 @@
+//go:build !sqlite
+// +build !sqlite
+
+package main
+
+import "errors"
+
+// Sin la etiqueta "sqlite" no se compila el driver (necesita cgo), así el
+// ejecutable de siempre se sigue compilando para Windows sin un compilador de C.
+func openSQLiteStore(path string, rotation *backupRotation) (SQLStorage, error) {
+	return nil, errors.New("este ejecutable se compiló sin soporte SQLite; compile con: go build -tags sqlite")
+}
@@ -0,0 +1,460 @@
+//go:build sqlite
+// +build sqlite
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestSQLiteStore crea una base con n personas en una carpeta temporal.
+func newTestSQLiteStore(t *testing.T, n int) *SQLiteStore {
+	t.Helper()
+	db, err := openSQLiteStore(filepath.Join(t.TempDir(), "censo.db"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := db.(*SQLiteStore)
+	t.Cleanup(func() { s.db.Close() })
+	if n > 0 {
+		headers, records := testCensus(n)
+		var buf bytes.Buffer
+		if err := writeWorkbook(&buf, PRIMERA_HOJA, headers, records); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.ImportWorkbook(&buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return s
+}
+
+func TestSQLiteStoreImportKeepsTrash(t *testing.T) {
+	s := newTestSQLiteStore(t, 3)
+	if err := s.Delete(DeleteInfo{By: "prueba", Reason: "mudanza"}, RecordRef{ID: "p00001"}); err != nil {
+		t.Fatal(err)
+	}
+	var exported bytes.Buffer
+	if err := s.ExportWorkbook(&exported); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.ImportWorkbook(&exported); err != nil {
+		t.Fatal(err)
+	}
+
+	trash, err := s.Trash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trash) != 1 || trash[0].ID != "p00001" || trash[0].Reason != "mudanza" {
+		t.Fatalf("la papelera quedó con %+v, se esperaba p00001", trash)
+	}
+	if records, _ := s.List(); len(records) != 2 {
+		t.Fatalf("quedaron %d personas en el censo, se esperaban 2", len(records))
+	}
+}
+
+func TestSQLiteStoreImportTrashSheet(t *testing.T) {
+	s := newTestSQLiteStore(t, 0)
+	// Un libro de modo Excel con una persona en la papelera
+	excel := newTestExcelStore(t, 3)
+	if err := excel.Delete(DeleteInfo{By: "otra"}, RecordRef{ID: "p00002"}); err != nil {
+		t.Fatal(err)
+	}
+	var book bytes.Buffer
+	if err := excel.ExportWorkbook(&book); err != nil {
+		t.Fatal(err)
+	}
+	old := PRIMERA_HOJA
+	PRIMERA_HOJA = "Sheet1"
+	defer func() { PRIMERA_HOJA = old }()
+	if err := s.ImportWorkbook(&book); err != nil {
+		t.Fatal(err)
+	}
+
+	trash, err := s.Trash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trash) != 1 || trash[0].ID != "p00002" || trash[0].DeletedBy != "otra" || trash[0].Fields["Nombre completo"] != "Persona 2" {
+		t.Fatalf("la papelera quedó con %+v, se esperaba p00002 del libro", trash)
+	}
+	// Restaurada en otra computadora: llega en el censo y sale de la papelera
+	headers, records := testCensus(3)
+	book.Reset()
+	if err := writeWorkbook(&book, PRIMERA_HOJA, headers, records); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.ImportWorkbook(&book); err != nil {
+		t.Fatal(err)
+	}
+	if trash, _ := s.Trash(); len(trash) != 0 {
+		t.Fatalf("la papelera quedó con %+v, p00002 ya está en el censo", trash)
+	}
+	if _, err := s.Get("p00002"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSQLiteStoreSave(t *testing.T) {
+	s := newTestSQLiteStore(t, 3)
+	rec, err := s.Get("p00002")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids, err := s.Save(
+		[]CensusRecord{{ID: "p00002", Fields: map[string]string{"Edad": "41", "Color": "rojo"}, IfVersion: rec.Version()}},
+		[]map[string]string{{"Nombre completo": "Nueva", CEDULA_HEADER: "V-777"}, {ID_HEADER: "propio", "Nombre completo": "Con ID"}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 2 || ids[0] == "" || ids[1] != "propio" {
+		t.Fatalf("Save devolvió los IDs %v", ids)
+	}
+
+	got, err := s.Get("p00002")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Solo cambia lo que se mandó, y las columnas que no existen se ignoran
+	if got.Fields["Edad"] != "41" || got.Fields["Nombre completo"] != "Persona 2" || got.Fields["Color"] != "" {
+		t.Errorf("p00002 quedó con %v", got.Fields)
+	}
+	if got.Version() == rec.Version() {
+		t.Error("la versión de p00002 no cambió")
+	}
+	if nueva, err := s.FindByCedula("V-777"); err != nil || nueva.ID != ids[0] {
+		t.Errorf("FindByCedula(V-777) devolvió %+v, %v", nueva, err)
+	}
+	if records, _ := s.List(); len(records) != 5 || records[3].ID != ids[0] || records[4].ID != "propio" {
+		t.Errorf("el censo quedó con %+v", records)
+	}
+
+	if _, err := s.Save([]CensusRecord{{ID: "no-existe", Fields: map[string]string{"Edad": "1"}}}, nil); err != errRecordNotFound {
+		t.Errorf("Save de una persona que no existe devolvió %v", err)
+	}
+}
+
+func TestSQLiteStoreSaveConflict(t *testing.T) {
+	s := newTestSQLiteStore(t, 3)
+	rec, _ := s.Get("p00001")
+	stale := rec.Version()
+	if err := s.Update(CensusRecord{ID: "p00001", Fields: map[string]string{"Edad": "50"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	other, _ := s.Get("p00002")
+	_, err := s.Save([]CensusRecord{
+		{ID: "p00002", Fields: map[string]string{"Edad": "60"}, IfVersion: other.Version()},
+		{ID: "p00001", Fields: map[string]string{"Edad": "51"}, IfVersion: stale},
+	}, []map[string]string{{"Nombre completo": "No se agrega"}})
+	conflict, ok := err.(*ConflictError)
+	if !ok {
+		t.Fatalf("Save con una versión vieja devolvió %v, se esperaba *ConflictError", err)
+	}
+	if len(conflict.Current) != 1 || conflict.Current[0].ID != "p00001" || conflict.Current[0].Fields["Edad"] != "50" {
+		t.Errorf("el conflicto trae %+v, se esperaba p00001 con Edad 50", conflict.Current)
+	}
+	// No se escribe nada, ni lo que no tenía conflicto
+	if got, _ := s.Get("p00002"); got.Fields["Edad"] != other.Fields["Edad"] {
+		t.Errorf("p00002 quedó con Edad %s", got.Fields["Edad"])
+	}
+	if records, _ := s.List(); len(records) != 3 {
+		t.Errorf("quedaron %d personas, se esperaban 3", len(records))
+	}
+
+	err = s.Delete(DeleteInfo{By: "prueba"}, RecordRef{ID: "p00001", IfVersion: stale})
+	if _, ok := err.(*ConflictError); !ok {
+		t.Fatalf("Delete con una versión vieja devolvió %v, se esperaba *ConflictError", err)
+	}
+	if _, err := s.Get("p00001"); err != nil {
+		t.Errorf("p00001 se borró a pesar del conflicto: %v", err)
+	}
+}
+
+func TestSQLiteStoreDuplicateID(t *testing.T) {
+	s := newTestSQLiteStore(t, 3)
+	if _, err := s.Insert(map[string]string{ID_HEADER: "p00001", "Nombre completo": "Repetida"}); err != errDuplicateID {
+		t.Fatalf("Insert con un ID del censo devolvió %v", err)
+	}
+	// El ID sigue ocupado mientras la persona está en la papelera
+	if err := s.Delete(DeleteInfo{By: "prueba"}, RecordRef{ID: "p00002"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Insert(
+		map[string]string{"Nombre completo": "Esta no se agrega"},
+		map[string]string{ID_HEADER: "p00002", "Nombre completo": "Repetida"},
+	); err != errDuplicateID {
+		t.Fatalf("Insert con un ID de la papelera devolvió %v", err)
+	}
+	if records, _ := s.List(); len(records) != 2 {
+		t.Errorf("quedaron %d personas, se esperaban 2", len(records))
+	}
+
+	// Un libro con IDs repetidos o sin ID: cada persona recibe uno propio
+	headers, records := testCensus(3)
+	records[1].ID = records[0].ID
+	records[2].ID = ""
+	var book bytes.Buffer
+	if err := writeWorkbook(&book, PRIMERA_HOJA, headers, records); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.ImportWorkbook(&book); err != nil {
+		t.Fatal(err)
+	}
+	imported, err := s.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := make(map[string]bool)
+	for _, rec := range imported {
+		if rec.ID == "" || seen[rec.ID] {
+			t.Errorf("el ID %q quedó vacío o repetido en %+v", rec.ID, imported)
+		}
+		seen[rec.ID] = true
+	}
+	if len(imported) != 3 || imported[0].ID != "p00000" {
+		t.Errorf("el censo quedó con %+v", imported)
+	}
+}
+
+func TestSQLiteStoreTrash(t *testing.T) {
+	s := newTestSQLiteStore(t, 4)
+	if err := s.Delete(DeleteInfo{By: "ana", Reason: "mudanza"}, RecordRef{ID: "p00001"}, RecordRef{ID: "p00003"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get("p00001"); err != errRecordNotFound {
+		t.Errorf("Get de una persona en la papelera devolvió %v", err)
+	}
+	if _, err := s.FindByCedula("V-00000001"); err != errRecordNotFound {
+		t.Errorf("FindByCedula de una persona en la papelera devolvió %v", err)
+	}
+	if err := s.Delete(DeleteInfo{By: "ana"}, RecordRef{ID: "p00001"}); err != errRecordNotFound {
+		t.Errorf("borrar dos veces devolvió %v", err)
+	}
+	trash, err := s.Trash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trash) != 2 || trash[0].DeletedBy != "ana" || trash[0].Reason != "mudanza" || trash[0].DeletedAt.IsZero() {
+		t.Fatalf("la papelera quedó con %+v", trash)
+	}
+
+	if err := s.Restore("p00003", "p00003"); err != nil {
+		t.Fatal(err)
+	}
+	if records, _ := s.List(); len(records) != 3 || records[2].ID != "p00003" {
+		t.Errorf("p00003 no volvió a su lugar: %+v", records)
+	}
+	if err := s.Restore("p00003"); err != errDuplicateID {
+		t.Errorf("restaurar a alguien que está en el censo devolvió %v", err)
+	}
+	if err := s.Restore("no-existe"); err != errRecordNotFound {
+		t.Errorf("restaurar a alguien que no está en la papelera devolvió %v", err)
+	}
+
+	if n, err := s.Purge(time.Now().Add(-time.Hour)); err != nil || n != 0 {
+		t.Errorf("Purge de hace una hora borró %d, %v", n, err)
+	}
+	if n, err := s.Purge(time.Now().Add(time.Second)); err != nil || n != 1 {
+		t.Errorf("Purge borró %d, %v; se esperaba 1", n, err)
+	}
+	if trash, _ := s.Trash(); len(trash) != 0 {
+		t.Errorf("la papelera quedó con %+v", trash)
+	}
+	if err := s.Restore("p00001"); err != errRecordNotFound {
+		t.Errorf("restaurar a alguien que se vació devolvió %v", err)
+	}
+	if records, _ := s.List(); len(records) != 3 {
+		t.Errorf("Purge tocó el censo: %+v", records)
+	}
+}
+
+func TestSQLiteStoreWorkbookRoundTrip(t *testing.T) {
+	s := newTestSQLiteStore(t, 3)
+	if err := s.Update(CensusRecord{ID: "p00002", Fields: map[string]string{"Edad": "99"}}); err != nil {
+		t.Fatal(err)
+	}
+	headers, _ := s.Headers()
+	before, _ := s.List()
+
+	var book bytes.Buffer
+	if err := s.ExportWorkbook(&book); err != nil {
+		t.Fatal(err)
+	}
+	other := newTestSQLiteStore(t, 0)
+	if err := other.ImportWorkbookIf(bytes.NewReader(book.Bytes()), ""); err != nil {
+		t.Fatal(err)
+	}
+	gotHeaders, _ := other.Headers()
+	after, _ := other.List()
+	if strings.Join(gotHeaders, "|") != strings.Join(headers, "|") {
+		t.Errorf("las cabeceras quedaron %v, se esperaban %v", gotHeaders, headers)
+	}
+	if censusVersion(after) != censusVersion(before) || len(after) != len(before) {
+		t.Fatalf("el censo quedó con %+v, se esperaba %+v", after, before)
+	}
+	for i := range before {
+		if after[i].ID != before[i].ID || after[i].Version() != before[i].Version() {
+			t.Errorf("la fila %d quedó %+v, se esperaba %+v", i, after[i], before[i])
+		}
+	}
+
+	// Con la versión del censo que se leyó, el libro se importa solo si nadie
+	// lo cambió mientras tanto
+	version := censusVersion(after)
+	if err := other.Update(CensusRecord{ID: "p00001", Fields: map[string]string{"Edad": "77"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := other.ImportWorkbookIf(bytes.NewReader(book.Bytes()), version); err != errCensusChanged {
+		t.Fatalf("ImportWorkbookIf con una versión vieja devolvió %v", err)
+	}
+	if got, _ := other.Get("p00001"); got.Fields["Edad"] != "77" {
+		t.Errorf("el libro se importó a pesar del conflicto: %v", got.Fields)
+	}
+	current, _ := other.List()
+	if err := other.ImportWorkbookIf(bytes.NewReader(book.Bytes()), censusVersion(current)); err != nil {
+		t.Fatal(err)
+	}
+	if after, _ := other.List(); censusVersion(after) != censusVersion(before) {
+		t.Errorf("el censo quedó con %+v", after)
+	}
+}
+
+func TestSQLiteStoreHistoryAndActivities(t *testing.T) {
+	s := newTestSQLiteStore(t, 0)
+	// Nunca se guardó: nil, para que migrateFromFiles sepa que tiene que migrar
+	if entries, err := s.LoadHistory(); err != nil || entries != nil {
+		t.Fatalf("LoadHistory de una base nueva devolvió %v, %v", entries, err)
+	}
+	if list, err := s.LoadActivities(); err != nil || list != nil {
+		t.Fatalf("LoadActivities de una base nueva devolvió %v, %v", list, err)
+	}
+
+	fecha := time.Date(2025, 9, 15, 10, 30, 0, 0, time.UTC)
+	history := []HistoryEntry{
+		{User: "ana", Description: "Editó a Persona 1", Timestamp: fecha},
+		{User: "luis", Description: "Borró a Persona 2", Timestamp: fecha.Add(time.Minute)},
+	}
+	if err := s.SaveHistory(history); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := s.LoadHistory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[1].User != "luis" || entries[1].Description != history[1].Description || !entries[1].Timestamp.Equal(history[1].Timestamp) {
+		t.Errorf("el historial quedó con %+v", entries)
+	}
+
+	acts := []Activity{
+		{ID: 7, Title: "Jornada", Description: "Vacunación", StartDate: "2025-09-20", EndDate: "2025-09-21", Time: "08:00", Location: "Centro de Salud", Image: "/uploads/a.jpg"},
+		{ID: 2, Title: "Reunión", StartDate: "2025-09-15"},
+	}
+	if err := s.SaveActivities(acts); err != nil {
+		t.Fatal(err)
+	}
+	list, err := s.LoadActivities()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 || list[0] != acts[0] || list[1] != acts[1] {
+		t.Errorf("las actividades quedaron %+v", list)
+	}
+
+	// Guardadas vacías ya no son nil
+	if err := s.SaveActivities(nil); err != nil {
+		t.Fatal(err)
+	}
+	if list, err := s.LoadActivities(); err != nil || list == nil || len(list) != 0 {
+		t.Errorf("LoadActivities después de guardar vacías devolvió %v, %v", list, err)
+	}
+}
+
+func TestMigrateFromFiles(t *testing.T) {
+	chdirTemp(t)
+	headers, records := testCensus(3)
+	f, err := os.Create(EXCEL_FILE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeWorkbook(f, PRIMERA_HOJA, headers, records); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	files := &JSONFileStore{HistoryPath: HISTORY_FILE, ActivitiesPath: ACTIVITIES_FILE}
+	if err := files.SaveHistory([]HistoryEntry{{User: "ana", Description: "antes de migrar"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := files.SaveActivities([]Activity{{ID: 1, Title: "Reunión"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	s := newTestSQLiteStore(t, 0)
+	if err := migrateFromFiles(s); err != nil {
+		t.Fatal(err)
+	}
+	migrated, err := s.List()
+	if err != nil || censusVersion(migrated) != censusVersion(records) {
+		t.Fatalf("el censo migrado quedó con %+v, %v", migrated, err)
+	}
+	if entries, _ := s.LoadHistory(); len(entries) != 1 || entries[0].Description != "antes de migrar" {
+		t.Errorf("el historial migrado quedó con %+v", entries)
+	}
+	if list, _ := s.LoadActivities(); len(list) != 1 || list[0].Title != "Reunión" {
+		t.Errorf("las actividades migradas quedaron %+v", list)
+	}
+
+	// Solo la primera vez: lo que cambió en la base no se pisa con los archivos
+	if err := s.Update(CensusRecord{ID: "p00001", Fields: map[string]string{"Edad": "50"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SaveHistory([]HistoryEntry{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SaveActivities(nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := migrateFromFiles(s); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := s.Get("p00001"); got.Fields["Edad"] != "50" {
+		t.Errorf("la segunda migración pisó el censo: %v", got.Fields)
+	}
+	if entries, _ := s.LoadHistory(); len(entries) != 0 {
+		t.Errorf("la segunda migración pisó el historial: %+v", entries)
+	}
+	if list, _ := s.LoadActivities(); len(list) != 0 {
+		t.Errorf("la segunda migración pisó las actividades: %+v", list)
+	}
+}
+
+func TestMigrateFromFilesEncrypted(t *testing.T) {
+	chdirTemp(t)
+	headers, records := testCensus(2)
+	var book bytes.Buffer
+	if err := writeWorkbook(&book, PRIMERA_HOJA, headers, records); err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := testCipher("clave", "").Encrypt(book.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(EXCEL_FILE, sealed, 0600); err != nil {
+		t.Fatal(err)
+	}
+	s := newTestSQLiteStore(t, 0)
+	if err := migrateFromFiles(s); err == nil || !strings.Contains(err.Error(), "cifrado") {
+		t.Fatalf("migrar un libro cifrado devolvió %v", err)
+	}
+	if _, err := s.Headers(); err != errCensusEmpty {
+		t.Errorf("la base quedó con datos: %v", err)
+	}
+}
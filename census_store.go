@@ -0,0 +1,334 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/360EntSecGroup-Skylar/excelize/v2"
+)
+
+// ------------------- ALMACENAMIENTO DEL CENSO -------------------------
+
+// CensusRecord es una persona del censo. ID es fijo desde que la persona se
+// agrega y no depende de la fila en que esté. Las claves de Fields son las
+// cabeceras limpias (sin espacios al inicio o al final).
+type CensusRecord struct {
+	ID     string
+	Fields map[string]string
+
+	// IfVersion solo se usa al escribir: si no está vacío, el cambio se aplica
+	// únicamente si la versión actual de la persona sigue siendo esa.
+	IfVersion string
+}
+
+// Version es una huella de los valores de la persona, que cambia cada vez que
+// cambia algún campo. Los clientes la reciben al leer y la devuelven al editar
+// o borrar, para detectar que otra persona cambió el registro mientras tanto.
+// Los campos vacíos no cuentan, así agregar una columna no cambia las versiones.
+func (r CensusRecord) Version() string {
+	keys := make([]string, 0, len(r.Fields))
+	for key, val := range r.Fields {
+		if val != "" {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	h := sha1.New()
+	for _, key := range keys {
+		io.WriteString(h, key)
+		h.Write([]byte{0})
+		io.WriteString(h, r.Fields[key])
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+// censusVersion es una huella de todas las personas del censo, sin importar
+// el orden: cambia si se agrega, se quita o se edita cualquiera.
+func censusVersion(records []CensusRecord) string {
+	keys := make([]string, len(records))
+	for i, rec := range records {
+		keys[i] = rec.ID + "\x00" + rec.Version()
+	}
+	sort.Strings(keys)
+	h := sha1.New()
+	for _, key := range keys {
+		io.WriteString(h, key)
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+// RecordRef identifica a una persona para borrarla. IfVersion funciona igual
+// que en CensusRecord.
+type RecordRef struct {
+	ID        string
+	IfVersion string
+}
+
+// DeleteInfo es quién borra y por qué. La fecha la pone el almacenamiento.
+type DeleteInfo struct {
+	By     string
+	Reason string
+}
+
+// DeletedRecord es una persona que está en la papelera.
+type DeletedRecord struct {
+	CensusRecord
+	DeletedBy string
+	DeletedAt time.Time
+	Reason    string
+}
+
+// ConflictError indica que una o más personas cambiaron desde que el cliente
+// las leyó. Current trae sus valores actuales. Cuando hay conflicto no se
+// aplica ningún cambio de la operación.
+type ConflictError struct {
+	Current []CensusRecord
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("%d registro(s) cambiaron desde que se leyeron", len(e.Current))
+}
+
+// staleVersion indica si la versión esperada ya no coincide con la actual.
+func staleVersion(current CensusRecord, ifVersion string) bool {
+	return ifVersion != "" && current.Version() != ifVersion
+}
+
+// Value devuelve el valor de una columna comparando las cabeceras normalizadas,
+// así "CEDULA DE IDENTIDAD" y "Cedula de identidad" son la misma columna.
+func (r CensusRecord) Value(header string) string {
+	if val, ok := r.Fields[header]; ok {
+		return val
+	}
+	wanted := normalizeHeader(header)
+	for key, val := range r.Fields {
+		if normalizeHeader(key) == wanted {
+			return val
+		}
+	}
+	return ""
+}
+
+// Household agrupa a las personas que viven en una misma casa o apartamento.
+type Household struct {
+	Comunidad string
+	Torre     string
+	Casa      string
+	Members   []CensusRecord
+}
+
+// CensusStore es la capa de almacenamiento del censo. Los handlers solo hablan
+// con esta interfaz, así podemos cambiar el Excel por otro almacenamiento.
+type CensusStore interface {
+	// Headers devuelve las cabeceras limpias en el orden de las columnas.
+	Headers() ([]string, error)
+	// List devuelve todas las personas en el orden en que están guardadas.
+	List() ([]CensusRecord, error)
+	Get(id string) (CensusRecord, error)
+	FindByCedula(cedula string) (CensusRecord, error)
+	// Households agrupa a las personas por comunidad, torre y casa.
+	Households() ([]Household, error)
+	// FindHousehold devuelve el hogar de esa comunidad, torre y casa, o
+	// errRecordNotFound si nadie vive ahí.
+	FindHousehold(comunidad, torre, casa string) (Household, error)
+	// Insert agrega personas nuevas y devuelve sus IDs. Una persona que trae
+	// ID_HEADER conserva ese ID (así llegan las agregadas en otra computadora);
+	// si ese ID ya está en el censo devuelve errDuplicateID y no agrega nada.
+	Insert(records ...map[string]string) ([]string, error)
+	// Update escribe solo los campos presentes en cada registro. Si alguna
+	// IfVersion no coincide devuelve *ConflictError y no escribe nada.
+	Update(records ...CensusRecord) error
+	// Delete manda personas a la papelera, con la misma comprobación de
+	// versión que Update. Dejan de aparecer en todas las demás consultas.
+	Delete(info DeleteInfo, refs ...RecordRef) error
+	// Save hace en una sola escritura lo de Update y lo de Insert: si algo
+	// falla no se guarda nada, así el cliente puede volver a mandar todo.
+	Save(updates []CensusRecord, inserts []map[string]string) ([]string, error)
+
+	// Trash devuelve la papelera, en el orden en que se borraron.
+	Trash() ([]DeletedRecord, error)
+	// Restore saca personas de la papelera y las devuelve al censo con el
+	// mismo ID. Los IDs repetidos cuentan una vez; si alguno ya está en el
+	// censo devuelve errDuplicateID y no restaura nada.
+	Restore(ids ...string) error
+	// Purge borra para siempre las personas que entraron a la papelera antes
+	// de esa fecha y devuelve cuántas fueron.
+	Purge(before time.Time) (int, error)
+
+	// ExportWorkbook escribe el censo completo como un libro de Excel.
+	ExportWorkbook(w io.Writer) error
+	// ImportWorkbook reemplaza el censo completo con el contenido de un libro de Excel.
+	ImportWorkbook(r io.Reader) error
+	// ImportWorkbookIf es ImportWorkbook, pero si ifVersion no está vacío
+	// solo reemplaza el censo si sigue en esa versión (ver censusVersion). Si
+	// no, devuelve errCensusChanged y no toca nada. La comparación y el
+	// reemplazo se hacen sin que otra escritura se meta en el medio.
+	ImportWorkbookIf(r io.Reader, ifVersion string) error
+}
+
+var errRecordNotFound = errors.New("registro no encontrado")
+var errDuplicateID = errors.New("ya existe una persona con ese ID")
+var errCensusChanged = errors.New("el censo cambió desde que se leyó")
+var errCensusEmpty = errors.New("sheet vacío o no existe")
+var errHouseholdColumns = errors.New("No se encontraron todas las columnas requeridas. Revisa que tu Excel tenga cabeceras llamadas 'COMUNIDAD', 'TORRE' y 'CASA O APTO'.")
+
+const CEDULA_HEADER = "Cedula de identidad"
+
+// ID_HEADER es la columna del libro donde se guarda el ID de cada persona.
+// No forma parte de las cabeceras que devuelve Headers.
+const ID_HEADER = "ID"
+
+// Hoja y columnas extra donde el ExcelStore guarda la papelera.
+const TRASH_SHEET = "PAPELERA"
+const DELETED_BY_HEADER = "Eliminado por"
+const DELETED_AT_HEADER = "Fecha de eliminación"
+const DELETE_REASON_HEADER = "Motivo de eliminación"
+
+// newRecordID genera un ID al azar para una persona nueva.
+func newRecordID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%016x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+// insertID es el ID de una persona que se va a agregar: el que trae en
+// ID_HEADER o uno nuevo.
+func insertID(fields map[string]string) string {
+	if id := strings.TrimSpace(fields[ID_HEADER]); id != "" {
+		return id
+	}
+	return newRecordID()
+}
+
+// uniqueIDs quita los IDs repetidos y conserva el orden.
+func uniqueIDs(ids []string) []string {
+	seen := make(map[string]bool, len(ids))
+	out := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			out = append(out, id)
+		}
+	}
+	return out
+}
+
+// withoutRecordID quita ID_HEADER de los campos que llegan de un formulario.
+// El ID de una persona nueva lo pone el almacenamiento: solo la
+// sincronización y los libros importados traen el suyo.
+func withoutRecordID(fields map[string]string) map[string]string {
+	for key := range fields {
+		if strings.EqualFold(strings.TrimSpace(key), ID_HEADER) {
+			delete(fields, key)
+		}
+	}
+	return fields
+}
+
+// census es el almacenamiento que usan todos los handlers.
+var census CensusStore
+
+// groupHouseholds arma los hogares a partir de las personas. Los hogares
+// quedan en el orden en que aparece su primera persona.
+func groupHouseholds(headers []string, records []CensusRecord) ([]Household, error) {
+	comunidadKey, torreKey, casaKey := "", "", ""
+	for _, h := range headers {
+		switch strings.ToLower(h) {
+		case "comunidad":
+			comunidadKey = h
+		case "torre":
+			torreKey = h
+		case "casa o apto", "casa", "apto":
+			casaKey = h
+		}
+	}
+	if comunidadKey == "" || torreKey == "" || casaKey == "" {
+		return nil, errHouseholdColumns
+	}
+
+	var households []Household
+	index := make(map[[3]string]int)
+	for _, rec := range records {
+		key := [3]string{
+			strings.TrimSpace(rec.Fields[comunidadKey]),
+			strings.TrimSpace(rec.Fields[torreKey]),
+			strings.TrimSpace(rec.Fields[casaKey]),
+		}
+		if key[0] == "" || key[1] == "" || key[2] == "" {
+			continue
+		}
+		i, ok := index[key]
+		if !ok {
+			i = len(households)
+			index[key] = i
+			households = append(households, Household{Comunidad: key[0], Torre: key[1], Casa: key[2]})
+		}
+		households[i].Members = append(households[i].Members, rec)
+	}
+	return households, nil
+}
+
+// readWorkbook lee las cabeceras limpias (sin la de ID) y las personas de la
+// hoja del censo de un libro. Las personas sin columna ID quedan con ID vacío.
+func readWorkbook(r io.Reader, sheet string) ([]string, []CensusRecord, error) {
+	f, err := excelize.OpenReader(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	rows, err := f.GetRows(sheet)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(rows) == 0 {
+		return nil, nil, errCensusEmpty
+	}
+	headers, records := recordsFromRows(rows)
+	return headers, records, nil
+}
+
+// readWorkbookTrash lee las personas de la hoja PAPELERA de un libro.
+func readWorkbookTrash(r io.Reader) ([]DeletedRecord, error) {
+	f, err := excelize.OpenReader(r)
+	if err != nil {
+		return nil, err
+	}
+	return trashRecords(f)
+}
+
+// writeWorkbook genera un libro de Excel con la hoja del censo. El ID de cada
+// persona va en la última columna.
+func writeWorkbook(w io.Writer, sheet string, headers []string, records []CensusRecord) error {
+	f := excelize.NewFile()
+	f.NewSheet(sheet)
+	if sheet != "Sheet1" {
+		f.DeleteSheet("Sheet1")
+	}
+	f.SetActiveSheet(f.GetSheetIndex(sheet))
+
+	for colIndex, header := range headers {
+		cell, _ := excelize.CoordinatesToCellName(colIndex+1, 1)
+		f.SetCellValue(sheet, cell, header)
+	}
+	idCell, _ := excelize.CoordinatesToCellName(len(headers)+1, 1)
+	f.SetCellValue(sheet, idCell, ID_HEADER)
+	for rowIndex, rec := range records {
+		for colIndex, header := range headers {
+			cell, _ := excelize.CoordinatesToCellName(colIndex+1, rowIndex+2)
+			f.SetCellValue(sheet, cell, rec.Fields[header])
+		}
+		idCell, _ := excelize.CoordinatesToCellName(len(headers)+1, rowIndex+2)
+		f.SetCellValue(sheet, idCell, rec.ID)
+	}
+	return f.Write(w)
+}
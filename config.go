@@ -0,0 +1,424 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ------------------- CONFIGURACIÓN -------------------------
+
+// CONFIG_FILE es el archivo de configuración por defecto (-config o RIOARO_CONFIG).
+const CONFIG_FILE = "config.json"
+
+// ENV_PREFIX antecede a las variables de entorno: "archivo_excel" se cambia
+// con RIOARO_ARCHIVO_EXCEL.
+const ENV_PREFIX = "RIOARO_"
+
+// Config es la configuración del programa. Cada opción se toma, de menor a
+// mayor prioridad, del valor por defecto, de config.json, de la variable de
+// entorno RIOARO_* y de la opción de la línea de comandos.
+//
+// Las claves (Dropbox, WebDAV) no van en config.json sino en el archivo de
+// credenciales, fuera de la carpeta del programa, o en variables de entorno.
+type Config struct {
+	Almacenamiento     string
+	BaseDatos          string
+	PapeleraDias       int
+	ArchivoExcel       string
+	HojaCenso          string
+	ArchivoHistorial   string
+	ArchivoActividades string
+	Sync               string
+	SyncCarpeta        string
+	SyncIntervalo      time.Duration
+	SyncModo           string
+	Instancia          string
+	Cifrado            string
+	WebDAVURL          string
+	WebDAVUsuario      string
+	DropboxRuta        string
+	DropboxURL         string
+	Credenciales       string
+
+	credentials *credentialsFile
+}
+
+// Nombres de las claves del archivo de credenciales.
+const (
+	CRED_DROPBOX_APP_KEY       = "dropbox_app_key"
+	CRED_DROPBOX_APP_SECRET    = "dropbox_app_secret"
+	CRED_DROPBOX_REFRESH_TOKEN = "dropbox_refresh_token"
+	CRED_WEBDAV_CLAVE          = "webdav_clave"
+	CRED_CLAVE_CIFRADO         = "clave_cifrado"
+	CRED_CLAVE_CIFRADO_ANT     = "clave_cifrado_anterior"
+)
+
+var credentialNames = []string{CRED_DROPBOX_APP_KEY, CRED_DROPBOX_APP_SECRET, CRED_DROPBOX_REFRESH_TOKEN, CRED_WEBDAV_CLAVE, CRED_CLAVE_CIFRADO, CRED_CLAVE_CIFRADO_ANT}
+
+// setting es una opción de Config: Name es la clave en config.json, Flag la
+// opción de la línea de comandos y Value apunta al campo (*string, *int o
+// *time.Duration).
+type setting struct {
+	Name  string
+	Flag  string
+	Usage string
+	Value interface{}
+}
+
+func (c *Config) settings() []setting {
+	return []setting{
+		{"almacenamiento", "almacenamiento", "dónde se guardan los datos: excel o sqlite", &c.Almacenamiento},
+		{"db", "db", "archivo de la base SQLite cuando almacenamiento es sqlite", &c.BaseDatos},
+		{"papelera_dias", "papelera-dias", "días que se guardan las personas en la papelera antes de poder vaciarla", &c.PapeleraDias},
+		{"archivo_excel", "excel", "libro del censo", &c.ArchivoExcel},
+		{"hoja_censo", "hoja", "hoja del libro donde está el censo", &c.HojaCenso},
+		{"archivo_historial", "historial", "archivo del historial", &c.ArchivoHistorial},
+		{"archivo_actividades", "actividades", "archivo del calendario de actividades", &c.ArchivoActividades},
+		{"sync", "sync", "dónde se comparte el Excel: dropbox, carpeta, webdav o ninguno", &c.Sync},
+		{"sync_carpeta", "sync-carpeta", "carpeta compartida cuando sync es carpeta", &c.SyncCarpeta},
+		{"sync_intervalo", "sync-intervalo", "cada cuánto se baja el Excel compartido, como 30s o 5m (0: solo al iniciar y a pedido)", &c.SyncIntervalo},
+		{"sync_modo", "sync-modo", "cómo se comparte el censo: libro (el Excel completo) o cambios (un registro de cambios por computadora)", &c.SyncModo},
+		{"instancia", "instancia", "nombre de esta computadora en el modo cambios (vacío: uno al azar que se guarda en sync/)", &c.Instancia},
+		{"webdav_url", "webdav-url", "dirección completa del Excel cuando sync es webdav", &c.WebDAVURL},
+		{"webdav_usuario", "webdav-usuario", "usuario del servidor WebDAV", &c.WebDAVUsuario},
+		{"dropbox_ruta", "dropbox-ruta", "ruta del Excel dentro de Dropbox", &c.DropboxRuta},
+		{"dropbox_url", "dropbox-url", "servidor que reemplaza a Dropbox, para pruebas (vacío: Dropbox)", &c.DropboxURL},
+		{"cifrado", "cifrado", "cifrar el censo, las copias y lo que se comparte con clave_cifrado: si o no", &c.Cifrado},
+		{"credenciales", "credenciales", "archivo con las claves de Dropbox, WebDAV y cifrado", &c.Credenciales},
+	}
+}
+
+func (s setting) env() string {
+	return ENV_PREFIX + strings.ToUpper(s.Name)
+}
+
+func (s setting) String() string {
+	switch v := s.Value.(type) {
+	case *string:
+		return *v
+	case *int:
+		return strconv.Itoa(*v)
+	case *time.Duration:
+		return v.String()
+	}
+	return ""
+}
+
+func (s setting) set(text string) error {
+	switch v := s.Value.(type) {
+	case *string:
+		*v = text
+	case *int:
+		n, err := strconv.Atoi(strings.TrimSpace(text))
+		if err != nil {
+			return fmt.Errorf("%s debe ser un número entero, no %q", s.Name, text)
+		}
+		*v = n
+	case *time.Duration:
+		d, err := time.ParseDuration(strings.TrimSpace(text))
+		if err != nil {
+			return fmt.Errorf("%s debe ser una duración como 30s o 5m, no %q", s.Name, text)
+		}
+		*v = d
+	}
+	return nil
+}
+
+func defaultConfig() *Config {
+	credenciales := "credenciales.json"
+	if dir, err := os.UserConfigDir(); err == nil {
+		credenciales = filepath.Join(dir, "RioAro", "credenciales.json")
+	}
+	return &Config{
+		Almacenamiento:     "excel",
+		BaseDatos:          "censo.db",
+		PapeleraDias:       30,
+		ArchivoExcel:       EXCEL_FILE,
+		HojaCenso:          PRIMERA_HOJA,
+		ArchivoHistorial:   HISTORY_FILE,
+		ArchivoActividades: ACTIVITIES_FILE,
+		Sync:               "dropbox",
+		SyncIntervalo:      time.Minute,
+		SyncModo:           "libro",
+		Cifrado:            "no",
+		DropboxRuta:        "/CENSO GENERAL NUEVO.xlsx",
+		Credenciales:       credenciales,
+	}
+}
+
+// loadConfig arma la configuración a partir de config.json, las variables de
+// entorno y args (sin el nombre del programa), y la valida. Los errores dicen
+// exactamente qué opción falta o es inválida y de dónde salió.
+func loadConfig(args []string) (*Config, error) {
+	c := defaultConfig()
+	settings := c.settings()
+
+	fs := flag.NewFlagSet(filepath.Base(os.Args[0]), flag.ContinueOnError)
+	configPath := fs.String("config", CONFIG_FILE, "archivo de configuración (también RIOARO_CONFIG)")
+	flags := make(map[string]*string, len(settings))
+	for _, s := range settings {
+		flags[s.Flag] = fs.String(s.Flag, s.String(), fmt.Sprintf("%s (también %s)", s.Usage, s.env()))
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	explicit := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+
+	// 1. config.json
+	path := *configPath
+	if env := os.Getenv(ENV_PREFIX + "CONFIG"); env != "" && !explicit["config"] {
+		path = env
+	}
+	if err := c.loadFile(path, settings, path != CONFIG_FILE); err != nil {
+		return nil, err
+	}
+
+	// 2. Variables de entorno
+	for _, s := range settings {
+		if v, ok := os.LookupEnv(s.env()); ok {
+			if err := s.set(v); err != nil {
+				return nil, fmt.Errorf("variable %s: %v", s.env(), err)
+			}
+		}
+	}
+
+	// 3. Línea de comandos
+	for _, s := range settings {
+		if explicit[s.Flag] {
+			if err := s.set(*flags[s.Flag]); err != nil {
+				return nil, fmt.Errorf("opción -%s: %v", s.Flag, err)
+			}
+		}
+	}
+
+	c.credentials = &credentialsFile{Path: c.Credenciales}
+	if err := c.credentials.load(); err != nil {
+		return nil, err
+	}
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// loadFile lee config.json. Si el archivo no existe se usan los valores por
+// defecto, salvo que se haya pedido ese archivo con -config o RIOARO_CONFIG.
+func (c *Config) loadFile(path string, settings []setting, required bool) error {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) && !required {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("no se pudo leer la configuración: %v", err)
+	}
+
+	var values map[string]interface{}
+	if err := json.Unmarshal(data, &values); err != nil {
+		return fmt.Errorf("%s: JSON inválido: %v", path, err)
+	}
+	byName := make(map[string]setting, len(settings))
+	for _, s := range settings {
+		byName[s.Name] = s
+	}
+	for name, raw := range values {
+		for _, cred := range credentialNames {
+			if name == cred {
+				return fmt.Errorf("%s: %s es una clave; va en el archivo de credenciales (%s), no en la configuración", path, name, c.Credenciales)
+			}
+		}
+		s, ok := byName[name]
+		if !ok {
+			return fmt.Errorf("%s: opción desconocida %q", path, name)
+		}
+		var text string
+		switch v := raw.(type) {
+		case string:
+			text = v
+		case float64:
+			text = strconv.FormatFloat(v, 'f', -1, 64)
+		default:
+			return fmt.Errorf("%s: %s debe ser un texto o un número", path, name)
+		}
+		if err := s.set(text); err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	return nil
+}
+
+// validate revisa todas las opciones y devuelve un error con cada problema.
+func (c *Config) validate() error {
+	var problems []string
+	problem := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	if c.Almacenamiento != "excel" && c.Almacenamiento != "sqlite" {
+		problem("almacenamiento: %q no es válido (use excel o sqlite)", c.Almacenamiento)
+	}
+	if c.Almacenamiento == "sqlite" && c.BaseDatos == "" {
+		problem("db: falta el archivo de la base SQLite")
+	}
+	if c.PapeleraDias < 0 {
+		problem("papelera_dias: no puede ser negativo (%d)", c.PapeleraDias)
+	}
+	if c.SyncIntervalo < 0 {
+		problem("sync_intervalo: no puede ser negativo (%s)", c.SyncIntervalo)
+	}
+	if c.SyncModo != "libro" && c.SyncModo != "cambios" {
+		problem("sync_modo: %q no es válido (use libro o cambios)", c.SyncModo)
+	}
+	if c.Instancia != "" && !validInstancia(c.Instancia) {
+		problem("instancia: %q solo puede tener letras, números, - y _", c.Instancia)
+	}
+	for _, s := range c.settings() {
+		switch s.Name {
+		case "archivo_excel", "hoja_censo", "archivo_historial", "archivo_actividades":
+			if strings.TrimSpace(s.String()) == "" {
+				problem("%s: no puede estar vacío", s.Name)
+			}
+		}
+	}
+
+	missing := func(cred string) {
+		if c.credentials.Get(cred) == "" {
+			problem("%s: falta en %s (o en la variable %s)", cred, c.Credenciales, ENV_PREFIX+strings.ToUpper(cred))
+		}
+	}
+	switch c.Cifrado {
+	case "si":
+		missing(CRED_CLAVE_CIFRADO)
+		if c.Almacenamiento == "sqlite" {
+			problem("cifrado: no se puede usar con almacenamiento sqlite: %s y su diario quedarían sin cifrar (use almacenamiento excel, o cifrado no y cifre el disco)", c.BaseDatos)
+		}
+	case "no":
+	default:
+		problem("cifrado: %q no es válido (use si o no)", c.Cifrado)
+	}
+	switch c.Sync {
+	case "dropbox":
+		if !strings.HasPrefix(c.DropboxRuta, "/") {
+			problem("dropbox_ruta: debe empezar con / (%q)", c.DropboxRuta)
+		}
+		if u, err := url.Parse(c.DropboxURL); c.DropboxURL != "" && (err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "") {
+			problem("dropbox_url: %q no es una dirección http o https", c.DropboxURL)
+		}
+		missing(CRED_DROPBOX_APP_KEY)
+		missing(CRED_DROPBOX_APP_SECRET)
+		missing(CRED_DROPBOX_REFRESH_TOKEN)
+	case "carpeta":
+		if c.SyncCarpeta == "" {
+			problem("sync_carpeta: falta la carpeta compartida (sync es carpeta)")
+		}
+	case "webdav":
+		if u, err := url.Parse(c.WebDAVURL); c.WebDAVURL == "" {
+			problem("webdav_url: falta la dirección del Excel (sync es webdav)")
+		} else if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			problem("webdav_url: %q no es una dirección http o https", c.WebDAVURL)
+		}
+	case "ninguno":
+	default:
+		problem("sync: %q no es válido (use dropbox, carpeta, webdav o ninguno)", c.Sync)
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("configuración inválida:\n  - %s", strings.Join(problems, "\n  - "))
+	}
+	return nil
+}
+
+// DropboxCredentials devuelve las claves de Dropbox vigentes.
+func (c *Config) DropboxCredentials() DropboxCredentials {
+	return DropboxCredentials{
+		AppKey:       c.credentials.Get(CRED_DROPBOX_APP_KEY),
+		AppSecret:    c.credentials.Get(CRED_DROPBOX_APP_SECRET),
+		RefreshToken: c.credentials.Get(CRED_DROPBOX_REFRESH_TOKEN),
+	}
+}
+
+// WebDAVPassword devuelve la clave de WebDAV vigente.
+func (c *Config) WebDAVPassword() string {
+	return c.credentials.Get(CRED_WEBDAV_CLAVE)
+}
+
+// CipherKeys devuelve la clave de cifrado vigente y la anterior (para leer lo
+// que se cifró antes de cambiarla).
+func (c *Config) CipherKeys() (string, string) {
+	return c.credentials.Get(CRED_CLAVE_CIFRADO), c.credentials.Get(CRED_CLAVE_CIFRADO_ANT)
+}
+
+// credentialsFile es el archivo JSON con las claves. Se vuelve a leer cada vez
+// que cambia, así las claves se rotan editando el archivo, sin recompilar ni
+// reiniciar. Las variables de entorno RIOARO_* tienen prioridad.
+type credentialsFile struct {
+	Path string
+
+	mu      sync.Mutex
+	modTime time.Time
+	values  map[string]string
+}
+
+// load lee el archivo. Que no exista no es un error: las claves pueden venir
+// de variables de entorno, y validate avisa de las que falten.
+func (c *credentialsFile) load() error {
+	info, err := os.Stat(c.Path)
+	if os.IsNotExist(err) {
+		c.values, c.modTime = nil, time.Time{}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("credenciales: %v", err)
+	}
+	if info.ModTime().Equal(c.modTime) {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(c.Path)
+	if err != nil {
+		return fmt.Errorf("credenciales: %v", err)
+	}
+	// Un archivo inválido no se vuelve a leer hasta que cambie otra vez
+	c.modTime = info.ModTime()
+	var values map[string]string
+	if err := json.Unmarshal(data, &values); err != nil {
+		return fmt.Errorf("%s: JSON inválido: %v", c.Path, err)
+	}
+	for name := range values {
+		known := false
+		for _, cred := range credentialNames {
+			known = known || name == cred
+		}
+		if !known {
+			return fmt.Errorf("%s: clave desconocida %q", c.Path, name)
+		}
+	}
+	if c.values != nil {
+		fmt.Println("--- LOG: Credenciales actualizadas desde", c.Path, "---")
+	}
+	c.values = values
+	return nil
+}
+
+// Get devuelve una clave. Si el archivo cambió y ahora es inválido, se siguen
+// usando las claves anteriores.
+func (c *credentialsFile) Get(name string) string {
+	if v := os.Getenv(ENV_PREFIX + strings.ToUpper(name)); v != "" {
+		return v
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.load(); err != nil {
+		fmt.Printf("--- ERROR: No se pudieron releer las credenciales: %v ---\n", err)
+	}
+	return c.values[name]
+}
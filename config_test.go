@@ -0,0 +1,303 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// clearConfigEnv quita las variables RIOARO_* del entorno durante la prueba,
+// así no se mezclan con las de la computadora que la corre.
+func clearConfigEnv(t *testing.T) {
+	t.Helper()
+	for _, kv := range os.Environ() {
+		name := strings.SplitN(kv, "=", 2)[0]
+		if strings.HasPrefix(name, ENV_PREFIX) {
+			value := os.Getenv(name)
+			os.Unsetenv(name)
+			t.Cleanup(func() { os.Setenv(name, value) })
+		}
+	}
+}
+
+// setConfigEnv pone una variable durante la prueba.
+func setConfigEnv(t *testing.T, name, value string) {
+	t.Helper()
+	os.Setenv(name, value)
+	t.Cleanup(func() { os.Unsetenv(name) })
+}
+
+func writeConfigFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	clearConfigEnv(t)
+	dir := chdirTemp(t)
+	creds := filepath.Join(dir, "no-existe.json")
+	writeConfigFile(t, CONFIG_FILE, `{
+		"sync": "carpeta", "sync_carpeta": "/compartida", "sync_intervalo": "2m",
+		"papelera_dias": 10, "hoja_censo": "DEL ARCHIVO", "instancia": "archivo",
+		"archivo_historial": "historial-archivo.json"
+	}`)
+	setConfigEnv(t, "RIOARO_PAPELERA_DIAS", "20")
+	setConfigEnv(t, "RIOARO_HOJA_CENSO", "DEL ENTORNO")
+	setConfigEnv(t, "RIOARO_INSTANCIA", "entorno")
+	setConfigEnv(t, "RIOARO_SYNC_INTERVALO", "")
+
+	c, err := loadConfig([]string{"-papelera-dias", "40", "-instancia", "", "-credenciales", creds})
+	if err == nil {
+		t.Fatal("un sync_intervalo vacío en el entorno no devolvió un error")
+	}
+	if !strings.Contains(err.Error(), "variable RIOARO_SYNC_INTERVALO") {
+		t.Fatalf("devolvió %v, se esperaba el error de RIOARO_SYNC_INTERVALO", err)
+	}
+	os.Unsetenv("RIOARO_SYNC_INTERVALO")
+
+	c, err = loadConfig([]string{"-papelera-dias", "40", "-instancia", "linea", "-credenciales", creds})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defaults := defaultConfig()
+	tests := []struct {
+		name      string
+		got, want interface{}
+	}{
+		{"almacenamiento (por defecto)", c.Almacenamiento, defaults.Almacenamiento},
+		{"archivo_excel (por defecto)", c.ArchivoExcel, defaults.ArchivoExcel},
+		{"sync (config.json)", c.Sync, "carpeta"},
+		{"sync_intervalo (config.json)", c.SyncIntervalo, 2 * time.Minute},
+		{"archivo_historial (config.json)", c.ArchivoHistorial, "historial-archivo.json"},
+		{"hoja_censo (entorno)", c.HojaCenso, "DEL ENTORNO"},
+		{"papelera_dias (línea de comandos)", c.PapeleraDias, 40},
+		{"instancia (línea de comandos)", c.Instancia, "linea"},
+		{"credenciales (línea de comandos)", c.Credenciales, creds},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("%s quedó %v, se esperaba %v", tt.name, tt.got, tt.want)
+		}
+	}
+
+	// Una opción de la línea de comandos gana aunque sea el valor por defecto
+	c, err = loadConfig([]string{"-hoja", PRIMERA_HOJA, "-credenciales", creds})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.HojaCenso != PRIMERA_HOJA {
+		t.Errorf("hoja_censo quedó %q, se esperaba %q de -hoja", c.HojaCenso, PRIMERA_HOJA)
+	}
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	clearConfigEnv(t)
+	dir := chdirTemp(t)
+	creds := "-credenciales=" + filepath.Join(dir, "no-existe.json")
+	setConfigEnv(t, "RIOARO_SYNC", "ninguno")
+
+	// Sin config.json se usan los valores por defecto
+	c, err := loadConfig([]string{creds})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.PapeleraDias != defaultConfig().PapeleraDias {
+		t.Errorf("papelera_dias quedó %d sin config.json", c.PapeleraDias)
+	}
+
+	writeConfigFile(t, "otra.json", `{"papelera_dias": 7}`)
+	writeConfigFile(t, "tercera.json", `{"papelera_dias": 8}`)
+	setConfigEnv(t, "RIOARO_CONFIG", "otra.json")
+	if c, err := loadConfig([]string{creds}); err != nil || c.PapeleraDias != 7 {
+		t.Errorf("con RIOARO_CONFIG papelera_dias quedó %v, %v", c, err)
+	}
+	// -config gana a RIOARO_CONFIG
+	if c, err := loadConfig([]string{creds, "-config", "tercera.json"}); err != nil || c.PapeleraDias != 8 {
+		t.Errorf("con -config papelera_dias quedó %v, %v", c, err)
+	}
+
+	tests := []struct {
+		name, file string
+		args       []string
+		err        string
+	}{
+		{"archivo pedido que no existe", "", []string{"-config", "no-existe.json"}, "no se pudo leer la configuración"},
+		{"JSON inválido", `{"sync": `, nil, "JSON inválido"},
+		{"opción desconocida", `{"color": "rojo"}`, nil, `opción desconocida "color"`},
+		{"clave en la configuración", `{"dropbox_app_secret": "x"}`, nil, "dropbox_app_secret es una clave; va en el archivo de credenciales"},
+		{"tipo inválido", `{"papelera_dias": true}`, nil, "papelera_dias debe ser un texto o un número"},
+		{"número inválido", `{"papelera_dias": "diez"}`, nil, `papelera_dias debe ser un número entero, no "diez"`},
+		{"duración inválida", `{"sync_intervalo": 5}`, nil, "sync_intervalo debe ser una duración"},
+		{"opción inválida", `{}`, []string{"-sync-intervalo", "rato"}, "opción -sync-intervalo: sync_intervalo debe ser una duración"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Unsetenv("RIOARO_CONFIG")
+			writeConfigFile(t, CONFIG_FILE, tt.file)
+			c, err := loadConfig(append([]string{creds}, tt.args...))
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("loadConfig devolvió %+v, %v; se esperaba %q", c, err, tt.err)
+			}
+		})
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	clearConfigEnv(t)
+	c := defaultConfig()
+	c.credentials = &credentialsFile{Path: filepath.Join(t.TempDir(), "no-existe.json")}
+	c.Sync = "ninguno"
+	if err := c.validate(); err != nil {
+		t.Fatalf("la configuración por defecto sin sync es inválida: %v", err)
+	}
+
+	c.Almacenamiento = "sqlite"
+	c.BaseDatos = ""
+	c.PapeleraDias = -1
+	c.SyncIntervalo = -time.Second
+	c.SyncModo = "todo"
+	c.Instancia = "mi compu"
+	c.ArchivoExcel = " "
+	c.Cifrado = "si"
+	c.Sync = "webdav"
+	c.WebDAVURL = "ftp://servidor/censo.xlsx"
+	err := c.validate()
+	if err == nil {
+		t.Fatal("validate no devolvió un error")
+	}
+	// Se listan todos los problemas, no solo el primero
+	want := []string{
+		"db: falta el archivo de la base SQLite",
+		"papelera_dias: no puede ser negativo (-1)",
+		"sync_intervalo: no puede ser negativo (-1s)",
+		`sync_modo: "todo" no es válido`,
+		`instancia: "mi compu" solo puede tener letras`,
+		"archivo_excel: no puede estar vacío",
+		"clave_cifrado: falta en",
+		"cifrado: no se puede usar con almacenamiento sqlite",
+		`webdav_url: "ftp://servidor/censo.xlsx" no es una dirección http o https`,
+	}
+	for _, w := range want {
+		if !strings.Contains(err.Error(), w) {
+			t.Errorf("el error no dice %q:\n%v", w, err)
+		}
+	}
+	if got := strings.Count(err.Error(), "\n  - "); got != len(want) {
+		t.Errorf("el error tiene %d problemas, se esperaban %d:\n%v", got, len(want), err)
+	}
+
+	tests := []struct {
+		name  string
+		setup func(c *Config)
+		want  []string
+	}{
+		{"valores desconocidos", func(c *Config) { c.Almacenamiento, c.Cifrado, c.Sync = "nube", "tal vez", "ftp" },
+			[]string{`almacenamiento: "nube" no es válido`, `cifrado: "tal vez" no es válido`, `sync: "ftp" no es válido`}},
+		{"dropbox sin claves", func(c *Config) { c.DropboxRuta, c.DropboxURL = "censo.xlsx", "localhost:8080" },
+			[]string{"dropbox_ruta: debe empezar con /", `dropbox_url: "localhost:8080" no es una dirección`,
+				"dropbox_app_key: falta", "dropbox_app_secret: falta", "dropbox_refresh_token: falta en"}},
+		{"carpeta sin carpeta", func(c *Config) { c.Sync = "carpeta" }, []string{"sync_carpeta: falta la carpeta compartida"}},
+		{"webdav sin dirección", func(c *Config) { c.Sync = "webdav" }, []string{"webdav_url: falta la dirección"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := defaultConfig()
+			c.credentials = &credentialsFile{Path: filepath.Join(t.TempDir(), "no-existe.json")}
+			c.Credenciales = c.credentials.Path
+			tt.setup(c)
+			err := c.validate()
+			if err == nil {
+				t.Fatal("validate no devolvió un error")
+			}
+			for _, w := range tt.want {
+				if !strings.Contains(err.Error(), w) {
+					t.Errorf("el error no dice %q:\n%v", w, err)
+				}
+			}
+			if got := strings.Count(err.Error(), "\n  - "); got != len(tt.want) {
+				t.Errorf("el error tiene %d problemas, se esperaban %d:\n%v", got, len(tt.want), err)
+			}
+		})
+	}
+
+	// Las claves pueden venir del entorno
+	c = defaultConfig()
+	c.credentials = &credentialsFile{Path: filepath.Join(t.TempDir(), "no-existe.json")}
+	setConfigEnv(t, "RIOARO_DROPBOX_APP_KEY", "key")
+	setConfigEnv(t, "RIOARO_DROPBOX_APP_SECRET", "secret")
+	setConfigEnv(t, "RIOARO_DROPBOX_REFRESH_TOKEN", "refresh")
+	if err := c.validate(); err != nil {
+		t.Errorf("con las claves en el entorno validate devolvió %v", err)
+	}
+}
+
+func TestCredentialsFileReload(t *testing.T) {
+	clearConfigEnv(t)
+	path := filepath.Join(t.TempDir(), "credenciales.json")
+	// Cada escritura con una fecha distinta, como al editar el archivo
+	stamp := time.Now().Add(-time.Hour)
+	write := func(content string) {
+		t.Helper()
+		writeConfigFile(t, path, content)
+		stamp = stamp.Add(time.Minute)
+		if err := os.Chtimes(path, stamp, stamp); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	creds := &credentialsFile{Path: path}
+	if err := creds.load(); err != nil {
+		t.Fatal(err)
+	}
+	if got := creds.Get(CRED_WEBDAV_CLAVE); got != "" {
+		t.Errorf("sin archivo la clave es %q", got)
+	}
+
+	write(`{"webdav_clave": "primera"}`)
+	if got := creds.Get(CRED_WEBDAV_CLAVE); got != "primera" {
+		t.Fatalf("la clave es %q, se esperaba primera", got)
+	}
+	// Se rota editando el archivo, sin reiniciar
+	write(`{"webdav_clave": "segunda", "clave_cifrado": "cifrado"}`)
+	if got := creds.Get(CRED_WEBDAV_CLAVE); got != "segunda" {
+		t.Fatalf("después de editar el archivo la clave es %q, se esperaba segunda", got)
+	}
+	if got, _ := (&Config{credentials: creds}).CipherKeys(); got != "cifrado" {
+		t.Errorf("CipherKeys devolvió %q", got)
+	}
+
+	// Si queda inválido se siguen usando las anteriores
+	for _, content := range []string{`{"webdav_clave": `, `{"webdav_clave": "tercera", "otra": "x"}`} {
+		write(content)
+		if got := creds.Get(CRED_WEBDAV_CLAVE); got != "segunda" {
+			t.Errorf("con %s la clave es %q, se esperaba la anterior", content, got)
+		}
+		if err := (&credentialsFile{Path: path}).load(); err == nil {
+			t.Errorf("load de %s no devolvió un error", content)
+		}
+	}
+
+	write(`{"webdav_clave": "cuarta"}`)
+	if got := creds.Get(CRED_WEBDAV_CLAVE); got != "cuarta" {
+		t.Errorf("después de arreglar el archivo la clave es %q, se esperaba cuarta", got)
+	}
+	// El entorno tiene prioridad
+	setConfigEnv(t, "RIOARO_WEBDAV_CLAVE", "del entorno")
+	if got := creds.Get(CRED_WEBDAV_CLAVE); got != "del entorno" {
+		t.Errorf("con RIOARO_WEBDAV_CLAVE la clave es %q", got)
+	}
+	os.Unsetenv("RIOARO_WEBDAV_CLAVE")
+
+	// Si se borra el archivo ya no hay claves
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if got := creds.Get(CRED_WEBDAV_CLAVE); got != "" {
+		t.Errorf("sin el archivo la clave es %q", got)
+	}
+}
@@ -0,0 +1,407 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// ------------------- CIFRADO -------------------------
+
+// Un archivo cifrado empieza con CIPHER_MAGIC, sigue la sal con que se derivó
+// la clave, el nonce y el contenido cifrado con AES-256-GCM. Lo que no empieza
+// con CIPHER_MAGIC se lee tal cual, así los archivos de antes de activar el
+// cifrado se siguen leyendo y se cifran la próxima vez que se guardan.
+const CIPHER_MAGIC = "RIOARO-CIFRADO-1"
+
+// CIPHER_LINE_PREFIX marca una línea cifrada (en base64) del diario de cambios.
+const CIPHER_LINE_PREFIX = "cifrado:"
+
+const cipherSaltSize = 16
+
+var errCipherNoKey = errors.New("el archivo está cifrado pero no hay clave_cifrado")
+var errCipherWrongKey = errors.New("el archivo está cifrado con otra clave (revise clave_cifrado y clave_cifrado_anterior)")
+var errCipherCut = errors.New("el archivo cifrado está cortado")
+
+// Cipher cifra y descifra archivos con una clave que solo tienen los
+// operadores. Keys devuelve la clave vigente y la anterior (vacía si no hay);
+// se piden en cada uso, así se pueden cambiar sin reiniciar. Un *Cipher nil no
+// cifra, pero igual avisa si encuentra un archivo cifrado.
+type Cipher struct {
+	Keys func() (string, string)
+
+	mu      sync.Mutex
+	salt    []byte
+	saltFor string
+	derived map[string][]byte
+}
+
+// censusCipher es el cifrado elegido en la configuración; nil si no se cifra.
+var censusCipher *Cipher
+
+// IsEncrypted dice si data está cifrado.
+func IsEncrypted(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(CIPHER_MAGIC))
+}
+
+// key deriva la clave de AES a partir de la clave del operador y la sal. Es
+// lento a propósito, así que se recuerda.
+func (c *Cipher) key(passphrase string, salt []byte) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	id := passphrase + "\x00" + string(salt)
+	if key, ok := c.derived[id]; ok {
+		return key, nil
+	}
+	key, err := scrypt.Key([]byte(passphrase), salt, 1<<15, 8, 1, 32)
+	if err != nil {
+		return nil, err
+	}
+	if c.derived == nil {
+		c.derived = make(map[string][]byte)
+	}
+	c.derived[id] = key
+	return key, nil
+}
+
+// currentSalt es la sal de esta ejecución para la clave vigente: todos los
+// archivos que se cifran comparten la clave derivada, que se calcula una vez.
+func (c *Cipher) currentSalt(passphrase string) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.salt == nil || c.saltFor != passphrase {
+		salt := make([]byte, cipherSaltSize)
+		if _, err := rand.Read(salt); err != nil {
+			return nil, err
+		}
+		c.salt, c.saltFor = salt, passphrase
+	}
+	return c.salt, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Encrypt cifra plain con la clave vigente. Sin cifrado lo devuelve igual.
+func (c *Cipher) Encrypt(plain []byte) ([]byte, error) {
+	if c == nil {
+		return plain, nil
+	}
+	passphrase, _ := c.Keys()
+	if passphrase == "" {
+		return nil, fmt.Errorf("no se puede cifrar: falta %s", CRED_CLAVE_CIFRADO)
+	}
+	salt, err := c.currentSalt(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	key, err := c.key(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	out := make([]byte, 0, len(CIPHER_MAGIC)+len(salt)+len(nonce)+len(plain)+gcm.Overhead())
+	out = append(out, CIPHER_MAGIC...)
+	out = append(out, salt...)
+	out = append(out, nonce...)
+	return gcm.Seal(out, nonce, plain, []byte(CIPHER_MAGIC)), nil
+}
+
+// Decrypt descifra data con la clave vigente o, si no sirve, con la anterior.
+// Si data no está cifrado lo devuelve igual.
+func (c *Cipher) Decrypt(data []byte) ([]byte, error) {
+	if !IsEncrypted(data) {
+		return data, nil
+	}
+	if c == nil {
+		return nil, errCipherNoKey
+	}
+	current, previous := c.Keys()
+	for _, passphrase := range []string{current, previous} {
+		if passphrase == "" {
+			continue
+		}
+		plain, err := c.open(data, passphrase)
+		if err != errCipherWrongKey {
+			return plain, err
+		}
+	}
+	if current == "" {
+		return nil, errCipherNoKey
+	}
+	return nil, errCipherWrongKey
+}
+
+// open descifra data con una clave. Si no es la clave devuelve errCipherWrongKey.
+func (c *Cipher) open(data []byte, passphrase string) ([]byte, error) {
+	rest := data[len(CIPHER_MAGIC):]
+	if len(rest) < cipherSaltSize {
+		return nil, errCipherCut
+	}
+	salt, rest := rest[:cipherSaltSize], rest[cipherSaltSize:]
+	key, err := c.key(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) < gcm.NonceSize() {
+		return nil, errCipherCut
+	}
+	plain, err := gcm.Open(nil, rest[:gcm.NonceSize()], rest[gcm.NonceSize():], []byte(CIPHER_MAGIC))
+	if err != nil {
+		return nil, errCipherWrongKey
+	}
+	return plain, nil
+}
+
+// current dice si data ya está cifrado con la clave vigente.
+func (c *Cipher) current(data []byte) bool {
+	passphrase, _ := c.Keys()
+	if !IsEncrypted(data) || passphrase == "" {
+		return false
+	}
+	_, err := c.open(data, passphrase)
+	return err == nil
+}
+
+// adoptSalt hace que lo que se cifre de aquí en adelante use la sal de data,
+// que ya está cifrado con la clave vigente. Así todos los archivos de esta
+// computadora comparten una sal y la clave se deriva una sola vez.
+func (c *Cipher) adoptSalt(data []byte) {
+	passphrase, _ := c.Keys()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.salt = append([]byte{}, data[len(CIPHER_MAGIC):len(CIPHER_MAGIC)+cipherSaltSize]...)
+	c.saltFor = passphrase
+}
+
+// sameSalt dice si data está cifrado con la sal que se usa para cifrar, que
+// solo se adopta de archivos cifrados con la clave vigente.
+func (c *Cipher) sameSalt(data []byte) bool {
+	if !IsEncrypted(data) || len(data) < len(CIPHER_MAGIC)+cipherSaltSize {
+		return false
+	}
+	passphrase, _ := c.Keys()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.salt != nil && c.saltFor == passphrase && bytes.Equal(data[len(CIPHER_MAGIC):len(CIPHER_MAGIC)+cipherSaltSize], c.salt)
+}
+
+// EncryptLine cifra una línea del diario; sin cifrado la devuelve igual.
+func (c *Cipher) EncryptLine(line []byte) ([]byte, error) {
+	if c == nil {
+		return line, nil
+	}
+	sealed, err := c.Encrypt(line)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(CIPHER_LINE_PREFIX + base64.StdEncoding.EncodeToString(sealed)), nil
+}
+
+// DecryptLine es lo contrario de EncryptLine. Las líneas sin cifrar se
+// devuelven igual.
+func (c *Cipher) DecryptLine(line []byte) ([]byte, error) {
+	line = bytes.TrimSpace(line)
+	if !bytes.HasPrefix(line, []byte(CIPHER_LINE_PREFIX)) {
+		return line, nil
+	}
+	sealed, err := base64.StdEncoding.DecodeString(string(line[len(CIPHER_LINE_PREFIX):]))
+	if err != nil {
+		return nil, err
+	}
+	return c.Decrypt(sealed)
+}
+
+// readEncryptedFile lee un archivo que puede estar cifrado.
+func readEncryptedFile(path string, c *Cipher) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return c.Decrypt(data)
+}
+
+// encryptExistingFiles cifra con la clave vigente los archivos del censo que
+// todavía están sin cifrar o cifrados con la clave anterior: el libro, las
+// copias de seguridad, la base de la sincronización y el diario. Así, al
+// activar el cifrado o cambiar la clave no queda nada atrás. El cifrado solo
+// se usa con el almacenamiento excel (ver loadConfig).
+func encryptExistingFiles(c *Cipher) error {
+	files := []string{EXCEL_FILE, syncBasePath()}
+	if list, err := ioutil.ReadDir(BACKUP_DIR); err == nil {
+		for _, f := range list {
+			if !f.IsDir() && !strings.HasPrefix(f.Name(), ".") {
+				files = append(files, filepath.Join(BACKUP_DIR, f.Name()))
+			}
+		}
+	}
+
+	// Primero se adopta la sal de lo que ya está cifrado con la clave
+	// vigente; después se vuelve a cifrar todo lo que tenga otra sal (sin
+	// cifrar, con la clave anterior o de otra ejecución), así la próxima vez
+	// basta con derivar la clave una vez
+	for _, path := range files {
+		if data, err := ioutil.ReadFile(path); err == nil && c.current(data) {
+			c.adoptSalt(data)
+			break
+		}
+	}
+	var pending []string
+	for _, path := range files {
+		data, err := ioutil.ReadFile(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if !c.sameSalt(data) {
+			pending = append(pending, path)
+		}
+	}
+
+	count := 0
+	for _, path := range pending {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		plain, err := c.Decrypt(data)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		sealed, err := c.Encrypt(plain)
+		if err != nil {
+			return err
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		if err := writeFileAtomic(path, sealed, 0644); err != nil {
+			return err
+		}
+		// Las copias conservan su fecha
+		os.Chtimes(path, info.ModTime(), info.ModTime())
+		count++
+	}
+
+	n, err := encryptJournalFile(c, JOURNAL_FILE)
+	if err != nil {
+		return fmt.Errorf("%s: %w", JOURNAL_FILE, err)
+	}
+	count += n
+	if count > 0 {
+		fmt.Printf("--- CIFRADO: Se cifraron %d archivo(s) con la clave vigente ---\n", count)
+	}
+	return nil
+}
+
+// checkNotEncrypted revisa, cuando el cifrado está apagado, que el libro no
+// esté cifrado: sin la clave no se podría leer nada.
+func checkNotEncrypted(storage string) error {
+	if storage != "excel" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(EXCEL_FILE)
+	if err == nil && IsEncrypted(data) {
+		return fmt.Errorf("%s está cifrado: use cifrado si y ponga %s en las credenciales", EXCEL_FILE, CRED_CLAVE_CIFRADO)
+	}
+	return nil
+}
+
+// encryptJournalFile reescribe el diario con todas sus líneas cifradas con la
+// clave vigente. Devuelve 1 si tuvo que reescribirlo.
+func encryptJournalFile(c *Cipher, path string) (int, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	var out bytes.Buffer
+	changed := false
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		if bytes.HasPrefix(line, []byte(CIPHER_LINE_PREFIX)) {
+			if sealed, err := base64.StdEncoding.DecodeString(string(line[len(CIPHER_LINE_PREFIX):])); err == nil && c.sameSalt(sealed) {
+				out.Write(line)
+				out.WriteByte('\n')
+				continue
+			}
+		}
+		plain, err := c.DecryptLine(line)
+		if err != nil {
+			return 0, err
+		}
+		sealed, err := c.EncryptLine(plain)
+		if err != nil {
+			return 0, err
+		}
+		out.Write(sealed)
+		out.WriteByte('\n')
+		changed = true
+	}
+	if !changed {
+		return 0, nil
+	}
+	return 1, writeFileAtomic(path, out.Bytes(), 0644)
+}
+
+// cipherBackend cifra todo lo que sube al almacenamiento compartido y lo
+// descifra al bajarlo. Quien no tenga la clave no puede leer nada de lo que
+// hay allí, ni siquiera abriendo la carpeta de Dropbox.
+type cipherBackend struct {
+	SyncBackend
+	Cipher *Cipher
+}
+
+func (b *cipherBackend) Pull(name string) ([]byte, string, error) {
+	data, rev, err := b.SyncBackend.Pull(name)
+	if err != nil {
+		return nil, "", err
+	}
+	plain, err := b.Cipher.Decrypt(data)
+	if err != nil {
+		return nil, "", fmt.Errorf("%s: %w", name, err)
+	}
+	return plain, rev, nil
+}
+
+func (b *cipherBackend) Push(name string, data []byte, parentRev string) (string, error) {
+	sealed, err := b.Cipher.Encrypt(data)
+	if err != nil {
+		return "", err
+	}
+	return b.SyncBackend.Push(name, sealed, parentRev)
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testCipher(current, previous string) *Cipher {
+	return &Cipher{Keys: func() (string, string) { return current, previous }}
+}
+
+// chdirTemp cambia a una carpeta temporal, donde quedan los archivos que el
+// programa busca por su ruta relativa, y vuelve al terminar la prueba.
+func chdirTemp(t *testing.T) string {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+	return dir
+}
+
+func TestCipherRoundTrip(t *testing.T) {
+	c := testCipher("clave", "")
+	plain := []byte("Nombre completo;CEDULA\nJosé Pérez;V-12345678\n")
+	sealed, err := c.Encrypt(plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsEncrypted(sealed) || bytes.Contains(sealed, []byte("Pérez")) {
+		t.Fatalf("el contenido cifrado no parece cifrado: %q", sealed)
+	}
+	got, err := c.Decrypt(sealed)
+	if err != nil || !bytes.Equal(got, plain) {
+		t.Fatalf("Decrypt devolvió %q, %v", got, err)
+	}
+
+	// Lo que no está cifrado se lee tal cual, con o sin clave
+	var none *Cipher
+	if got, err := none.Decrypt(plain); err != nil || !bytes.Equal(got, plain) {
+		t.Fatalf("Decrypt de un archivo sin cifrar devolvió %q, %v", got, err)
+	}
+	if got, err := none.Encrypt(plain); err != nil || !bytes.Equal(got, plain) {
+		t.Fatalf("Encrypt sin cifrado devolvió %q, %v", got, err)
+	}
+
+	line, err := c.EncryptLine([]byte(`{"op":"editar"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(line), CIPHER_LINE_PREFIX) || bytes.ContainsAny(line, "\n{") {
+		t.Fatalf("la línea cifrada no sirve para el diario: %q", line)
+	}
+	if got, err := c.DecryptLine(line); err != nil || string(got) != `{"op":"editar"}` {
+		t.Fatalf("DecryptLine devolvió %q, %v", got, err)
+	}
+}
+
+func TestCipherWrongKey(t *testing.T) {
+	sealed, err := testCipher("clave", "").Encrypt([]byte("secreto"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := testCipher("otra", "").Decrypt(sealed); err != errCipherWrongKey {
+		t.Errorf("Decrypt con otra clave devolvió %v, se esperaba errCipherWrongKey", err)
+	}
+	if _, err := testCipher("otra", "tampoco").Decrypt(sealed); err != errCipherWrongKey {
+		t.Errorf("Decrypt con otras dos claves devolvió %v, se esperaba errCipherWrongKey", err)
+	}
+	var none *Cipher
+	if _, err := none.Decrypt(sealed); err != errCipherNoKey {
+		t.Errorf("Decrypt sin cifrado devolvió %v, se esperaba errCipherNoKey", err)
+	}
+	if _, err := testCipher("", "").Decrypt(sealed); err != errCipherNoKey {
+		t.Errorf("Decrypt sin clave devolvió %v, se esperaba errCipherNoKey", err)
+	}
+	if _, err := testCipher("", "").Encrypt([]byte("secreto")); err == nil {
+		t.Error("Encrypt sin clave no devolvió error")
+	}
+}
+
+func TestCipherTampered(t *testing.T) {
+	c := testCipher("clave", "")
+	sealed, err := c.Encrypt([]byte("Edad: 40"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, i := range []int{len(CIPHER_MAGIC), len(CIPHER_MAGIC) + cipherSaltSize, len(sealed) - 1} {
+		tampered := append([]byte{}, sealed...)
+		tampered[i] ^= 1
+		if _, err := c.Decrypt(tampered); err != errCipherWrongKey {
+			t.Errorf("Decrypt con el byte %d cambiado devolvió %v, se esperaba errCipherWrongKey", i, err)
+		}
+	}
+	for _, n := range []int{len(CIPHER_MAGIC), len(CIPHER_MAGIC) + cipherSaltSize - 1, len(CIPHER_MAGIC) + cipherSaltSize + 4} {
+		if _, err := c.Decrypt(sealed[:n]); err != errCipherCut {
+			t.Errorf("Decrypt cortado en %d bytes devolvió %v, se esperaba errCipherCut", n, err)
+		}
+	}
+}
+
+func TestCipherPreviousKey(t *testing.T) {
+	old, err := testCipher("vieja", "").Encrypt([]byte("antes del cambio"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := testCipher("nueva", "vieja")
+	got, err := c.Decrypt(old)
+	if err != nil || string(got) != "antes del cambio" {
+		t.Fatalf("Decrypt con la clave anterior devolvió %q, %v", got, err)
+	}
+	if c.current(old) {
+		t.Error("lo cifrado con la clave anterior cuenta como vigente")
+	}
+
+	// Lo que se cifra de nuevo usa la clave vigente
+	sealed, err := c.Encrypt(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.current(sealed) {
+		t.Error("lo recién cifrado no cuenta como vigente")
+	}
+	if _, err := testCipher("vieja", "").Decrypt(sealed); err != errCipherWrongKey {
+		t.Errorf("la clave anterior todavía abre lo recién cifrado: %v", err)
+	}
+}
+
+func TestEncryptExistingFiles(t *testing.T) {
+	chdirTemp(t)
+	old := testCipher("vieja", "")
+	plain := map[string][]byte{
+		EXCEL_FILE:     []byte("libro"),
+		syncBasePath(): []byte("base"),
+		filepath.Join(BACKUP_DIR, "guardado-1.xlsx"): []byte("copia sin cifrar"),
+		filepath.Join(BACKUP_DIR, "diario-1.xlsx"):   []byte("copia con la clave vieja"),
+	}
+	for path, data := range plain {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(string(data), "vieja") {
+			var err error
+			if data, err = old.Encrypt(data); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := ioutil.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	oldLine, err := old.EncryptLine([]byte(`{"id":"p00002"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	journalData := "{\"id\":\"p00001\"}\n" + string(oldLine) + "\n"
+	if err := ioutil.WriteFile(JOURNAL_FILE, []byte(journalData), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c := testCipher("nueva", "vieja")
+	if err := encryptExistingFiles(c); err != nil {
+		t.Fatal(err)
+	}
+	check := testCipher("nueva", "")
+	for path, want := range plain {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !check.current(data) {
+			t.Errorf("%s no quedó cifrado con la clave vigente", path)
+			continue
+		}
+		if got, _ := check.Decrypt(data); !bytes.Equal(got, want) {
+			t.Errorf("%s quedó con %q, se esperaba %q", path, got, want)
+		}
+	}
+	data, err := ioutil.ReadFile(JOURNAL_FILE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	want := []string{`{"id":"p00001"}`, `{"id":"p00002"}`}
+	if len(lines) != len(want) {
+		t.Fatalf("el diario quedó con %d líneas:\n%s", len(lines), data)
+	}
+	for i, line := range lines {
+		got, err := check.DecryptLine([]byte(line))
+		if err != nil || string(got) != want[i] {
+			t.Errorf("la línea %d del diario quedó como %q (%v), se esperaba %q", i+1, got, err, want[i])
+		}
+	}
+
+	// La segunda vez no hay nada que cifrar: los archivos no cambian
+	before := map[string][]byte{}
+	for path := range plain {
+		before[path], _ = ioutil.ReadFile(path)
+	}
+	if err := encryptExistingFiles(c); err != nil {
+		t.Fatal(err)
+	}
+	for path := range plain {
+		if after, _ := ioutil.ReadFile(path); !bytes.Equal(after, before[path]) {
+			t.Errorf("%s se volvió a cifrar sin necesidad", path)
+		}
+	}
+	if n, err := encryptJournalFile(c, JOURNAL_FILE); n != 0 || err != nil {
+		t.Errorf("encryptJournalFile reescribió un diario ya cifrado: %d, %v", n, err)
+	}
+}
+
+func TestEncryptExistingFilesOtherKey(t *testing.T) {
+	chdirTemp(t)
+	sealed, err := testCipher("de otro censo", "").Encrypt([]byte("libro"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(EXCEL_FILE, sealed, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := encryptExistingFiles(testCipher("nueva", "vieja")); err == nil {
+		t.Fatal("se aceptó un libro cifrado con una clave desconocida")
+	}
+	if data, _ := ioutil.ReadFile(EXCEL_FILE); !bytes.Equal(data, sealed) {
+		t.Error("el libro con otra clave se modificó")
+	}
+}
+
+func TestCipherBackend(t *testing.T) {
+	dir := t.TempDir()
+	c := testCipher("clave", "")
+	b := &cipherBackend{SyncBackend: &FolderBackend{Dir: dir}, Cipher: c}
+	testSyncBackend(t, b)
+
+	rev, err := b.Push("cambios/ana-00000001.jsonl", []byte("José Pérez"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := ioutil.ReadFile(filepath.Join(dir, "cambios", "ana-00000001.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsEncrypted(raw) || bytes.Contains(raw, []byte("Pérez")) {
+		t.Fatalf("en la carpeta compartida quedó %q sin cifrar", raw)
+	}
+	data, pulled, err := b.Pull("cambios/ana-00000001.jsonl")
+	if err != nil || string(data) != "José Pérez" || pulled != rev {
+		t.Fatalf("Pull devolvió %q, %q, %v", data, pulled, err)
+	}
+
+	// Quien no tiene la clave no puede bajar nada
+	other := &cipherBackend{SyncBackend: &FolderBackend{Dir: dir}, Cipher: testCipher("otra", "")}
+	if _, _, err := other.Pull("cambios/ana-00000001.jsonl"); err == nil || !strings.Contains(err.Error(), errCipherWrongKey.Error()) {
+		t.Errorf("Pull con otra clave devolvió %v, se esperaba errCipherWrongKey", err)
+	}
+}
+
+func TestEncryptedBackups(t *testing.T) {
+	b := &backupRotation{Dir: t.TempDir(), Ext: ".xlsx", Keep: 5, KeepDaily: 5, Cipher: testCipher("clave", "")}
+	write := func(content string) func(string) error {
+		return func(path string) error { return ioutil.WriteFile(path, []byte(content), 0644) }
+	}
+	if err := b.snapshot(write("primera")); err != nil {
+		t.Fatal(err)
+	}
+	// La misma copia se reconoce aunque el cifrado dé otros bytes
+	if err := b.snapshot(write("primera")); err != nil {
+		t.Fatal(err)
+	}
+	if saves := b.names("guardado-"); len(saves) != 1 {
+		t.Fatalf("quedaron %d copias de guardado, se esperaba 1", len(saves))
+	}
+	for _, prefix := range []string{"guardado-", "diario-"} {
+		for _, name := range b.names(prefix) {
+			data, err := ioutil.ReadFile(filepath.Join(b.Dir, name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !IsEncrypted(data) {
+				t.Errorf("la copia %s quedó sin cifrar", name)
+			}
+			if got, err := readEncryptedFile(filepath.Join(b.Dir, name), b.Cipher); err != nil || string(got) != "primera" {
+				t.Errorf("la copia %s tiene %q, %v", name, got, err)
+			}
+		}
+	}
+	if _, err := readEncryptedFile(filepath.Join(b.Dir, b.names("guardado-")[0]), nil); err != errCipherNoKey {
+		t.Errorf("leer una copia cifrada sin clave devolvió %v, se esperaba errCipherNoKey", err)
+	}
+}
@@ -11,9 +11,15 @@ require (
 	github.com/jinzhu/now v1.1.0 // indirect
 	github.com/joho/godotenv v1.3.0 // indirect
 	github.com/kr/pretty v0.3.0 // indirect
+	github.com/mattn/go-sqlite3 v1.14.10
 	github.com/olekukonko/tablewriter v0.0.5 // indirect
 	github.com/rogpeppe/go-internal v1.8.0 // indirect
 	github.com/stretchr/testify v1.7.1 // indirect
+	golang.org/x/crypto v0.0.0-20201012173705-84dcc777aaee
 	gopkg.in/check.v1 v1.0.0-20201130134442-10cb98267c6c // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
+
+// gorm v1.9.12 pide github.com/mattn/go-sqlite3 v2.0.1+incompatible, una
+// versión retirada y anterior a la v1.14; sin esto se compilaría esa.
+exclude github.com/mattn/go-sqlite3 v2.0.1+incompatible
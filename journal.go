@@ -0,0 +1,562 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ------------------- DIARIO DE CAMBIOS -------------------------
+
+// JOURNAL_FILE guarda el diario de cambios en modo Excel, una entrada por línea.
+const JOURNAL_FILE = "journal.jsonl"
+
+// Operaciones del diario. "editar", "agregar" e "importar" son cambios de un
+// campo; las demás afectan a la persona entera y dejan Campo vacío. Al
+// eliminar, después de la entrada con el motivo en New va una por cada
+// campo con el valor que tenía, así queda lo que se borró.
+const (
+	OP_EDITAR    = "editar"
+	OP_AGREGAR   = "agregar"
+	OP_IMPORTAR  = "importar"
+	OP_ELIMINAR  = "eliminar"
+	OP_RESTAURAR = "restaurar"
+	OP_PURGAR    = "purgar"
+)
+
+// JournalEntry es un cambio de una persona. Todas las entradas que generó una
+// misma operación (un guardado, una importación) comparten Change.
+type JournalEntry struct {
+	Seq      int64     `json:"seq"`
+	Change   string    `json:"cambio"`
+	Time     time.Time `json:"fecha"`
+	Operator string    `json:"operador"`
+	Op       string    `json:"operacion"`
+	RecordID string    `json:"id"`
+	Field    string    `json:"campo,omitempty"`
+	Old      string    `json:"anterior"`
+	New      string    `json:"nuevo"`
+	// Reverts es el Seq de la entrada que este cambio deshizo, o 0.
+	Reverts int64 `json:"revierte,omitempty"`
+	// Instancia es la computadora donde se hizo el cambio, en el modo de
+	// sincronización por cambios; vacío en los demás casos.
+	Instancia string `json:"instancia,omitempty"`
+}
+
+// JournalFilter elige entradas del diario. Los campos vacíos no filtran.
+type JournalFilter struct {
+	Seq      int64
+	RecordID string
+	Change   string
+	// After deja solo las entradas con Seq mayor.
+	After int64
+}
+
+// JournalStore guarda el diario de cambios del censo.
+type JournalStore interface {
+	// AppendJournal agrega entradas y les asigna Seq.
+	AppendJournal(entries []JournalEntry) error
+	// Journal devuelve las entradas que cumplen el filtro, de la más vieja a la más nueva.
+	Journal(filter JournalFilter) ([]JournalEntry, error)
+}
+
+var journal JournalStore
+
+func (f JournalFilter) match(e JournalEntry) bool {
+	return (f.Seq == 0 || e.Seq == f.Seq) &&
+		(f.RecordID == "" || e.RecordID == f.RecordID) &&
+		(f.Change == "" || e.Change == f.Change) &&
+		(f.After == 0 || e.Seq > f.After)
+}
+
+// JSONLJournal guarda el diario en un archivo de texto con una entrada JSON
+// por línea. Solo se agregan líneas al final, nunca se reescribe. Con Cipher
+// cada línea se cifra por separado.
+type JSONLJournal struct {
+	Path   string
+	Cipher *Cipher
+
+	mu      sync.Mutex
+	lastSeq int64
+	loaded  bool
+}
+
+// scan recorre el archivo entrada por entrada. Un archivo que no existe es un
+// diario vacío.
+func (j *JSONLJournal) scan(fn func(e JournalEntry)) error {
+	file, err := os.Open(j.Path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 1 {
+			var e JournalEntry
+			// Una línea cortada (el programa se cerró a mitad de escribirla) se
+			// ignora; las demás tienen que poder descifrarse
+			plain, cipherErr := j.Cipher.DecryptLine(line)
+			if cipherErr != nil && err == nil {
+				return cipherErr
+			}
+			if cipherErr == nil && json.Unmarshal(plain, &e) == nil {
+				fn(e)
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (j *JSONLJournal) AppendJournal(entries []JournalEntry) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if !j.loaded {
+		err := j.scan(func(e JournalEntry) {
+			if e.Seq > j.lastSeq {
+				j.lastSeq = e.Seq
+			}
+		})
+		if err != nil {
+			return err
+		}
+		if err := j.dropCutLine(); err != nil {
+			return err
+		}
+		j.loaded = true
+	}
+
+	var buf []byte
+	for i := range entries {
+		j.lastSeq++
+		entries[i].Seq = j.lastSeq
+		line, err := json.Marshal(entries[i])
+		if err != nil {
+			return err
+		}
+		if line, err = j.Cipher.EncryptLine(line); err != nil {
+			return err
+		}
+		buf = append(append(buf, line...), '\n')
+	}
+
+	file, err := os.OpenFile(j.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(buf); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// dropCutLine quita la última línea si quedó cortada (el programa se cerró a
+// mitad de escribirla); si no, la próxima entrada quedaría pegada a ella y
+// también se perdería.
+func (j *JSONLJournal) dropCutLine() error {
+	data, err := ioutil.ReadFile(j.Path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if len(data) == 0 || data[len(data)-1] == '\n' {
+		return nil
+	}
+	return os.Truncate(j.Path, int64(bytes.LastIndexByte(data, '\n')+1))
+}
+
+func (j *JSONLJournal) Journal(filter JournalFilter) ([]JournalEntry, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	list := []JournalEntry{}
+	err := j.scan(func(e JournalEntry) {
+		if filter.match(e) {
+			list = append(list, e)
+		}
+	})
+	return list, err
+}
+
+// journaledCensus anota en el diario cada cambio que pasa por el censo. Compara
+// cada persona antes y después de escribir, así el diario tiene los valores
+// que de verdad quedaron guardados. mu hace que nadie escriba entre esa
+// lectura y la escritura.
+type journaledCensus struct {
+	CensusStore
+	backups  BackupStore
+	journal  JournalStore
+	operator string
+	reverts  int64
+	mu       *sync.Mutex
+
+	// instancia se anota en cada entrada (modo cambios). Al repetir un
+	// cambio de otra computadora, origin es su entrada: las nuevas conservan
+	// su cambio, fecha, operador e instancia.
+	instancia string
+	origin    *JournalEntry
+}
+
+// newJournaledCensus envuelve el censo y sus copias de seguridad.
+func newJournaledCensus(store CensusStore, backups BackupStore, journal JournalStore) *journaledCensus {
+	return &journaledCensus{CensusStore: store, backups: backups, journal: journal, operator: OPERADOR, mu: &sync.Mutex{}}
+}
+
+// as devuelve el mismo censo, pero anotando los cambios a nombre de operator.
+func (c *journaledCensus) as(operator string) *journaledCensus {
+	view := *c
+	if operator != "" {
+		view.operator = operator
+	}
+	return &view
+}
+
+// censusAs es el censo que usan los handlers cuando saben quién hace el cambio.
+func censusAs(operator string) CensusStore {
+	if c, ok := census.(*journaledCensus); ok {
+		return c.as(operator)
+	}
+	return census
+}
+
+// record escribe las entradas en el diario. El cambio en el censo ya se hizo,
+// así que un error aquí solo se informa.
+func (c *journaledCensus) record(entries []JournalEntry) {
+	if len(entries) == 0 {
+		return
+	}
+	change, now, operator, instancia := newRecordID(), time.Now(), c.operator, c.instancia
+	if c.origin != nil {
+		change, now, operator, instancia = c.origin.Change, c.origin.Time, c.origin.Operator, c.origin.Instancia
+	}
+	for i := range entries {
+		entries[i].Change = change
+		entries[i].Time = now
+		entries[i].Operator = operator
+		entries[i].Reverts = c.reverts
+		entries[i].Instancia = instancia
+	}
+	if err := c.journal.AppendJournal(entries); err != nil {
+		fmt.Printf("--- ERROR: No se pudo escribir el diario de cambios: %v ---\n", err)
+	}
+}
+
+// fieldChanges devuelve una entrada por cada campo distinto entre before y
+// after, en el orden de las cabeceras.
+func fieldChanges(op, id string, headers []string, before, after map[string]string) []JournalEntry {
+	keys := append([]string{}, headers...)
+	var extra []string
+	for _, fields := range []map[string]string{before, after} {
+		for key := range fields {
+			if indexOf(keys, key) == -1 && indexOf(extra, key) == -1 {
+				extra = append(extra, key)
+			}
+		}
+	}
+	sort.Strings(extra)
+
+	var entries []JournalEntry
+	for _, key := range append(keys, extra...) {
+		if before[key] != after[key] {
+			entries = append(entries, JournalEntry{Op: op, RecordID: id, Field: key, Old: before[key], New: after[key]})
+		}
+	}
+	return entries
+}
+
+// snapshotByID lee todas las personas para comparar el antes y el después de
+// un cambio del censo completo.
+func (c *journaledCensus) snapshotByID() ([]string, map[string]CensusRecord) {
+	headers, _ := c.CensusStore.Headers()
+	records, _ := c.CensusStore.List()
+	byID := make(map[string]CensusRecord, len(records))
+	for _, rec := range records {
+		byID[rec.ID] = rec
+	}
+	return headers, byID
+}
+
+// censusChanges compara dos fotos completas del censo.
+func censusChanges(headers []string, before, after map[string]CensusRecord) []JournalEntry {
+	ids := make([]string, 0, len(before)+len(after))
+	for id := range before {
+		ids = append(ids, id)
+	}
+	for id := range after {
+		if _, ok := before[id]; !ok {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+
+	var entries []JournalEntry
+	for _, id := range ids {
+		entries = append(entries, fieldChanges(OP_IMPORTAR, id, headers, before[id].Fields, after[id].Fields)...)
+	}
+	return entries
+}
+
+func (c *journaledCensus) Insert(records ...map[string]string) ([]string, error) {
+	return c.Save(nil, records)
+}
+
+func (c *journaledCensus) Update(records ...CensusRecord) error {
+	_, err := c.Save(records, nil)
+	return err
+}
+
+func (c *journaledCensus) Save(updates []CensusRecord, inserts []map[string]string) ([]string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	before := make(map[string]CensusRecord, len(updates))
+	for _, rec := range updates {
+		if current, err := c.CensusStore.Get(rec.ID); err == nil {
+			before[rec.ID] = current
+		}
+	}
+	ids, err := c.CensusStore.Save(updates, inserts)
+	if err != nil {
+		return ids, err
+	}
+	headers, _ := c.CensusStore.Headers()
+	var entries []JournalEntry
+	for _, rec := range updates {
+		old, ok := before[rec.ID]
+		if !ok {
+			continue
+		}
+		delete(before, rec.ID)
+		if current, err := c.CensusStore.Get(rec.ID); err == nil {
+			entries = append(entries, fieldChanges(OP_EDITAR, rec.ID, headers, old.Fields, current.Fields)...)
+		}
+	}
+	for _, id := range ids {
+		if rec, err := c.CensusStore.Get(id); err == nil {
+			entries = append(entries, fieldChanges(OP_AGREGAR, id, headers, nil, rec.Fields)...)
+		}
+	}
+	c.record(entries)
+	return ids, nil
+}
+
+func (c *journaledCensus) Delete(info DeleteInfo, refs ...RecordRef) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	before := make(map[string]CensusRecord, len(refs))
+	for _, ref := range refs {
+		if current, err := c.CensusStore.Get(ref.ID); err == nil {
+			before[ref.ID] = current
+		}
+	}
+	if err := c.CensusStore.Delete(info, refs...); err != nil {
+		return err
+	}
+	headers, _ := c.CensusStore.Headers()
+	var entries []JournalEntry
+	for _, ref := range refs {
+		entries = append(entries, JournalEntry{Op: OP_ELIMINAR, RecordID: ref.ID, New: info.Reason})
+		entries = append(entries, fieldChanges(OP_ELIMINAR, ref.ID, headers, before[ref.ID].Fields, nil)...)
+	}
+	c.as(info.By).record(entries)
+	return nil
+}
+
+func (c *journaledCensus) Restore(ids ...string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ids = uniqueIDs(ids)
+	if err := c.CensusStore.Restore(ids...); err != nil {
+		return err
+	}
+	entries := make([]JournalEntry, len(ids))
+	for i, id := range ids {
+		entries[i] = JournalEntry{Op: OP_RESTAURAR, RecordID: id}
+	}
+	c.record(entries)
+	return nil
+}
+
+func (c *journaledCensus) Purge(before time.Time) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	trash, _ := c.CensusStore.Trash()
+	n, err := c.CensusStore.Purge(before)
+	if err != nil || n == 0 {
+		return n, err
+	}
+	remaining := make(map[string]bool)
+	if list, err := c.CensusStore.Trash(); err == nil {
+		for _, rec := range list {
+			remaining[rec.ID] = true
+		}
+	}
+	var entries []JournalEntry
+	for _, rec := range trash {
+		if !remaining[rec.ID] {
+			entries = append(entries, JournalEntry{Op: OP_PURGAR, RecordID: rec.ID})
+		}
+	}
+	c.record(entries)
+	return n, nil
+}
+
+func (c *journaledCensus) ImportWorkbook(r io.Reader) error {
+	return c.ImportWorkbookIf(r, "")
+}
+
+func (c *journaledCensus) ImportWorkbookIf(r io.Reader, ifVersion string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	_, before := c.snapshotByID()
+	if err := c.CensusStore.ImportWorkbookIf(r, ifVersion); err != nil {
+		return err
+	}
+	headers, after := c.snapshotByID()
+	c.record(censusChanges(headers, before, after))
+	return nil
+}
+
+func (c *journaledCensus) Backups() ([]BackupInfo, error) {
+	return c.backups.Backups()
+}
+
+func (c *journaledCensus) ReadBackup(nombre string) ([]string, []CensusRecord, error) {
+	return c.backups.ReadBackup(nombre)
+}
+
+func (c *journaledCensus) RestoreBackup(nombre string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	_, before := c.snapshotByID()
+	if err := c.backups.RestoreBackup(nombre); err != nil {
+		return err
+	}
+	headers, after := c.snapshotByID()
+	c.record(censusChanges(headers, before, after))
+	return nil
+}
+
+var errCannotRevert = errors.New("este cambio no se puede deshacer")
+
+// revert deshace una entrada del diario aplicando el cambio contrario por el
+// camino normal de escritura, así el deshacer queda también en el diario (con
+// Reverts apuntando a la entrada). Si la persona cambió desde entonces devuelve
+// *ConflictError con sus valores actuales.
+func (c *journaledCensus) revert(e JournalEntry) error {
+	view := *c
+	view.reverts = e.Seq
+
+	switch e.Op {
+	case OP_EDITAR:
+		return view.revertField(e)
+	case OP_AGREGAR:
+		// Deshacer un agregado envía a la persona a la papelera, de donde se
+		// puede recuperar
+		current, err := c.Get(e.RecordID)
+		if err != nil {
+			return err
+		}
+		info := DeleteInfo{By: c.operator, Reason: fmt.Sprintf("Se deshizo el agregado #%d", e.Seq)}
+		return view.Delete(info, RecordRef{ID: e.RecordID, IfVersion: current.Version()})
+	case OP_IMPORTAR:
+		if _, err := c.Get(e.RecordID); err != errRecordNotFound {
+			return view.revertField(e)
+		}
+		// Si la importación quitó a la persona, todas sus entradas de ese
+		// cambio quedaron vacías: se vuelve a agregar con los valores de antes
+		same, err := c.journal.Journal(JournalFilter{Change: e.Change, RecordID: e.RecordID})
+		if err != nil {
+			return err
+		}
+		fields := map[string]string{ID_HEADER: e.RecordID}
+		for _, other := range same {
+			if other.Op != OP_IMPORTAR || other.New != "" {
+				return errRecordNotFound
+			}
+			fields[other.Field] = other.Old
+		}
+		// Si después quedó en la papelera, se recupera desde allí
+		trash, err := c.Trash()
+		if err != nil {
+			return err
+		}
+		for _, rec := range trash {
+			if rec.ID == e.RecordID {
+				return errCannotRevert
+			}
+		}
+		_, err = view.Insert(fields)
+		return err
+	case OP_ELIMINAR:
+		return view.Restore(e.RecordID)
+	case OP_RESTAURAR:
+		current, err := c.Get(e.RecordID)
+		if err != nil {
+			return err
+		}
+		info := DeleteInfo{By: c.operator, Reason: fmt.Sprintf("Se deshizo la restauración #%d", e.Seq)}
+		return view.Delete(info, RecordRef{ID: e.RecordID, IfVersion: current.Version()})
+	}
+	// Lo purgado ya no existe; para recuperarlo están las copias de seguridad
+	return errCannotRevert
+}
+
+// revertField vuelve un campo al valor que tenía antes de e.
+func (c *journaledCensus) revertField(e JournalEntry) error {
+	current, err := c.Get(e.RecordID)
+	if err != nil {
+		return err
+	}
+	// Solo se deshace si el campo todavía tiene el valor que dejó este cambio
+	if current.Fields[e.Field] != e.New {
+		return &ConflictError{Current: []CensusRecord{current}}
+	}
+	return c.Update(CensusRecord{
+		ID:        e.RecordID,
+		Fields:    map[string]string{e.Field: e.Old},
+		IfVersion: current.Version(),
+	})
+}
+
+// revertJournalEntry busca la entrada seq del diario y la deshace a nombre de operator.
+func revertJournalEntry(seq int64, operator string) (JournalEntry, error) {
+	c, ok := census.(*journaledCensus)
+	if !ok {
+		return JournalEntry{}, errCannotRevert
+	}
+	list, err := c.journal.Journal(JournalFilter{Seq: seq})
+	if err != nil {
+		return JournalEntry{}, err
+	}
+	if len(list) == 0 {
+		return JournalEntry{}, errRecordNotFound
+	}
+	return list[0], c.as(operator).revert(list[0])
+}
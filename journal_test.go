@@ -0,0 +1,367 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newTestJournaledCensus es un censo de testCensus(n) con su diario, en una
+// carpeta temporal.
+func newTestJournaledCensus(t *testing.T, n int) (*journaledCensus, *JSONLJournal) {
+	t.Helper()
+	store := newTestExcelStore(t, n)
+	j := &JSONLJournal{Path: filepath.Join(t.TempDir(), JOURNAL_FILE)}
+	return newJournaledCensus(store, store, j), j
+}
+
+func TestJournalDeleteRecordsFields(t *testing.T) {
+	c, j := newTestJournaledCensus(t, 3)
+	before, err := c.Get("p00001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Delete(DeleteInfo{By: "ana", Reason: "mudanza"}, RecordRef{ID: "p00001"}); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := j.Journal(JournalFilter{RecordID: "p00001"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) == 0 || entries[0].Op != OP_ELIMINAR || entries[0].Field != "" || entries[0].New != "mudanza" {
+		t.Fatalf("la primera entrada no trae el motivo: %+v", entries)
+	}
+	fields := map[string]string{}
+	for _, e := range entries[1:] {
+		if e.Op != OP_ELIMINAR || e.New != "" || e.Operator != "ana" || e.Change != entries[0].Change {
+			t.Errorf("entrada inesperada %+v", e)
+		}
+		fields[e.Field] = e.Old
+	}
+	if len(fields) != len(before.Fields) {
+		t.Errorf("se anotaron los campos %v, se esperaban %v", fields, before.Fields)
+	}
+	for name, value := range before.Fields {
+		if fields[name] != value {
+			t.Errorf("el campo %s quedó anotado con %q, se esperaba %q", name, fields[name], value)
+		}
+	}
+}
+
+func TestJSONLJournal(t *testing.T) {
+	path := filepath.Join(t.TempDir(), JOURNAL_FILE)
+	j := &JSONLJournal{Path: path}
+	if list, err := j.Journal(JournalFilter{}); err != nil || len(list) != 0 {
+		t.Fatalf("un diario que no existe devolvió %+v, %v", list, err)
+	}
+	err := j.AppendJournal([]JournalEntry{
+		{Change: "c1", Op: OP_EDITAR, RecordID: "a", Field: "Edad", Old: "1", New: "2"},
+		{Change: "c1", Op: OP_EDITAR, RecordID: "b", Field: "Edad", Old: "3", New: "4"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Una línea cortada al final (el programa se cerró a mitad de escribirla)
+	// se ignora, y otra ejecución sigue la numeración
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"seq":99,"cambio":"c`)
+	f.Close()
+	again := &JSONLJournal{Path: path}
+	if err := again.AppendJournal([]JournalEntry{{Change: "c2", Op: OP_RESTAURAR, RecordID: "a"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		filter JournalFilter
+		seqs   []int64
+	}{
+		{JournalFilter{}, []int64{1, 2, 3}},
+		{JournalFilter{RecordID: "a"}, []int64{1, 3}},
+		{JournalFilter{Change: "c1"}, []int64{1, 2}},
+		{JournalFilter{Seq: 2}, []int64{2}},
+		{JournalFilter{After: 1, RecordID: "a"}, []int64{3}},
+		{JournalFilter{RecordID: "c"}, nil},
+	}
+	for _, tt := range tests {
+		list, err := again.Journal(tt.filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var seqs []int64
+		for _, e := range list {
+			seqs = append(seqs, e.Seq)
+		}
+		if len(seqs) != len(tt.seqs) {
+			t.Errorf("Journal(%+v) devolvió %v, se esperaba %v", tt.filter, seqs, tt.seqs)
+			continue
+		}
+		for i := range seqs {
+			if seqs[i] != tt.seqs[i] {
+				t.Errorf("Journal(%+v) devolvió %v, se esperaba %v", tt.filter, seqs, tt.seqs)
+				break
+			}
+		}
+	}
+}
+
+func TestJournalEncrypted(t *testing.T) {
+	j := &JSONLJournal{Path: filepath.Join(t.TempDir(), JOURNAL_FILE), Cipher: testCipher("clave", "")}
+	if err := j.AppendJournal([]JournalEntry{{Op: OP_EDITAR, RecordID: "a", Field: "Nombre completo", New: "José Pérez"}}); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(j.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, []byte("Pérez")) {
+		t.Errorf("el diario quedó sin cifrar:\n%s", data)
+	}
+	list, err := j.Journal(JournalFilter{})
+	if err != nil || len(list) != 1 || list[0].New != "José Pérez" {
+		t.Errorf("Journal devolvió %+v, %v", list, err)
+	}
+	other := &JSONLJournal{Path: j.Path, Cipher: testCipher("otra", "")}
+	if _, err := other.Journal(JournalFilter{}); err != errCipherWrongKey {
+		t.Errorf("Journal con otra clave devolvió %v, se esperaba errCipherWrongKey", err)
+	}
+}
+
+func TestJournalSave(t *testing.T) {
+	c, j := newTestJournaledCensus(t, 3)
+	c = c.as("ana")
+	if err := c.Update(CensusRecord{ID: "p00000", Fields: map[string]string{"Edad": "40", "Nombre completo": "Persona 0"}}); err != nil {
+		t.Fatal(err)
+	}
+	ids, err := c.Insert(map[string]string{"Nombre completo": "Nueva", "Edad": "3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	list, err := j.Journal(JournalFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Los campos que no cambiaron no se anotan
+	if len(list) != 3 {
+		t.Fatalf("el diario tiene %+v, se esperaban 3 entradas", list)
+	}
+	edit := list[0]
+	if edit.Op != OP_EDITAR || edit.RecordID != "p00000" || edit.Field != "Edad" || edit.Old != "0" || edit.New != "40" || edit.Operator != "ana" {
+		t.Errorf("la edición quedó como %+v", edit)
+	}
+	for _, e := range list[1:] {
+		if e.Op != OP_AGREGAR || e.RecordID != ids[0] || e.Old != "" || e.Change != list[1].Change {
+			t.Errorf("el agregado quedó como %+v", e)
+		}
+	}
+	if list[1].Field != "Nombre completo" || list[1].New != "Nueva" || list[2].Field != "Edad" || list[2].New != "3" {
+		t.Errorf("los campos agregados no siguen el orden de las columnas: %+v", list[1:])
+	}
+	if edit.Change == list[1].Change {
+		t.Error("dos guardados comparten el mismo cambio")
+	}
+}
+
+// lastEntry devuelve la última entrada del diario.
+func lastEntry(t *testing.T, j JournalStore) JournalEntry {
+	t.Helper()
+	list, err := j.Journal(JournalFilter{})
+	if err != nil || len(list) == 0 {
+		t.Fatalf("el diario devolvió %+v, %v", list, err)
+	}
+	return list[len(list)-1]
+}
+
+func TestRevertEdit(t *testing.T) {
+	c, j := newTestJournaledCensus(t, 3)
+	if err := c.Update(CensusRecord{ID: "p00001", Fields: map[string]string{"Edad": "41"}}); err != nil {
+		t.Fatal(err)
+	}
+	edit := lastEntry(t, j)
+	if err := c.as("beto").revert(edit); err != nil {
+		t.Fatal(err)
+	}
+	if rec, _ := c.Get("p00001"); rec.Fields["Edad"] != "1" {
+		t.Errorf("Edad quedó en %q, se esperaba 1", rec.Fields["Edad"])
+	}
+	undo := lastEntry(t, j)
+	if undo.Reverts != edit.Seq || undo.Operator != "beto" || undo.Old != "41" || undo.New != "1" {
+		t.Errorf("el deshacer quedó como %+v", undo)
+	}
+
+	// El campo ya no tiene el valor que dejó la edición
+	err := c.revert(edit)
+	if conflict, ok := err.(*ConflictError); !ok || len(conflict.Current) != 1 || conflict.Current[0].Fields["Edad"] != "1" {
+		t.Errorf("deshacer dos veces devolvió %v, se esperaba *ConflictError", err)
+	}
+}
+
+func TestRevertInsert(t *testing.T) {
+	c, j := newTestJournaledCensus(t, 3)
+	ids, err := c.Insert(map[string]string{"Nombre completo": "Nueva"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	insert := lastEntry(t, j)
+	if err := c.revert(insert); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Get(ids[0]); err != errRecordNotFound {
+		t.Errorf("la persona agregada sigue en el censo: %v", err)
+	}
+	trash, err := c.Trash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trash) != 1 || trash[0].ID != ids[0] || trash[0].Fields["Nombre completo"] != "Nueva" {
+		t.Fatalf("la papelera quedó con %+v", trash)
+	}
+	list, _ := j.Journal(JournalFilter{RecordID: ids[0], After: insert.Seq})
+	if len(list) == 0 || list[0].Op != OP_ELIMINAR || list[0].Reverts != insert.Seq {
+		t.Errorf("el deshacer quedó como %+v", list)
+	}
+}
+
+func TestRevertDeleteAndRestore(t *testing.T) {
+	c, j := newTestJournaledCensus(t, 3)
+	if err := c.Delete(DeleteInfo{By: "ana", Reason: "error"}, RecordRef{ID: "p00002"}); err != nil {
+		t.Fatal(err)
+	}
+	deleted, _ := j.Journal(JournalFilter{RecordID: "p00002"})
+	if err := c.revert(deleted[0]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Get("p00002"); err != nil {
+		t.Fatalf("p00002 no volvió al censo: %v", err)
+	}
+
+	restore := lastEntry(t, j)
+	if restore.Op != OP_RESTAURAR || restore.Reverts != deleted[0].Seq {
+		t.Fatalf("la restauración quedó como %+v", restore)
+	}
+	if err := c.revert(restore); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Get("p00002"); err != errRecordNotFound {
+		t.Errorf("p00002 sigue en el censo: %v", err)
+	}
+}
+
+func TestRevertImportRemoval(t *testing.T) {
+	c, j := newTestJournaledCensus(t, 3)
+	before, err := c.Get("p00001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// El libro importado no tiene a p00001 y le cambia la Edad a p00002
+	headers, records := testCensus(3)
+	records = []CensusRecord{records[0], records[2]}
+	records[1].Fields["Edad"] = "52"
+	var book bytes.Buffer
+	if err := writeWorkbook(&book, "Sheet1", headers, records); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.ImportWorkbook(&book); err != nil {
+		t.Fatal(err)
+	}
+
+	removed, _ := j.Journal(JournalFilter{RecordID: "p00001"})
+	if len(removed) == 0 {
+		t.Fatal("la importación no anotó a la persona quitada")
+	}
+	if err := c.revert(removed[len(removed)-1]); err != nil {
+		t.Fatal(err)
+	}
+	after, err := c.Get("p00001")
+	if err != nil {
+		t.Fatalf("p00001 no volvió al censo: %v", err)
+	}
+	if after.Version() != before.Version() {
+		t.Errorf("p00001 volvió como %+v, se esperaba %+v", after, before)
+	}
+	// Ya está otra vez en el censo: no se agrega dos veces
+	if _, ok := c.revert(removed[0]).(*ConflictError); !ok {
+		t.Error("deshacer otra vez no devolvió *ConflictError")
+	}
+
+	changed, _ := j.Journal(JournalFilter{RecordID: "p00002"})
+	if len(changed) != 1 || changed[0].Op != OP_IMPORTAR {
+		t.Fatalf("el diario de p00002 tiene %+v", changed)
+	}
+	if err := c.revert(changed[0]); err != nil {
+		t.Fatal(err)
+	}
+	if rec, _ := c.Get("p00002"); rec.Fields["Edad"] != "2" {
+		t.Errorf("p00002 quedó con Edad %q, se esperaba 2", rec.Fields["Edad"])
+	}
+}
+
+func TestRevertImportRemovalInTrash(t *testing.T) {
+	c, j := newTestJournaledCensus(t, 2)
+	headers, records := testCensus(2)
+	var book bytes.Buffer
+	if err := writeWorkbook(&book, "Sheet1", headers, records[:1]); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.ImportWorkbook(&book); err != nil {
+		t.Fatal(err)
+	}
+	removed, _ := j.Journal(JournalFilter{RecordID: "p00001"})
+	if err := c.revert(removed[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Delete(DeleteInfo{By: "ana"}, RecordRef{ID: "p00001"}); err != nil {
+		t.Fatal(err)
+	}
+	// Está en la papelera: se recupera desde allí, no deshaciendo la importación
+	if err := c.revert(removed[0]); err != errCannotRevert {
+		t.Errorf("deshacer devolvió %v, se esperaba errCannotRevert", err)
+	}
+}
+
+func TestRevertPurge(t *testing.T) {
+	c, j := newTestJournaledCensus(t, 2)
+	if err := c.Delete(DeleteInfo{By: "ana"}, RecordRef{ID: "p00000"}); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := c.Purge(time.Now().Add(time.Minute)); err != nil || n != 1 {
+		t.Fatalf("Purge devolvió %d, %v", n, err)
+	}
+	purge := lastEntry(t, j)
+	if purge.Op != OP_PURGAR || purge.RecordID != "p00000" {
+		t.Fatalf("la purga quedó como %+v", purge)
+	}
+	if err := c.revert(purge); err != errCannotRevert {
+		t.Errorf("deshacer una purga devolvió %v, se esperaba errCannotRevert", err)
+	}
+}
+
+func TestRevertJournalEntry(t *testing.T) {
+	c, j := newTestJournaledCensus(t, 2)
+	old := census
+	census = c
+	t.Cleanup(func() { census = old })
+
+	if err := c.Update(CensusRecord{ID: "p00000", Fields: map[string]string{"Edad": "9"}}); err != nil {
+		t.Fatal(err)
+	}
+	edit := lastEntry(t, j)
+	entry, err := revertJournalEntry(edit.Seq, "beto")
+	if err != nil || entry.Seq != edit.Seq {
+		t.Fatalf("revertJournalEntry devolvió %+v, %v", entry, err)
+	}
+	if undo := lastEntry(t, j); undo.Operator != "beto" || undo.Reverts != edit.Seq {
+		t.Errorf("el deshacer quedó como %+v", undo)
+	}
+	if _, err := revertJournalEntry(edit.Seq+100, "beto"); err != errRecordNotFound {
+		t.Errorf("deshacer un cambio que no existe devolvió %v, se esperaba errRecordNotFound", err)
+	}
+}
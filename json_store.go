@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+)
+
+// HistoryStore guarda el historial de cambios que muestra /historia.
+type HistoryStore interface {
+	// LoadHistory devuelve nil, sin error, si todavía no hay historial guardado.
+	LoadHistory() ([]HistoryEntry, error)
+	SaveHistory(entries []HistoryEntry) error
+}
+
+// ActivityStore guarda las actividades del calendario.
+type ActivityStore interface {
+	// LoadActivities devuelve nil, sin error, si todavía no hay actividades guardadas.
+	LoadActivities() ([]Activity, error)
+	SaveActivities(list []Activity) error
+}
+
+var historyStore HistoryStore
+var activityStore ActivityStore
+
+// JSONFileStore guarda el historial y las actividades en archivos JSON,
+// como history.json y activities.json.
+type JSONFileStore struct {
+	HistoryPath    string
+	ActivitiesPath string
+}
+
+// readJSON decodifica un archivo en v. Devuelve false si el archivo no existe.
+func readJSON(path string, v interface{}) (bool, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, json.Unmarshal(data, v)
+}
+
+func writeJSON(path string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data, 0644)
+}
+
+func (s *JSONFileStore) LoadHistory() ([]HistoryEntry, error) {
+	var entries []HistoryEntry
+	found, err := readJSON(s.HistoryPath, &entries)
+	if !found || err != nil {
+		return nil, err
+	}
+	if entries == nil {
+		entries = []HistoryEntry{}
+	}
+	return entries, nil
+}
+
+func (s *JSONFileStore) SaveHistory(entries []HistoryEntry) error {
+	return writeJSON(s.HistoryPath, entries)
+}
+
+func (s *JSONFileStore) LoadActivities() ([]Activity, error) {
+	var list []Activity
+	found, err := readJSON(s.ActivitiesPath, &list)
+	if !found || err != nil {
+		return nil, err
+	}
+	if list == nil {
+		list = []Activity{}
+	}
+	return list, nil
+}
+
+func (s *JSONFileStore) SaveActivities(list []Activity) error {
+	return writeJSON(s.ActivitiesPath, list)
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"flag"
 	"fmt"
 	"strconv"
 
@@ -18,62 +19,31 @@ import (
 	"os/exec"
 	"regexp"
 	"runtime"
+	"sync"
 	"time"
 
 	"github.com/360EntSecGroup-Skylar/excelize/v2"
 	wkhtml "github.com/SebastiaanKlippert/go-wkhtmltopdf" // Para PDF
 )
 
-// --- CONFIGURACIÓN DROPBOX ---
-const DROPBOX_TOKEN = "sl.u.AGQXLy0X9LTgzxU6MVV2JB3wrJvSF8FXOrzGxz4sw5u7uO9TGizc7QY4M705qtl_AhebScr_74iB8tulXuQF93-uPEF3T0YRWKcLnhtWJcDEjNVePyfSPtsPwiwragvPYa3j61AbASO5a1jI8gGt4iIkCcj7UDDPxxju4rEcga-WUIET1TeTc1kFBNplncc_nM9kd0K7df5Ai6bjyUhMHaNT7WTUoYVMCkQ1mCYbHu8HzDufTFoUr2yNo7ldyqyUb6HnysNaeF4LbEZ_TnK3wsuQOQ10x-18Gpn0-Ynmz08IPoVujlKus_IpKOCZiBVzpfpCzhd8iMA83sOVqMuTa0YLDqi9syOz7X5fq_wdIvhAFxzG3nnskioco6GPRlQEoYvzzUEJjtvwWa8iDX5jyUgIA89dMSTBTXKUcp9ia4h8NaDVWGFtMaVR2YJpLzsKRNy0bqiFcUI8ej_ITuaQPNJeQ5KRx67kSDrWXNfTYJHMl5_wX8Lofs0C0Twm_8RVuVlsycDy31eUEqJILapEE8QuZuuHMp5utustEtkrwYZR7T-9m--OcPv2C4Laq4ZBZn0cPxvzQJqxBXHUtAATugGktcok3E5fiq_swdnVAY-cnzFCVIV-OAaFVKmCxkzSR1VdkiBfYGsswEks4xK9TxXz3QEZYKUzNKEMtJNwsFqWoAhwg4SNf5fCAEBeYL8Vhwxd-aYE_FEuWpWi3BrBQNeFR5qV59nuhQTkSNRQCZAq_YSc7GMWCbMUBdIDAF0-W_AtpJfpbVj42GLQGvuDfwZX-5JUSM-KAZKQNBQScCHxcyWFT8ZQYlh_G_UbuzAbO40Ced6bO3zitdcBf_r8CsHQEfzKbj-d3kT1iAb3V9nwF536VXKRKd2CqfiAx6d4egK365goqDaomFoXmgnApkfHzufQ2jdpFmu2Bvvy2EqRzqZLaeOfuGyVnGDaa12sK-99o-dqD2VR0seRC0PYJYYwaZRs3ZSuL9YLrc7ej5fb-AAf38L7IbH8rr3J-lRqWL_jwXW8MQr0UMMnVp2tBXf6rhQpV362TGtziTb-chSX9ZW_Rbjg_Y5d9wcTxrdDjjIlvyo_jVnO5BK9bQ9qEySohxB9hlweJL8XoDJLOPrDGjJBoF83EeyEOymeMZbrrb2JuhuRHGj9tjOusZW7j8WVKFwlDPiXRd0S7Yni4lRZn9nKS20yHfpxZZ2bPyYLrwN6YZt1rRSvDQTQwHSw2v9eMUVXnGAKDRlT2elm7odUzIhY7G5nXq7BrA93suJDHzohKgdRfw5N-3I_1CEELg_kLyrRA_tsGZO4xhRx9EqIZpysrwEPMSvOqhdqwcKIo1oSq8Y9vEXSNQCPMvHZFpuh6hWi1B853Wd1mqVdQkl2IiF8Kv2AC-CBM3cjP9hgPWpred3-Rgxx9dqpQznMAa2qooBQJhUze0_aPJfc_cHpyTF2DYF0ifIZoVqFes2UiCw" // El token que generaste en Dropbox Developers
-const DROPBOX_FILE_PATH = "/CENSO GENERAL NUEVO.xlsx"                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                                            // Ruta dentro de Dropbox
-// -----------------------------
+// Excel. Son los valores por defecto; se pueden cambiar en la configuración
+// (ver config.go).
+var EXCEL_FILE = "CENSO GENERAL NUEVO.xlsx"
+var PRIMERA_HOJA = "CENSO"
 
-// Variables globales nuevas
-const APP_KEY = "grsa7fthagyjn16"
-const APP_SECRET = "7e6br5qqqpcjp20"
-const REFRESH_TOKEN = "c9JQ3nw0Y5kAAAAAAAAAAaMoWRgVmdL-DkQhxj14D2ElvsCzUQSaZ6eKlrCdd613"
+var HISTORY_FILE = "history.json"
+var ACTIVITIES_FILE = "activities.json"
 
-// Función para obtener un token de acceso válido usando el Refresh Token
-func obtenerAccessToken() (string, error) {
-	url := "https://api.dropbox.com/oauth2/token"
-	data := "grant_type=refresh_token&refresh_token=" + REFRESH_TOKEN
-
-	req, _ := http.NewRequest("POST", url, strings.NewReader(data))
-	req.SetBasicAuth(APP_KEY, APP_SECRET)
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return "", err
-	}
-	defer resp.Body.Close()
-
-	var result map[string]interface{}
-	json.NewDecoder(resp.Body).Decode(&result)
-
-	return result["access_token"].(string), nil
-}
-
-// Excel
-const EXCEL_FILE = "CENSO GENERAL NUEVO.xlsx"
-const PRIMERA_HOJA = "CENSO"
-
-const HISTORY_FILE = "history.json"
-const ACTIVITIES_FILE = "activities.json"
-
-// Carga los logs desde el archivo al iniciar el programa
-func loadLogsFromFile() {
-	if _, err := os.Stat(HISTORY_FILE); os.IsNotExist(err) {
-		return // Si el archivo no existe, no hace nada
-	}
-	data, err := ioutil.ReadFile(HISTORY_FILE)
+// Carga los logs desde el almacenamiento al iniciar el programa
+func loadLogs() {
+	entries, err := historyStore.LoadHistory()
 	if err != nil {
-		fmt.Println("Error al leer el archivo de historial:", err)
+		fmt.Println("Error al leer el historial:", err)
 		return
 	}
-	json.Unmarshal(data, &historyLogs)
+	if entries != nil {
+		historyLogs = entries
+	}
 }
 
 type HistoryEntry struct {
@@ -82,32 +52,36 @@ type HistoryEntry struct {
 	Timestamp   time.Time `json:"timestamp"`
 }
 
-// Guarda los logs en el archivo cada vez que hay un cambio
-func saveLogsToFile() {
-	data, err := json.MarshalIndent(historyLogs, "", "  ")
-	if err != nil {
-		fmt.Println("Error al codificar el historial:", err)
-		return
-	}
-	err = ioutil.WriteFile(HISTORY_FILE, data, 0644)
-	if err != nil {
-		fmt.Println("Error al escribir el archivo de historial:", err)
+// Guarda los logs cada vez que hay un cambio
+func saveLogs() {
+	if err := historyStore.SaveHistory(historyLogs); err != nil {
+		fmt.Println("Error al guardar el historial:", err)
 	}
 }
 
 var historyLogs []HistoryEntry
 
+// OPERADOR es el usuario que queda en el historial y en la papelera cuando
+// el frontend no manda otro.
+const OPERADOR = "Operador Dropbox"
+
+// historyMu protege historyLogs: varios handlers agregan entradas a la vez.
+var historyMu sync.Mutex
+
 func addLog(description string) {
 	entry := HistoryEntry{
-		User:        "Operador Dropbox",
+		User:        OPERADOR,
 		Description: description,
 		Timestamp:   time.Now(),
 	}
+	historyMu.Lock()
+	defer historyMu.Unlock()
+
 	// Agregamos al inicio del slice
 	historyLogs = append([]HistoryEntry{entry}, historyLogs...)
 
 	// GUARDAR EN DISCO
-	saveLogsToFile()
+	saveLogs()
 }
 
 // --- INICIO DE LA MODIFICACIÓN ---
@@ -179,8 +153,13 @@ func deleteRowHandler(w http.ResponseWriter, r *http.Request) {
 	fmt.Println("--- LOG: Endpoint /api/delete-row invocado. ---")
 
 	var req struct {
-		// El frontend enviará el número de fila en el JSON
-		Row int `json:"__row"`
+		// El frontend envía el ID fijo de la persona, no el número de fila,
+		// y la versión que tenía en pantalla
+		ID      string `json:"__id"`
+		Version string `json:"__version"`
+		// Opcionales: quién la borra y por qué, para la papelera
+		Usuario string `json:"usuario"`
+		Motivo  string `json:"motivo"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -189,34 +168,388 @@ func deleteRowHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	fmt.Printf("--- LOG: Solicitud para eliminar la fila número: %d ---\n", req.Row)
+	if req.Version == "" {
+		http.Error(w, "Falta la versión (__version) de la persona a eliminar", http.StatusPreconditionRequired)
+		return
+	}
+
+	fmt.Printf("--- LOG: Solicitud para eliminar a la persona con ID: %s ---\n", req.ID)
+
+	// El nombre es solo para el historial; si falla, Delete da el error
+	rec, _ := census.Get(req.ID)
+	if req.Usuario == "" {
+		req.Usuario = OPERADOR
+	}
+	info := DeleteInfo{By: req.Usuario, Reason: req.Motivo}
+	if err := census.Delete(info, RecordRef{ID: req.ID, IfVersion: req.Version}); err != nil {
+		fmt.Printf("--- ERROR: No se pudo eliminar a la persona %s: %v ---\n", req.ID, err)
+		if conflict, ok := err.(*ConflictError); ok {
+			writeConflict(w, conflict)
+			return
+		}
+		if err == errRecordNotFound {
+			http.Error(w, "La persona no existe", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Error al remover la fila", http.StatusInternalServerError)
+		return
+	}
+
+	encolarSubida()
+
+	fmt.Println("--- LOG: ¡Persona enviada a la papelera y censo guardado exitosamente! ---")
+	w.WriteHeader(http.StatusOK)
+
+	addLog(fmt.Sprintf("Base de Datos: %s envió a la papelera a %s", req.Usuario, firstNonBlank(rec.Value("Nombre completo"), req.ID)))
+}
+
+func firstNonBlank(values ...string) string {
+	for _, v := range values {
+		if strings.TrimSpace(v) != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// ------------------- DIARIO DE CAMBIOS -------------------------
+// journalItem es una entrada del diario con el nombre de la persona, para mostrarla.
+type journalItem struct {
+	JournalEntry
+	Nombre string `json:"nombre"`
+}
+
+// getJournalHandler devuelve el diario de cambios, de lo más viejo a lo más
+// nuevo. ?persona=<ID> da la historia completa de una persona, ?cambio=<ID>
+// todas las entradas de un mismo guardado y ?limite=N solo las N últimas.
+func getJournalHandler(w http.ResponseWriter, r *http.Request) {
+	filter := JournalFilter{
+		RecordID: r.URL.Query().Get("persona"),
+		Change:   r.URL.Query().Get("cambio"),
+	}
+	list, err := journal.Journal(filter)
+	if err != nil {
+		fmt.Printf("--- ERROR: No se pudo leer el diario de cambios: %v ---\n", err)
+		http.Error(w, "Error al leer el diario de cambios", http.StatusInternalServerError)
+		return
+	}
+	if limite, err := strconv.Atoi(r.URL.Query().Get("limite")); err == nil && limite >= 0 && limite < len(list) {
+		list = list[len(list)-limite:]
+	}
+
+	// Nombres de las personas, estén en el censo o en la papelera
+	nombres := make(map[string]string)
+	if records, err := census.List(); err == nil {
+		for _, rec := range records {
+			nombres[rec.ID] = rec.Value("Nombre completo")
+		}
+	}
+	if trash, err := census.Trash(); err == nil {
+		for _, rec := range trash {
+			nombres[rec.ID] = rec.Value("Nombre completo")
+		}
+	}
+	items := make([]journalItem, len(list))
+	for i, e := range list {
+		items[i] = journalItem{JournalEntry: e, Nombre: nombres[e.RecordID]}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(items)
+}
+
+// revertJournalHandler deshace una entrada del diario: {"seq": N}. Si la
+// persona cambió desde entonces responde 409 con sus valores actuales.
+func revertJournalHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Método no permitido", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		Seq     int64  `json:"seq"`
+		Usuario string `json:"usuario"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Seq <= 0 {
+		http.Error(w, "Payload inválido", http.StatusBadRequest)
+		return
+	}
+	if req.Usuario == "" {
+		req.Usuario = OPERADOR
+	}
+
+	fmt.Printf("--- LOG: Deshaciendo el cambio #%d ---\n", req.Seq)
+	entry, err := revertJournalEntry(req.Seq, req.Usuario)
+	if err != nil {
+		fmt.Printf("--- ERROR: No se pudo deshacer el cambio #%d: %v ---\n", req.Seq, err)
+		if conflict, ok := err.(*ConflictError); ok {
+			writeConflict(w, conflict)
+			return
+		}
+		switch err {
+		case errRecordNotFound:
+			http.Error(w, "El cambio o la persona ya no existen", http.StatusNotFound)
+		case errCannotRevert:
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		default:
+			http.Error(w, "Error al deshacer el cambio", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	encolarSubida()
+
+	detalle := entry.Op
+	if entry.Field != "" {
+		detalle += " " + entry.Field
+	}
+	addLog(fmt.Sprintf("Historial: %s deshizo el cambio #%d (%s)", req.Usuario, entry.Seq, detalle))
+	w.WriteHeader(http.StatusOK)
+}
+
+// ------------------- ESTADO DE LA SINCRONIZACIÓN -------------------------
+// getSyncStatusHandler devuelve la última bajada y subida, los cambios que
+// faltan por subir y el último error.
+func getSyncStatusHandler(w http.ResponseWriter, r *http.Request) {
+	status, err := currentSyncStatus()
+	if err != nil {
+		http.Error(w, "Error al leer el estado de la sincronización", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// pullSyncHandler pide una bajada ahora. No espera a que termine: el
+// resultado se ve en /api/sync/status.
+func pullSyncHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Método no permitido", http.StatusMethodNotAllowed)
+		return
+	}
+	descargarAhora()
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// retrySyncHandler reintenta la subida sin esperar a que pase la espera.
+func retrySyncHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Método no permitido", http.StatusMethodNotAllowed)
+		return
+	}
+	reintentarSubida()
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// ------------------- CONFLICTOS DE SINCRONIZACIÓN -------------------------
+// getSyncConflictsHandler devuelve los cambios que no se pudieron combinar
+// solos al sincronizar con otra computadora.
+func getSyncConflictsHandler(w http.ResponseWriter, r *http.Request) {
+	list, err := syncConflicts()
+	if err != nil {
+		http.Error(w, "Error al leer los conflictos", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// resolveSyncConflictHandler recibe {"seq": N, "usar": "local"|"remoto"}.
+func resolveSyncConflictHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Método no permitido", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		Seq     int    `json:"seq"`
+		Usar    string `json:"usar"`
+		Usuario string `json:"usuario"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Seq <= 0 || (req.Usar != "local" && req.Usar != "remoto") {
+		http.Error(w, "Payload inválido", http.StatusBadRequest)
+		return
+	}
+	if req.Usuario == "" {
+		req.Usuario = OPERADOR
+	}
+
+	changed, err := resolveSyncConflict(req.Seq, req.Usar, req.Usuario)
+	if err != nil {
+		fmt.Printf("--- ERROR: No se pudo resolver el conflicto #%d: %v ---\n", req.Seq, err)
+		if conflict, ok := err.(*ConflictError); ok {
+			writeConflict(w, conflict)
+			return
+		}
+		if err == errConflictNotFound {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Error al resolver el conflicto", http.StatusInternalServerError)
+		return
+	}
+	if changed {
+		encolarSubida()
+	}
+	addLog(fmt.Sprintf("Sincronización: %s resolvió el conflicto #%d usando la versión %s", req.Usuario, req.Seq, req.Usar))
+	w.WriteHeader(http.StatusOK)
+}
+
+// ------------------- DIFERENCIAS -------------------------
+// diffHandler compara el censo actual con otra versión sin cambiar nada.
+// GET ?copia=<nombre> compara con una copia de seguridad; POST con un libro en
+// "excelFile" compara con ese libro antes de subirlo. ?clave=id|cedula elige
+// cómo emparejar a las personas; por defecto se usa el ID, o la cédula si la
+// otra versión no tiene IDs.
+func diffHandler(w http.ResponseWriter, r *http.Request) {
+	var otherHeaders []string
+	var other []CensusRecord
+	var err error
+	switch r.Method {
+	case http.MethodGet:
+		nombre := r.URL.Query().Get("copia")
+		otherHeaders, other, err = backups.ReadBackup(nombre)
+		if err == errBackupNotFound {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+	case http.MethodPost:
+		if err := r.ParseMultipartForm(10 << 20); err != nil {
+			http.Error(w, "Error en formulario", http.StatusBadRequest)
+			return
+		}
+		file, _, ferr := r.FormFile("excelFile")
+		if ferr != nil {
+			http.Error(w, "Archivo no encontrado", http.StatusBadRequest)
+			return
+		}
+		defer file.Close()
+		otherHeaders, other, err = readWorkbook(file, PRIMERA_HOJA)
+	default:
+		http.Error(w, "Método no permitido", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		http.Error(w, "No se pudo leer la otra versión: "+err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	f, err := excelize.OpenFile(EXCEL_FILE)
+	headers, err := census.Headers()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	current, err := census.List()
 	if err != nil {
-		fmt.Printf("--- ERROR: No se pudo abrir el archivo Excel: %v ---\n", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	// Usamos la función de la librería excelize para remover la fila
-	if err := f.RemoveRow(PRIMERA_HOJA, req.Row); err != nil {
-		fmt.Printf("--- ERROR: No se pudo remover la fila %d del sheet: %v ---\n", req.Row, err)
-		http.Error(w, "Error al remover la fila", http.StatusInternalServerError)
+	byCedula := r.FormValue("clave") == "cedula"
+	if r.FormValue("clave") == "" {
+		byCedula = true
+		for _, rec := range other {
+			if rec.ID != "" {
+				byCedula = false
+				break
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(diffCensus(headers, current, otherHeaders, other, byCedula))
+}
+
+// ------------------- PAPELERA -------------------------
+// papeleraDias es la antigüedad por defecto que borra /api/papelera/purge (flag -papelera-dias).
+var papeleraDias = 30
+
+// getTrashHandler devuelve la papelera: los campos de cada persona más quién
+// la borró, cuándo y por qué.
+func getTrashHandler(w http.ResponseWriter, r *http.Request) {
+	list, err := census.Trash()
+	if err != nil {
+		fmt.Printf("--- ERROR: No se pudo leer la papelera: %v ---\n", err)
+		http.Error(w, "Error al leer la papelera", http.StatusInternalServerError)
 		return
 	}
+	data := make([]map[string]string, len(list))
+	for i, rec := range list {
+		data[i] = recordJSON(rec.CensusRecord)
+		data[i]["__eliminado_por"] = rec.DeletedBy
+		data[i]["__eliminado_en"] = rec.DeletedAt.Format(time.RFC3339)
+		data[i]["__motivo"] = rec.Reason
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(data)
+}
 
-	fmt.Printf("--- LOG: Fila %d removida del sheet en memoria. Guardando archivo... ---\n", req.Row)
+// restoreTrashHandler devuelve personas de la papelera al censo: {"ids": ["..."]}.
+func restoreTrashHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Método no permitido", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		IDs []string `json:"ids"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.IDs) == 0 {
+		http.Error(w, "Payload inválido", http.StatusBadRequest)
+		return
+	}
 
-	if err := f.Save(); err != nil {
-		fmt.Printf("--- ERROR: No se pudo guardar el archivo Excel tras la eliminación: %v ---\n", err)
-		http.Error(w, "No se guardó el Excel", http.StatusInternalServerError)
+	if err := census.Restore(req.IDs...); err != nil {
+		fmt.Printf("--- ERROR: No se pudo restaurar de la papelera: %v ---\n", err)
+		if err == errRecordNotFound {
+			http.Error(w, "Alguna de las personas no está en la papelera", http.StatusNotFound)
+			return
+		}
+		if err == errDuplicateID {
+			http.Error(w, "Alguna de las personas ya está en el censo con el mismo ID", http.StatusConflict)
+			return
+		}
+		http.Error(w, "Error al restaurar", http.StatusInternalServerError)
 		return
 	}
 
-	fmt.Println("--- LOG: ¡Archivo Excel guardado exitosamente! ---")
+	encolarSubida()
+
+	addLog(fmt.Sprintf("Papelera: Se restauraron %d persona(s) al censo", len(uniqueIDs(req.IDs))))
 	w.WriteHeader(http.StatusOK)
+}
+
+// purgeTrashHandler borra para siempre lo que lleva en la papelera más de
+// "dias" días (por defecto, los del flag -papelera-dias).
+func purgeTrashHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Método no permitido", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		Dias *int `json:"dias"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		http.Error(w, "Payload inválido", http.StatusBadRequest)
+		return
+	}
+	dias := papeleraDias
+	if req.Dias != nil {
+		dias = *req.Dias
+	}
+	if dias < 0 {
+		http.Error(w, "Los días no pueden ser negativos", http.StatusBadRequest)
+		return
+	}
 
-	addLog("Base de Datos: Se eliminó una fila")
+	n, err := census.Purge(time.Now().AddDate(0, 0, -dias))
+	if err != nil {
+		fmt.Printf("--- ERROR: No se pudo vaciar la papelera: %v ---\n", err)
+		http.Error(w, "Error al vaciar la papelera", http.StatusInternalServerError)
+		return
+	}
+	if n > 0 {
+		encolarSubida()
+		addLog(fmt.Sprintf("Papelera: Se borraron para siempre %d persona(s) con más de %d días en la papelera", n, dias))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"borrados": n})
 }
 
 func normalizeHeader(header string) string {
@@ -243,54 +576,52 @@ func bulkImportHandler(w http.ResponseWriter, r *http.Request) {
 
 	fmt.Printf("--- LOG: Recibidas %d personas para importar.\n", len(req.Datos))
 
-	f, err := excelize.OpenFile(EXCEL_FILE)
+	headers, err := census.Headers()
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	rows, _ := f.GetRows(PRIMERA_HOJA)
-	headers := rows[0]
-	nextRow := len(rows) + 1
-
 	// --- LÓGICA DE MAPEO INTELIGENTE ---
 	// Crear un mapa donde la clave es el nombre de la cabecera NORMALIZADO
-	// y el valor es el índice de la columna original.
-	normalizedHeaderMap := make(map[string]int)
+	// y el valor es la cabecera limpia del censo.
+	normalizedHeaderMap := make(map[string]string)
 	for i, h := range headers {
 		normalized := normalizeHeader(h)
-		normalizedHeaderMap[normalized] = i
+		normalizedHeaderMap[normalized] = h
 		fmt.Printf("--- LOG (Mapeo Censo): '%s' -> '%s' en índice %d\n", h, normalized, i)
 	}
 
-	fmt.Println("--- LOG: Iniciando proceso de escritura en el Excel... ---")
+	fmt.Println("--- LOG: Iniciando proceso de escritura en el censo... ---")
+	nuevos := make([]map[string]string, 0, len(req.Datos))
 	for _, persona := range req.Datos {
+		fields := make(map[string]string)
 		for keyFromImport, val := range persona {
 			// Normalizar la clave del archivo importado
 			normalizedKeyFromImport := normalizeHeader(keyFromImport)
 
 			// Buscar la columna correspondiente en nuestro mapa normalizado
-			if colIndex, ok := normalizedHeaderMap[normalizedKeyFromImport]; ok {
-				// Se encontró una coincidencia, escribir en la celda correcta
-				cell, _ := excelize.CoordinatesToCellName(colIndex+1, nextRow)
-				f.SetCellValue(PRIMERA_HOJA, cell, val)
+			if header, ok := normalizedHeaderMap[normalizedKeyFromImport]; ok {
+				fields[header] = val
 			} else {
 				fmt.Printf("--- AVISO: La columna importada '%s' (normalizada a '%s') no se encontró en el censo principal y será ignorada.\n", keyFromImport, normalizedKeyFromImport)
 			}
 		}
-		nextRow++
+		nuevos = append(nuevos, fields)
 	}
 
-	if err := f.Save(); err != nil {
-		fmt.Printf("--- ERROR: No se pudo guardar el archivo Excel: %v ---\n", err)
+	if _, err := census.Insert(nuevos...); err != nil {
+		fmt.Printf("--- ERROR: No se pudo guardar el censo: %v ---\n", err)
 		http.Error(w, "No se guardó el Excel", http.StatusInternalServerError)
 		return
 	}
 
+	encolarSubida()
+
 	fmt.Println("--- LOG: ¡Importación en bloque completada y archivo guardado! ---")
 	w.WriteHeader(http.StatusOK)
 
-	addLog("Base de Datos: Importación de datos realizada")
+	addLog(fmt.Sprintf("Base de Datos: Importación de datos realizada (%d persona(s))", len(nuevos)))
 }
 
 // checkCedulasHandler (con logs detallados) recibe una lista de cédulas y devuelve las que ya existen.
@@ -305,35 +636,16 @@ func checkCedulasHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	fmt.Printf("--- LOG (check-cedulas): Recibidas %d Cédulas para verificar.\n", len(req.Cedulas))
 
-	f, err := excelize.OpenFile(EXCEL_FILE)
+	records, err := census.List()
 	if err != nil {
 		http.Error(w, "No se pudo abrir el Excel", http.StatusInternalServerError)
 		return
 	}
-	rows, _ := f.GetRows(PRIMERA_HOJA)
-
-	cedulaHeaderNormalized := normalizeHeader("Cedula de identidad")
-	cedulaColIndex := -1
-	for i, h := range rows[0] {
-		if normalizeHeader(h) == cedulaHeaderNormalized {
-			cedulaColIndex = i
-			break
-		}
-	}
-	if cedulaColIndex == -1 {
-		fmt.Println("--- ERROR (check-cedulas): No se encontró la columna 'Cedula de identidad' en el archivo principal.")
-		http.Error(w, "No se encontró la columna de Cedula", http.StatusInternalServerError)
-		return
-	}
-	fmt.Printf("--- LOG (check-cedulas): Columna 'Cedula de identidad' encontrada en el índice %d.\n", cedulaColIndex)
 
 	existingCedulas := make(map[string]bool)
-	for i, row := range rows {
-		if i == 0 {
-			continue
-		}
-		if cedulaColIndex < len(row) {
-			existingCedulas[row[cedulaColIndex]] = true
+	for _, rec := range records {
+		if cedula := rec.Value(CEDULA_HEADER); cedula != "" {
+			existingCedulas[cedula] = true
 		}
 	}
 	fmt.Printf("--- LOG (check-cedulas): Se construyó un set con %d Cédulas existentes del archivo principal.\n", len(existingCedulas))
@@ -356,52 +668,24 @@ func getPersonByCedulaHandler(w http.ResponseWriter, r *http.Request) {
 	cedulaToFind := r.URL.Query().Get("cedula")
 	fmt.Printf("--- LOG (get-person): Endpoint invocado para buscar la cédula: %s ---\n", cedulaToFind)
 
-	f, err := excelize.OpenFile(EXCEL_FILE)
-	if err != nil {
-		http.Error(w, "No se pudo abrir el Excel", http.StatusInternalServerError)
-		return
-	}
-	rows, _ := f.GetRows(PRIMERA_HOJA)
-	headers := rows[0]
-
-	cedulaHeaderNormalized := normalizeHeader("Cedula de identidad")
-	cedulaColIndex := -1
-	for i, h := range headers {
-		if normalizeHeader(h) == cedulaHeaderNormalized {
-			cedulaColIndex = i
-			break
-		}
-	}
-	if cedulaColIndex == -1 {
-		fmt.Println("--- ERROR (get-person): No se encontró la columna 'Cedula de identidad'.")
-		http.Error(w, "No se encontró la columna de Cedula", http.StatusInternalServerError)
-		return
-	}
-
-	var personData map[string]string
 	fmt.Printf("--- LOG (get-person): Buscando en el archivo principal...\n")
-	for i, row := range rows[1:] {
-		if cedulaColIndex < len(row) && row[cedulaColIndex] == cedulaToFind {
-			fmt.Printf("--- LOG (get-person): ¡Coincidencia encontrada en la fila %d del Excel!\n", i+2)
-			personData = make(map[string]string)
-			for j, header := range headers {
-				if j < len(row) {
-					personData[header] = row[j]
-				}
-			}
-			break
-		}
-	}
-
-	if personData == nil {
+	rec, err := census.FindByCedula(cedulaToFind)
+	if err == errRecordNotFound {
 		fmt.Println("--- LOG (get-person): Persona no encontrada. Enviando respuesta 404 Not Found.")
 		http.NotFound(w, r)
 		return
 	}
+	if err != nil {
+		fmt.Printf("--- ERROR (get-person): %v\n", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fmt.Printf("--- LOG (get-person): ¡Coincidencia encontrada en el registro %s!\n", rec.ID)
 
 	fmt.Println("--- LOG (get-person): Enviando datos de la persona encontrada al frontend.")
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(personData)
+	w.Header().Set("ETag", `"`+rec.Version()+`"`)
+	json.NewEncoder(w).Encode(rec.Fields)
 }
 
 // Estructuras para las respuestas JSON
@@ -418,151 +702,94 @@ type DTResponse struct {
 	Data            []map[string]string `json:"data"`
 }
 
+// recordJSON arma la fila que recibe el frontend: los campos más el "__id" y
+// la "__version", que el frontend devuelve al guardar o borrar.
+func recordJSON(rec CensusRecord) map[string]string {
+	out := make(map[string]string, len(rec.Fields)+2)
+	for key, val := range rec.Fields {
+		out[key] = val
+	}
+	out["__id"] = rec.ID
+	out["__version"] = rec.Version()
+	return out
+}
+
+// writeConflict responde 409 con los valores actuales de las personas que
+// otro usuario cambió, para que el frontend muestre qué pasó.
+func writeConflict(w http.ResponseWriter, conflict *ConflictError) {
+	actuales := make([]map[string]string, len(conflict.Current))
+	for i, rec := range conflict.Current {
+		actuales[i] = recordJSON(rec)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusConflict)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error":    "Otro usuario modificó estos registros después de que los abriste",
+		"actuales": actuales,
+	})
+}
+
 // Obtiene las columnas del Excel y las devuelve como JSON
 func getColumns(w http.ResponseWriter, r *http.Request) {
-	f, err := excelize.OpenFile(EXCEL_FILE)
+	// El almacenamiento ya devuelve las cabeceras limpias de espacios
+	headers, err := census.Headers()
 	if err != nil {
 		http.Error(w, "no se pudo abrir el Excel", 500)
 		return
 	}
 
-	// Leer solo la primera fila del sheet PRIMERA_HOJA
-	row, err := f.GetRows(PRIMERA_HOJA)
-	if err != nil || len(row) == 0 {
-		http.Error(w, "sheet vacío o no existe", 500)
-		return
-	}
-
-	headers := row[0]
-
-	// Limpiar espacios de las cabeceras antes de enviarlas al frontend
-	cleanHeaders := make([]string, len(headers))
-	for i, h := range headers {
-		cleanHeaders[i] = strings.TrimSpace(h)
-	}
-
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(cleanHeaders) // Enviar las cabeceras limpias
+	json.NewEncoder(w).Encode(headers)
 }
 
 // Leer datos del Excel y paginarlos para DataTables (FUNCIÓN CORREGIDA)
 func getData(w http.ResponseWriter, r *http.Request) {
-	// Descargar antes de abrir el Excel para lectura
-	descargarDeDropbox()
-
-	f, err := excelize.OpenFile(EXCEL_FILE)
-
-	// Filtro global
-	search := strings.ToLower(r.URL.Query().Get("search[value]"))
-
 	// Paginación
 	start, _ := strconv.Atoi(r.URL.Query().Get("start"))
 	length, _ := strconv.Atoi(r.URL.Query().Get("length"))
 	draw, _ := strconv.Atoi(r.URL.Query().Get("draw"))
 
-	// Leer los parámetros de filtro de columna
-	filterColumnName := r.URL.Query().Get("filterColumn") // Ya viene limpio del frontend
-	filterValue := strings.ToLower(r.URL.Query().Get("filterValue"))
-
+	headers, err := census.Headers()
 	if err != nil {
 		http.Error(w, "no se pudo abrir el Excel", 500)
 		return
 	}
 
-	// Leer todas las filas de la hoja
-	rows, err := f.GetRows(PRIMERA_HOJA)
-	if err != nil || len(rows) == 0 {
-		http.Error(w, "error leyendo filas", 500)
+	// Buscador, filtros de columna y consulta (ver census_filter.go)
+	filter, err := censusFilterFromRequest(r, headers)
+	if err != nil {
+		http.Error(w, "Filtro inválido: "+err.Error(), http.StatusBadRequest)
 		return
 	}
-
-	// Leer cabecera para los keys
-	keys := rows[0]
-
-	// Encontrar el índice de la columna que queremos filtrar
-	filterColumnIndex := -1
-	if filterColumnName != "" {
-		for i, key := range keys {
-			// Comparar la cabecera limpia (TrimSpace) con el nombre que viene del frontend
-			if strings.TrimSpace(key) == filterColumnName {
-				filterColumnIndex = i
-				break
-			}
-		}
-	}
-
-	type IndexedRow struct {
-		Index int      // índice real en el Excel
-		Cells []string // contenido de la fila
+	// Orden de las columnas de la tabla (ver census_sort.go)
+	order, err := censusSortFromRequest(r, headers)
+	if err != nil {
+		http.Error(w, "Orden inválido: "+err.Error(), http.StatusBadRequest)
+		return
 	}
 
-	filtered := make([]IndexedRow, 0)
-	for i := 1; i < len(rows); i++ {
-		row := rows[i]
-
-		// 1. Comprobación del filtro global (search[value])
-		globalMatch := false
-		if search == "" {
-			globalMatch = true
-		} else {
-			for _, cell := range row {
-				if strings.Contains(strings.ToLower(cell), search) {
-					globalMatch = true
-					break
-				}
-			}
-		}
-
-		// 2. Comprobación del filtro por columna (filterColumn / filterValue)
-		columnMatch := false
-		if filterValue == "" || filterColumnIndex == -1 {
-			columnMatch = true // Si no hay filtro de columna, todas las filas coinciden
-		} else if filterColumnIndex < len(row) {
-
-			// --- INICIO DE LA CORRECCIÓN ---
-			cellValue := strings.ToLower(strings.TrimSpace(row[filterColumnIndex]))
-
-			// Decidir si usar "Contains" o "Exact Match"
-			// 'filterColumnName' es el nombre limpio de la columna (ej: "Nombre completo")
-			if containsSearchColumns[filterColumnName] {
-				// Usar "Contains" para esta columna
-				if strings.Contains(cellValue, filterValue) {
-					columnMatch = true
-				}
-			} else {
-				// Usar "Exact Match" para esta columna
-				if cellValue == filterValue {
-					columnMatch = true
-				}
-			}
-			// --- FIN DE LA CORRECCIÓN ---
-		}
-
-		// 3. Decisión final: La fila debe coincidir con AMBOS filtros
-		if globalMatch && columnMatch {
-			filtered = append(filtered, IndexedRow{Index: i + 1, Cells: row}) // +1 porque Excel empieza en 1
-		}
+	// Leer todas las personas del censo
+	records, err := census.List()
+	if err != nil {
+		http.Error(w, "error leyendo filas", 500)
+		return
 	}
+	filtered := filter.Apply(records)
+	sortCensus(filtered, order)
 
 	data := make([]map[string]string, 0, length)
 	for i := start; i < len(filtered) && len(data) < length; i++ {
-		row := filtered[i]
-		rec := map[string]string{}
-		rec["__row"] = strconv.Itoa(row.Index)
-
-		for j, key := range keys {
-			val := ""
-			if j < len(row.Cells) {
-				val = row.Cells[j]
-			}
-			rec[strings.TrimSpace(key)] = val // Usar la cabecera limpia como clave
+		row := recordJSON(filtered[i])
+		if filter.Ranked() {
+			// Cuánto se parece a lo buscado, de 0 a 1 (ver census_search.go)
+			row["__score"] = strconv.FormatFloat(filter.Score(filtered[i]), 'f', 2, 64)
 		}
-		data = append(data, rec)
+		data = append(data, row)
 	}
 
 	resp := DTResponse{
 		Draw:            draw,
-		RecordsTotal:    len(rows) - 1,
+		RecordsTotal:    len(records),
 		RecordsFiltered: len(filtered),
 		Data:            data,
 	}
@@ -578,12 +805,12 @@ type UpdateRequest struct {
 
 // updateExcelData
 func updateExcelData(w http.ResponseWriter, r *http.Request) {
-	descargarDeDropbox()
-
 	fmt.Println("--- LOG: Endpoint /api/update-excel invocado. ---")
 
 	var req struct {
 		Datos []map[string]string `json:"datos"`
+		// Opcional: a nombre de quién queda el cambio en el diario
+		Usuario string `json:"usuario"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		fmt.Printf("--- ERROR: No se pudo decodificar el payload JSON: %v ---\n", err)
@@ -592,55 +819,47 @@ func updateExcelData(w http.ResponseWriter, r *http.Request) {
 	}
 
 	fmt.Printf("--- LOG: Payload recibido del frontend: %+v\n", req.Datos)
+	store := censusAs(req.Usuario)
 
-	f, err := excelize.OpenFile(EXCEL_FILE)
-	if err != nil {
-		fmt.Printf("--- ERROR: No se pudo abrir el archivo Excel: %v ---\n", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	rows, _ := f.GetRows(PRIMERA_HOJA)
-	headers := rows[0]
-	nextAvailableRow := len(rows) + 1
-
+	var nuevos []map[string]string
+	var existentes []CensusRecord
 	for _, fila := range req.Datos {
-		rowNumStr := fila["__row"]
-		rowNum, err := strconv.Atoi(rowNumStr)
-
-		if err != nil {
-			fmt.Printf("--- LOG: Detectada nueva persona. Se agregará en la fila %d\n", nextAvailableRow)
-			for colIndex, key := range headers {
-				cleanKey := strings.TrimSpace(key)
-				if val, ok := fila[cleanKey]; ok {
-					cell, _ := excelize.CoordinatesToCellName(colIndex+1, nextAvailableRow)
-					fmt.Printf("    -> Escribiendo en celda %s: '%s'\n", cell, val)
-					f.SetCellValue(PRIMERA_HOJA, cell, val)
-				}
-			}
-			nextAvailableRow++
+		id, version := fila["__id"], fila["__version"]
+		delete(fila, "__id")
+		delete(fila, "__version")
+		withoutRecordID(fila)
+		if id == "" {
+			fmt.Println("--- LOG: Detectada nueva persona. Se agregará al final del censo")
+			nuevos = append(nuevos, fila)
+		} else if version == "" {
+			// Sin versión no hay forma de saber si pisaríamos el cambio de otro usuario
+			http.Error(w, "Falta la versión (__version) de la persona "+id, http.StatusPreconditionRequired)
+			return
 		} else {
-			fmt.Printf("--- LOG: Detectada persona existente. Se actualizará la fila %d\n", rowNum)
-			for colIndex, key := range headers {
-				cleanKey := strings.TrimSpace(key)
-				if val, ok := fila[cleanKey]; ok {
-					cell := fmt.Sprintf("%s%d", columnLetter(colIndex), rowNum)
-					fmt.Printf("    -> Escribiendo en celda %s: '%s'\n", cell, val)
-					f.SetCellValue(PRIMERA_HOJA, cell, val)
-				}
-			}
+			fmt.Printf("--- LOG: Detectada persona existente. Se actualizará el ID %s\n", id)
+			existentes = append(existentes, CensusRecord{ID: id, Fields: fila, IfVersion: version})
 		}
 	}
 
-	fmt.Println("--- LOG: Intentando guardar los cambios en el archivo Excel... ---")
-	if err := f.Save(); err != nil {
-		fmt.Printf("--- ERROR: No se pudo guardar el archivo Excel: %v ---\n", err)
+	fmt.Println("--- LOG: Intentando guardar los cambios en el censo... ---")
+	// Cambios y personas nuevas van en una sola escritura: si falla no queda
+	// nada a medias y el frontend puede volver a mandar todo sin duplicar
+	if _, err := store.Save(existentes, nuevos); err != nil {
+		fmt.Printf("--- ERROR: No se pudo guardar el censo: %v ---\n", err)
+		if conflict, ok := err.(*ConflictError); ok {
+			writeConflict(w, conflict)
+			return
+		}
+		if err == errRecordNotFound {
+			http.Error(w, "Una de las personas ya no existe en el censo", http.StatusNotFound)
+			return
+		}
 		http.Error(w, "no se guardó el Excel", http.StatusInternalServerError)
 		return
 	}
 
-	// 2. DESPUÉS DE GUARDAR LOCAL: Subir a Dropbox inmediatamente
-	go subirADropbox() // Usamos 'go' para que el usuario no tenga que esperar la subida
+	// 2. DESPUÉS DE GUARDAR LOCAL: Subir al almacenamiento compartido inmediatamente
+	encolarSubida() // La subida la hace la cola, así el usuario no espera a la red
 
 	fmt.Println("--- LOG: ¡Archivo Excel guardado exitosamente! ---")
 	w.WriteHeader(http.StatusOK)
@@ -650,76 +869,30 @@ func updateExcelData(w http.ResponseWriter, r *http.Request) {
 
 // exportToExcel (FUNCIÓN CORREGIDA)
 func exportToExcel(w http.ResponseWriter, r *http.Request) {
-	search := strings.ToLower(r.URL.Query().Get("search[value]"))
-	filterColumnName := r.URL.Query().Get("filterColumn")
-	filterValue := strings.ToLower(r.URL.Query().Get("filterValue"))
-
-	f, err := excelize.OpenFile(EXCEL_FILE)
+	headers, err := census.Headers()
 	if err != nil {
 		http.Error(w, "no se pudo abrir el Excel", 500)
 		return
 	}
 
-	rows, err := f.GetRows(PRIMERA_HOJA)
-	if err != nil || len(rows) == 0 {
-		http.Error(w, "error leyendo filas", 500)
+	filter, err := censusFilterFromRequest(r, headers)
+	if err != nil {
+		http.Error(w, "Filtro inválido: "+err.Error(), http.StatusBadRequest)
 		return
 	}
-
-	headers := rows[0]
-
-	filterColumnIndex := -1
-	if filterColumnName != "" {
-		for i, key := range headers {
-			if strings.TrimSpace(key) == filterColumnName {
-				filterColumnIndex = i
-				break
-			}
-		}
+	order, err := censusSortFromRequest(r, headers)
+	if err != nil {
+		http.Error(w, "Orden inválido: "+err.Error(), http.StatusBadRequest)
+		return
 	}
 
-	filteredRows := make([][]string, 0)
-	for i := 1; i < len(rows); i++ {
-		row := rows[i]
-
-		globalMatch := false
-		if search == "" {
-			globalMatch = true
-		} else {
-			for _, cell := range row {
-				if strings.Contains(strings.ToLower(cell), search) {
-					globalMatch = true
-					break
-				}
-			}
-		}
-
-		columnMatch := false
-		if filterValue == "" || filterColumnIndex == -1 {
-			columnMatch = true
-		} else if filterColumnIndex < len(row) {
-			// --- INICIO DE LA CORRECCIÓN ---
-			cellValue := strings.ToLower(strings.TrimSpace(row[filterColumnIndex]))
-
-			// Decidir si usar "Contains" o "Exact Match"
-			if containsSearchColumns[filterColumnName] {
-				// Usar "Contains"
-				if strings.Contains(cellValue, filterValue) {
-					columnMatch = true
-				}
-			} else {
-				// Usar "Exact Match"
-				if cellValue == filterValue {
-					columnMatch = true
-				}
-			}
-			// --- FIN DE LA CORRECCIÓN ---
-		}
-
-		if globalMatch && columnMatch {
-			filteredRows = append(filteredRows, row)
-		}
+	records, err := census.List()
+	if err != nil {
+		http.Error(w, "error leyendo filas", 500)
+		return
 	}
+	filteredRows := filter.Apply(records)
+	sortCensus(filteredRows, order)
 
 	exportFile := excelize.NewFile()
 	sheetName := "Reporte"
@@ -728,13 +901,13 @@ func exportToExcel(w http.ResponseWriter, r *http.Request) {
 
 	for colIndex, header := range headers {
 		cell := fmt.Sprintf("%s%d", columnLetter(colIndex), 1)
-		exportFile.SetCellValue(sheetName, cell, header) // Exportar con la cabecera original
+		exportFile.SetCellValue(sheetName, cell, header)
 	}
 
-	for rowIndex, rowData := range filteredRows {
-		for colIndex, cellValue := range rowData {
+	for rowIndex, rec := range filteredRows {
+		for colIndex, header := range headers {
 			cell := fmt.Sprintf("%s%d", columnLetter(colIndex), rowIndex+2)
-			exportFile.SetCellValue(sheetName, cell, cellValue)
+			exportFile.SetCellValue(sheetName, cell, rec.Fields[header])
 		}
 	}
 
@@ -748,116 +921,64 @@ func exportToExcel(w http.ResponseWriter, r *http.Request) {
 
 // exportToPDF (FUNCIÓN CORREGIDA)
 func exportToPDF(w http.ResponseWriter, r *http.Request) {
-	search := strings.ToLower(r.URL.Query().Get("search[value]"))
-	filterColumnName := r.URL.Query().Get("filterColumn")
-	filterValue := strings.ToLower(r.URL.Query().Get("filterValue"))
-
-	f, err := excelize.OpenFile(EXCEL_FILE)
+	allHeaders, err := census.Headers()
 	if err != nil {
 		http.Error(w, "no se pudo abrir el Excel", 500)
 		return
 	}
 
-	rows, err := f.GetRows(PRIMERA_HOJA)
-	if err != nil || len(rows) == 0 {
-		http.Error(w, "error leyendo filas", 500)
+	filter, err := censusFilterFromRequest(r, allHeaders)
+	if err != nil {
+		http.Error(w, "Filtro inválido: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	order, err := censusSortFromRequest(r, allHeaders)
+	if err != nil {
+		http.Error(w, "Orden inválido: "+err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	allHeaders := rows[0]
-
-	filterColumnIndex := -1
-	if filterColumnName != "" {
-		for i, key := range allHeaders {
-			if strings.TrimSpace(key) == filterColumnName {
-				filterColumnIndex = i
-				break
-			}
-		}
+	records, err := census.List()
+	if err != nil {
+		http.Error(w, "error leyendo filas", 500)
+		return
 	}
 
 	selectedColumns := []string{"Nombre completo", "Cedula de identidad", "Edad", "Genero"}
 
 	var displayHeaders []string
-	headerIndexMap := make(map[string]int)
-	for i, header := range allHeaders {
-		cleanHeader := strings.TrimSpace(header)
+	for _, header := range allHeaders {
 		for _, selectedCol := range selectedColumns {
-			if cleanHeader == selectedCol { // Comparar limpio
-				displayHeaders = append(displayHeaders, cleanHeader)
-				headerIndexMap[cleanHeader] = i
+			if header == selectedCol { // Las cabeceras ya vienen limpias
+				displayHeaders = append(displayHeaders, header)
 				break
 			}
 		}
 	}
 
-	filteredData := make([]map[string]string, 0)
-	for i := 1; i < len(rows); i++ {
-		row := rows[i]
-
-		globalMatch := false
-		if search == "" {
-			globalMatch = true
-		} else {
-			for _, cell := range row {
-				if strings.Contains(strings.ToLower(cell), search) {
-					globalMatch = true
-					break
-				}
-			}
-		}
-
-		columnMatch := false
-		if filterValue == "" || filterColumnIndex == -1 {
-			columnMatch = true
-		} else if filterColumnIndex < len(row) {
-			// --- INICIO DE LA CORRECCIÓN ---
-			cellValue := strings.ToLower(strings.TrimSpace(row[filterColumnIndex]))
-
-			// Decidir si usar "Contains" o "Exact Match"
-			if containsSearchColumns[filterColumnName] {
-				// Usar "Contains"
-				if strings.Contains(cellValue, filterValue) {
-					columnMatch = true
-				}
-			} else {
-				// Usar "Exact Match"
-				if cellValue == filterValue {
-					columnMatch = true
-				}
-			}
-			// --- FIN DE LA CORRECCIÓN ---
-		}
+	filteredRows := filter.Apply(records)
+	sortCensus(filteredRows, order)
 
-		if globalMatch && columnMatch {
-			rowData := make(map[string]string)
-			for _, header := range displayHeaders {
-				originalIndex := headerIndexMap[header]
-				val := ""
-				if originalIndex < len(row) {
-					val = row[originalIndex]
-				}
-				rowData[header] = val
-			}
-			filteredData = append(filteredData, rowData)
+	filteredData := make([]map[string]string, 0)
+	for _, rec := range filteredRows {
+		rowData := make(map[string]string)
+		for _, header := range displayHeaders {
+			rowData[header] = rec.Fields[header]
 		}
+		filteredData = append(filteredData, rowData)
 	}
 
 	// --- Generación del HTML para el PDF ---
 	data := struct {
-		Headers      []string
-		Rows         []map[string]string
-		Search       string
-		FilterColumn string
-		FilterValue  string
-		RowCount     int
+		Headers  []string
+		Rows     []map[string]string
+		Filtro   string
+		RowCount int
 	}{
-		Headers:      displayHeaders,
-		Rows:         filteredData,
-		Search:       r.URL.Query().Get("search[value]"),
-		FilterColumn: filterColumnName,
-		FilterValue:  r.URL.Query().Get("filterValue"),
-		RowCount:     len(filteredData),
+		Headers:  displayHeaders,
+		Rows:     filteredData,
+		Filtro:   filter.String(),
+		RowCount: len(filteredData),
 	}
 
 	htmlTemplate := `
@@ -879,11 +1000,8 @@ func exportToPDF(w http.ResponseWriter, r *http.Request) {
 	</head>
 	<body>
 		<h1>Reporte de Habitantes de Río Aro</h1>
-		{{if .Search}}
-		<p>Filtrado global por: "{{.Search}}"</p>
-		{{end}}
-		{{if .FilterValue}}
-		<p>Filtrado de columna "{{.FilterColumn}}" por: "{{.FilterValue}}"</p>
+		{{if .Filtro}}
+		<p>Filtrado por: {{.Filtro}}</p>
 		{{end}}
 		<h3>Cantidad de filas filtradas: {{.RowCount}}</h3>
 		<table>
@@ -977,17 +1095,21 @@ var activities = []Activity{
 }
 var lastActivityID = 2
 
-// Carga las actividades desde el archivo JSON al iniciar
-func loadActivitiesFromFile() {
-	if _, err := os.Stat(ACTIVITIES_FILE); os.IsNotExist(err) {
-		return // Si no existe, usamos el slice vacío por defecto
-	}
-	data, err := ioutil.ReadFile(ACTIVITIES_FILE)
+// activitiesMu protege activities y lastActivityID: los cambian los handlers
+// y la sincronización.
+var activitiesMu sync.Mutex
+
+// Carga las actividades desde el almacenamiento al iniciar
+func loadActivities() {
+	list, err := activityStore.LoadActivities()
 	if err != nil {
 		fmt.Println("Error al leer actividades:", err)
 		return
 	}
-	json.Unmarshal(data, &activities)
+	if list == nil {
+		return // Si no hay nada guardado, usamos las actividades por defecto
+	}
+	activities = list
 
 	// Actualizar el ID autoincremental para no repetir IDs existentes
 	for _, a := range activities {
@@ -997,22 +1119,20 @@ func loadActivitiesFromFile() {
 	}
 }
 
-// Guarda el slice de actividades en el archivo JSON
-func saveActivitiesToFile() {
-	data, err := json.MarshalIndent(activities, "", "  ")
-	if err != nil {
-		fmt.Println("Error al codificar actividades:", err)
-		return
-	}
-	err = ioutil.WriteFile(ACTIVITIES_FILE, data, 0644)
-	if err != nil {
+// Guarda el slice de actividades en el almacenamiento
+func saveActivities() {
+	if err := activityStore.SaveActivities(activities); err != nil {
 		fmt.Println("Error al guardar actividades:", err)
 	}
 }
 
 func getActivitiesHandler(w http.ResponseWriter, r *http.Request) {
-	events := make([]map[string]interface{}, 0, len(activities))
-	for _, a := range activities {
+	activitiesMu.Lock()
+	list := append([]Activity(nil), activities...)
+	activitiesMu.Unlock()
+
+	events := make([]map[string]interface{}, 0, len(list))
+	for _, a := range list {
 		event := map[string]interface{}{
 			"id":    a.ID,
 			"title": a.Title,
@@ -1074,12 +1194,15 @@ func addActivityHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	activitiesMu.Lock()
 	lastActivityID++
 	newActivity.ID = lastActivityID
 	activities = append(activities, newActivity)
+	saveActivities()
+	activitiesMu.Unlock()
 
-	saveActivitiesToFile()
 	addLog("Calendario: Se agregó la actividad " + newActivity.Title)
+	encolarSubida()
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]bool{"success": true})
@@ -1106,6 +1229,8 @@ func editActivityHandler(w http.ResponseWriter, r *http.Request) {
 	updatedActivity.Time = r.FormValue("time")
 	updatedActivity.Location = r.FormValue("location")
 
+	activitiesMu.Lock()
+	defer activitiesMu.Unlock()
 	for i, a := range activities {
 		if a.ID == id {
 			activities[i].Title = updatedActivity.Title
@@ -1143,8 +1268,9 @@ func editActivityHandler(w http.ResponseWriter, r *http.Request) {
 			break
 		}
 	}
-	saveActivitiesToFile()
+	saveActivities()
 	addLog("Calendario: Se editó una actividad")
+	encolarSubida()
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]bool{"success": true})
@@ -1158,6 +1284,8 @@ func deleteActivityHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	activitiesMu.Lock()
+	defer activitiesMu.Unlock()
 	for i, a := range activities {
 		if a.ID == id {
 			if a.Image != "" {
@@ -1170,8 +1298,9 @@ func deleteActivityHandler(w http.ResponseWriter, r *http.Request) {
 			break
 		}
 	}
-	saveActivitiesToFile()
+	saveActivities()
 	addLog("Calendario: Se eliminó una actividad")
+	encolarSubida()
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]bool{"success": true})
@@ -1179,23 +1308,34 @@ func deleteActivityHandler(w http.ResponseWriter, r *http.Request) {
 
 // Handler NUEVO para el Historial (corrige el error Unexpected token)
 func getHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	historyMu.Lock()
+	logs := historyLogs
+	historyMu.Unlock()
+
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(historyLogs)
+	json.NewEncoder(w).Encode(logs)
 }
 
-// Permite descargar el archivo físico real
+// Permite descargar el censo completo como libro de Excel
 func downloadFullExcelHandler(w http.ResponseWriter, r *http.Request) {
-	if _, err := os.Stat(EXCEL_FILE); os.IsNotExist(err) {
-		http.Error(w, "Archivo no encontrado", http.StatusNotFound)
+	// Se genera en memoria para no enviar un archivo a medias si algo falla
+	var buf bytes.Buffer
+	if err := census.ExportWorkbook(&buf); err != nil {
+		if os.IsNotExist(err) {
+			http.Error(w, "Archivo no encontrado", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "No se pudo generar el Excel: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
 	addLog("Exportación: Se descargó el archivo Excel completo")
 	w.Header().Set("Content-Disposition", "attachment; filename=\""+EXCEL_FILE+"\"")
 	w.Header().Set("Content-Type", "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet")
-	http.ServeFile(w, r, EXCEL_FILE)
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	w.Write(buf.Bytes())
 }
 
-// Reemplaza el archivo local y lo sube a Dropbox
+// Reemplaza el archivo local y lo sube al almacenamiento compartido
 func uploadFullExcelHandler(w http.ResponseWriter, r *http.Request) {
 	if err := r.ParseMultipartForm(10 << 20); err != nil {
 		http.Error(w, "Error en formulario", http.StatusBadRequest)
@@ -1209,22 +1349,59 @@ func uploadFullExcelHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	defer file.Close()
 
-	dst, err := os.Create(EXCEL_FILE)
+	if err := censusAs(r.FormValue("usuario")).ImportWorkbook(file); err != nil {
+		http.Error(w, "Error al guardar contenido: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Sincronizar inmediatamente
+	encolarSubida()
+
+	addLog("Importación: Se reemplazó la base de datos completa y se subió al almacenamiento compartido")
+	w.WriteHeader(http.StatusOK)
+}
+
+// ------------------- COPIAS DE SEGURIDAD -------------------------
+// listBackupsHandler devuelve las copias de seguridad del censo, de la más nueva a la más vieja.
+func listBackupsHandler(w http.ResponseWriter, r *http.Request) {
+	list, err := backups.Backups()
 	if err != nil {
-		http.Error(w, "Error al crear archivo local", 500)
+		fmt.Printf("--- ERROR: No se pudieron listar las copias de seguridad: %v ---\n", err)
+		http.Error(w, "Error al leer las copias de seguridad", http.StatusInternalServerError)
 		return
 	}
-	defer dst.Close()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
 
-	if _, err := io.Copy(dst, file); err != nil {
-		http.Error(w, "Error al guardar contenido", 500)
+// restoreBackupHandler reemplaza el censo con una copia: {"nombre": "guardado-..."}.
+func restoreBackupHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Método no permitido", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		Nombre string `json:"nombre"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Payload inválido", http.StatusBadRequest)
+		return
+	}
+
+	fmt.Printf("--- LOG: Restaurando la copia de seguridad %s ---\n", req.Nombre)
+	if err := backups.RestoreBackup(req.Nombre); err != nil {
+		fmt.Printf("--- ERROR: No se pudo restaurar %s: %v ---\n", req.Nombre, err)
+		if err == errBackupNotFound {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Error al restaurar: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	// Sincronizar con Dropbox inmediatamente
-	go subirADropbox()
+	encolarSubida()
 
-	addLog("Importación: Se reemplazó la base de datos completa y se subió a Dropbox")
+	addLog("Copias de seguridad: Se restauró el censo desde " + req.Nombre)
 	w.WriteHeader(http.StatusOK)
 }
 
@@ -1238,11 +1415,61 @@ func init() {
 }
 
 func main() {
+	cfg, err := loadConfig(os.Args[1:])
+	if err == flag.ErrHelp {
+		return
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	EXCEL_FILE, PRIMERA_HOJA = cfg.ArchivoExcel, cfg.HojaCenso
+	HISTORY_FILE, ACTIVITIES_FILE = cfg.ArchivoHistorial, cfg.ArchivoActividades
+	papeleraDias = cfg.PapeleraDias
+
 	os.MkdirAll(uploadDir, os.ModePerm)
 
+	// Cifrado del censo y de lo que se comparte
+	if cfg.Cifrado == "si" {
+		censusCipher = &Cipher{Keys: cfg.CipherKeys}
+		if err := encryptExistingFiles(censusCipher); err != nil {
+			log.Fatal(err)
+		}
+	} else if err := checkNotEncrypted(cfg.Almacenamiento); err != nil {
+		log.Fatal(err)
+	}
+
+	// Almacenamiento del censo, el historial y las actividades
+	if err := openStorage(cfg.Almacenamiento, cfg.BaseDatos, censusCipher); err != nil {
+		log.Fatal(err)
+	}
+
+	// Almacenamiento compartido con las otras computadoras
+	backend, censusName, err := openSyncBackend(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if backend != nil && censusCipher != nil {
+		backend = &cipherBackend{SyncBackend: backend, Cipher: censusCipher}
+	}
+	syncBackend, syncCensusName = backend, censusName
+	if syncBackend != nil && cfg.SyncModo == "cambios" {
+		syncModo = cfg.SyncModo
+		if syncInstancia, err = loadInstancia(cfg.Instancia); err != nil {
+			log.Fatal(err)
+		}
+		if c, ok := census.(*journaledCensus); ok {
+			c.instancia = syncInstancia
+		}
+		fmt.Printf("--- SYNC (%s): Sincronización por cambios, esta computadora es %q ---\n", syncBackend.Name(), syncInstancia)
+	}
+	if syncBackend != nil {
+		go syncWorker()
+		go pullWorker(cfg.SyncIntervalo)
+	}
+
 	// CARGAR HISTORIAL PERSISTENTE
-	loadLogsFromFile()
-	loadActivitiesFromFile()
+	loadLogs()
+	loadActivities()
 
 	//  Rutas api
 	http.HandleFunc("/api/activities", getActivitiesHandler)
@@ -1269,9 +1496,26 @@ func main() {
 	http.HandleFunc("/api/excel", getData)
 	http.HandleFunc("/api/excel/download-full", downloadFullExcelHandler)
 	http.HandleFunc("/api/excel/upload-full", uploadFullExcelHandler)
+	http.HandleFunc("/api/backups", listBackupsHandler)
+	http.HandleFunc("/api/cambios", getJournalHandler)
+	http.HandleFunc("/api/diff", diffHandler)
+	http.HandleFunc("/api/sync/status", getSyncStatusHandler)
+	http.HandleFunc("/api/sync/reintentar", retrySyncHandler)
+	http.HandleFunc("/api/sync/descargar", pullSyncHandler)
+	http.HandleFunc("/api/sync/conflictos", getSyncConflictsHandler)
+	http.HandleFunc("/api/sync/conflictos/resolver", resolveSyncConflictHandler)
+	http.HandleFunc("/api/cambios/revertir", revertJournalHandler)
+	http.HandleFunc("/api/papelera", getTrashHandler)
+	http.HandleFunc("/api/papelera/restore", restoreTrashHandler)
+	http.HandleFunc("/api/papelera/purge", purgeTrashHandler)
+	http.HandleFunc("/api/backups/restore", restoreBackupHandler)
 
 	// Inicializar log
-	addLog("Sistema iniciado con sincronización Dropbox")
+	if syncBackend != nil {
+		addLog("Sistema iniciado con sincronización " + syncBackend.Name())
+	} else {
+		addLog("Sistema iniciado sin sincronización")
+	}
 
 	http.HandleFunc("/editar-hogar", func(w http.ResponseWriter, r *http.Request) {
 		http.ServeFile(w, r, "paginas/editar_hogar.html")
@@ -1285,6 +1529,9 @@ func main() {
 	http.HandleFunc("/historia", func(w http.ResponseWriter, r *http.Request) {
 		http.ServeFile(w, r, "paginas/historia.html")
 	})
+	http.HandleFunc("/diferencias", func(w http.ResponseWriter, r *http.Request) {
+		http.ServeFile(w, r, "paginas/diferencias.html")
+	})
 
 	http.HandleFunc("/listado_votantes", func(w http.ResponseWriter, r *http.Request) {
 		http.ServeFile(w, r, "paginas/listado_votantes.html")
@@ -1385,6 +1632,7 @@ func uploadHandler(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, "/galeria", http.StatusSeeOther)
 
 	addLog("Galería: Nueva imagen subida")
+	encolarSubida()
 }
 
 func deleteHandler(w http.ResponseWriter, r *http.Request) {
@@ -1404,88 +1652,46 @@ func deleteHandler(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, "/galeria", http.StatusSeeOther)
 
 	addLog("Galería: Imagen eliminada")
+	encolarSubida()
 }
 
 // getTreeData
 func getTreeData(w http.ResponseWriter, r *http.Request) {
-	f, err := excelize.OpenFile(EXCEL_FILE)
-	if err != nil {
-		fmt.Println("Error al abrir el archivo Excel:", err) // LOG
-		http.Error(w, "no se pudo abrir el Excel: "+err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	rows, err := f.GetRows(PRIMERA_HOJA)
-	if err != nil || len(rows) < 2 {
-		fmt.Println("Error: La hoja está vacía o no se pudo leer.") // LOG
-		http.Error(w, "sheet vacío o no existe", http.StatusInternalServerError)
+	households, err := census.Households()
+	if err == errHouseholdColumns {
+		fmt.Println(err) // LOG
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-
-	headers := rows[0]
-	comunidadIdx, torreIdx, casaIdx := -1, -1, -1
-	for i, h := range headers {
-		headerClean := strings.TrimSpace(strings.ToLower(h))
-		switch headerClean {
-		case "comunidad":
-			comunidadIdx = i
-		case "torre":
-			torreIdx = i
-		case "casa o apto", "casa", "apto":
-			casaIdx = i
-		}
-	}
-
-	fmt.Println("--- Depurando la carga del árbol ---")
-	fmt.Printf("Índice encontrado para 'Comunidad': %d\n", comunidadIdx)
-	fmt.Printf("Índice encontrado para 'Torre': %d\n", torreIdx)
-	fmt.Printf("Índice encontrado para 'Casa/Apto': %d\n", casaIdx)
-	fmt.Println("------------------------------------")
-
-	if comunidadIdx == -1 || torreIdx == -1 || casaIdx == -1 {
-		errorMsg := "No se encontraron todas las columnas requeridas. Revisa que tu Excel tenga cabeceras llamadas 'COMUNIDAD', 'TORRE' y 'CASA O APTO'."
-		fmt.Println(errorMsg) // LOG
-		http.Error(w, errorMsg, http.StatusInternalServerError)
+	if err != nil {
+		fmt.Println("Error al leer los hogares del censo:", err) // LOG
+		http.Error(w, "no se pudo abrir el Excel: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	tree := make(map[string]map[string]map[string]struct{})
-	for _, row := range rows[1:] {
-		if len(row) <= comunidadIdx || len(row) <= torreIdx || len(row) <= casaIdx {
-			continue
-		}
-		comunidad := strings.TrimSpace(row[comunidadIdx])
-		torre := strings.TrimSpace(row[torreIdx])
-		casa := strings.TrimSpace(row[casaIdx])
-		if comunidad == "" || torre == "" || casa == "" {
-			continue
-		}
-		if _, ok := tree[comunidad]; !ok {
-			tree[comunidad] = make(map[string]map[string]struct{})
-		}
-		if _, ok := tree[comunidad][torre]; !ok {
-			tree[comunidad][torre] = make(map[string]struct{})
-		}
-		tree[comunidad][torre][casa] = struct{}{}
-	}
-
 	var result []*TreeNode
-	for comName, torres := range tree {
-		comNode := &TreeNode{Text: comName, Type: "comunidad"}
-		comNode.State.Opened = false
+	comunidades := make(map[string]*TreeNode)
+	torres := make(map[[2]string]*TreeNode)
+	for _, h := range households {
+		comNode, ok := comunidades[h.Comunidad]
+		if !ok {
+			comNode = &TreeNode{Text: h.Comunidad, Type: "comunidad"}
+			comNode.State.Opened = false
+			comunidades[h.Comunidad] = comNode
+			result = append(result, comNode)
+		}
 
-		for torreName, casas := range torres {
-			torreNode := &TreeNode{Text: "Torre " + torreName, Type: "torre"}
+		torreKey := [2]string{h.Comunidad, h.Torre}
+		torreNode, ok := torres[torreKey]
+		if !ok {
+			torreNode = &TreeNode{Text: "Torre " + h.Torre, Type: "torre"}
 			torreNode.State.Opened = false
-
-			for casaName := range casas {
-				casaNode := &TreeNode{Text: "Casa/Apto " + casaName, Type: "casa"}
-
-				torreNode.Children = append(torreNode.Children, casaNode)
-			}
+			torres[torreKey] = torreNode
 			comNode.Children = append(comNode.Children, torreNode)
 		}
-		result = append(result, comNode)
+
+		casaNode := &TreeNode{Text: "Casa/Apto " + h.Casa, Type: "casa"}
+		torreNode.Children = append(torreNode.Children, casaNode)
 	}
 
 	fmt.Printf("Se encontraron %d comunidades para el árbol.\n", len(result)) // LOG
@@ -1505,60 +1711,19 @@ func getPeopleInHouse(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	f, err := excelize.OpenFile(EXCEL_FILE)
-	if err != nil {
-		http.Error(w, "no se pudo abrir el Excel", http.StatusInternalServerError)
-		return
-	}
-
-	rows, err := f.GetRows(PRIMERA_HOJA)
-	if err != nil || len(rows) < 2 {
-		http.Error(w, "sheet vacío o no existe", http.StatusInternalServerError)
-		return
-	}
-
-	headers := rows[0]
-	comIdx, torreIdx, casaIdx, parentescoIdx, nombresIdx, docIdx := -1, -1, -1, -1, -1, -1
-	for i, h := range headers {
-		headerClean := strings.TrimSpace(strings.ToLower(h))
-		switch headerClean {
-		case "comunidad":
-			comIdx = i
-		case "torre":
-			torreIdx = i
-		case "casa o apto", "casa", "apto":
-			casaIdx = i
-		case "parentesco":
-			parentescoIdx = i
-		case "nombre completo":
-			nombresIdx = i
-		case "cedula de identidad":
-			docIdx = i
-		}
-	}
-
-	if comIdx == -1 || torreIdx == -1 || casaIdx == -1 || parentescoIdx == -1 || nombresIdx == -1 || docIdx == -1 {
+	h, err := census.FindHousehold(comunidad, torre, casa)
+	if err != nil && err != errRecordNotFound {
 		http.Error(w, "No se encontraron todas las columnas requeridas en el Excel", http.StatusInternalServerError)
 		return
 	}
 
 	var people []Person
-	for _, row := range rows[1:] {
-		if len(row) > comIdx && len(row) > torreIdx && len(row) > casaIdx {
-			if row[comIdx] == comunidad && row[torreIdx] == torre && row[casaIdx] == casa {
-				person := Person{}
-				if parentescoIdx < len(row) {
-					person.Parentesco = row[parentescoIdx]
-				}
-				if nombresIdx < len(row) {
-					person.Nombres = row[nombresIdx]
-				}
-				if docIdx < len(row) {
-					person.Documento = row[docIdx]
-				}
-				people = append(people, person)
-			}
-		}
+	for _, rec := range h.Members {
+		people = append(people, Person{
+			Parentesco: rec.Value("Parentesco"),
+			Nombres:    rec.Value("Nombre completo"),
+			Documento:  rec.Value(CEDULA_HEADER),
+		})
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -1576,59 +1741,15 @@ func getHouseholdDetails(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	f, err := excelize.OpenFile(EXCEL_FILE)
-	if err != nil {
-		http.Error(w, "No se pudo abrir el Excel", http.StatusInternalServerError)
-		return
-	}
-
-	rows, err := f.GetRows(PRIMERA_HOJA)
-	if err != nil || len(rows) < 2 {
-		http.Error(w, "Sheet vacío o no existe", http.StatusInternalServerError)
-		return
-	}
-
-	headers := rows[0]
-	comIdx, torreIdx, casaIdx := -1, -1, -1
-	for i, h := range headers {
-		headerClean := strings.TrimSpace(strings.ToLower(h))
-		if headerClean == "comunidad" {
-			comIdx = i
-		}
-		if headerClean == "torre" {
-			torreIdx = i
-		}
-		if headerClean == "casa o apto" || headerClean == "casa" {
-			casaIdx = i
-		}
-	}
-
-	if comIdx == -1 || torreIdx == -1 || casaIdx == -1 {
+	h, err := census.FindHousehold(comunidad, torre, casa)
+	if err != nil && err != errRecordNotFound {
 		http.Error(w, "Columnas clave no encontradas", http.StatusInternalServerError)
 		return
 	}
 
 	var householdData []map[string]string
-	for i, row := range rows {
-		if i == 0 {
-			continue
-		}
-
-		if len(row) > comIdx && len(row) > torreIdx && len(row) > casaIdx {
-			if row[comIdx] == comunidad && row[torreIdx] == torre && row[casaIdx] == casa {
-				personData := make(map[string]string)
-				personData["__row"] = strconv.Itoa(i + 1)
-				for j, header := range headers {
-					cleanHeader := strings.TrimSpace(header)
-					if j < len(row) {
-						personData[cleanHeader] = row[j]
-					} else {
-						personData[cleanHeader] = ""
-					}
-				}
-				householdData = append(householdData, personData)
-			}
-		}
+	for _, rec := range h.Members {
+		householdData = append(householdData, recordJSON(rec))
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -1645,115 +1766,17 @@ func addHouseholdData(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	f, err := excelize.OpenFile(EXCEL_FILE)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	rows, _ := f.GetRows(PRIMERA_HOJA)
-	headers := rows[0]
-	nextRow := len(rows) + 1
-
-	headerMap := make(map[string]int)
-	for i, h := range headers {
-		headerMap[strings.TrimSpace(h)] = i // Usar clave limpia
-	}
-
-	for _, persona := range req.Datos {
-		for key, val := range persona {
-			if colIndex, ok := headerMap[key]; ok { // 'key' ya viene limpia del frontend
-				cell, _ := excelize.CoordinatesToCellName(colIndex+1, nextRow)
-				f.SetCellValue(PRIMERA_HOJA, cell, val)
-			}
-		}
-		nextRow++
+	// Las claves ya vienen limpias del frontend
+	for _, fila := range req.Datos {
+		withoutRecordID(fila)
 	}
-
-	if err := f.Save(); err != nil {
+	if _, err := census.Insert(req.Datos...); err != nil {
 		http.Error(w, "No se guardó el Excel", http.StatusInternalServerError)
 		return
 	}
-	w.WriteHeader(http.StatusOK)
-}
-
-// Descarga el archivo de Dropbox a la carpeta local
-func descargarDeDropbox() error {
-	fmt.Println("--- DROPBOX: Descargando última versión del Excel... ---")
-
-	// 1. OBTENER TOKEN NUEVO
-	token, err := obtenerAccessToken() // <--- CAMBIO
-	if err != nil {
-		return fmt.Errorf("error al obtener token: %v", err)
-	}
 
-	url := "https://content.dropboxapi.com/2/files/download"
-	req, err := http.NewRequest("POST", url, nil)
-	if err != nil {
-		return err
-	}
-
-	req.Header.Set("Authorization", "Bearer "+token)
-	req.Header.Set("Dropbox-API-Arg", `{"path": "`+DROPBOX_FILE_PATH+`"}`)
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return err
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("error al descargar: %s", resp.Status)
-	}
-
-	data, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return err
-	}
-
-	fmt.Println("--- DROPBOX: Excel descargado ---")
-
-	return ioutil.WriteFile(EXCEL_FILE, data, 0644)
-}
-
-// Sube el archivo local a Dropbox (sobrescribe)
-func subirADropbox() error {
-	fmt.Println("--- DROPBOX: Subiendo cambios a la nube... ---")
-
-	// 1. OBTENER TOKEN NUEVO
-	token, err := obtenerAccessToken() // <--- CAMBIO
-	if err != nil {
-		return fmt.Errorf("error al obtener token: %v", err)
-	}
-
-	contenido, err := ioutil.ReadFile(EXCEL_FILE)
-	if err != nil {
-		return err
-	}
-
-	url := "https://content.dropboxapi.com/2/files/upload"
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(contenido))
-	if err != nil {
-		return err
-	}
-
-	req.Header.Set("Authorization", "Bearer "+token)
-	// 'overwrite' permite que siempre se guarde la última versión
-	req.Header.Set("Dropbox-API-Arg", `{"path": "`+DROPBOX_FILE_PATH+`","mode": "overwrite"}`)
-	req.Header.Set("Content-Type", "application/octet-stream")
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return err
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("error al subir: %s", resp.Status)
-	}
+	encolarSubida()
+	w.WriteHeader(http.StatusOK)
 
-	fmt.Println("--- DROPBOX: Cambios subidos a Excel satisfactoriamente---")
-	return nil
+	addLog(fmt.Sprintf("Hogares: Se agregaron %d persona(s) a un hogar", len(req.Datos)))
 }
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// SQLStorage es una base de datos que guarda el censo, el historial, las
+// actividades y el diario de cambios.
+type SQLStorage interface {
+	CensusStore
+	HistoryStore
+	ActivityStore
+	BackupStore
+	JournalStore
+}
+
+// openStorage prepara el almacenamiento elegido con -almacenamiento.
+// "excel" usa el libro y los JSON de siempre; "sqlite" usa una base embebida.
+// En los dos casos los cambios del censo pasan por el diario de cambios. Con
+// cipher el libro, el diario y las copias se guardan cifrados; SQLite no se
+// puede cifrar, así que con sqlite no hay cipher (ver loadConfig).
+func openStorage(kind, dbPath string, cipher *Cipher) error {
+	switch kind {
+	case "excel":
+		excel := &ExcelStore{Path: EXCEL_FILE, Sheet: PRIMERA_HOJA, Cipher: cipher, Rotation: &backupRotation{
+			Dir: BACKUP_DIR, Ext: filepath.Ext(EXCEL_FILE), Keep: BACKUPS_GUARDADOS, KeepDaily: BACKUPS_DIARIOS, Cipher: cipher,
+		}}
+		files := &JSONFileStore{HistoryPath: HISTORY_FILE, ActivitiesPath: ACTIVITIES_FILE}
+		journal = &JSONLJournal{Path: JOURNAL_FILE, Cipher: cipher}
+		wrapped := newJournaledCensus(excel, excel, journal)
+		census, backups = wrapped, wrapped
+		historyStore, activityStore = files, files
+		return nil
+	case "sqlite":
+		db, err := openSQLiteStore(dbPath, &backupRotation{
+			Dir: BACKUP_DIR, Ext: ".db", Keep: BACKUPS_GUARDADOS, KeepDaily: BACKUPS_DIARIOS,
+		})
+		if err != nil {
+			return err
+		}
+		if err := migrateFromFiles(db); err != nil {
+			return fmt.Errorf("no se pudo migrar a %s: %v", dbPath, err)
+		}
+		journal = db
+		wrapped := newJournaledCensus(db, db, db)
+		census, backups = wrapped, wrapped
+		historyStore, activityStore = db, db
+		return nil
+	}
+	return fmt.Errorf("almacenamiento desconocido %q (use excel o sqlite)", kind)
+}
+
+// migrateFromFiles copia a la base el libro, history.json y activities.json
+// la primera vez que se usa. Si la base ya tiene datos no toca nada. Un libro
+// cifrado no se migra: la base quedaría con el censo sin cifrar.
+func migrateFromFiles(db SQLStorage) error {
+	if _, err := db.Headers(); err == errCensusEmpty {
+		data, err := ioutil.ReadFile(EXCEL_FILE)
+		if err == nil && IsEncrypted(data) {
+			return fmt.Errorf("%s está cifrado y SQLite no se puede cifrar: siga con almacenamiento excel, o descargue el Excel completo desde el portal (sale descifrado) y póngalo en lugar de %s", EXCEL_FILE, EXCEL_FILE)
+		}
+		if err == nil {
+			fmt.Println("--- MIGRACIÓN: Importando", EXCEL_FILE, "a la base de datos ---")
+			if err := db.ImportWorkbook(bytes.NewReader(data)); err != nil {
+				return err
+			}
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+
+	files := &JSONFileStore{HistoryPath: HISTORY_FILE, ActivitiesPath: ACTIVITIES_FILE}
+
+	current, err := db.LoadHistory()
+	if err != nil {
+		return err
+	}
+	if current == nil {
+		entries, err := files.LoadHistory()
+		if err != nil {
+			return err
+		}
+		if entries != nil {
+			fmt.Println("--- MIGRACIÓN: Importando", HISTORY_FILE, "---")
+			if err := db.SaveHistory(entries); err != nil {
+				return err
+			}
+		}
+	}
+
+	list, err := db.LoadActivities()
+	if err != nil {
+		return err
+	}
+	if list == nil {
+		list, err = files.LoadActivities()
+		if err != nil {
+			return err
+		}
+		if list != nil {
+			fmt.Println("--- MIGRACIÓN: Importando", ACTIVITIES_FILE, "---")
+			if err := db.SaveActivities(list); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,458 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// ------------------- SINCRONIZACIÓN -------------------------
+
+// SyncBackend es el lugar compartido donde viven las copias que usan todas
+// las computadoras (el censo, el historial, las actividades y las imágenes):
+// Dropbox, una carpeta (de red o sincronizada por otro programa) o un servidor
+// WebDAV. Los archivos se nombran con rutas relativas separadas por "/", como
+// "history.json" o "imagenes/foto.png".
+type SyncBackend interface {
+	// Name identifica al backend en los mensajes.
+	Name() string
+	// Pull descarga un archivo y devuelve también su revisión.
+	Pull(name string) ([]byte, string, error)
+	// Push sube un archivo solo si el remoto sigue en parentRev (o no existe,
+	// si parentRev está vacío) y devuelve la revisión nueva. Si no, devuelve
+	// errRemoteChanged sin tocar el remoto.
+	Push(name string, data []byte, parentRev string) (string, error)
+	// Revision devuelve la revisión actual de un archivo sin descargarlo.
+	Revision(name string) (string, error)
+	// Delete borra un archivo solo si sigue en parentRev; si no, devuelve
+	// errRemoteChanged. Si ya no existe no es un error.
+	Delete(name, parentRev string) error
+	// List devuelve los archivos de la carpeta dir (sin subcarpetas) con su
+	// revisión, por nombre. Si la carpeta no existe devuelve un mapa vacío.
+	List(dir string) (map[string]string, error)
+}
+
+// errRemoteNotFound indica que el libro todavía no existe en el backend.
+var errRemoteNotFound = errors.New("el archivo no existe en el almacenamiento compartido")
+
+// errRemoteChanged indica que el libro compartido ya no está en la revisión
+// que se esperaba al subir: otra computadora lo cambió.
+var errRemoteChanged = errors.New("el archivo compartido cambió desde la última sincronización")
+
+// syncBackend es el backend elegido en la configuración; nil si no se
+// sincroniza. syncCensusName es el nombre del libro en el backend.
+var syncBackend SyncBackend
+var syncCensusName string
+
+// openSyncBackend prepara el backend elegido en la configuración (sync):
+// "dropbox" (el de siempre), "carpeta", "webdav" o "ninguno", y devuelve
+// también el nombre del libro. Los demás archivos van en la misma carpeta que
+// el libro. Las claves se piden a cfg en cada uso, así se pueden rotar sin
+// reiniciar.
+func openSyncBackend(cfg *Config) (SyncBackend, string, error) {
+	client := &http.Client{Timeout: 2 * time.Minute}
+	switch cfg.Sync {
+	case "dropbox":
+		dir, name := path.Split(cfg.DropboxRuta)
+		return &DropboxBackend{Dir: dir, Credentials: cfg.DropboxCredentials, Client: client, BaseURL: cfg.DropboxURL}, name, nil
+	case "carpeta":
+		return &FolderBackend{Dir: cfg.SyncCarpeta}, filepath.Base(EXCEL_FILE), nil
+	case "webdav":
+		dir, name := path.Split(cfg.WebDAVURL)
+		if unescaped, err := url.PathUnescape(name); err == nil {
+			name = unescaped
+		}
+		return &WebDAVBackend{Dir: dir, User: cfg.WebDAVUsuario, Password: cfg.WebDAVPassword, Client: client}, name, nil
+	case "ninguno":
+		return nil, "", nil
+	}
+	return nil, "", fmt.Errorf("sincronización desconocida %q (use dropbox, carpeta, webdav o ninguno)", cfg.Sync)
+}
+
+// SYNC_DIR guarda la última versión del libro que se compartió con las otras
+// computadoras (la base para combinar cambios) y el estado de la sincronización.
+const SYNC_DIR = "sync"
+const SYNC_STATE_FILE = "estado.json"
+
+// syncState es lo que se recuerda entre sincronizaciones: la revisión del
+// libro compartido que corresponde a la base, los conflictos y los cambios
+// que todavía hay que subir.
+type syncState struct {
+	Rev        string         `json:"rev"`
+	Conflictos []SyncConflict `json:"conflictos"`
+	Siguiente  int            `json:"siguiente"`
+	Pendientes int            `json:"pendientes"`
+	// Archivos son el historial, las actividades y las imágenes
+	// ("imagenes/foto.png"), por nombre en el backend.
+	Archivos map[string]syncFile `json:"archivos,omitempty"`
+
+	// Modo cambios: Instancia es la computadora que empezó con este estado e
+	// Inicio la última entrada del diario en ese momento. Publicado es la
+	// última entrada ya revisada para subir, Segmento el último segmento
+	// propio y Aplicados el último segmento repetido de cada otra instancia.
+	Instancia string         `json:"instancia,omitempty"`
+	Inicio    int64          `json:"inicio,omitempty"`
+	Publicado int64          `json:"publicado,omitempty"`
+	Segmento  int            `json:"segmento,omitempty"`
+	Aplicados map[string]int `json:"aplicados,omitempty"`
+}
+
+var errConflictNotFound = errors.New("el conflicto no existe o ya se resolvió")
+
+// syncMu evita que dos sincronizaciones se mezclen. stateMu protege el
+// archivo de estado, y solo se toma un momento, así anotar un cambio nunca
+// espera a la red.
+var syncMu sync.Mutex
+var stateMu sync.Mutex
+
+// loadSyncState lee el estado. Se puede leer sin stateMu porque el archivo
+// se reemplaza de una vez.
+func loadSyncState() (syncState, error) {
+	st := syncState{Conflictos: []SyncConflict{}}
+	_, err := readJSON(filepath.Join(SYNC_DIR, SYNC_STATE_FILE), &st)
+	return st, err
+}
+
+// updateSyncState lee, cambia y guarda el estado sin que otro cambio se meta
+// en el medio.
+func updateSyncState(update func(st *syncState)) error {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	st, err := loadSyncState()
+	if err != nil {
+		return err
+	}
+	update(&st)
+	if err := os.MkdirAll(SYNC_DIR, 0755); err != nil {
+		return err
+	}
+	return writeJSON(filepath.Join(SYNC_DIR, SYNC_STATE_FILE), st)
+}
+
+func syncBasePath() string {
+	return filepath.Join(SYNC_DIR, "base"+filepath.Ext(EXCEL_FILE))
+}
+
+// readSyncBase devuelve nil si todavía no se sincronizó nunca.
+func readSyncBase() ([]byte, error) {
+	data, err := readEncryptedFile(syncBasePath(), censusCipher)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return data, err
+}
+
+// saveSyncBase guarda la base y su revisión juntas.
+func saveSyncBase(data []byte, rev string) error {
+	if err := os.MkdirAll(SYNC_DIR, 0755); err != nil {
+		return err
+	}
+	sealed, err := censusCipher.Encrypt(data)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(syncBasePath(), sealed, 0644); err != nil {
+		return err
+	}
+	return updateSyncState(func(st *syncState) { st.Rev = rev })
+}
+
+func exportCensus() ([]byte, error) {
+	var buf bytes.Buffer
+	if err := census.ExportWorkbook(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// hasMissingIDs dice si alguna persona del libro todavía no tiene ID.
+func hasMissingIDs(records []CensusRecord) bool {
+	for _, rec := range records {
+		if rec.ID == "" {
+			return true
+		}
+	}
+	return false
+}
+
+// syncPullLocked trae el libro compartido si cambió desde la última vez. Si
+// aquí no hubo cambios lo importa tal cual; si los hubo, combina los dos
+// lados contra la base y guarda los conflictos. Sin base nunca importa encima
+// de lo local: combina con firstSyncBase. Devuelve true si hay que subir el
+// resultado. Con force descarga aunque la revisión no haya cambiado.
+// Hay que tener tomado syncMu.
+func syncPullLocked(force bool) (bool, error) {
+	name := syncBackend.Name()
+	st, err := loadSyncState()
+	if err != nil {
+		return false, err
+	}
+	if !force && st.Rev != "" {
+		rev, err := syncBackend.Revision(syncCensusName)
+		if err == errRemoteNotFound {
+			return false, nil
+		}
+		if err != nil {
+			return false, fmt.Errorf("error al consultar la revisión: %w", err)
+		}
+		if rev == st.Rev {
+			return false, nil
+		}
+	}
+
+	fmt.Printf("--- SYNC (%s): Descargando última versión del Excel... ---\n", name)
+	remote, rev, err := syncBackend.Pull(syncCensusName)
+	if err == errRemoteNotFound {
+		fmt.Printf("--- SYNC (%s): Todavía no hay un Excel compartido ---\n", name)
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("error al descargar: %w", err)
+	}
+	fmt.Printf("--- SYNC (%s): Excel descargado (revisión %s) ---\n", name, rev)
+
+	remoteHeaders, remoteRecords, err := readWorkbook(bytes.NewReader(remote), PRIMERA_HOJA)
+	if err != nil {
+		return false, fmt.Errorf("el Excel compartido no tiene una hoja %q válida: %v", PRIMERA_HOJA, err)
+	}
+	base, err := readSyncBase()
+	if err != nil {
+		return false, err
+	}
+	local, err := exportCensus()
+	if err != nil {
+		return false, err
+	}
+	localHeaders, localRecords, err := readWorkbook(bytes.NewReader(local), PRIMERA_HOJA)
+	if err != nil && err != errCensusEmpty {
+		return false, err
+	}
+
+	var baseHeaders []string
+	var baseRecords []CensusRecord
+	mergeLocal, mergeRemote := localRecords, remoteRecords
+	if base != nil {
+		baseHeaders, baseRecords, err = readWorkbook(bytes.NewReader(base), PRIMERA_HOJA)
+		if err != nil {
+			return false, fmt.Errorf("la base de la sincronización está dañada: %v", err)
+		}
+	} else {
+		// Sin base (la primera sincronización, también la primera después de
+		// actualizar el programa) no se sabe qué cambió de cada lado: lo local
+		// gana y no se borra nada
+		baseHeaders = remoteHeaders
+		baseRecords, mergeLocal, mergeRemote = firstSyncBase(localRecords, remoteRecords)
+	}
+
+	if base != nil && sameRecords(localRecords, baseRecords) || base == nil && len(localRecords) == 0 {
+		// Aquí no hubo cambios (o no hay nada): el libro compartido reemplaza
+		// al local. Las personas que llegan sin ID lo reciben al importarlas,
+		// y hay que subirlas para que todas las computadoras usen los mismos IDs.
+		if err := importIfUnchanged(remote, localRecords); err != nil {
+			return false, err
+		}
+		imported, err := exportCensus()
+		if err != nil {
+			return false, err
+		}
+		return hasMissingIDs(remoteRecords), saveSyncBase(imported, rev)
+	}
+
+	headers, merged, conflicts := mergeCensus(baseHeaders, baseRecords, localHeaders, mergeLocal, remoteHeaders, mergeRemote)
+	data, err := mergedWorkbook(local, remote, PRIMERA_HOJA, headers, merged)
+	if err != nil {
+		return false, err
+	}
+	if err := importIfUnchanged(data, localRecords); err != nil {
+		return false, err
+	}
+	fmt.Printf("--- SYNC (%s): Cambios combinados, %d conflicto(s) ---\n", name, len(conflicts))
+	// Si lo combinado ya es lo que está compartido no hay nada que subir
+	push := !sameRecords(merged, remoteRecords) || hasMissingIDs(remoteRecords)
+	if err := saveSyncBase(remote, rev); err != nil {
+		return push, err
+	}
+	return push, addSyncConflicts(conflicts, nil)
+}
+
+// importIfUnchanged reemplaza el censo con data solo si sigue igual a
+// localRecords. Si alguien guardó un cambio mientras se sincronizaba, se
+// vuelve a intentar en la próxima sincronización en vez de perderlo.
+func importIfUnchanged(data []byte, localRecords []CensusRecord) error {
+	err := censusAs(syncBackend.Name()).ImportWorkbookIf(bytes.NewReader(data), censusVersion(localRecords))
+	if err == errCensusChanged {
+		return fmt.Errorf("el censo cambió mientras se sincronizaba; se reintentará")
+	}
+	return err
+}
+
+// addSyncConflicts numera y guarda conflictos nuevos. update, si no es nil,
+// cambia el estado en el mismo guardado.
+func addSyncConflicts(conflicts []SyncConflict, update func(st *syncState)) error {
+	now := time.Now()
+	return updateSyncState(func(st *syncState) {
+		for _, c := range conflicts {
+			st.Siguiente++
+			c.Seq, c.Fecha = st.Siguiente, now
+			st.Conflictos = append(st.Conflictos, c)
+		}
+		if update != nil {
+			update(st)
+		}
+	})
+}
+
+// syncPushLocked sube el censo local solo si el libro compartido sigue en la
+// revisión de la base; si no, devuelve errRemoteChanged. Hay que tener tomado
+// syncMu.
+func syncPushLocked() error {
+	st, err := loadSyncState()
+	if err != nil {
+		return err
+	}
+	local, err := exportCensus()
+	if err != nil {
+		return err
+	}
+	rev, err := syncBackend.Push(syncCensusName, local, st.Rev)
+	if err != nil {
+		return err
+	}
+	return saveSyncBase(local, rev)
+}
+
+// descargarCenso trae la última versión del libro compartido y la combina con
+// la local. En el modo cambios repite los cambios de las otras instancias.
+func descargarCenso() error {
+	if syncBackend == nil {
+		return nil
+	}
+	var push bool
+	var err error
+	syncMu.Lock()
+	if syncModo == "cambios" {
+		err = replayChangesLocked()
+	} else {
+		push, err = syncPullLocked(false)
+	}
+	syncMu.Unlock()
+	if err != nil {
+		setSyncError(err)
+		return err
+	}
+	setSyncStatus(func(s *SyncStatus) {
+		s.UltimaBajada = time.Now()
+		// Si no hay una subida esperando para reintentar, el error era de
+		// una bajada y ya pasó
+		if s.ProximoIntento.IsZero() {
+			s.UltimoError, s.TipoError, s.FechaError = "", "", time.Time{}
+		}
+	})
+	if push {
+		encolarSubida()
+	}
+	return nil
+}
+
+// subirCenso sube el censo local al libro compartido. Si otra computadora lo
+// cambió desde la última sincronización, primero combina los cambios. En el
+// modo cambios solo publica los cambios hechos aquí.
+func subirCenso() error {
+	if syncBackend == nil {
+		return nil
+	}
+	syncMu.Lock()
+	defer syncMu.Unlock()
+	fmt.Printf("--- SYNC (%s): Subiendo cambios... ---\n", syncBackend.Name())
+
+	if syncModo == "cambios" {
+		if err := publishChangesLocked(); err != nil {
+			return fmt.Errorf("error al subir: %w", err)
+		}
+		return nil
+	}
+
+	for intento := 0; intento < 3; intento++ {
+		err := syncPushLocked()
+		if err == nil {
+			fmt.Printf("--- SYNC (%s): Cambios subidos satisfactoriamente ---\n", syncBackend.Name())
+			return nil
+		}
+		if err != errRemoteChanged {
+			return fmt.Errorf("error al subir: %w", err)
+		}
+		fmt.Printf("--- SYNC (%s): El Excel compartido cambió; combinando cambios ---\n", syncBackend.Name())
+		if _, err := syncPullLocked(true); err != nil {
+			return err
+		}
+	}
+	return fmt.Errorf("error al subir: %w", errRemoteChanged)
+}
+
+// syncConflicts devuelve los conflictos pendientes.
+func syncConflicts() ([]SyncConflict, error) {
+	st, err := loadSyncState()
+	return st.Conflictos, err
+}
+
+// resolveSyncConflict aplica la decisión del operador: usar "local" o
+// "remoto". El cambio queda en el diario a nombre de operator. Devuelve true
+// si el censo cambió y hay que subirlo.
+func resolveSyncConflict(seq int, usar, operator string) (bool, error) {
+	syncMu.Lock()
+	defer syncMu.Unlock()
+
+	st, err := loadSyncState()
+	if err != nil {
+		return false, err
+	}
+	idx := -1
+	for i, c := range st.Conflictos {
+		if c.Seq == seq {
+			idx = i
+		}
+	}
+	if idx == -1 {
+		return false, errConflictNotFound
+	}
+	c := st.Conflictos[idx]
+
+	store := censusAs(operator)
+	changed := false
+	current, err := store.Get(c.ID)
+	switch {
+	case err == errRecordNotFound:
+		// La persona ya no está: no queda nada que decidir
+	case err != nil:
+		return false, err
+	case c.Tipo == CONFLICTO_CAMPO && usar == "remoto":
+		err = store.Update(CensusRecord{ID: c.ID, Fields: map[string]string{c.Campo: c.Remoto}, IfVersion: current.Version()})
+		changed = true
+	case c.Tipo == CONFLICTO_CAMPO && usar == "local" && current.Fields[c.Campo] == c.Remoto && c.Local != c.Remoto:
+		// En el modo cambios quedó el valor más nuevo, que puede ser el remoto
+		err = store.Update(CensusRecord{ID: c.ID, Fields: map[string]string{c.Campo: c.Local}, IfVersion: current.Version()})
+		changed = true
+	case c.Tipo == CONFLICTO_ELIMINADO_AQUI && usar == "local", c.Tipo == CONFLICTO_ELIMINADO_ALLA && usar == "remoto":
+		err = store.Delete(DeleteInfo{By: operator, Reason: "Conflicto de sincronización"}, RecordRef{ID: c.ID, IfVersion: current.Version()})
+		changed = true
+	}
+	if err != nil && err != errRecordNotFound {
+		return false, err
+	}
+
+	return changed, updateSyncState(func(st *syncState) {
+		for i, other := range st.Conflictos {
+			if other.Seq == seq {
+				st.Conflictos = append(st.Conflictos[:i], st.Conflictos[i+1:]...)
+				break
+			}
+		}
+	})
+}
@@ -0,0 +1,429 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ------------------- SINCRONIZACIÓN POR CAMBIOS -------------------------
+
+// En el modo "cambios" cada computadora (instancia) no sube el libro
+// completo sino sus entradas del diario, en archivos que nunca se reescriben:
+// SYNC_CHANGES_DIR/<instancia>-00000001.jsonl, -00000002.jsonl... Cada una
+// repite los cambios de las demás por el camino normal de escritura, así dos
+// personas que editan hogares distintos no se pisan. Si dos computadoras
+// cambian el mismo campo queda el cambio más nuevo en todas, y donde se
+// reemplazó un cambio propio se anota un conflicto para que el operador lo
+// revise. El libro compartido solo sirve para empezar.
+const SYNC_CHANGES_DIR = "cambios"
+
+// SYNC_INSTANCE_FILE guarda el nombre de esta computadora cuando no se
+// configuró uno.
+const SYNC_INSTANCE_FILE = "instancia"
+
+// syncModo es "libro" o "cambios"; syncInstancia es el nombre de esta
+// computadora en el modo cambios.
+var syncModo = "libro"
+var syncInstancia string
+
+var instanciaPattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+func validInstancia(name string) bool {
+	return instanciaPattern.MatchString(name)
+}
+
+// loadInstancia devuelve el nombre de esta computadora: el configurado o, si
+// no hay, uno al azar que se guarda para los próximos arranques.
+func loadInstancia(configured string) (string, error) {
+	if configured != "" {
+		return configured, nil
+	}
+	file := filepath.Join(SYNC_DIR, SYNC_INSTANCE_FILE)
+	data, err := ioutil.ReadFile(file)
+	if err == nil && validInstancia(strings.TrimSpace(string(data))) {
+		return strings.TrimSpace(string(data)), nil
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+	name := newRecordID()
+	if err := os.MkdirAll(SYNC_DIR, 0755); err != nil {
+		return "", err
+	}
+	return name, writeFileAtomic(file, []byte(name+"\n"), 0644)
+}
+
+// changeSegment es el nombre (dentro de SYNC_CHANGES_DIR) del segmento n de
+// una instancia.
+func changeSegment(instancia string, n int) string {
+	return fmt.Sprintf("%s-%08d.jsonl", instancia, n)
+}
+
+// parseChangeSegment es lo contrario de changeSegment.
+func parseChangeSegment(name string) (string, int, bool) {
+	base := strings.TrimSuffix(name, ".jsonl")
+	i := strings.LastIndex(base, "-")
+	if base == name || i <= 0 {
+		return "", 0, false
+	}
+	n, err := strconv.Atoi(base[i+1:])
+	if err != nil || n <= 0 || !validInstancia(base[:i]) {
+		return "", 0, false
+	}
+	return base[:i], n, true
+}
+
+// startChangesLocked prepara el modo cambios la primera vez que esta
+// instancia sincroniza: trae el libro compartido (o lo sube si todavía no hay
+// uno) y anota desde qué entrada del diario empiezan sus cambios propios.
+// Hay que tener tomado syncMu.
+func startChangesLocked() error {
+	st, err := loadSyncState()
+	if err != nil || st.Instancia == syncInstancia {
+		return err
+	}
+	fmt.Printf("--- SYNC (%s): Empezando la sincronización por cambios como %q ---\n", syncBackend.Name(), syncInstancia)
+
+	push, err := syncPullLocked(false)
+	if err != nil {
+		return err
+	}
+	if _, err := syncBackend.Revision(syncCensusName); err == errRemoteNotFound {
+		push = true
+	} else if err != nil {
+		return fmt.Errorf("error al consultar la revisión: %w", err)
+	}
+	if push {
+		// Las personas sin ID lo reciben al leerlas, y todas las instancias
+		// tienen que empezar con los mismos IDs
+		if _, err := census.List(); err != nil {
+			return err
+		}
+		if err := syncPushLocked(); err != nil {
+			return fmt.Errorf("error al subir el libro inicial: %w", err)
+		}
+	}
+
+	entries, err := journal.Journal(JournalFilter{})
+	if err != nil {
+		return err
+	}
+	var last int64
+	if len(entries) > 0 {
+		last = entries[len(entries)-1].Seq
+	}
+	return updateSyncState(func(st *syncState) {
+		st.Instancia, st.Inicio, st.Publicado, st.Segmento = syncInstancia, last, last, 0
+	})
+}
+
+// publishChangesLocked sube en un segmento nuevo las entradas del diario
+// hechas aquí que todavía no se publicaron. Hay que tener tomado syncMu.
+func publishChangesLocked() error {
+	if err := startChangesLocked(); err != nil {
+		return err
+	}
+	st, err := loadSyncState()
+	if err != nil {
+		return err
+	}
+	entries, err := journal.Journal(JournalFilter{After: st.Publicado})
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	last, count := st.Publicado, 0
+	for _, e := range entries {
+		last = e.Seq
+		if e.Instancia != syncInstancia {
+			continue
+		}
+		line, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+		count++
+	}
+	if count == 0 {
+		return updateSyncState(func(st *syncState) { st.Publicado = last })
+	}
+
+	// Si el segmento ya existe (se subió pero el estado no llegó a
+	// guardarse) se usa el siguiente: repetir un cambio dos veces no hace daño
+	segmento := st.Segmento
+	for intento := 0; ; intento++ {
+		segmento++
+		_, err := syncBackend.Push(path.Join(SYNC_CHANGES_DIR, changeSegment(syncInstancia, segmento)), buf.Bytes(), "")
+		if err == nil {
+			break
+		}
+		if err != errRemoteChanged || intento == 10 {
+			return err
+		}
+	}
+	fmt.Printf("--- SYNC (%s): %d cambio(s) publicados en el segmento %d ---\n", syncBackend.Name(), count, segmento)
+	return updateSyncState(func(st *syncState) { st.Publicado, st.Segmento = last, segmento })
+}
+
+// newerEntry dice si a es posterior a b. Con la misma fecha decide el nombre
+// de la instancia, así todas las computadoras eligen lo mismo.
+func newerEntry(a, b JournalEntry) bool {
+	if !a.Time.Equal(b.Time) {
+		return a.Time.After(b.Time)
+	}
+	return a.Instancia > b.Instancia
+}
+
+func fieldKey(id, field string) string {
+	return id + "\x00" + field
+}
+
+// replayChangesLocked trae los segmentos nuevos de las otras instancias y
+// repite sus cambios, del más viejo al más nuevo. Los segmentos de cada
+// instancia se aplican en orden: si falta uno (la carpeta compartida todavía
+// no lo trajo) se espera a la próxima vez. Hay que tener tomado syncMu.
+func replayChangesLocked() error {
+	if err := startChangesLocked(); err != nil {
+		return err
+	}
+	name := syncBackend.Name()
+	st, err := loadSyncState()
+	if err != nil {
+		return err
+	}
+	files, err := syncBackend.List(SYNC_CHANGES_DIR)
+	if err != nil {
+		return fmt.Errorf("error al listar los cambios: %w", err)
+	}
+	segments := make(map[string][]int)
+	for file := range files {
+		inst, n, ok := parseChangeSegment(file)
+		if ok && inst != syncInstancia && n > st.Aplicados[inst] {
+			segments[inst] = append(segments[inst], n)
+		}
+	}
+
+	var remote []JournalEntry
+	applied := make(map[string]int)
+	for inst, nums := range segments {
+		sort.Ints(nums)
+		next := st.Aplicados[inst] + 1
+		for _, n := range nums {
+			if n != next {
+				break
+			}
+			entries, err := pullChangeSegment(inst, n)
+			if err != nil {
+				return fmt.Errorf("error al descargar los cambios de %s: %w", inst, err)
+			}
+			remote = append(remote, entries...)
+			applied[inst] = n
+			next++
+		}
+	}
+	if len(remote) == 0 {
+		return nil
+	}
+	sort.SliceStable(remote, func(i, j int) bool {
+		a, b := remote[i], remote[j]
+		if !a.Time.Equal(b.Time) || a.Instancia != b.Instancia {
+			return newerEntry(b, a)
+		}
+		return a.Seq < b.Seq
+	})
+	fmt.Printf("--- SYNC (%s): Repitiendo %d cambio(s) de otras computadoras ---\n", name, len(remote))
+
+	// Lo último que se sabe de cada campo. Lo anterior al inicio del modo
+	// cambios ya está en el libro compartido y cuenta como más viejo que todo.
+	local, err := journal.Journal(JournalFilter{After: st.Inicio})
+	if err != nil {
+		return err
+	}
+	latest := make(map[string]JournalEntry)
+	for _, e := range local {
+		if e.Field != "" {
+			latest[fieldKey(e.RecordID, e.Field)] = e
+		}
+	}
+	trash, err := census.Trash()
+	if err != nil {
+		return err
+	}
+	trashed := make(map[string]bool, len(trash))
+	for _, rec := range trash {
+		trashed[rec.ID] = true
+	}
+
+	var conflicts []SyncConflict
+	for start := 0; start < len(remote); {
+		end := start + 1
+		for end < len(remote) && remote[end].Change == remote[start].Change && remote[end].Instancia == remote[start].Instancia {
+			end++
+		}
+		found, err := replayChange(remote[start:end], latest, trashed)
+		if err != nil {
+			return err
+		}
+		conflicts = append(conflicts, found...)
+		start = end
+	}
+
+	if len(conflicts) > 0 {
+		fmt.Printf("--- SYNC (%s): %d conflicto(s) al repetir cambios ---\n", name, len(conflicts))
+	}
+	return addSyncConflicts(conflicts, func(st *syncState) {
+		if st.Aplicados == nil {
+			st.Aplicados = make(map[string]int)
+		}
+		for inst, n := range applied {
+			st.Aplicados[inst] = n
+		}
+	})
+}
+
+// pullChangeSegment descarga y lee un segmento de otra instancia.
+func pullChangeSegment(inst string, n int) ([]JournalEntry, error) {
+	data, _, err := syncBackend.Pull(path.Join(SYNC_CHANGES_DIR, changeSegment(inst, n)))
+	if err != nil {
+		return nil, err
+	}
+	var entries []JournalEntry
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), len(data)+1)
+	for scanner.Scan() {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var e JournalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("el segmento %d está dañado: %v", n, err)
+		}
+		e.Instancia = inst
+		entries = append(entries, e)
+	}
+	return entries, scanner.Err()
+}
+
+// replayChange repite las entradas de un mismo cambio de otra instancia y
+// devuelve los conflictos. Un campo solo se escribe si su entrada es más
+// nueva que la última que se conoce de ese campo. Las eliminaciones ganan
+// siempre (se pueden deshacer desde la papelera) y los cambios a personas en
+// la papelera se ignoran. Las purgas no se repiten: cada computadora vacía su
+// propia papelera.
+func replayChange(entries []JournalEntry, latest map[string]JournalEntry, trashed map[string]bool) ([]SyncConflict, error) {
+	c, ok := census.(*journaledCensus)
+	if !ok {
+		return nil, fmt.Errorf("el almacenamiento no tiene diario de cambios")
+	}
+	origin := entries[0]
+	view := c.as("")
+	view.origin = &origin
+
+	var inserts []map[string]string
+	insertByID := make(map[string]map[string]string)
+	var updates []CensusRecord
+	updateByID := make(map[string]int)
+	var deletes []RecordRef
+	var restores []string
+	var conflicts []SyncConflict
+
+	for _, e := range entries {
+		switch e.Op {
+		case OP_EDITAR, OP_AGREGAR, OP_IMPORTAR:
+			key := fieldKey(e.RecordID, e.Field)
+			prev, known := latest[key]
+			if known && newerEntry(prev, e) {
+				continue
+			}
+			latest[key] = e
+			if trashed[e.RecordID] {
+				continue
+			}
+			if fields, ok := insertByID[e.RecordID]; ok {
+				fields[e.Field] = e.New
+				continue
+			}
+			rec, err := census.Get(e.RecordID)
+			if err == errRecordNotFound {
+				// Una edición de alguien que aquí no existe (se purgó) se ignora
+				if e.Op != OP_EDITAR {
+					fields := map[string]string{ID_HEADER: e.RecordID, e.Field: e.New}
+					insertByID[e.RecordID] = fields
+					inserts = append(inserts, fields)
+				}
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			if rec.Fields[e.Field] == e.New {
+				continue
+			}
+			if known && prev.Instancia == syncInstancia && rec.Fields[e.Field] != e.Old {
+				conflicts = append(conflicts, SyncConflict{
+					Tipo: CONFLICTO_CAMPO, ID: rec.ID, Nombre: rec.Value("Nombre completo"),
+					Campo: e.Field, Local: rec.Fields[e.Field], Remoto: e.New,
+				})
+			}
+			i, ok := updateByID[e.RecordID]
+			if !ok {
+				i = len(updates)
+				updateByID[e.RecordID] = i
+				updates = append(updates, CensusRecord{ID: rec.ID, Fields: map[string]string{}, IfVersion: rec.Version()})
+			}
+			updates[i].Fields[e.Field] = e.New
+		case OP_ELIMINAR:
+			if trashed[e.RecordID] {
+				continue
+			}
+			if _, err := census.Get(e.RecordID); err == errRecordNotFound {
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+			deletes = append(deletes, RecordRef{ID: e.RecordID})
+			trashed[e.RecordID] = true
+		case OP_RESTAURAR:
+			if trashed[e.RecordID] {
+				restores = append(restores, e.RecordID)
+				delete(trashed, e.RecordID)
+			}
+		}
+	}
+
+	// Si alguien guardó un cambio después de leer, Update devuelve
+	// *ConflictError y el segmento se repite en la próxima sincronización
+	if len(inserts) > 0 {
+		if _, err := view.Insert(inserts...); err != nil {
+			return nil, err
+		}
+	}
+	if len(updates) > 0 {
+		if err := view.Update(updates...); err != nil {
+			return nil, err
+		}
+	}
+	if len(deletes) > 0 {
+		if err := view.Delete(DeleteInfo{By: origin.Operator, Reason: origin.New}, deletes...); err != nil {
+			return nil, err
+		}
+	}
+	if len(restores) > 0 {
+		if err := view.Restore(restores...); err != nil {
+			return nil, err
+		}
+	}
+	return conflicts, nil
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// newChangesTest prepara dos computadoras con el mismo censo que sincronizan
+// por cambios en una carpeta compartida. La primera sube el libro inicial.
+func newChangesTest(t *testing.T) (*FolderBackend, *testComputer, *testComputer) {
+	t.Helper()
+	backend := &FolderBackend{Dir: t.TempDir()}
+	useTestBackend(t, backend, "cambios")
+	a, b := newTestComputer(t, "ana", 6), newTestComputer(t, "beto", 6)
+	publishChanges(t, a)
+	publishChanges(t, b)
+	return backend, a, b
+}
+
+func publishChanges(t *testing.T, c *testComputer) {
+	t.Helper()
+	c.use(t)
+	syncMu.Lock()
+	defer syncMu.Unlock()
+	if err := publishChangesLocked(); err != nil {
+		t.Fatalf("%s no pudo publicar: %v", c.name, err)
+	}
+}
+
+func replayChanges(t *testing.T, c *testComputer) {
+	t.Helper()
+	if err := tryReplayChanges(t, c); err != nil {
+		t.Fatalf("%s no pudo repetir los cambios: %v", c.name, err)
+	}
+}
+
+func tryReplayChanges(t *testing.T, c *testComputer) error {
+	c.use(t)
+	syncMu.Lock()
+	defer syncMu.Unlock()
+	return replayChangesLocked()
+}
+
+// exchange publica y repite los cambios de las dos computadoras.
+func exchange(t *testing.T, a, b *testComputer) {
+	t.Helper()
+	publishChanges(t, a)
+	publishChanges(t, b)
+	replayChanges(t, a)
+	replayChanges(t, b)
+}
+
+func setField(t *testing.T, c *testComputer, id, field, value string) {
+	t.Helper()
+	c.use(t)
+	if err := c.census.as("operador de " + c.name).Update(CensusRecord{ID: id, Fields: map[string]string{field: value}}); err != nil {
+		t.Fatal(err)
+	}
+	// Las fechas del diario deciden qué cambio es más nuevo
+	time.Sleep(5 * time.Millisecond)
+}
+
+func field(t *testing.T, c *testComputer, id, name string) string {
+	t.Helper()
+	rec, err := c.store.Get(id)
+	if err != nil {
+		t.Fatalf("%s: %s: %v", c.name, id, err)
+	}
+	return rec.Fields[name]
+}
+
+func conflictsOf(t *testing.T, c *testComputer) []SyncConflict {
+	t.Helper()
+	c.use(t)
+	list, err := syncConflicts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return list
+}
+
+func TestChangesDifferentHouseholds(t *testing.T) {
+	_, a, b := newChangesTest(t)
+	setField(t, a, "p00000", "Edad", "40")
+	setField(t, b, "p00003", "Edad", "70")
+	exchange(t, a, b)
+
+	for _, c := range []*testComputer{a, b} {
+		if got := field(t, c, "p00000", "Edad"); got != "40" {
+			t.Errorf("%s: p00000 tiene Edad %q, se esperaba 40", c.name, got)
+		}
+		if got := field(t, c, "p00003", "Edad"); got != "70" {
+			t.Errorf("%s: p00003 tiene Edad %q, se esperaba 70", c.name, got)
+		}
+		if list := conflictsOf(t, c); len(list) != 0 {
+			t.Errorf("%s: quedaron conflictos %+v", c.name, list)
+		}
+	}
+}
+
+func TestChangesSameFieldLastWriterWins(t *testing.T) {
+	_, a, b := newChangesTest(t)
+	setField(t, a, "p00001", "Edad", "de ana")
+	setField(t, b, "p00001", "Edad", "de beto")
+	exchange(t, a, b)
+
+	for _, c := range []*testComputer{a, b} {
+		if got := field(t, c, "p00001", "Edad"); got != "de beto" {
+			t.Errorf("%s: p00001 tiene Edad %q, se esperaba el cambio más nuevo", c.name, got)
+		}
+	}
+	// Solo donde se reemplazó el cambio propio queda el conflicto
+	list := conflictsOf(t, a)
+	if len(list) != 1 || list[0].Tipo != CONFLICTO_CAMPO || list[0].ID != "p00001" || list[0].Campo != "Edad" ||
+		list[0].Local != "de ana" || list[0].Remoto != "de beto" {
+		t.Errorf("ana quedó con los conflictos %+v", list)
+	}
+	if list := conflictsOf(t, b); len(list) != 0 {
+		t.Errorf("beto quedó con los conflictos %+v", list)
+	}
+}
+
+func TestChangesInsertDeleteRestore(t *testing.T) {
+	_, a, b := newChangesTest(t)
+	a.use(t)
+	ids, err := a.census.Insert(map[string]string{"Nombre completo": "Nueva", "COMUNIDAD": "Comunidad 1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.census.Delete(DeleteInfo{By: "ana", Reason: "mudanza"}, RecordRef{ID: "p00002"}); err != nil {
+		t.Fatal(err)
+	}
+	exchange(t, a, b)
+
+	if got := field(t, b, ids[0], "Nombre completo"); got != "Nueva" {
+		t.Errorf("beto tiene a %s con nombre %q", ids[0], got)
+	}
+	if got := field(t, b, ids[0], "COMUNIDAD"); got != "Comunidad 1" {
+		t.Errorf("beto tiene a %s en la comunidad %q", ids[0], got)
+	}
+	trash, err := b.store.Trash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trash) != 1 || trash[0].ID != "p00002" || trash[0].Reason != "mudanza" {
+		t.Fatalf("la papelera de beto quedó con %+v", trash)
+	}
+
+	a.use(t)
+	if err := a.census.Restore("p00002"); err != nil {
+		t.Fatal(err)
+	}
+	exchange(t, a, b)
+	if _, err := b.store.Get("p00002"); err != nil {
+		t.Fatalf("beto no restauró p00002: %v", err)
+	}
+	if records, _ := b.store.List(); len(records) != 7 {
+		t.Errorf("beto quedó con %d personas, se esperaban 7", len(records))
+	}
+}
+
+// conflictOnceStore devuelve *ConflictError en el guardado número failAt,
+// como si alguien hubiera guardado entre la lectura y la escritura.
+type conflictOnceStore struct {
+	CensusStore
+	saves, failAt int
+}
+
+func (s *conflictOnceStore) Save(updates []CensusRecord, inserts []map[string]string) ([]string, error) {
+	s.saves++
+	if s.saves == s.failAt {
+		return nil, &ConflictError{}
+	}
+	return s.CensusStore.Save(updates, inserts)
+}
+
+func TestChangesReplayAfterConflict(t *testing.T) {
+	_, a, b := newChangesTest(t)
+	setField(t, a, "p00004", "Edad", "33")
+	a.use(t)
+	ids, err := a.census.Insert(map[string]string{"Nombre completo": "Nueva"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	publishChanges(t, a)
+
+	// El primer cambio se guarda y el segundo choca a mitad de camino
+	flaky := &conflictOnceStore{CensusStore: b.store, failAt: 2}
+	b.census = newJournaledCensus(flaky, b.store, b.journal)
+	b.census.instancia = b.name
+	if err := tryReplayChanges(t, b); err == nil {
+		t.Fatal("la repetición no devolvió el conflicto")
+	} else if _, ok := err.(*ConflictError); !ok {
+		t.Fatalf("la repetición devolvió %v, se esperaba *ConflictError", err)
+	}
+
+	// La próxima vez se repite todo el segmento sin duplicar nada
+	replayChanges(t, b)
+	replayChanges(t, b)
+	if got := field(t, b, "p00004", "Edad"); got != "33" {
+		t.Errorf("p00004 tiene Edad %q, se esperaba 33", got)
+	}
+	records, _ := b.store.List()
+	nuevas := 0
+	for _, rec := range records {
+		if rec.Fields["Nombre completo"] == "Nueva" {
+			nuevas++
+			if rec.ID != ids[0] {
+				t.Errorf("la persona nueva quedó con el ID %s, se esperaba %s", rec.ID, ids[0])
+			}
+		}
+	}
+	if nuevas != 1 {
+		t.Errorf("la persona nueva quedó %d veces", nuevas)
+	}
+	entries, _ := b.journal.Journal(JournalFilter{RecordID: "p00004"})
+	if len(entries) != 1 {
+		t.Errorf("el diario de beto tiene %d entradas de p00004, se esperaba 1", len(entries))
+	}
+}
+
+func TestChangesOwnEntriesNotRepublished(t *testing.T) {
+	backend, a, b := newChangesTest(t)
+	setField(t, b, "p00005", "Edad", "20")
+	exchange(t, a, b)
+	before, err := backend.List(SYNC_CHANGES_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Ana repitió el cambio de beto: publicar otra vez no sube nada
+	publishChanges(t, a)
+	publishChanges(t, b)
+	after, err := backend.List(SYNC_CHANGES_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(after) != len(before) {
+		t.Fatalf("se publicaron segmentos de más: antes %v, después %v", before, after)
+	}
+	for name := range after {
+		if strings.HasPrefix(name, a.name+"-") {
+			t.Errorf("ana publicó %s sin tener cambios propios", name)
+		}
+	}
+
+	setField(t, a, "p00000", "Edad", "1")
+	publishChanges(t, a)
+	data, _, err := backend.Pull(SYNC_CHANGES_DIR + "/" + changeSegment(a.name, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "p00005") || !strings.Contains(string(data), "p00000") {
+		t.Errorf("el segmento de ana tiene cambios ajenos o le falta el propio:\n%s", data)
+	}
+}
+
+func TestParseChangeSegment(t *testing.T) {
+	tests := []struct {
+		name string
+		inst string
+		n    int
+		ok   bool
+	}{
+		{changeSegment("ana", 1), "ana", 1, true},
+		{changeSegment("casa-comunal_2", 120), "casa-comunal_2", 120, true},
+		{"ana-00000000.jsonl", "", 0, false},
+		{"ana-x.jsonl", "", 0, false},
+		{"ana-00000001.json", "", 0, false},
+		{"-00000001.jsonl", "", 0, false},
+		{"a b-00000001.jsonl", "", 0, false},
+	}
+	for _, tt := range tests {
+		inst, n, ok := parseChangeSegment(tt.name)
+		if inst != tt.inst || n != tt.n || ok != tt.ok {
+			t.Errorf("parseChangeSegment(%q) = %q, %d, %v; se esperaba %q, %d, %v", tt.name, inst, n, ok, tt.inst, tt.n, tt.ok)
+		}
+	}
+	if got := changeSegment("ana", 3); got != "ana-00000003.jsonl" {
+		t.Errorf("changeSegment devolvió %q", got)
+	}
+}
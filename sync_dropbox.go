@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// DropboxCredentials son las claves de la aplicación de Dropbox.
+type DropboxCredentials struct {
+	AppKey       string
+	AppSecret    string
+	RefreshToken string
+}
+
+// DropboxBackend guarda los archivos en la carpeta Dir dentro de la cuenta de
+// Dropbox de la aplicación. El token de acceso se pide con el refresh token y se reutiliza
+// hasta poco antes de que venza (ver dropboxTokens).
+//
+// BaseURL reemplaza los servidores de Dropbox por otro que atiende las mismas
+// rutas, como el Dropbox de prueba de los tests; vacío usa Dropbox.
+type DropboxBackend struct {
+	Dir         string
+	Credentials func() DropboxCredentials
+	Client      *http.Client
+	BaseURL     string
+
+	tokens dropboxTokens
+}
+
+func (d *DropboxBackend) Name() string { return "Dropbox" }
+
+// endpoint arma la dirección de una ruta de la API. Dropbox la reparte entre
+// varios servidores (host); con BaseURL todas van al mismo.
+func (d *DropboxBackend) endpoint(host, path string) string {
+	if d.BaseURL != "" {
+		return strings.TrimRight(d.BaseURL, "/") + path
+	}
+	return "https://" + host + path
+}
+
+// accessToken devuelve un token de acceso vigente. Los errores son
+// *DropboxTokenError.
+func (d *DropboxBackend) accessToken() (string, error) {
+	return d.tokens.get(d.Credentials(), func(creds DropboxCredentials) (string, time.Duration, error) {
+		return requestDropboxToken(d.Client, d.endpoint("api.dropbox.com", "/oauth2/token"), creds)
+	})
+}
+
+// call hace una petición autenticada a la API de Dropbox. arg va en el
+// encabezado Dropbox-API-Arg (endpoints de contenido) o como cuerpo JSON. Si
+// Dropbox rechaza el token (401) se pide otro y se reintenta una vez.
+func (d *DropboxBackend) call(url, arg string, body []byte, argInHeader bool) (*http.Response, error) {
+	for intento := 0; ; intento++ {
+		token, err := d.accessToken()
+		if err != nil {
+			return nil, err
+		}
+
+		var req *http.Request
+		if argInHeader {
+			req, err = http.NewRequest("POST", url, bytes.NewReader(body))
+			if err == nil {
+				req.Header.Set("Dropbox-API-Arg", arg)
+				if body != nil {
+					req.Header.Set("Content-Type", "application/octet-stream")
+				}
+			}
+		} else {
+			req, err = http.NewRequest("POST", url, strings.NewReader(arg))
+			if err == nil {
+				req.Header.Set("Content-Type", "application/json")
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+
+		resp, err := d.Client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		switch resp.StatusCode {
+		case http.StatusOK:
+			return resp, nil
+		case http.StatusUnauthorized:
+			msg, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			d.tokens.invalidate(token)
+			if intento == 0 {
+				continue
+			}
+			return nil, fmt.Errorf("Dropbox rechazó el token de acceso: %s", dropboxErrorSummary(msg))
+		case http.StatusConflict:
+			// Dropbox responde 409 con "path/not_found" si el archivo no existe y
+			// con "path/conflict" si cambió desde la revisión esperada
+			msg, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			summary := dropboxErrorSummary(msg)
+			if strings.Contains(summary, "not_found") {
+				return nil, errRemoteNotFound
+			}
+			if strings.Contains(summary, "conflict") {
+				return nil, errRemoteChanged
+			}
+			return nil, fmt.Errorf("%s: %s", resp.Status, summary)
+		}
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s", resp.Status)
+	}
+}
+
+// dropboxErrorSummary saca el error_summary de una respuesta de error de la
+// API, o devuelve el texto tal cual si no es JSON.
+func dropboxErrorSummary(msg []byte) string {
+	var result struct {
+		ErrorSummary string `json:"error_summary"`
+	}
+	if json.Unmarshal(msg, &result) == nil && result.ErrorSummary != "" {
+		return result.ErrorSummary
+	}
+	return strings.TrimSpace(string(msg))
+}
+
+// dropboxArg arma el argumento JSON de una llamada sobre el archivo name.
+func (d *DropboxBackend) dropboxArg(name string, extra map[string]interface{}) string {
+	arg := map[string]interface{}{"path": d.path(name)}
+	for k, v := range extra {
+		arg[k] = v
+	}
+	b, _ := json.Marshal(arg)
+	return string(b)
+}
+
+// path es la ruta de name dentro de Dropbox: la carpeta del libro más name.
+func (d *DropboxBackend) path(name string) string {
+	p := d.Dir
+	if !strings.HasSuffix(p, "/") {
+		p += "/"
+	}
+	return strings.TrimSuffix(p+name, "/")
+}
+
+func (d *DropboxBackend) Pull(name string) ([]byte, string, error) {
+	resp, err := d.call(d.endpoint("content.dropboxapi.com", "/2/files/download"), d.dropboxArg(name, nil), nil, true)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", err
+	}
+	var meta struct {
+		Rev string `json:"rev"`
+	}
+	json.Unmarshal([]byte(resp.Header.Get("Dropbox-API-Result")), &meta)
+	return data, meta.Rev, nil
+}
+
+// Push usa el modo "update" de Dropbox, que solo sube si el archivo sigue en
+// parentRev, o "add" si todavía no hay archivo. Dropbox responde 409 con
+// "conflict" si otra computadora lo cambió.
+func (d *DropboxBackend) Push(name string, data []byte, parentRev string) (string, error) {
+	var mode interface{} = "add"
+	if parentRev != "" {
+		mode = map[string]string{".tag": "update", "update": parentRev}
+	}
+	resp, err := d.call(d.endpoint("content.dropboxapi.com", "/2/files/upload"), d.dropboxArg(name, map[string]interface{}{"mode": mode, "autorename": false}), data, true)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	return decodeDropboxRev(resp)
+}
+
+func (d *DropboxBackend) Revision(name string) (string, error) {
+	resp, err := d.call(d.endpoint("api.dropboxapi.com", "/2/files/get_metadata"), d.dropboxArg(name, nil), nil, false)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	return decodeDropboxRev(resp)
+}
+
+// Delete usa parent_rev, así Dropbox solo borra si nadie cambió el archivo.
+func (d *DropboxBackend) Delete(name, parentRev string) error {
+	resp, err := d.call(d.endpoint("api.dropboxapi.com", "/2/files/delete_v2"), d.dropboxArg(name, map[string]interface{}{"parent_rev": parentRev}), nil, false)
+	if err == errRemoteNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// List pide la carpeta con list_folder y sigue con list_folder/continue
+// mientras Dropbox diga que hay más.
+func (d *DropboxBackend) List(dir string) (map[string]string, error) {
+	revs := make(map[string]string)
+	url := d.endpoint("api.dropboxapi.com", "/2/files/list_folder")
+	arg := d.dropboxArg(dir, nil)
+	for {
+		resp, err := d.call(url, arg, nil, false)
+		if err == errRemoteNotFound {
+			return revs, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		var page struct {
+			Entries []struct {
+				Tag  string `json:".tag"`
+				Name string `json:"name"`
+				Rev  string `json:"rev"`
+			} `json:"entries"`
+			Cursor  string `json:"cursor"`
+			HasMore bool   `json:"has_more"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("respuesta de Dropbox inválida: %v", err)
+		}
+		for _, e := range page.Entries {
+			if e.Tag == "file" {
+				revs[e.Name] = e.Rev
+			}
+		}
+		if !page.HasMore {
+			return revs, nil
+		}
+		url = d.endpoint("api.dropboxapi.com", "/2/files/list_folder/continue")
+		b, _ := json.Marshal(map[string]string{"cursor": page.Cursor})
+		arg = string(b)
+	}
+}
+
+func decodeDropboxRev(resp *http.Response) (string, error) {
+	var meta struct {
+		Rev string `json:"rev"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&meta); err != nil {
+		return "", fmt.Errorf("respuesta de Dropbox inválida: %v", err)
+	}
+	return meta.Rev, nil
+}
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeDropbox imita la parte de la API de Dropbox que usa DropboxBackend
+// (oauth2/token, files/download, files/upload, files/get_metadata,
+// files/delete_v2 y files/list_folder), con los archivos en memoria y una
+// revisión nueva en cada subida.
+//
+// Los contadores fallar* y cortarDescarga hacen que las próximas peticiones
+// de ese tipo fallen como fallaría Dropbox; cada petición que falla descuenta
+// uno. peticiones dice cuántas recibió cada ruta.
+type fakeDropbox struct {
+	credentials   DropboxCredentials
+	tokenDuracion time.Duration // 4 horas si es 0, como en Dropbox
+
+	mu             sync.Mutex
+	fallarToken    int // oauth2/token responde 400 invalid_grant
+	fallarSubida   int // files/upload responde 500
+	cortarDescarga int // files/download manda solo la mitad del archivo
+	files          map[string]fakeDropboxFile
+	tokens         map[string]time.Time
+	ultimaRev      int
+	peticiones     map[string]int
+}
+
+type fakeDropboxFile struct {
+	Path     string // como se subió; las claves de files van en minúsculas
+	Data     []byte
+	Rev      string
+	Modified time.Time
+}
+
+func (f *fakeDropbox) put(path string, data []byte) string {
+	if f.files == nil {
+		f.files = make(map[string]fakeDropboxFile)
+	}
+	f.ultimaRev++
+	rev := fmt.Sprintf("%09x", f.ultimaRev)
+	f.files[strings.ToLower(path)] = fakeDropboxFile{Path: path, Data: append([]byte{}, data...), Rev: rev, Modified: time.Now().UTC()}
+	return rev
+}
+
+func (f *fakeDropbox) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.peticiones == nil {
+		f.peticiones = make(map[string]int)
+	}
+	f.peticiones[r.URL.Path]++
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Método no permitido", http.StatusMethodNotAllowed)
+		return
+	}
+	if r.URL.Path == "/oauth2/token" {
+		f.token(w, r)
+		return
+	}
+
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if vence, ok := f.tokens[token]; !ok || time.Now().After(vence) {
+		fakeDropboxError(w, http.StatusUnauthorized, "expired_access_token", "")
+		return
+	}
+
+	var arg struct {
+		Path      string          `json:"path"`
+		Mode      json.RawMessage `json:"mode"`
+		ParentRev string          `json:"parent_rev"`
+	}
+	var body []byte
+	switch r.URL.Path {
+	case "/2/files/download", "/2/files/upload":
+		if err := json.Unmarshal([]byte(r.Header.Get("Dropbox-API-Arg")), &arg); err != nil {
+			http.Error(w, "Dropbox-API-Arg inválido: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		body, _ = ioutil.ReadAll(r.Body)
+	case "/2/files/get_metadata", "/2/files/delete_v2", "/2/files/list_folder":
+		if err := json.NewDecoder(r.Body).Decode(&arg); err != nil {
+			http.Error(w, "JSON inválido: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	file, exists := f.files[strings.ToLower(arg.Path)]
+
+	switch r.URL.Path {
+	case "/2/files/download":
+		if !exists {
+			fakeDropboxError(w, http.StatusConflict, "path", "not_found")
+			return
+		}
+		w.Header().Set("Dropbox-API-Result", fakeDropboxMetadata(file))
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Length", strconv.Itoa(len(file.Data)))
+		data := file.Data
+		if f.cortarDescarga > 0 {
+			// Se corta la conexión antes de terminar, como una descarga
+			// interrumpida
+			f.cortarDescarga--
+			data = data[:len(data)/2]
+		}
+		w.Write(data)
+
+	case "/2/files/upload":
+		if f.fallarSubida > 0 {
+			f.fallarSubida--
+			http.Error(w, "Error interno", http.StatusInternalServerError)
+			return
+		}
+		var mode struct {
+			Tag    string `json:".tag"`
+			Update string `json:"update"`
+		}
+		var plain string
+		if json.Unmarshal(arg.Mode, &plain) == nil {
+			mode.Tag = plain
+		} else {
+			json.Unmarshal(arg.Mode, &mode)
+		}
+		switch mode.Tag {
+		case "", "add":
+			if exists {
+				fakeDropboxError(w, http.StatusConflict, "path", "conflict")
+				return
+			}
+		case "update":
+			if !exists || file.Rev != mode.Update {
+				fakeDropboxError(w, http.StatusConflict, "path", "conflict")
+				return
+			}
+		case "overwrite":
+		default:
+			http.Error(w, "mode desconocido: "+mode.Tag, http.StatusBadRequest)
+			return
+		}
+		f.put(arg.Path, body)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, fakeDropboxMetadata(f.files[strings.ToLower(arg.Path)]))
+
+	case "/2/files/get_metadata":
+		if !exists {
+			fakeDropboxError(w, http.StatusConflict, "path", "not_found")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, fakeDropboxMetadata(file))
+
+	case "/2/files/delete_v2":
+		if !exists {
+			fakeDropboxError(w, http.StatusConflict, "path_lookup", "not_found")
+			return
+		}
+		if arg.ParentRev != "" && arg.ParentRev != file.Rev {
+			fakeDropboxError(w, http.StatusConflict, "path_write", "conflict")
+			return
+		}
+		delete(f.files, strings.ToLower(arg.Path))
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"metadata": %s}`, fakeDropboxMetadata(file))
+
+	case "/2/files/list_folder":
+		// Solo los archivos que están directamente en la carpeta
+		prefix := strings.ToLower(arg.Path) + "/"
+		var entries []json.RawMessage
+		for key, file := range f.files {
+			if strings.HasPrefix(key, prefix) && !strings.Contains(key[len(prefix):], "/") {
+				entries = append(entries, json.RawMessage(fakeDropboxMetadata(file)))
+			}
+		}
+		if len(entries) == 0 {
+			fakeDropboxError(w, http.StatusConflict, "path", "not_found")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"entries": entries, "cursor": "", "has_more": false})
+	}
+}
+
+// token atiende oauth2/token con grant_type=refresh_token.
+func (f *fakeDropbox) token(w http.ResponseWriter, r *http.Request) {
+	oauthError := func(status int, code, description string) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]string{"error": code, "error_description": description})
+	}
+	if f.fallarToken > 0 {
+		f.fallarToken--
+		oauthError(http.StatusBadRequest, "invalid_grant", "refresh token is invalid or revoked")
+		return
+	}
+
+	key, secret, _ := r.BasicAuth()
+	refresh := r.FormValue("refresh_token")
+	want := f.credentials
+	if want.AppKey == "" {
+		if key == "" || secret == "" {
+			oauthError(http.StatusBadRequest, "invalid_client", "missing client credentials")
+			return
+		}
+		if refresh == "" {
+			oauthError(http.StatusBadRequest, "invalid_grant", "refresh token is invalid or revoked")
+			return
+		}
+	} else {
+		if key != want.AppKey || secret != want.AppSecret {
+			oauthError(http.StatusBadRequest, "invalid_client", "invalid client_id or client_secret")
+			return
+		}
+		if refresh != want.RefreshToken {
+			oauthError(http.StatusBadRequest, "invalid_grant", "refresh token is invalid or revoked")
+			return
+		}
+	}
+	if r.FormValue("grant_type") != "refresh_token" {
+		oauthError(http.StatusBadRequest, "unsupported_grant_type", "grant_type must be refresh_token")
+		return
+	}
+
+	duracion := f.tokenDuracion
+	if duracion == 0 {
+		duracion = DROPBOX_TOKEN_DURACION
+	}
+	if f.tokens == nil {
+		f.tokens = make(map[string]time.Time)
+	}
+	token := fmt.Sprintf("prueba.%d", time.Now().UnixNano())
+	f.tokens[token] = time.Now().Add(duracion)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token": token,
+		"token_type":   "bearer",
+		"expires_in":   int(duracion / time.Second),
+	})
+}
+
+// fakeDropboxError responde un error con el formato de Dropbox, por ejemplo
+// 409 con error_summary "path/not_found/".
+func fakeDropboxError(w http.ResponseWriter, status int, tag, subtag string) {
+	summary := tag + "/"
+	detail := map[string]interface{}{".tag": tag}
+	if subtag != "" {
+		summary += subtag + "/"
+		detail[tag] = map[string]string{".tag": subtag}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{"error_summary": summary, "error": detail})
+}
+
+func fakeDropboxMetadata(file fakeDropboxFile) string {
+	b, _ := json.Marshal(map[string]interface{}{
+		".tag":            "file",
+		"name":            file.Path[strings.LastIndex(file.Path, "/")+1:],
+		"path_display":    file.Path,
+		"rev":             file.Rev,
+		"size":            len(file.Data),
+		"server_modified": file.Modified.Format(time.RFC3339),
+	})
+	return string(b)
+}
+
+func newTestDropboxBackend(t *testing.T) (*DropboxBackend, *fakeDropbox) {
+	creds := DropboxCredentials{AppKey: "clave", AppSecret: "secreta", RefreshToken: "renovar"}
+	fake := &fakeDropbox{credentials: creds}
+	srv := httptest.NewServer(fake)
+	t.Cleanup(srv.Close)
+	b := &DropboxBackend{
+		Dir:         "/censo",
+		Credentials: func() DropboxCredentials { return creds },
+		Client:      srv.Client(),
+		BaseURL:     srv.URL,
+	}
+	return b, fake
+}
+
+// set cambia el Dropbox de prueba con el candado tomado.
+func (f *fakeDropbox) set(change func()) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	change()
+}
+
+func TestDropboxBackend(t *testing.T) {
+	b, _ := newTestDropboxBackend(t)
+	testSyncBackend(t, b)
+}
+
+func TestDropboxBackendTokenRefreshFailure(t *testing.T) {
+	b, fake := newTestDropboxBackend(t)
+	fake.set(func() { fake.fallarToken = 1 })
+
+	_, _, err := b.Pull("history.json")
+	tokenErr, ok := err.(*DropboxTokenError)
+	if !ok {
+		t.Fatalf("Pull sin token devolvió %v, se esperaba *DropboxTokenError", err)
+	}
+	if !tokenErr.Credenciales() || tokenErr.Code != "invalid_grant" {
+		t.Fatalf("el error del token es %+v, se esperaba invalid_grant de credenciales", tokenErr)
+	}
+	// El token fallido no queda guardado: la próxima llamada pide otro
+	if _, _, err := b.Pull("history.json"); err != errRemoteNotFound {
+		t.Fatalf("Pull después de un token fallido devolvió %v, se esperaba errRemoteNotFound", err)
+	}
+}
+
+func TestDropboxBackendExpiredToken(t *testing.T) {
+	b, fake := newTestDropboxBackend(t)
+	if _, err := b.Push("history.json", []byte("[]"), ""); err != nil {
+		t.Fatal(err)
+	}
+	// Dropbox deja de aceptar el token antes de que venza: se pide otro y se
+	// repite la llamada
+	fake.set(func() { fake.tokens = nil })
+	if data, _, err := b.Pull("history.json"); err != nil || string(data) != "[]" {
+		t.Fatalf("Pull con el token vencido devolvió %q, %v", data, err)
+	}
+	fake.set(func() {
+		if n := fake.peticiones["/oauth2/token"]; n != 2 {
+			t.Errorf("se pidieron %d tokens, se esperaban 2", n)
+		}
+	})
+}
+
+func TestDropboxBackendConflict(t *testing.T) {
+	b, fake := newTestDropboxBackend(t)
+	rev, err := b.Push("CENSO GENERAL NUEVO.xlsx", []byte("uno"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Otra computadora sube antes
+	fake.set(func() { fake.put("/censo/CENSO GENERAL NUEVO.xlsx", []byte("de otra")) })
+
+	if _, err := b.Push("CENSO GENERAL NUEVO.xlsx", []byte("dos"), rev); err != errRemoteChanged {
+		t.Fatalf("Push sobre una revisión vieja devolvió %v, se esperaba errRemoteChanged", err)
+	}
+	if err := b.Delete("CENSO GENERAL NUEVO.xlsx", rev); err != errRemoteChanged {
+		t.Fatalf("Delete sobre una revisión vieja devolvió %v, se esperaba errRemoteChanged", err)
+	}
+	if data, _, _ := b.Pull("CENSO GENERAL NUEVO.xlsx"); string(data) != "de otra" {
+		t.Fatalf("el conflicto cambió el remoto a %q", data)
+	}
+}
+
+func TestDropboxBackendPartialDownload(t *testing.T) {
+	b, fake := newTestDropboxBackend(t)
+	if _, err := b.Push("CENSO GENERAL NUEVO.xlsx", []byte("un libro bastante largo"), ""); err != nil {
+		t.Fatal(err)
+	}
+	fake.set(func() { fake.cortarDescarga = 1 })
+
+	// Una descarga cortada es un error, nunca medio libro
+	if data, _, err := b.Pull("CENSO GENERAL NUEVO.xlsx"); err == nil {
+		t.Fatalf("Pull de una descarga cortada devolvió %q sin error", data)
+	}
+	if data, _, err := b.Pull("CENSO GENERAL NUEVO.xlsx"); err != nil || string(data) != "un libro bastante largo" {
+		t.Fatalf("Pull después de la descarga cortada devolvió %q, %v", data, err)
+	}
+}
+
+func TestDropboxBackendUploadRetry(t *testing.T) {
+	b, fake := newTestDropboxBackend(t)
+	rev, err := b.Push("CENSO GENERAL NUEVO.xlsx", []byte("uno"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake.set(func() { fake.fallarSubida = 2 })
+
+	// Las subidas que fallan no tocan el remoto, así el reintento sigue
+	// subiendo sobre la misma revisión
+	for i := 0; i < 2; i++ {
+		if _, err := b.Push("CENSO GENERAL NUEVO.xlsx", []byte("dos"), rev); err == nil || err == errRemoteChanged {
+			t.Fatalf("la subida %d devolvió %v, se esperaba el error 500", i+1, err)
+		}
+	}
+	newRev, err := b.Push("CENSO GENERAL NUEVO.xlsx", []byte("dos"), rev)
+	if err != nil {
+		t.Fatalf("el reintento devolvió %v", err)
+	}
+	if data, got, err := b.Pull("CENSO GENERAL NUEVO.xlsx"); err != nil || string(data) != "dos" || got != newRev {
+		t.Fatalf("Pull después del reintento devolvió %q, %q, %v", data, got, err)
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ------------------- TOKEN DE ACCESO DE DROPBOX -------------------------
+
+// Un token se deja de usar DROPBOX_TOKEN_MARGEN antes de que venza, y desde
+// DROPBOX_TOKEN_RENOVAR antes se pide otro en segundo plano mientras se sigue
+// usando el actual, así las operaciones casi nunca esperan por el token.
+const DROPBOX_TOKEN_MARGEN = time.Minute
+const DROPBOX_TOKEN_RENOVAR = 5 * time.Minute
+
+// DROPBOX_TOKEN_DURACION es cuánto se supone que dura un token si la
+// respuesta no lo dice (expires_in vacío o 0): lo que duran los de Dropbox.
+const DROPBOX_TOKEN_DURACION = 4 * time.Hour
+
+// DropboxTokenError es un error al pedir el token de acceso. Si Dropbox
+// respondió, Status es el código HTTP y Code/Description el error de OAuth
+// ("invalid_grant", "invalid_client"...); si no hubo respuesta, Err es el
+// error de la conexión.
+type DropboxTokenError struct {
+	Status      int
+	Code        string
+	Description string
+	Err         error
+}
+
+func (e *DropboxTokenError) Error() string {
+	switch {
+	case e.Err != nil:
+		return fmt.Sprintf("no se pudo pedir el token de Dropbox: %v", e.Err)
+	case e.Credenciales():
+		return fmt.Sprintf("Dropbox rechazó las credenciales (%s: %s); revise %s, %s y %s",
+			e.Code, e.Description, CRED_DROPBOX_APP_KEY, CRED_DROPBOX_APP_SECRET, CRED_DROPBOX_REFRESH_TOKEN)
+	case e.Code != "":
+		return fmt.Sprintf("Dropbox no entregó el token (%d %s: %s)", e.Status, e.Code, e.Description)
+	}
+	return fmt.Sprintf("Dropbox no entregó el token (%d %s)", e.Status, e.Description)
+}
+
+func (e *DropboxTokenError) Unwrap() error { return e.Err }
+
+// Credenciales dice si el problema son las claves. Reintentar no sirve hasta
+// que se corrijan en el archivo de credenciales.
+func (e *DropboxTokenError) Credenciales() bool {
+	switch e.Code {
+	case "invalid_grant", "invalid_client", "unauthorized_client":
+		return true
+	}
+	return e.Err == nil && e.Code == "" && e.Status == http.StatusUnauthorized
+}
+
+// dropboxTokens guarda el token de acceso vigente. Es seguro usarlo desde
+// varias goroutines: si hace falta un token nuevo se pide una sola vez y los
+// demás esperan ese mismo pedido. mu no se tiene tomado mientras se pide, así
+// que las demás operaciones no esperan por la red.
+type dropboxTokens struct {
+	mu     sync.Mutex
+	token  string
+	creds  DropboxCredentials
+	vence  time.Time
+	pedido *dropboxTokenRequest
+}
+
+// dropboxTokenRequest es un pedido de token en curso; done se cierra cuando
+// termina, con token y err ya puestos.
+type dropboxTokenRequest struct {
+	creds DropboxCredentials
+	done  chan struct{}
+	token string
+	err   error
+}
+
+// dropboxRefresh pide un token nuevo y dice cuánto dura.
+type dropboxRefresh func(creds DropboxCredentials) (string, time.Duration, error)
+
+// get devuelve el token guardado si sigue vigente y es de las mismas
+// credenciales (si se rotaron, el anterior ya no sirve); si no, pide uno o
+// espera el que ya se está pidiendo con esas credenciales.
+func (t *dropboxTokens) get(creds DropboxCredentials, refresh dropboxRefresh) (string, error) {
+	t.mu.Lock()
+	now := time.Now()
+	if t.token != "" && t.creds == creds && now.Before(t.vence.Add(-DROPBOX_TOKEN_MARGEN)) {
+		token := t.token
+		if now.After(t.vence.Add(-DROPBOX_TOKEN_RENOVAR)) && t.pedido == nil {
+			p := t.start(creds)
+			go func() {
+				if err := t.run(p, refresh); err != nil {
+					// El token actual sigue valiendo un rato; get lo vuelve a intentar
+					fmt.Printf("--- ERROR: No se pudo renovar el token de Dropbox: %v ---\n", err)
+				}
+			}()
+		}
+		t.mu.Unlock()
+		return token, nil
+	}
+
+	p := t.pedido
+	if p == nil || p.creds != creds {
+		p = t.start(creds)
+		t.mu.Unlock()
+		t.run(p, refresh)
+	} else {
+		t.mu.Unlock()
+	}
+	<-p.done
+	return p.token, p.err
+}
+
+// start anota un pedido nuevo con creds. Hay que tener tomado mu.
+func (t *dropboxTokens) start(creds DropboxCredentials) *dropboxTokenRequest {
+	t.pedido = &dropboxTokenRequest{creds: creds, done: make(chan struct{})}
+	return t.pedido
+}
+
+// run hace el pedido p sin tener tomado mu y guarda el token, salvo que otro
+// pedido con otras credenciales lo haya reemplazado mientras tanto.
+func (t *dropboxTokens) run(p *dropboxTokenRequest, refresh dropboxRefresh) error {
+	token, duracion, err := refresh(p.creds)
+
+	t.mu.Lock()
+	if t.pedido == p {
+		t.pedido = nil
+		if err == nil {
+			t.token, t.creds, t.vence = token, p.creds, time.Now().Add(duracion)
+		}
+	}
+	t.mu.Unlock()
+	p.token, p.err = token, err
+	close(p.done)
+	return err
+}
+
+// invalidate descarta token si es el guardado, por ejemplo porque Dropbox lo
+// rechazó antes de lo esperado.
+func (t *dropboxTokens) invalidate(token string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.token == token {
+		t.token = ""
+	}
+}
+
+// requestDropboxToken pide un token de acceso a tokenURL usando el Refresh
+// Token. Las respuestas de error se convierten en *DropboxTokenError.
+func requestDropboxToken(client *http.Client, tokenURL string, creds DropboxCredentials) (string, time.Duration, error) {
+	form := url.Values{"grant_type": {"refresh_token"}, "refresh_token": {creds.RefreshToken}}
+	req, err := http.NewRequest("POST", tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", 0, &DropboxTokenError{Err: err}
+	}
+	req.SetBasicAuth(creds.AppKey, creds.AppSecret)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", 0, &DropboxTokenError{Err: err}
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", 0, &DropboxTokenError{Err: err}
+	}
+
+	var result struct {
+		AccessToken      string `json:"access_token"`
+		ExpiresIn        int    `json:"expires_in"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	jsonErr := json.Unmarshal(body, &result)
+
+	if resp.StatusCode != http.StatusOK || result.AccessToken == "" {
+		tokenErr := &DropboxTokenError{Status: resp.StatusCode, Code: result.Error, Description: result.ErrorDescription}
+		if jsonErr != nil || tokenErr.Code == "" {
+			// No es el formato de OAuth: se muestra lo que haya mandado,
+			// salvo que sea una página de error
+			tokenErr.Description = strings.TrimSpace(string(body))
+			if len(tokenErr.Description) > 200 {
+				tokenErr.Description = tokenErr.Description[:200]
+			}
+			if tokenErr.Description == "" || strings.HasPrefix(tokenErr.Description, "<") {
+				tokenErr.Description = http.StatusText(resp.StatusCode)
+			}
+		}
+		return "", 0, tokenErr
+	}
+	duracion := time.Duration(result.ExpiresIn) * time.Second
+	if duracion <= 0 {
+		// Sin duración el token se daría por vencido enseguida y se pediría
+		// uno nuevo en cada llamada
+		duracion = DROPBOX_TOKEN_DURACION
+	}
+	return result.AccessToken, duracion, nil
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRequestDropboxTokenWithoutExpiresIn(t *testing.T) {
+	for _, body := range []string{
+		`{"access_token": "token", "token_type": "bearer"}`,
+		`{"access_token": "token", "token_type": "bearer", "expires_in": 0}`,
+	} {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprint(w, body)
+		}))
+		token, duracion, err := requestDropboxToken(srv.Client(), srv.URL, DropboxCredentials{})
+		srv.Close()
+		if err != nil || token != "token" {
+			t.Fatalf("con %s devolvió %q, %v", body, token, err)
+		}
+		if duracion != DROPBOX_TOKEN_DURACION {
+			t.Errorf("con %s el token dura %s, se esperaba %s", body, duracion, DROPBOX_TOKEN_DURACION)
+		}
+	}
+}
+
+func TestDropboxTokensReuse(t *testing.T) {
+	var tokens dropboxTokens
+	pedidos := 0
+	refresh := func(DropboxCredentials) (string, time.Duration, error) {
+		pedidos++
+		return fmt.Sprintf("token %d", pedidos), DROPBOX_TOKEN_DURACION, nil
+	}
+	for i := 0; i < 3; i++ {
+		if token, err := tokens.get(DropboxCredentials{AppKey: "a"}, refresh); err != nil || token != "token 1" {
+			t.Fatalf("get devolvió %q, %v; se esperaba el primer token", token, err)
+		}
+	}
+	// Con otras credenciales el token anterior no sirve
+	if token, _ := tokens.get(DropboxCredentials{AppKey: "b"}, refresh); token != "token 2" {
+		t.Fatalf("get con otras credenciales devolvió %q, se esperaba un token nuevo", token)
+	}
+}
+
+func TestDropboxTokensSingleRefresh(t *testing.T) {
+	var tokens dropboxTokens
+	var pedidos int32
+	empezo := make(chan struct{})
+	seguir := make(chan struct{})
+	refresh := func(DropboxCredentials) (string, time.Duration, error) {
+		if atomic.AddInt32(&pedidos, 1) == 1 {
+			close(empezo)
+		}
+		<-seguir
+		return "token", DROPBOX_TOKEN_DURACION, nil
+	}
+
+	const n = 20
+	var wg sync.WaitGroup
+	results := make(chan string, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			token, err := tokens.get(DropboxCredentials{AppKey: "a"}, refresh)
+			if err != nil {
+				token = err.Error()
+			}
+			results <- token
+		}()
+	}
+	<-empezo
+	// Mientras se pide el token las demás operaciones no se quedan esperando
+	done := make(chan struct{})
+	go func() {
+		tokens.invalidate("otro")
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("invalidate esperó a que terminara el pedido del token")
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(seguir)
+	wg.Wait()
+	close(results)
+
+	for token := range results {
+		if token != "token" {
+			t.Errorf("get devolvió %q", token)
+		}
+	}
+	if got := atomic.LoadInt32(&pedidos); got != 1 {
+		t.Errorf("se pidieron %d tokens, se esperaba uno solo", got)
+	}
+}
+
+func TestDropboxTokensRefreshError(t *testing.T) {
+	var tokens dropboxTokens
+	fallar := true
+	refresh := func(DropboxCredentials) (string, time.Duration, error) {
+		if fallar {
+			return "", 0, &DropboxTokenError{Status: http.StatusBadRequest, Code: "invalid_grant"}
+		}
+		return "token", DROPBOX_TOKEN_DURACION, nil
+	}
+	if _, err := tokens.get(DropboxCredentials{}, refresh); err == nil {
+		t.Fatal("get no devolvió el error del pedido")
+	}
+	// El error no queda guardado: la próxima vez se vuelve a pedir
+	fallar = false
+	if token, err := tokens.get(DropboxCredentials{}, refresh); err != nil || token != "token" {
+		t.Fatalf("get después del error devolvió %q, %v", token, err)
+	}
+}
+
+func TestDropboxTokensRenewAhead(t *testing.T) {
+	var tokens dropboxTokens
+	var pedidos int32
+	renovando := make(chan struct{})
+	seguir := make(chan struct{})
+	refresh := func(DropboxCredentials) (string, time.Duration, error) {
+		switch atomic.AddInt32(&pedidos, 1) {
+		case 1:
+			// Vence dentro de DROPBOX_TOKEN_RENOVAR: se renueva en segundo plano
+			return "token 1", DROPBOX_TOKEN_RENOVAR - time.Minute, nil
+		case 2:
+			close(renovando)
+			<-seguir
+			return "", 0, fmt.Errorf("sin conexión")
+		default:
+			return "token 2", DROPBOX_TOKEN_DURACION, nil
+		}
+	}
+	creds := DropboxCredentials{AppKey: "a"}
+	if token, err := tokens.get(creds, refresh); err != nil || token != "token 1" {
+		t.Fatalf("get devolvió %q, %v", token, err)
+	}
+	// El token sigue vigente: se devuelve sin esperar a la renovación, y
+	// mientras se renueva no se pide otro
+	for i := 0; i < 3; i++ {
+		if token, err := tokens.get(creds, refresh); err != nil || token != "token 1" {
+			t.Fatalf("get durante la renovación devolvió %q, %v", token, err)
+		}
+	}
+	<-renovando
+	if token, _ := tokens.get(creds, refresh); token != "token 1" {
+		t.Fatalf("get durante la renovación devolvió %q", token)
+	}
+	if got := atomic.LoadInt32(&pedidos); got != 2 {
+		t.Fatalf("se pidieron %d tokens, se esperaban 2", got)
+	}
+
+	// Si la renovación falla se sigue usando el actual y se vuelve a intentar
+	close(seguir)
+	deadline := time.Now().Add(time.Second)
+	for {
+		token, err := tokens.get(creds, refresh)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token == "token 2" {
+			break
+		}
+		if token != "token 1" || time.Now().After(deadline) {
+			t.Fatalf("get devolvió %q, se esperaba que se renovara a token 2", token)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if got := atomic.LoadInt32(&pedidos); got != 3 {
+		t.Errorf("se pidieron %d tokens, se esperaban 3", got)
+	}
+	// El renovado dura lo normal: no se vuelve a pedir
+	if token, _ := tokens.get(creds, refresh); token != "token 2" || atomic.LoadInt32(&pedidos) != 3 {
+		t.Errorf("get devolvió %q después de renovar (%d pedidos)", token, atomic.LoadInt32(&pedidos))
+	}
+}
+
+func TestDropboxTokensRotatedDuringRefresh(t *testing.T) {
+	var tokens dropboxTokens
+	empezo := make(chan struct{})
+	seguir := make(chan struct{})
+	refresh := func(creds DropboxCredentials) (string, time.Duration, error) {
+		if creds.AppKey == "vieja" {
+			close(empezo)
+			<-seguir
+		}
+		return "token " + creds.AppKey, DROPBOX_TOKEN_DURACION, nil
+	}
+	vieja := make(chan string)
+	go func() {
+		token, _ := tokens.get(DropboxCredentials{AppKey: "vieja"}, refresh)
+		vieja <- token
+	}()
+	<-empezo
+	// Las credenciales cambian mientras se pide el token de las anteriores
+	if token, err := tokens.get(DropboxCredentials{AppKey: "nueva"}, refresh); err != nil || token != "token nueva" {
+		t.Fatalf("get con las credenciales nuevas devolvió %q, %v", token, err)
+	}
+	close(seguir)
+	if token := <-vieja; token != "token vieja" {
+		t.Errorf("el pedido anterior devolvió %q", token)
+	}
+	// El token de las credenciales viejas no reemplaza al nuevo
+	if token, _ := tokens.get(DropboxCredentials{AppKey: "nueva"}, refresh); token != "token nueva" {
+		t.Errorf("quedó guardado %q, se esperaba el de las credenciales nuevas", token)
+	}
+}
@@ -0,0 +1,464 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ------------------- SINCRONIZACIÓN DEL HISTORIAL, ACTIVIDADES E IMÁGENES -------------------------
+
+// SYNC_IMAGES_DIR es la carpeta de las imágenes (uploadDir) en el
+// almacenamiento compartido.
+const SYNC_IMAGES_DIR = "imagenes"
+
+// syncFile es lo que se recuerda de un archivo compartido (aparte del libro)
+// desde la última sincronización: su revisión remota y la huella del
+// contenido local.
+type syncFile struct {
+	Rev  string `json:"rev"`
+	Hash string `json:"hash"`
+}
+
+// errLocalChanged indica que los datos locales cambiaron mientras se
+// combinaban con los remotos; se reintenta en la próxima sincronización.
+var errLocalChanged = errors.New("los datos cambiaron mientras se combinaban; se reintentará")
+
+// syncDocument es un archivo JSON que se combina entrada por entrada con el
+// compartido, como el historial o las actividades.
+type syncDocument struct {
+	Name string
+	// Export devuelve el contenido local.
+	Export func() ([]byte, error)
+	// Merge combina local y remote contra base (nil si nunca se
+	// sincronizó).
+	Merge func(base, local, remote []byte) ([]byte, error)
+	// Import reemplaza lo local con data. local es lo que devolvió Export
+	// antes de combinar; si ya no es lo mismo devuelve errLocalChanged.
+	Import func(data, local []byte) error
+}
+
+func syncDocuments() []syncDocument {
+	return []syncDocument{
+		{Name: filepath.Base(HISTORY_FILE), Export: exportHistory, Merge: mergeHistory, Import: importHistory},
+		{Name: filepath.Base(ACTIVITIES_FILE), Export: exportActivities, Merge: mergeActivities, Import: importActivities},
+	}
+}
+
+// sincronizarArchivos combina el historial, las actividades y las imágenes
+// con los compartidos: trae lo que cambió en las otras computadoras y sube lo
+// que cambió aquí, archivo por archivo.
+func sincronizarArchivos() error {
+	if syncBackend == nil {
+		return nil
+	}
+	syncMu.Lock()
+	defer syncMu.Unlock()
+
+	for _, doc := range syncDocuments() {
+		if err := syncDocumentLocked(doc); err != nil {
+			err = fmt.Errorf("%s: %w", doc.Name, err)
+			setSyncError(err)
+			return err
+		}
+	}
+	if err := syncImagesLocked(); err != nil {
+		err = fmt.Errorf("imágenes: %w", err)
+		setSyncError(err)
+		return err
+	}
+	return nil
+}
+
+func syncDocBasePath(name string) string {
+	return filepath.Join(SYNC_DIR, "base-"+name)
+}
+
+// saveSyncFile anota la revisión y la huella de un archivo ya sincronizado.
+// Con rev vacío lo olvida (se borró de los dos lados).
+func saveSyncFile(name, rev, hash string) error {
+	return updateSyncState(func(st *syncState) {
+		if rev == "" {
+			delete(st.Archivos, name)
+			return
+		}
+		if st.Archivos == nil {
+			st.Archivos = make(map[string]syncFile)
+		}
+		st.Archivos[name] = syncFile{Rev: rev, Hash: hash}
+	})
+}
+
+// syncDocumentLocked sincroniza un documento. Si el remoto no cambió desde la
+// última vez, sube lo local si cambió; si cambió, lo combina con lo local y
+// sube el resultado si es distinto del remoto. Hay que tener tomado syncMu.
+func syncDocumentLocked(doc syncDocument) error {
+	name := syncBackend.Name()
+	for intento := 0; intento < 3; intento++ {
+		st, err := loadSyncState()
+		if err != nil {
+			return err
+		}
+		known := st.Archivos[doc.Name]
+		local, err := doc.Export()
+		if err != nil {
+			return err
+		}
+		rev, err := syncBackend.Revision(doc.Name)
+		if err == errRemoteNotFound {
+			rev = ""
+		} else if err != nil {
+			return err
+		}
+
+		data := local
+		switch {
+		case rev == known.Rev && contentRevision(local) == known.Hash:
+			// Nada cambió de ningún lado
+			return nil
+		case rev != known.Rev && rev != "":
+			remote, pulledRev, err := syncBackend.Pull(doc.Name)
+			if err != nil {
+				return err
+			}
+			base, err := ioutil.ReadFile(syncDocBasePath(doc.Name))
+			if os.IsNotExist(err) {
+				base = nil
+			} else if err != nil {
+				return err
+			}
+			if data, err = doc.Merge(base, local, remote); err != nil {
+				return err
+			}
+			if err := doc.Import(data, local); err != nil {
+				return err
+			}
+			if bytes.Equal(data, remote) {
+				fmt.Printf("--- SYNC (%s): %s actualizado ---\n", name, doc.Name)
+				return recordSyncDocument(doc.Name, pulledRev, data)
+			}
+			rev = pulledRev
+		}
+		// Si el remoto no existe (nunca se subió o lo borraron) se sube lo local
+
+		newRev, err := syncBackend.Push(doc.Name, data, rev)
+		if err == errRemoteChanged {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Printf("--- SYNC (%s): %s subido ---\n", name, doc.Name)
+		return recordSyncDocument(doc.Name, newRev, data)
+	}
+	return errRemoteChanged
+}
+
+// recordSyncDocument guarda data como la base del documento y anota su
+// revisión.
+func recordSyncDocument(name, rev string, data []byte) error {
+	if err := os.MkdirAll(SYNC_DIR, 0755); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(syncDocBasePath(name), data, 0644); err != nil {
+		return err
+	}
+	return saveSyncFile(name, rev, contentRevision(data))
+}
+
+// --- Historial ---
+
+func exportHistory() ([]byte, error) {
+	historyMu.Lock()
+	defer historyMu.Unlock()
+	return json.MarshalIndent(historyLogs, "", "  ")
+}
+
+// mergeHistory junta las entradas de los dos lados, más nuevas primero. El
+// historial solo crece, así que no hace falta la base.
+func mergeHistory(base, local, remote []byte) ([]byte, error) {
+	var a, b []HistoryEntry
+	if err := json.Unmarshal(local, &a); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(remote, &b); err != nil {
+		return nil, fmt.Errorf("el historial compartido no es válido: %v", err)
+	}
+	return json.MarshalIndent(unionHistory(a, b), "", "  ")
+}
+
+func unionHistory(a, b []HistoryEntry) []HistoryEntry {
+	type key struct {
+		User, Description string
+		Timestamp         int64
+	}
+	seen := make(map[key]bool, len(a)+len(b))
+	union := make([]HistoryEntry, 0, len(a)+len(b))
+	for _, list := range [][]HistoryEntry{a, b} {
+		for _, e := range list {
+			k := key{e.User, e.Description, e.Timestamp.UnixNano()}
+			if !seen[k] {
+				seen[k] = true
+				union = append(union, e)
+			}
+		}
+	}
+	sort.SliceStable(union, func(i, j int) bool { return union[i].Timestamp.After(union[j].Timestamp) })
+	return union
+}
+
+// importHistory junta data con el historial actual en vez de reemplazarlo,
+// así no se pierden las entradas agregadas mientras se combinaba.
+func importHistory(data, local []byte) error {
+	var entries []HistoryEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return err
+	}
+	historyMu.Lock()
+	defer historyMu.Unlock()
+	historyLogs = unionHistory(historyLogs, entries)
+	saveLogs()
+	return nil
+}
+
+// --- Actividades ---
+
+func exportActivities() ([]byte, error) {
+	activitiesMu.Lock()
+	defer activitiesMu.Unlock()
+	return json.MarshalIndent(activities, "", "  ")
+}
+
+// mergeActivities combina las actividades por ID contra la base: lo que
+// cambió de un solo lado toma ese valor y lo que se eliminó de un lado sin
+// cambios del otro se elimina. Si los dos lados cambiaron la misma actividad
+// queda la local; si uno la eliminó y el otro la cambió, se conserva. Dos
+// actividades nuevas con el mismo ID (cada computadora numera las suyas) se
+// conservan las dos y la local recibe otro ID. Sin base (la primera
+// sincronización) no se sabe qué es nuevo: el mismo ID de los dos lados es la
+// misma actividad y, si no coinciden, queda la local.
+func mergeActivities(base, local, remote []byte) ([]byte, error) {
+	var b, l, r []Activity
+	if base != nil {
+		if err := json.Unmarshal(base, &b); err != nil {
+			return nil, fmt.Errorf("la base de la sincronización está dañada: %v", err)
+		}
+	}
+	if err := json.Unmarshal(local, &l); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(remote, &r); err != nil {
+		return nil, fmt.Errorf("las actividades compartidas no son válidas: %v", err)
+	}
+	byID := func(list []Activity) map[int]Activity {
+		m := make(map[int]Activity, len(list))
+		for _, a := range list {
+			m[a.ID] = a
+		}
+		return m
+	}
+	baseByID, localByID, remoteByID := byID(b), byID(l), byID(r)
+
+	maxID := 0
+	ids := make(map[int]bool)
+	for _, list := range [][]Activity{l, r} {
+		for _, a := range list {
+			ids[a.ID] = true
+			if a.ID > maxID {
+				maxID = a.ID
+			}
+		}
+	}
+
+	merged := []Activity{}
+	var renumber []Activity
+	for id := range ids {
+		loc, inLocal := localByID[id]
+		rem, inRemote := remoteByID[id]
+		bas, inBase := baseByID[id]
+		switch {
+		case inLocal && inRemote:
+			switch {
+			case loc == rem:
+				merged = append(merged, loc)
+			case base != nil && !inBase:
+				// Agregadas de los dos lados con el mismo ID
+				merged = append(merged, rem)
+				renumber = append(renumber, loc)
+			case inBase && loc == bas:
+				merged = append(merged, rem)
+			default:
+				merged = append(merged, loc)
+			}
+		case inLocal:
+			// Agregada aquí, o eliminada allá pero cambiada aquí
+			if !inBase || loc != bas {
+				merged = append(merged, loc)
+			}
+		case inRemote:
+			if !inBase || rem != bas {
+				merged = append(merged, rem)
+			}
+		}
+	}
+	sort.Slice(renumber, func(i, j int) bool { return renumber[i].ID < renumber[j].ID })
+	for _, a := range renumber {
+		maxID++
+		a.ID = maxID
+		merged = append(merged, a)
+	}
+	sort.SliceStable(merged, func(i, j int) bool { return merged[i].ID < merged[j].ID })
+	return json.MarshalIndent(merged, "", "  ")
+}
+
+func importActivities(data, local []byte) error {
+	var list []Activity
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	activitiesMu.Lock()
+	defer activitiesMu.Unlock()
+	current, err := json.MarshalIndent(activities, "", "  ")
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(current, local) {
+		return errLocalChanged
+	}
+	activities = list
+	for _, a := range activities {
+		if a.ID > lastActivityID {
+			lastActivityID = a.ID
+		}
+	}
+	saveActivities()
+	return nil
+}
+
+// --- Imágenes ---
+
+// localImageHashes recuerda las huellas de las imágenes locales entre una
+// sincronización y la siguiente.
+var localImageHashes fileHashes
+
+// localImages devuelve las imágenes de uploadDir con su huella. Solo se
+// vuelven a leer las que cambiaron desde la última vez.
+func localImages() (map[string]string, error) {
+	files, err := ioutil.ReadDir(uploadDir)
+	if err != nil {
+		return nil, err
+	}
+	return localImageHashes.dir(uploadDir, files)
+}
+
+// syncImagesLocked sincroniza las imágenes una por una, comparando cada lado
+// con lo que se anotó en la última sincronización: solo se suben o bajan las
+// que cambiaron, y una imagen borrada de un lado se borra del otro si allí no
+// cambió. Si cambió de los dos lados queda la local. Un error con una imagen
+// no detiene a las demás; se devuelve el primero. Hay que tener tomado syncMu.
+func syncImagesLocked() error {
+	backend := syncBackend.Name()
+	st, err := loadSyncState()
+	if err != nil {
+		return err
+	}
+	local, err := localImages()
+	if err != nil {
+		return err
+	}
+	remote, err := syncBackend.List(SYNC_IMAGES_DIR)
+	if err != nil {
+		return err
+	}
+
+	names := make(map[string]bool)
+	for n := range local {
+		names[n] = true
+	}
+	for n := range remote {
+		names[n] = true
+	}
+	for key := range st.Archivos {
+		if strings.HasPrefix(key, SYNC_IMAGES_DIR+"/") {
+			names[strings.TrimPrefix(key, SYNC_IMAGES_DIR+"/")] = true
+		}
+	}
+
+	var firstErr error
+	for n := range names {
+		if n == "" || strings.HasPrefix(n, ".") || strings.ContainsAny(n, `/\`) {
+			continue
+		}
+		key := SYNC_IMAGES_DIR + "/" + n
+		known, wasKnown := st.Archivos[key]
+		hash, inLocal := local[n]
+		rev, inRemote := remote[n]
+		localChanged := inLocal != wasKnown || inLocal && hash != known.Hash
+		remoteChanged := inRemote != wasKnown || inRemote && rev != known.Rev
+
+		var err error
+		switch {
+		case !localChanged && !remoteChanged:
+		case !inLocal && !inRemote:
+			err = saveSyncFile(key, "", "")
+		case remoteChanged && !inRemote && !localChanged:
+			fmt.Printf("--- SYNC (%s): Imagen eliminada en otra computadora: %s ---\n", backend, n)
+			if err = os.Remove(filepath.Join(uploadDir, n)); err == nil || os.IsNotExist(err) {
+				err = saveSyncFile(key, "", "")
+			}
+		case localChanged && !inLocal && !remoteChanged:
+			fmt.Printf("--- SYNC (%s): Eliminando imagen compartida: %s ---\n", backend, n)
+			if err = syncBackend.Delete(key, known.Rev); err == nil {
+				err = saveSyncFile(key, "", "")
+			}
+		case inRemote && (!localChanged || !inLocal):
+			// Nueva o cambiada allá, o eliminada aquí pero cambiada allá
+			err = pullImage(key, n)
+		default:
+			// Nueva o cambiada aquí. Si también cambió allá queda la local
+			parent := ""
+			if inRemote {
+				parent = rev
+			}
+			err = pushImage(key, n, parent)
+		}
+		if err != nil {
+			fmt.Printf("--- ERROR: Sincronización de la imagen %s: %v ---\n", n, err)
+			if firstErr == nil {
+				firstErr = fmt.Errorf("%s: %w", n, err)
+			}
+		}
+	}
+	return firstErr
+}
+
+func pullImage(key, n string) error {
+	data, rev, err := syncBackend.Pull(key)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("--- SYNC (%s): Imagen descargada: %s ---\n", syncBackend.Name(), n)
+	if err := writeFileAtomic(filepath.Join(uploadDir, n), data, 0644); err != nil {
+		return err
+	}
+	return saveSyncFile(key, rev, contentRevision(data))
+}
+
+func pushImage(key, n, parentRev string) error {
+	data, err := ioutil.ReadFile(filepath.Join(uploadDir, n))
+	if err != nil {
+		return err
+	}
+	fmt.Printf("--- SYNC (%s): Subiendo imagen: %s ---\n", syncBackend.Name(), n)
+	rev, err := syncBackend.Push(key, data, parentRev)
+	if err != nil {
+		return err
+	}
+	return saveSyncFile(key, rev, contentRevision(data))
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func activitiesJSON(t *testing.T, list ...Activity) []byte {
+	t.Helper()
+	if list == nil {
+		list = []Activity{}
+	}
+	data, err := json.Marshal(list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestMergeActivities(t *testing.T) {
+	act := func(id int, title string) Activity { return Activity{ID: id, Title: title} }
+	tests := []struct {
+		name                string
+		base, local, remote []Activity
+		noBase              bool
+		want                string
+	}{
+		{"cambiada allá", []Activity{act(1, "a")}, []Activity{act(1, "a")}, []Activity{act(1, "b")}, false, "1:b"},
+		{"cambiada aquí", []Activity{act(1, "a")}, []Activity{act(1, "b")}, []Activity{act(1, "a")}, false, "1:b"},
+		{"cambiada de los dos lados queda la local", []Activity{act(1, "a")}, []Activity{act(1, "aquí")}, []Activity{act(1, "allá")}, false, "1:aquí"},
+		{"eliminada allá", []Activity{act(1, "a"), act(2, "b")}, []Activity{act(1, "a"), act(2, "b")}, []Activity{act(2, "b")}, false, "2:b"},
+		{"eliminada aquí", []Activity{act(1, "a"), act(2, "b")}, []Activity{act(2, "b")}, []Activity{act(1, "a"), act(2, "b")}, false, "2:b"},
+		{"eliminada allá pero cambiada aquí", []Activity{act(1, "a")}, []Activity{act(1, "b")}, []Activity{}, false, "1:b"},
+		{"eliminada aquí pero cambiada allá", []Activity{act(1, "a")}, []Activity{}, []Activity{act(1, "b")}, false, "1:b"},
+		{"nuevas de un lado", []Activity{act(1, "a")}, []Activity{act(1, "a"), act(2, "aquí")}, []Activity{act(1, "a"), act(3, "allá")}, false, "1:a,2:aquí,3:allá"},
+		// Cada computadora numera las suyas: la local recibe otro ID
+		{"nuevas con el mismo ID", []Activity{act(1, "a")},
+			[]Activity{act(1, "a"), act(2, "aquí"), act(3, "aquí también")},
+			[]Activity{act(1, "a"), act(2, "allá")}, false, "1:a,2:allá,3:aquí también,4:aquí"},
+		{"nuevas iguales con el mismo ID", []Activity{}, []Activity{act(2, "igual")}, []Activity{act(2, "igual")}, false, "2:igual"},
+		// Sin base el mismo ID es la misma actividad, aunque no coincida
+		{"sin base", nil, []Activity{act(1, "Reunión"), act(2, "Jornada aquí")},
+			[]Activity{act(1, "Reunión"), act(2, "Jornada allá"), act(3, "otra")}, true, "1:Reunión,2:Jornada aquí,3:otra"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var base []byte
+			if !tt.noBase {
+				base = activitiesJSON(t, tt.base...)
+			}
+			data, err := mergeActivities(base, activitiesJSON(t, tt.local...), activitiesJSON(t, tt.remote...))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var merged []Activity
+			if err := json.Unmarshal(data, &merged); err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, a := range merged {
+				got = append(got, strconv.Itoa(a.ID)+":"+a.Title)
+			}
+			if strings.Join(got, ",") != tt.want {
+				t.Errorf("quedó %s, se esperaba %s", strings.Join(got, ","), tt.want)
+			}
+		})
+	}
+
+	if _, err := mergeActivities([]byte("{"), activitiesJSON(t), activitiesJSON(t)); err == nil || !strings.Contains(err.Error(), "dañada") {
+		t.Errorf("una base dañada devolvió %v", err)
+	}
+	if _, err := mergeActivities(nil, activitiesJSON(t), []byte("no")); err == nil || !strings.Contains(err.Error(), "no son válidas") {
+		t.Errorf("actividades compartidas inválidas devolvieron %v", err)
+	}
+}
+
+// writeImage guarda una imagen en la carpeta de la computadora actual.
+func writeImage(t *testing.T, name, content string) {
+	t.Helper()
+	if err := os.MkdirAll(uploadDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(uploadDir, name), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// images devuelve las imágenes de la computadora actual como nombre=contenido,
+// sin los archivos ocultos.
+func images(t *testing.T) string {
+	t.Helper()
+	files, err := ioutil.ReadDir(uploadDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var list []string
+	for _, f := range files {
+		if strings.HasPrefix(f.Name(), ".") {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(uploadDir, f.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		list = append(list, f.Name()+"="+string(data))
+	}
+	sort.Strings(list)
+	return strings.Join(list, ",")
+}
+
+func TestSyncImages(t *testing.T) {
+	backend := &FolderBackend{Dir: t.TempDir()}
+	useTestBackend(t, backend, "libro")
+	a, b := newTestComputer(t, "a", 0), newTestComputer(t, "b", 0)
+	sync := func(c *testComputer) {
+		t.Helper()
+		c.use(t)
+		if err := syncImagesLocked(); err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+	}
+	remote := func() string {
+		t.Helper()
+		revs, err := backend.List(SYNC_IMAGES_DIR)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for n := range revs {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return strings.Join(names, ",")
+	}
+
+	a.use(t)
+	writeImage(t, "uno.jpg", "uno")
+	writeImage(t, "dos.jpg", "dos")
+	writeImage(t, "tres.jpg", "tres")
+	sync(a)
+	b.use(t)
+	writeImage(t, ".oculta", "no se sube")
+	sync(b)
+	if got := images(t); got != "dos.jpg=dos,tres.jpg=tres,uno.jpg=uno" {
+		t.Fatalf("b quedó con %s", got)
+	}
+	if got := remote(); got != "dos.jpg,tres.jpg,uno.jpg" {
+		t.Fatalf("el remoto quedó con %s", got)
+	}
+
+	// b borra uno.jpg: se borra del remoto y después de a
+	if err := os.Remove(filepath.Join(uploadDir, "uno.jpg")); err != nil {
+		t.Fatal(err)
+	}
+	sync(b)
+	if got := remote(); got != "dos.jpg,tres.jpg" {
+		t.Fatalf("el remoto quedó con %s después de borrar uno.jpg en b", got)
+	}
+	sync(a)
+	if got := images(t); got != "dos.jpg=dos,tres.jpg=tres" {
+		t.Fatalf("a quedó con %s, uno.jpg se borró en b", got)
+	}
+
+	// a borra dos.jpg mientras b la cambia: la cambiada se conserva
+	if err := os.Remove(filepath.Join(uploadDir, "dos.jpg")); err != nil {
+		t.Fatal(err)
+	}
+	sync(a)
+	b.use(t)
+	writeImage(t, "dos.jpg", "dos cambiada")
+	sync(b)
+	sync(a)
+	if got := images(t); got != "dos.jpg=dos cambiada,tres.jpg=tres" {
+		t.Fatalf("a quedó con %s, dos.jpg se cambió en b", got)
+	}
+
+	// Borrada de los dos lados: se olvida
+	for _, c := range []*testComputer{a, b} {
+		c.use(t)
+		if err := os.Remove(filepath.Join(uploadDir, "tres.jpg")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	revs, err := backend.List(SYNC_IMAGES_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := backend.Delete(SYNC_IMAGES_DIR+"/tres.jpg", revs["tres.jpg"]); err != nil {
+		t.Fatal(err)
+	}
+	sync(a)
+	st, err := loadSyncState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := st.Archivos[SYNC_IMAGES_DIR+"/tres.jpg"]; ok {
+		t.Errorf("a todavía recuerda tres.jpg: %+v", st.Archivos)
+	}
+	sync(b)
+	if got := images(t); got != "dos.jpg=dos cambiada" {
+		t.Errorf("b quedó con %s", got)
+	}
+	if got := remote(); got != "dos.jpg" {
+		t.Errorf("el remoto quedó con %s", got)
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FolderBackend guarda los archivos en una carpeta compartida: una carpeta de
+// red o una que otro programa (Syncthing, Google Drive, OneDrive...) mantiene
+// igual en todas las computadoras. La revisión es una huella del contenido.
+type FolderBackend struct {
+	Dir string
+
+	hashes fileHashes
+}
+
+func (f *FolderBackend) Name() string { return "Carpeta" }
+
+func (f *FolderBackend) path(name string) string {
+	return filepath.Join(f.Dir, filepath.FromSlash(name))
+}
+
+func (f *FolderBackend) Pull(name string) ([]byte, string, error) {
+	data, err := ioutil.ReadFile(f.path(name))
+	if os.IsNotExist(err) {
+		return nil, "", errRemoteNotFound
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	return data, contentRevision(data), nil
+}
+
+// Push compara la huella del archivo actual con parentRev antes de
+// reemplazarlo. Entre la comparación y el reemplazo otra computadora podría
+// escribir; las carpetas compartidas no permiten algo mejor.
+func (f *FolderBackend) Push(name string, data []byte, parentRev string) (string, error) {
+	if err := os.MkdirAll(filepath.Dir(f.path(name)), 0755); err != nil {
+		return "", err
+	}
+	current, rev, err := f.Pull(name)
+	switch {
+	case err == errRemoteNotFound:
+	case err != nil:
+		return "", err
+	case bytes.Equal(current, data):
+		return rev, nil
+	case rev != parentRev:
+		return "", errRemoteChanged
+	}
+	if err := writeFileAtomic(f.path(name), data, 0644); err != nil {
+		return "", err
+	}
+	return contentRevision(data), nil
+}
+
+func (f *FolderBackend) Revision(name string) (string, error) {
+	_, rev, err := f.Pull(name)
+	return rev, err
+}
+
+func (f *FolderBackend) Delete(name, parentRev string) error {
+	rev, err := f.Revision(name)
+	if err == errRemoteNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if rev != parentRev {
+		return errRemoteChanged
+	}
+	return os.Remove(f.path(name))
+}
+
+func (f *FolderBackend) List(dir string) (map[string]string, error) {
+	files, err := ioutil.ReadDir(f.path(dir))
+	if os.IsNotExist(err) {
+		return map[string]string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return f.hashes.dir(f.path(dir), files)
+}
+
+// fileHashes recuerda la huella de los archivos de cada carpeta junto con su
+// tamaño y su fecha de modificación, así al listar la carpeta solo se vuelven
+// a leer los archivos que cambiaron.
+type fileHashes struct {
+	mu   sync.Mutex
+	dirs map[string]map[string]fileHash
+}
+
+type fileHash struct {
+	Size    int64
+	ModTime time.Time
+	Rev     string
+}
+
+// dir devuelve la huella de cada archivo de files, que es el contenido de la
+// carpeta dir. Los temporales de writeFileAtomic (".nombre.tmp-...") y las
+// subcarpetas no cuentan. Lo recordado de dir se reemplaza, así los archivos
+// borrados no quedan.
+func (h *fileHashes) dir(dir string, files []os.FileInfo) (map[string]string, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	known := h.dirs[dir]
+	current := make(map[string]fileHash, len(files))
+	revs := make(map[string]string, len(files))
+	for _, file := range files {
+		if file.IsDir() || strings.HasPrefix(file.Name(), ".") {
+			continue
+		}
+		hash, ok := known[file.Name()]
+		if !ok || hash.Size != file.Size() || !hash.ModTime.Equal(file.ModTime()) {
+			data, err := ioutil.ReadFile(filepath.Join(dir, file.Name()))
+			if err != nil {
+				return nil, err
+			}
+			hash = fileHash{Size: file.Size(), ModTime: file.ModTime(), Rev: contentRevision(data)}
+		}
+		current[file.Name()] = hash
+		revs[file.Name()] = hash.Rev
+	}
+	if h.dirs == nil {
+		h.dirs = make(map[string]map[string]fileHash)
+	}
+	h.dirs[dir] = current
+	return revs, nil
+}
+
+// contentRevision es la revisión de los backends que no tienen una propia.
+func contentRevision(data []byte) string {
+	sum := sha1.Sum(data)
+	return hex.EncodeToString(sum[:])[:16]
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFolderBackend(t *testing.T) {
+	testSyncBackend(t, &FolderBackend{Dir: t.TempDir()})
+}
+
+func TestFolderBackendListSkipsTemporaries(t *testing.T) {
+	dir := t.TempDir()
+	b := &FolderBackend{Dir: dir}
+	if _, err := b.Push("imagenes/foto.png", []byte("foto"), ""); err != nil {
+		t.Fatal(err)
+	}
+	// Un guardado a medias de otra computadora y una subcarpeta
+	if err := ioutil.WriteFile(filepath.Join(dir, "imagenes", ".foto.png.tmp-1"), []byte("fo"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "imagenes", "viejas"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	revs, err := b.List("imagenes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revs) != 1 || revs["foto.png"] != contentRevision([]byte("foto")) {
+		t.Fatalf("List devolvió %v, se esperaba solo foto.png", revs)
+	}
+}
+
+func TestFolderBackendPushSameContent(t *testing.T) {
+	b := &FolderBackend{Dir: t.TempDir()}
+	rev, err := b.Push("history.json", []byte("[]"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Otra computadora ya subió lo mismo: no hay nada que pisar
+	if again, err := b.Push("history.json", []byte("[]"), "vieja"); err != nil || again != rev {
+		t.Fatalf("Push del mismo contenido devolvió %q, %v; se esperaba %q", again, err, rev)
+	}
+}
+
+func TestFolderBackendListRehashesOnlyChanged(t *testing.T) {
+	dir := t.TempDir()
+	b := &FolderBackend{Dir: dir}
+	for _, name := range []string{"uno.png", "dos.png"} {
+		if _, err := b.Push("imagenes/"+name, []byte(name), ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := b.List("imagenes"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Mismo tamaño y misma fecha: la huella no se vuelve a calcular
+	uno := filepath.Join(dir, "imagenes", "uno.png")
+	info, err := os.Stat(uno)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(uno, []byte("UNO.png"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(uno, info.ModTime(), info.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+	revs, err := b.List("imagenes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if revs["uno.png"] != contentRevision([]byte("uno.png")) {
+		t.Fatalf("se volvió a leer un archivo sin cambios: %v", revs)
+	}
+
+	// Otra fecha sí, y un archivo borrado deja de aparecer
+	later := info.ModTime().Add(time.Minute)
+	if err := os.Chtimes(uno, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(dir, "imagenes", "dos.png")); err != nil {
+		t.Fatal(err)
+	}
+	revs, err = b.List("imagenes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revs) != 1 || revs["uno.png"] != contentRevision([]byte("UNO.png")) {
+		t.Fatalf("List devolvió %v, se esperaba solo uno.png con la huella nueva", revs)
+	}
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"time"
+
+	"github.com/360EntSecGroup-Skylar/excelize/v2"
+)
+
+// ------------------- COMBINAR CAMBIOS DE DOS COMPUTADORAS -------------------------
+
+// Tipos de conflicto al combinar el censo local con el compartido.
+const (
+	CONFLICTO_CAMPO          = "campo"          // los dos lados cambiaron el mismo campo
+	CONFLICTO_ELIMINADO_AQUI = "eliminado_aqui" // se eliminó aquí y se modificó en el otro lado
+	CONFLICTO_ELIMINADO_ALLA = "eliminado_alla" // se eliminó en el otro lado y se modificó aquí
+)
+
+// SyncConflict es un cambio que no se pudo combinar solo. Mientras el
+// operador no lo resuelve queda el valor local (CONFLICTO_CAMPO) o la persona
+// se conserva (los dos tipos de eliminación), así no se pierde nada.
+type SyncConflict struct {
+	Seq    int       `json:"seq"`
+	Tipo   string    `json:"tipo"`
+	ID     string    `json:"id"`
+	Nombre string    `json:"nombre"`
+	Campo  string    `json:"campo,omitempty"`
+	Local  string    `json:"local"`
+	Remoto string    `json:"remoto"`
+	Fecha  time.Time `json:"fecha"`
+}
+
+// mergeCensus combina el censo local con el remoto, persona por persona y
+// campo por campo, contra la última versión que compartían (base). Un campo
+// que cambió de un solo lado toma ese valor; si cambió distinto en los dos
+// lados es un conflicto. Las personas sin ID en el remoto (agregadas a mano
+// en el Excel) se toman como nuevas.
+func mergeCensus(baseHeaders []string, base []CensusRecord, localHeaders []string, local []CensusRecord, remoteHeaders []string, remote []CensusRecord) ([]string, []CensusRecord, []SyncConflict) {
+	headers := append([]string{}, localHeaders...)
+	for _, h := range remoteHeaders {
+		if indexOf(headers, h) == -1 {
+			headers = append(headers, h)
+		}
+	}
+	baseByID := recordsByID(base)
+	remoteByID := recordsByID(remote)
+	localByID := recordsByID(local)
+
+	var merged []CensusRecord
+	var conflicts []SyncConflict
+	conflict := func(tipo string, rec CensusRecord, campo, local, remoto string) {
+		conflicts = append(conflicts, SyncConflict{
+			Tipo: tipo, ID: rec.ID, Nombre: rec.Value("Nombre completo"), Campo: campo, Local: local, Remoto: remoto,
+		})
+	}
+
+	for _, loc := range local {
+		b, inBase := baseByID[loc.ID]
+		rem, inRemote := remoteByID[loc.ID]
+		switch {
+		case inRemote:
+			fields := make(map[string]string, len(headers))
+			for _, h := range headers {
+				lv, rv, bv := loc.Fields[h], rem.Fields[h], b.Fields[h]
+				switch {
+				case lv == rv, rv == bv:
+					fields[h] = lv
+				case lv == bv:
+					fields[h] = rv
+				default:
+					fields[h] = lv
+					conflict(CONFLICTO_CAMPO, loc, h, lv, rv)
+				}
+			}
+			merged = append(merged, CensusRecord{ID: loc.ID, Fields: fields})
+		case !inBase:
+			// Agregada aquí
+			merged = append(merged, loc)
+		case loc.Version() != b.Version():
+			// Eliminada allá, pero aquí alguien la cambió: se conserva
+			conflict(CONFLICTO_ELIMINADO_ALLA, loc, "", "", "")
+			merged = append(merged, loc)
+		}
+	}
+
+	for _, rem := range remote {
+		if rem.ID != "" {
+			if _, inLocal := localByID[rem.ID]; inLocal {
+				continue
+			}
+		}
+		b, inBase := baseByID[rem.ID]
+		switch {
+		case rem.ID == "" || !inBase:
+			// Agregada allá
+			merged = append(merged, rem)
+		case rem.Version() != b.Version():
+			// Eliminada aquí, pero allá alguien la cambió: se conserva
+			conflict(CONFLICTO_ELIMINADO_AQUI, rem, "", "", "")
+			merged = append(merged, rem)
+		}
+	}
+	return headers, merged, conflicts
+}
+
+// firstSyncBase arma una base para combinar cuando todavía no hay una: las
+// personas que están en los dos lados, con los valores del remoto. Así lo que
+// cambió aquí gana (como cuando cada subida sobrescribía el libro compartido)
+// y lo que está de un solo lado se conserva.
+//
+// Las personas con los mismos valores pero sin el mismo ID en los dos lados
+// (el libro compartido sin IDs de las versiones anteriores, o IDs que cada
+// computadora asignó por su cuenta) son la misma persona: quedan con el ID del
+// remoto, o con el local si el remoto no tiene. Devuelve la base y las dos
+// listas con esos IDs.
+func firstSyncBase(local, remote []CensusRecord) ([]CensusRecord, []CensusRecord, []CensusRecord) {
+	local = append([]CensusRecord(nil), local...)
+	remote = append([]CensusRecord(nil), remote...)
+	localByID := recordsByID(local)
+	remoteByID := recordsByID(remote)
+
+	// Las personas locales sin pareja por ID, por sus valores
+	unmatched := make(map[string][]int)
+	for i, rec := range local {
+		if _, ok := remoteByID[rec.ID]; !ok {
+			unmatched[rec.Version()] = append(unmatched[rec.Version()], i)
+		}
+	}
+
+	var base []CensusRecord
+	for i, rem := range remote {
+		if _, ok := localByID[rem.ID]; ok && rem.ID != "" {
+			base = append(base, rem)
+			continue
+		}
+		same := unmatched[rem.Version()]
+		if len(same) == 0 {
+			continue
+		}
+		j := same[0]
+		unmatched[rem.Version()] = same[1:]
+		if rem.ID == "" {
+			remote[i].ID = local[j].ID
+		} else {
+			local[j].ID = rem.ID
+		}
+		base = append(base, remote[i])
+	}
+	return base, local, remote
+}
+
+func recordsByID(records []CensusRecord) map[string]CensusRecord {
+	byID := make(map[string]CensusRecord, len(records))
+	for _, rec := range records {
+		if rec.ID != "" {
+			byID[rec.ID] = rec
+		}
+	}
+	return byID
+}
+
+// sameRecords dice si dos versiones del censo tienen las mismas personas con
+// los mismos valores.
+func sameRecords(a, b []CensusRecord) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	byID := recordsByID(b)
+	for _, rec := range a {
+		other, ok := byID[rec.ID]
+		if !ok || rec.ID == "" || other.Version() != rec.Version() {
+			return false
+		}
+	}
+	return true
+}
+
+// mergedWorkbook escribe el censo combinado sobre el libro local, así se
+// conservan sus formatos y sus otras hojas. Las personas de la papelera del
+// libro remoto que no están en la local (ni en el censo combinado) se agregan
+// a la papelera local.
+func mergedWorkbook(local, remote []byte, sheet string, headers []string, records []CensusRecord) ([]byte, error) {
+	f, err := excelize.OpenReader(bytes.NewReader(local))
+	if err != nil {
+		return nil, err
+	}
+	rows, err := f.GetRows(sheet)
+	if err != nil {
+		return nil, err
+	}
+
+	// Las columnas del libro local quedan donde estaban; las nuevas van al final
+	var columns []string
+	if len(rows) > 0 {
+		columns = cleanHeaders(rows[0])
+	}
+	if indexOf(columns, ID_HEADER) == -1 {
+		columns = append(columns, ID_HEADER)
+	}
+	for _, h := range headers {
+		if indexOf(columns, h) == -1 {
+			columns = append(columns, h)
+		}
+	}
+	for colIndex, h := range columns {
+		cell, _ := excelize.CoordinatesToCellName(colIndex+1, 1)
+		f.SetCellValue(sheet, cell, h)
+	}
+	for rowIndex, rec := range records {
+		for colIndex, h := range columns {
+			val := rec.Fields[h]
+			if h == ID_HEADER {
+				val = rec.ID
+			}
+			cell, _ := excelize.CoordinatesToCellName(colIndex+1, rowIndex+2)
+			f.SetCellValue(sheet, cell, val)
+		}
+	}
+	var extra []int
+	for n := len(records) + 2; n <= len(rows); n++ {
+		extra = append(extra, n)
+	}
+	if err := removeRows(f, sheet, extra); err != nil {
+		return nil, err
+	}
+
+	if err := mergeTrash(f, remote, headers, records); err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	if err := f.Write(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// mergeTrash copia a la papelera de f las personas de la papelera remota que
+// le faltan.
+func mergeTrash(f *excelize.File, remote []byte, headers []string, records []CensusRecord) error {
+	rf, err := excelize.OpenReader(bytes.NewReader(remote))
+	if err != nil {
+		return err
+	}
+	if rf.GetSheetIndex(TRASH_SHEET) == -1 {
+		return nil
+	}
+	remoteRows, err := rf.GetRows(TRASH_SHEET)
+	if err != nil || len(remoteRows) < 2 {
+		return err
+	}
+
+	skip := make(map[string]bool, len(records))
+	for _, rec := range records {
+		skip[rec.ID] = true
+	}
+	if f.GetSheetIndex(TRASH_SHEET) != -1 {
+		rows, _ := f.GetRows(TRASH_SHEET)
+		if len(rows) > 0 {
+			idCol := indexOf(cleanHeaders(rows[0]), ID_HEADER)
+			for _, row := range rows[1:] {
+				skip[strings.TrimSpace(cellAt(row, idCol))] = true
+			}
+		}
+	}
+
+	remoteHeaders := cleanHeaders(remoteRows[0])
+	trashHeaders, trashRows := trashSheet(f, headers)
+	nextRow := len(trashRows) + 1
+	for _, row := range remoteRows[1:] {
+		if emptyRow(row) {
+			continue
+		}
+		rec := deletedFromRow(remoteHeaders, row)
+		if rec.ID == "" || skip[rec.ID] {
+			continue
+		}
+		values := make(map[string]string, len(remoteHeaders))
+		for j, h := range remoteHeaders {
+			values[h] = cellAt(row, j)
+		}
+		for _, h := range remoteHeaders {
+			if indexOf(trashHeaders, h) == -1 {
+				trashHeaders = append(trashHeaders, h)
+				cell, _ := excelize.CoordinatesToCellName(len(trashHeaders), 1)
+				f.SetCellValue(TRASH_SHEET, cell, h)
+			}
+		}
+		writeRow(f, TRASH_SHEET, trashHeaders, nextRow, values)
+		nextRow++
+	}
+	return nil
+}
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestFirstSyncBase(t *testing.T) {
+	person := func(id, name, edad string) CensusRecord {
+		return CensusRecord{ID: id, Fields: map[string]string{"Nombre completo": name, "Edad": edad}}
+	}
+	headers := []string{"Nombre completo", "Edad"}
+	local := []CensusRecord{
+		person("a", "Ana", "31"),  // editada aquí
+		person("b", "Beto", "40"), // sin cambios
+		person("l1", "Carla", "25"),
+		person("l2", "Solo local", "1"),
+	}
+	remote := []CensusRecord{
+		person("a", "Ana", "30"),
+		person("b", "Beto", "40"),
+		person("", "Carla", "25"), // el libro compartido de antes, sin IDs
+		person("r", "Solo remoto", "2"),
+	}
+
+	base, l, r := firstSyncBase(local, remote)
+	_, merged, conflicts := mergeCensus(headers, base, headers, l, headers, r)
+	if len(conflicts) != 0 {
+		t.Fatalf("hubo conflictos: %+v", conflicts)
+	}
+	got := recordsByID(merged)
+	if len(merged) != 5 || len(got) != 5 {
+		t.Fatalf("quedaron %+v; se esperaban 5 personas, sin repetir a Carla", merged)
+	}
+	if got["a"].Fields["Edad"] != "31" {
+		t.Errorf("se perdió la edición local: Edad = %q", got["a"].Fields["Edad"])
+	}
+	for _, id := range []string{"b", "l1", "l2", "r"} {
+		if _, ok := got[id]; !ok {
+			t.Errorf("falta %s en lo combinado", id)
+		}
+	}
+	if local[2].ID != "l1" || remote[2].ID != "" {
+		t.Error("firstSyncBase cambió las listas que recibió")
+	}
+}
+
+func TestMergeCensus(t *testing.T) {
+	headers := []string{"Nombre completo", "Edad"}
+	person := func(id, name, edad string) CensusRecord {
+		return CensusRecord{ID: id, Fields: map[string]string{"Nombre completo": name, "Edad": edad}}
+	}
+	base := []CensusRecord{person("a", "Ana", "30"), person("b", "Beto", "40")}
+	tests := []struct {
+		name      string
+		local     []CensusRecord
+		remote    []CensusRecord
+		want      []CensusRecord
+		conflicts []SyncConflict
+	}{
+		{
+			name:   "campos distintos de cada lado",
+			local:  []CensusRecord{person("a", "Ana", "31"), person("b", "Beto", "40")},
+			remote: []CensusRecord{person("a", "Ana María", "30"), person("b", "Beto", "41")},
+			want:   []CensusRecord{person("a", "Ana María", "31"), person("b", "Beto", "41")},
+		},
+		{
+			name:   "el mismo cambio de los dos lados",
+			local:  []CensusRecord{person("a", "Ana", "31"), person("b", "Beto", "40")},
+			remote: []CensusRecord{person("a", "Ana", "31"), person("b", "Beto", "40")},
+			want:   []CensusRecord{person("a", "Ana", "31"), person("b", "Beto", "40")},
+		},
+		{
+			name:      "el mismo campo distinto de cada lado",
+			local:     []CensusRecord{person("a", "Ana", "31"), person("b", "Beto", "40")},
+			remote:    []CensusRecord{person("a", "Ana", "32"), person("b", "Beto", "40")},
+			want:      []CensusRecord{person("a", "Ana", "31"), person("b", "Beto", "40")},
+			conflicts: []SyncConflict{{Tipo: CONFLICTO_CAMPO, ID: "a", Nombre: "Ana", Campo: "Edad", Local: "31", Remoto: "32"}},
+		},
+		{
+			name:   "eliminada allá sin cambios aquí",
+			local:  []CensusRecord{person("a", "Ana", "30"), person("b", "Beto", "40")},
+			remote: []CensusRecord{person("b", "Beto", "40")},
+			want:   []CensusRecord{person("b", "Beto", "40")},
+		},
+		{
+			name:      "eliminada allá y cambiada aquí",
+			local:     []CensusRecord{person("a", "Ana", "31"), person("b", "Beto", "40")},
+			remote:    []CensusRecord{person("b", "Beto", "40")},
+			want:      []CensusRecord{person("a", "Ana", "31"), person("b", "Beto", "40")},
+			conflicts: []SyncConflict{{Tipo: CONFLICTO_ELIMINADO_ALLA, ID: "a", Nombre: "Ana"}},
+		},
+		{
+			name:   "eliminada aquí sin cambios allá",
+			local:  []CensusRecord{person("b", "Beto", "40")},
+			remote: []CensusRecord{person("a", "Ana", "30"), person("b", "Beto", "40")},
+			want:   []CensusRecord{person("b", "Beto", "40")},
+		},
+		{
+			name:      "eliminada aquí y cambiada allá",
+			local:     []CensusRecord{person("b", "Beto", "40")},
+			remote:    []CensusRecord{person("a", "Ana", "32"), person("b", "Beto", "40")},
+			want:      []CensusRecord{person("b", "Beto", "40"), person("a", "Ana", "32")},
+			conflicts: []SyncConflict{{Tipo: CONFLICTO_ELIMINADO_AQUI, ID: "a", Nombre: "Ana"}},
+		},
+		{
+			name:   "eliminada de los dos lados",
+			local:  []CensusRecord{person("b", "Beto", "40")},
+			remote: []CensusRecord{person("b", "Beto", "40")},
+			want:   []CensusRecord{person("b", "Beto", "40")},
+		},
+		{
+			name:   "agregadas de los dos lados",
+			local:  []CensusRecord{person("a", "Ana", "30"), person("b", "Beto", "40"), person("l", "Lucía", "5")},
+			remote: []CensusRecord{person("a", "Ana", "30"), person("b", "Beto", "40"), person("r", "Rosa", "7"), person("", "Sin ID", "9")},
+			want: []CensusRecord{
+				person("a", "Ana", "30"), person("b", "Beto", "40"), person("l", "Lucía", "5"),
+				person("r", "Rosa", "7"), person("", "Sin ID", "9"),
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotHeaders, got, conflicts := mergeCensus(headers, base, headers, tt.local, headers, tt.remote)
+			if len(gotHeaders) != len(headers) {
+				t.Errorf("las columnas quedaron %v", gotHeaders)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("quedaron %+v, se esperaba %+v", got, tt.want)
+			}
+			for i := range got {
+				if got[i].ID != tt.want[i].ID || got[i].Version() != tt.want[i].Version() {
+					t.Errorf("la persona %d quedó %+v, se esperaba %+v", i, got[i], tt.want[i])
+				}
+			}
+			if len(conflicts) != len(tt.conflicts) {
+				t.Fatalf("hubo los conflictos %+v, se esperaba %+v", conflicts, tt.conflicts)
+			}
+			for i := range conflicts {
+				if conflicts[i] != tt.conflicts[i] {
+					t.Errorf("el conflicto %d es %+v, se esperaba %+v", i, conflicts[i], tt.conflicts[i])
+				}
+			}
+		})
+	}
+}
+
+func TestMergeCensusNewColumns(t *testing.T) {
+	base := []CensusRecord{{ID: "a", Fields: map[string]string{"Nombre completo": "Ana"}}}
+	local := []CensusRecord{{ID: "a", Fields: map[string]string{"Nombre completo": "Ana", "Correo": "ana@correo"}}}
+	remote := []CensusRecord{{ID: "a", Fields: map[string]string{"Nombre completo": "Ana", "Teléfono": "0414"}}}
+	headers, merged, conflicts := mergeCensus(
+		[]string{"Nombre completo"}, base,
+		[]string{"Nombre completo", "Correo"}, local,
+		[]string{"Teléfono", "Nombre completo"}, remote)
+	if strings.Join(headers, ",") != "Nombre completo,Correo,Teléfono" {
+		t.Errorf("las columnas quedaron %v", headers)
+	}
+	if len(conflicts) != 0 {
+		t.Errorf("hubo conflictos: %+v", conflicts)
+	}
+	if len(merged) != 1 || merged[0].Fields["Correo"] != "ana@correo" || merged[0].Fields["Teléfono"] != "0414" {
+		t.Errorf("quedó %+v", merged)
+	}
+}
+
+// workbookBytes lee el libro de un ExcelStore de prueba.
+func workbookBytes(t *testing.T, s *ExcelStore) []byte {
+	t.Helper()
+	data, err := ioutil.ReadFile(s.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestMergedWorkbook(t *testing.T) {
+	local, remote := newTestExcelStore(t, 6), newTestExcelStore(t, 6)
+	if err := local.Delete(DeleteInfo{By: "ana", Reason: "aquí"}, RecordRef{ID: "p00001"}); err != nil {
+		t.Fatal(err)
+	}
+	// p00001 también está en la papelera remota y p00003 vuelve al censo
+	// combinado: ninguna de las dos se copia
+	for _, id := range []string{"p00001", "p00002", "p00003"} {
+		if err := remote.Delete(DeleteInfo{By: "beto", Reason: "allá " + id}, RecordRef{ID: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	headers, records := testCensus(6)
+	headers = append(headers, "Teléfono")
+	var merged []CensusRecord
+	for _, rec := range records {
+		switch rec.ID {
+		case "p00000":
+			rec.Fields["Teléfono"] = "0414"
+			merged = append(merged, rec)
+		case "p00003", "p00005":
+			merged = append(merged, rec)
+		}
+	}
+	merged = append(merged, CensusRecord{ID: "nueva", Fields: map[string]string{"Nombre completo": "Nueva"}})
+
+	data, err := mergedWorkbook(workbookBytes(t, local), workbookBytes(t, remote), "Sheet1", headers, merged)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotHeaders, got, err := readWorkbook(bytes.NewReader(data), "Sheet1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Las columnas del libro local quedan donde estaban
+	localHeaders, _ := local.Headers()
+	for i, h := range localHeaders {
+		if gotHeaders[i] != h {
+			t.Fatalf("las columnas quedaron %v, se esperaba que empezaran con %v", gotHeaders, localHeaders)
+		}
+	}
+	if gotHeaders[len(gotHeaders)-1] != "Teléfono" {
+		t.Errorf("la columna nueva no quedó al final: %v", gotHeaders)
+	}
+	// Sobran filas del libro local: se borran
+	if len(got) != len(merged) {
+		t.Fatalf("el libro quedó con %d personas, se esperaban %d", len(got), len(merged))
+	}
+	for i := range got {
+		if got[i].ID != merged[i].ID || got[i].Value("Nombre completo") != merged[i].Value("Nombre completo") {
+			t.Errorf("la fila %d quedó %+v, se esperaba %+v", i, got[i], merged[i])
+		}
+	}
+	if got[0].Fields["Teléfono"] != "0414" {
+		t.Errorf("p00000 quedó con Teléfono %q", got[0].Fields["Teléfono"])
+	}
+
+	trash, err := readWorkbookTrash(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reasons := map[string]string{}
+	for _, rec := range trash {
+		if _, dup := reasons[rec.ID]; dup {
+			t.Errorf("%s quedó dos veces en la papelera", rec.ID)
+		}
+		reasons[rec.ID] = rec.Reason
+	}
+	want := map[string]string{"p00001": "aquí", "p00002": "allá p00002"}
+	if len(reasons) != len(want) {
+		t.Fatalf("la papelera quedó con %v, se esperaba %v", reasons, want)
+	}
+	for id, reason := range want {
+		if reasons[id] != reason {
+			t.Errorf("%s quedó en la papelera con el motivo %q, se esperaba %q", id, reasons[id], reason)
+		}
+	}
+}
+
+func TestMergeTrashWithoutRemoteTrash(t *testing.T) {
+	local, remote := newTestExcelStore(t, 3), newTestExcelStore(t, 3)
+	headers, records := testCensus(3)
+	data, err := mergedWorkbook(workbookBytes(t, local), workbookBytes(t, remote), "Sheet1", headers, records)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if trash, err := readWorkbookTrash(bytes.NewReader(data)); err != nil || len(trash) != 0 {
+		t.Errorf("la papelera quedó con %+v, %v", trash, err)
+	}
+}
+
+// movingBackend es un libro compartido al que otra computadora le sube
+// cambios justo antes de cada Push, entre la bajada y la subida de esta.
+type movingBackend struct {
+	SyncBackend
+	pushes int
+	moves  int
+	move   func(n int) []byte
+}
+
+func (b *movingBackend) Push(name string, data []byte, parentRev string) (string, error) {
+	if name == syncCensusName && b.pushes < b.moves {
+		b.pushes++
+		rev, err := b.SyncBackend.Revision(name)
+		if err != nil {
+			return "", err
+		}
+		if _, err := b.SyncBackend.Push(name, b.move(b.pushes), rev); err != nil {
+			return "", err
+		}
+	}
+	return b.SyncBackend.Push(name, data, parentRev)
+}
+
+// otherComputerEdit devuelve el libro de testCensus(n) con la Edad de id cambiada.
+func otherComputerEdit(t *testing.T, n int, id, edad string) []byte {
+	headers, records := testCensus(n)
+	for _, rec := range records {
+		if rec.ID == id {
+			rec.Fields["Edad"] = edad
+		}
+	}
+	var buf bytes.Buffer
+	if err := writeWorkbook(&buf, PRIMERA_HOJA, headers, records); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestSubirCensoRetriesWhenRemoteMoves(t *testing.T) {
+	backend := &movingBackend{SyncBackend: &FolderBackend{Dir: t.TempDir()}}
+	useTestBackend(t, backend, "libro")
+	a := newTestComputer(t, "ana", 6)
+	a.use(t)
+	if err := subirCenso(); err != nil {
+		t.Fatal(err)
+	}
+
+	setField(t, a, "p00001", "Edad", "41")
+	backend.moves = 1
+	backend.move = func(int) []byte { return otherComputerEdit(t, 6, "p00002", "52") }
+	if err := subirCenso(); err != nil {
+		t.Fatalf("subirCenso no combinó el cambio de la otra computadora: %v", err)
+	}
+	if backend.pushes != 1 {
+		t.Errorf("el libro compartido cambió %d veces, se esperaba 1", backend.pushes)
+	}
+
+	data, _, err := backend.SyncBackend.Pull(syncCensusName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, remote, err := readWorkbook(bytes.NewReader(data), PRIMERA_HOJA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	byID := recordsByID(remote)
+	if byID["p00001"].Fields["Edad"] != "41" || byID["p00002"].Fields["Edad"] != "52" {
+		t.Errorf("el libro compartido quedó con Edad %q y %q, se esperaba 41 y 52",
+			byID["p00001"].Fields["Edad"], byID["p00002"].Fields["Edad"])
+	}
+	if got := field(t, a, "p00002", "Edad"); got != "52" {
+		t.Errorf("ana quedó con Edad %q para p00002, se esperaba 52", got)
+	}
+	if list := conflictsOf(t, a); len(list) != 0 {
+		t.Errorf("quedaron conflictos %+v", list)
+	}
+}
+
+func TestSubirCensoGivesUp(t *testing.T) {
+	backend := &movingBackend{SyncBackend: &FolderBackend{Dir: t.TempDir()}}
+	useTestBackend(t, backend, "libro")
+	a := newTestComputer(t, "ana", 6)
+	a.use(t)
+	if err := subirCenso(); err != nil {
+		t.Fatal(err)
+	}
+
+	setField(t, a, "p00001", "Edad", "41")
+	backend.moves = 10
+	backend.move = func(n int) []byte { return otherComputerEdit(t, 6, "p00002", fmt.Sprint(60+n)) }
+	err := subirCenso()
+	if !errors.Is(err, errRemoteChanged) {
+		t.Fatalf("subirCenso devolvió %v, se esperaba errRemoteChanged", err)
+	}
+	if backend.pushes != 3 {
+		t.Errorf("se intentó subir %d veces, se esperaban 3", backend.pushes)
+	}
+	// Lo local no se pierde aunque no se haya podido subir
+	if got := field(t, a, "p00001", "Edad"); got != "41" {
+		t.Errorf("ana quedó con Edad %q para p00001, se esperaba 41", got)
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// ------------------- COLA DE SUBIDAS -------------------------
+
+// Espera entre reintentos cuando una subida falla: empieza en
+// SYNC_REINTENTO_MIN y se duplica en cada fallo hasta SYNC_REINTENTO_MAX.
+const SYNC_REINTENTO_MIN = 5 * time.Second
+const SYNC_REINTENTO_MAX = 10 * time.Minute
+
+// SyncStatus es lo que muestra /api/sync/status. Pendientes son los cambios
+// guardados aquí que todavía no llegaron al almacenamiento compartido.
+// TipoError es uno de los SYNC_ERROR_*. Modo es "libro" o "cambios", e
+// Instancia el nombre de esta computadora en el modo cambios.
+type SyncStatus struct {
+	Backend        string    `json:"backend"`
+	Modo           string    `json:"modo"`
+	Instancia      string    `json:"instancia,omitempty"`
+	UltimaBajada   time.Time `json:"ultima_bajada"`
+	UltimaSubida   time.Time `json:"ultima_subida"`
+	Pendientes     int       `json:"pendientes"`
+	Conflictos     int       `json:"conflictos"`
+	UltimoError    string    `json:"ultimo_error"`
+	TipoError      string    `json:"tipo_error"`
+	FechaError     time.Time `json:"fecha_error"`
+	ProximoIntento time.Time `json:"proximo_intento"`
+}
+
+var (
+	statusMu   sync.Mutex
+	syncStatus SyncStatus
+
+	// syncWake despierta al worker cuando hay algo nuevo que subir;
+	// syncRetry hace que reintente ya, sin esperar; syncPullNow pide una
+	// bajada sin esperar al intervalo.
+	syncWake    = make(chan struct{}, 1)
+	syncRetry   = make(chan struct{}, 1)
+	syncPullNow = make(chan struct{}, 1)
+)
+
+func signal(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// encolarSubida anota que el censo cambió y hay que subirlo. No espera a la
+// red: la subida la hace syncWorker. Varios cambios seguidos se suben juntos,
+// porque siempre se sube el censo completo.
+func encolarSubida() {
+	if syncBackend == nil {
+		return
+	}
+	if err := updateSyncState(func(st *syncState) { st.Pendientes++ }); err != nil {
+		fmt.Printf("--- ERROR: No se pudo anotar el cambio en la cola de sincronización: %v ---\n", err)
+	}
+	signal(syncWake)
+}
+
+// reintentarSubida hace que el worker reintente ahora mismo.
+func reintentarSubida() {
+	signal(syncRetry)
+}
+
+// descargarAhora hace que pullWorker baje el libro compartido ahora mismo.
+func descargarAhora() {
+	signal(syncPullNow)
+}
+
+// pullWorker baja el libro compartido al iniciar, cada intervalo y cuando se
+// pide con descargarAhora. Con intervalo 0 solo baja al iniciar y a pedido.
+// Las páginas leen siempre la copia local, así nunca esperan a la red, y una
+// bajada que falla no toca la copia local.
+func pullWorker(intervalo time.Duration) {
+	for {
+		err := descargarCenso()
+		if err == nil {
+			err = sincronizarArchivos()
+		}
+		if err != nil {
+			fmt.Printf("--- ERROR: Sincronización: %v ---\n", err)
+		}
+		var tick <-chan time.Time
+		if intervalo > 0 {
+			tick = time.After(intervalo)
+		}
+		select {
+		case <-tick:
+		case <-syncPullNow:
+		}
+	}
+}
+
+// syncWorker sube los cambios pendientes, reintentando con espera creciente
+// mientras falle. Como los pendientes se guardan en el estado de la
+// sincronización, después de reiniciar el programa sigue donde quedó.
+func syncWorker() {
+	espera := SYNC_REINTENTO_MIN
+	for {
+		st, err := loadSyncState()
+		if err != nil {
+			fmt.Printf("--- ERROR: No se pudo leer el estado de la sincronización: %v ---\n", err)
+		}
+		if err == nil && st.Pendientes == 0 {
+			<-syncWake
+			continue
+		}
+
+		if err == nil {
+			err = subirCenso()
+		}
+		if err == nil {
+			err = sincronizarArchivos()
+		}
+		if err == nil {
+			// Lo que se anotó durante la subida queda para la próxima
+			updateSyncState(func(st2 *syncState) {
+				st2.Pendientes -= st.Pendientes
+				if st2.Pendientes < 0 {
+					st2.Pendientes = 0
+				}
+			})
+			setSyncStatus(func(s *SyncStatus) {
+				s.UltimaSubida = time.Now()
+				s.UltimoError, s.TipoError, s.FechaError, s.ProximoIntento = "", "", time.Time{}, time.Time{}
+			})
+			espera = SYNC_REINTENTO_MIN
+			continue
+		}
+
+		fmt.Printf("--- ERROR: Sincronización: %v (se reintentará en %s) ---\n", err, espera)
+		setSyncError(err)
+		setSyncStatus(func(s *SyncStatus) { s.ProximoIntento = time.Now().Add(espera) })
+		select {
+		case <-time.After(espera):
+		case <-syncRetry:
+		}
+		espera *= 2
+		if espera > SYNC_REINTENTO_MAX {
+			espera = SYNC_REINTENTO_MAX
+		}
+	}
+}
+
+func setSyncStatus(update func(s *SyncStatus)) {
+	statusMu.Lock()
+	defer statusMu.Unlock()
+	update(&syncStatus)
+}
+
+// Tipos de error de la sincronización, para que la página diga qué hacer.
+const (
+	SYNC_ERROR_CREDENCIALES = "credenciales" // hay que corregir las claves (o la de cifrado); reintentar no sirve
+	SYNC_ERROR_CONEXION     = "conexion"     // no se llegó al servidor o no entregó el token
+	SYNC_ERROR_OTRO         = "otro"
+)
+
+func setSyncError(err error) {
+	setSyncStatus(func(s *SyncStatus) {
+		s.UltimoError, s.TipoError, s.FechaError = err.Error(), syncErrorKind(err), time.Now()
+	})
+}
+
+func syncErrorKind(err error) string {
+	var tokenErr *DropboxTokenError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &tokenErr) && tokenErr.Credenciales(),
+		errors.Is(err, errCipherNoKey), errors.Is(err, errCipherWrongKey):
+		return SYNC_ERROR_CREDENCIALES
+	case errors.As(err, &tokenErr), errors.As(err, &netErr):
+		return SYNC_ERROR_CONEXION
+	}
+	return SYNC_ERROR_OTRO
+}
+
+// currentSyncStatus junta el estado en memoria con los pendientes y los
+// conflictos guardados.
+func currentSyncStatus() (SyncStatus, error) {
+	statusMu.Lock()
+	status := syncStatus
+	statusMu.Unlock()
+	if syncBackend == nil {
+		status.Backend = "ninguno"
+		return status, nil
+	}
+	status.Backend, status.Modo = syncBackend.Name(), syncModo
+	if syncModo == "cambios" {
+		status.Instancia = syncInstancia
+	}
+
+	st, err := loadSyncState()
+	status.Pendientes, status.Conflictos = st.Pendientes, len(st.Conflictos)
+	return status, err
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testSyncBackend revisa lo que promete SyncBackend con un backend vacío.
+func testSyncBackend(t *testing.T, b SyncBackend) {
+	t.Helper()
+	const name = "CENSO GENERAL NUEVO.xlsx"
+
+	if _, _, err := b.Pull(name); err != errRemoteNotFound {
+		t.Fatalf("Pull de un archivo que no existe devolvió %v, se esperaba errRemoteNotFound", err)
+	}
+	if _, err := b.Revision(name); err != errRemoteNotFound {
+		t.Fatalf("Revision de un archivo que no existe devolvió %v, se esperaba errRemoteNotFound", err)
+	}
+	if revs, err := b.List("imagenes"); err != nil || len(revs) != 0 {
+		t.Fatalf("List de una carpeta que no existe devolvió %v, %v", revs, err)
+	}
+
+	rev1, err := b.Push(name, []byte("uno"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, rev, err := b.Pull(name)
+	if err != nil || string(data) != "uno" || rev != rev1 {
+		t.Fatalf("Pull devolvió %q, %q, %v; se esperaba \"uno\", %q", data, rev, err, rev1)
+	}
+	if rev, err := b.Revision(name); err != nil || rev != rev1 {
+		t.Fatalf("Revision devolvió %q, %v; se esperaba %q", rev, err, rev1)
+	}
+
+	// Subir como si no existiera, o sobre una revisión vieja, no toca el remoto
+	if _, err := b.Push(name, []byte("otro"), ""); err != errRemoteChanged {
+		t.Fatalf("Push sin revisión sobre un archivo que existe devolvió %v, se esperaba errRemoteChanged", err)
+	}
+	rev2, err := b.Push(name, []byte("dos"), rev1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rev2 == rev1 {
+		t.Fatalf("la revisión no cambió al subir: %q", rev2)
+	}
+	if _, err := b.Push(name, []byte("tres"), rev1); err != errRemoteChanged {
+		t.Fatalf("Push sobre una revisión vieja devolvió %v, se esperaba errRemoteChanged", err)
+	}
+	if data, _, _ := b.Pull(name); !bytes.Equal(data, []byte("dos")) {
+		t.Fatalf("un Push rechazado cambió el remoto a %q", data)
+	}
+
+	// Los archivos en una carpeta que todavía no existe
+	fotoRev, err := b.Push("imagenes/foto.png", []byte("foto"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Push("imagenes/otra foto.png", []byte("otra"), ""); err != nil {
+		t.Fatal(err)
+	}
+	revs, err := b.List("imagenes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revs) != 2 || revs["foto.png"] != fotoRev || revs["otra foto.png"] == "" {
+		t.Fatalf("List devolvió %v; se esperaba foto.png en %q y otra foto.png", revs, fotoRev)
+	}
+
+	oldFotoRev := fotoRev
+	if fotoRev, err = b.Push("imagenes/foto.png", []byte("foto editada"), fotoRev); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Delete("imagenes/foto.png", oldFotoRev); err != errRemoteChanged {
+		t.Fatalf("Delete sobre una revisión vieja devolvió %v, se esperaba errRemoteChanged", err)
+	}
+	if _, _, err := b.Pull("imagenes/foto.png"); err != nil {
+		t.Fatalf("un Delete rechazado borró el archivo: %v", err)
+	}
+	if err := b.Delete("imagenes/foto.png", fotoRev); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := b.Pull("imagenes/foto.png"); err != errRemoteNotFound {
+		t.Fatalf("Pull después de Delete devolvió %v, se esperaba errRemoteNotFound", err)
+	}
+	if err := b.Delete("imagenes/foto.png", fotoRev); err != nil {
+		t.Fatalf("Delete de un archivo que ya no existe devolvió %v", err)
+	}
+	if revs, err := b.List("imagenes"); err != nil || len(revs) != 1 {
+		t.Fatalf("List después de Delete devolvió %v, %v", revs, err)
+	}
+}
+
+// testComputer es una de las computadoras de una prueba de sincronización:
+// su carpeta (con sync/ y el diario), su censo y su diario.
+type testComputer struct {
+	name    string
+	dir     string
+	store   *ExcelStore
+	journal *JSONLJournal
+	census  *journaledCensus
+}
+
+// newTestComputer crea una computadora con el censo de testCensus(n).
+func newTestComputer(t *testing.T, name string, n int) *testComputer {
+	t.Helper()
+	dir := t.TempDir()
+	headers, records := testCensus(n)
+	var book bytes.Buffer
+	if err := writeWorkbook(&book, PRIMERA_HOJA, headers, records); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, filepath.Base(EXCEL_FILE))
+	if err := ioutil.WriteFile(path, book.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c := &testComputer{name: name, dir: dir, store: &ExcelStore{Path: path, Sheet: PRIMERA_HOJA}}
+	c.journal = &JSONLJournal{Path: filepath.Join(dir, JOURNAL_FILE)}
+	c.census = newJournaledCensus(c.store, c.store, c.journal)
+	c.census.instancia = name
+	return c
+}
+
+// use hace que el programa sea esta computadora: su carpeta de trabajo, su
+// censo, su diario y su nombre.
+func (c *testComputer) use(t *testing.T) {
+	t.Helper()
+	if err := os.Chdir(c.dir); err != nil {
+		t.Fatal(err)
+	}
+	census, journal, syncInstancia = c.census, c.journal, c.name
+}
+
+// useTestBackend comparte backend entre las computadoras de la prueba y
+// deja todo como estaba al terminar.
+func useTestBackend(t *testing.T, backend SyncBackend, modo string) {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldCensus, oldJournal, oldBackend, oldName := census, journal, syncBackend, syncCensusName
+	oldModo, oldInstancia := syncModo, syncInstancia
+	t.Cleanup(func() {
+		os.Chdir(wd)
+		census, journal, syncBackend, syncCensusName = oldCensus, oldJournal, oldBackend, oldName
+		syncModo, syncInstancia = oldModo, oldInstancia
+	})
+	syncBackend, syncCensusName, syncModo = backend, filepath.Base(EXCEL_FILE), modo
+}
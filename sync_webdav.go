@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// WebDAVBackend guarda los archivos en la carpeta Dir (una dirección que
+// termina en "/") de un servidor WebDAV, como Nextcloud. La revisión es el
+// ETag del servidor, o la fecha de modificación si el servidor no manda ETag.
+type WebDAVBackend struct {
+	Dir      string
+	User     string
+	Password func() string
+	Client   *http.Client
+}
+
+func (d *WebDAVBackend) Name() string { return "WebDAV" }
+
+// url arma la dirección de name, escapando cada parte de la ruta.
+func (d *WebDAVBackend) url(name string) string {
+	parts := strings.Split(name, "/")
+	for i, p := range parts {
+		parts[i] = url.PathEscape(p)
+	}
+	return d.Dir + strings.Join(parts, "/")
+}
+
+func (d *WebDAVBackend) do(method, target string, body []byte, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequest(method, target, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if d.User != "" {
+		req.SetBasicAuth(d.User, d.Password())
+	}
+	if body != nil && req.Header.Get("Content-Type") == "" {
+		req.Header.Set("Content-Type", "application/octet-stream")
+	}
+	resp, err := d.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, errRemoteNotFound
+	}
+	if resp.StatusCode == http.StatusPreconditionFailed {
+		resp.Body.Close()
+		return nil, errRemoteChanged
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		resp.Body.Close()
+		return nil, &webdavStatusError{Method: method, URL: target, Status: resp.Status, Code: resp.StatusCode}
+	}
+	return resp, nil
+}
+
+// webdavStatusError es una respuesta del servidor que no es 2xx (salvo 404 y
+// 412, que son errRemoteNotFound y errRemoteChanged).
+type webdavStatusError struct {
+	Method, URL, Status string
+	Code                int
+}
+
+func (e *webdavStatusError) Error() string {
+	return fmt.Sprintf("%s %s: %s", e.Method, e.URL, e.Status)
+}
+
+func isWebDAVStatus(err error, code int) bool {
+	var statusErr *webdavStatusError
+	return errors.As(err, &statusErr) && statusErr.Code == code
+}
+
+func webdavRevision(resp *http.Response) string {
+	if etag := resp.Header.Get("ETag"); etag != "" {
+		return etag
+	}
+	return resp.Header.Get("Last-Modified")
+}
+
+// webdavCondition arma los encabezados para que el servidor solo acepte el
+// cambio si el archivo sigue en parentRev: If-Match con el ETag esperado (o
+// If-Unmodified-Since si la revisión es una fecha), o If-None-Match: * si
+// todavía no hay archivo. El servidor responde 412 si otra computadora lo
+// cambió.
+func webdavCondition(parentRev string) http.Header {
+	header := http.Header{}
+	switch {
+	case parentRev == "":
+		header.Set("If-None-Match", "*")
+	case strings.HasPrefix(parentRev, `"`) || strings.HasPrefix(parentRev, `W/"`):
+		header.Set("If-Match", parentRev)
+	default:
+		header.Set("If-Unmodified-Since", parentRev)
+	}
+	return header
+}
+
+func (d *WebDAVBackend) Pull(name string) ([]byte, string, error) {
+	resp, err := d.do("GET", d.url(name), nil, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", err
+	}
+	return data, webdavRevision(resp), nil
+}
+
+// Push sube con la condición de webdavCondition. Si la carpeta del archivo
+// no existe (409) la crea y vuelve a intentar.
+func (d *WebDAVBackend) Push(name string, data []byte, parentRev string) (string, error) {
+	resp, err := d.do("PUT", d.url(name), data, webdavCondition(parentRev))
+	if isWebDAVStatus(err, http.StatusConflict) && strings.Contains(name, "/") {
+		if err := d.mkcol(path.Dir(name)); err != nil {
+			return "", err
+		}
+		resp, err = d.do("PUT", d.url(name), data, webdavCondition(parentRev))
+	}
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	// No todos los servidores devuelven el ETag nuevo al subir
+	if rev := webdavRevision(resp); rev != "" {
+		return rev, nil
+	}
+	return d.Revision(name)
+}
+
+// mkcol crea la carpeta dir. Que ya exista (405) no es un error.
+func (d *WebDAVBackend) mkcol(dir string) error {
+	resp, err := d.do("MKCOL", d.url(dir)+"/", nil, nil)
+	if isWebDAVStatus(err, http.StatusMethodNotAllowed) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (d *WebDAVBackend) Revision(name string) (string, error) {
+	resp, err := d.do("HEAD", d.url(name), nil, nil)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	return webdavRevision(resp), nil
+}
+
+func (d *WebDAVBackend) Delete(name, parentRev string) error {
+	resp, err := d.do("DELETE", d.url(name), nil, webdavCondition(parentRev))
+	if err == errRemoteNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// webdavMultistatus es la respuesta de PROPFIND.
+type webdavMultistatus struct {
+	Responses []struct {
+		Href     string `xml:"DAV: href"`
+		Propstat []struct {
+			Prop struct {
+				ETag         string `xml:"DAV: getetag"`
+				LastModified string `xml:"DAV: getlastmodified"`
+				ResourceType struct {
+					Collection *struct{} `xml:"DAV: collection"`
+				} `xml:"DAV: resourcetype"`
+			} `xml:"DAV: prop"`
+		} `xml:"DAV: propstat"`
+	} `xml:"DAV: response"`
+}
+
+// List pide la carpeta con PROPFIND (Depth: 1).
+func (d *WebDAVBackend) List(dir string) (map[string]string, error) {
+	body := []byte(`<?xml version="1.0" encoding="utf-8"?><propfind xmlns="DAV:"><prop><getetag/><getlastmodified/><resourcetype/></prop></propfind>`)
+	header := http.Header{}
+	header.Set("Depth", "1")
+	header.Set("Content-Type", "application/xml")
+	resp, err := d.do("PROPFIND", d.url(dir)+"/", body, header)
+	if err == errRemoteNotFound {
+		return map[string]string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var ms webdavMultistatus
+	if err := xml.NewDecoder(resp.Body).Decode(&ms); err != nil {
+		return nil, fmt.Errorf("respuesta de WebDAV inválida: %v", err)
+	}
+	revs := make(map[string]string)
+	for _, r := range ms.Responses {
+		href := strings.TrimSuffix(r.Href, "/")
+		if unescaped, err := url.PathUnescape(href); err == nil {
+			href = unescaped
+		}
+		var rev string
+		collection := false
+		for _, ps := range r.Propstat {
+			if ps.Prop.ResourceType.Collection != nil {
+				collection = true
+			}
+			if ps.Prop.ETag != "" {
+				rev = ps.Prop.ETag
+			} else if rev == "" {
+				rev = ps.Prop.LastModified
+			}
+		}
+		if collection {
+			// La carpeta misma y sus subcarpetas
+			continue
+		}
+		revs[path.Base(href)] = rev
+	}
+	return revs, nil
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeWebDAV es un servidor WebDAV mínimo en memoria: GET, HEAD, PUT, MKCOL,
+// DELETE y PROPFIND con Depth 1, con ETag y las condiciones If-Match e
+// If-None-Match. Como los servidores reales, responde 409 si se sube a una
+// carpeta que no existe.
+type fakeWebDAV struct {
+	user, password string
+
+	mu    sync.Mutex
+	files map[string][]byte
+	etags map[string]string
+	dirs  map[string]bool
+	seq   int
+}
+
+func newFakeWebDAV(user, password string) *fakeWebDAV {
+	return &fakeWebDAV{
+		user: user, password: password,
+		files: map[string][]byte{}, etags: map[string]string{}, dirs: map[string]bool{"/dav/": true},
+	}
+}
+
+func (s *fakeWebDAV) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if user, password, _ := r.BasicAuth(); user != s.user || password != s.password {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p := r.URL.Path
+	etag, exists := s.etags[p]
+	precondition := func() bool {
+		if r.Header.Get("If-None-Match") == "*" && exists {
+			return false
+		}
+		if match := r.Header.Get("If-Match"); match != "" && (!exists || match != etag) {
+			return false
+		}
+		return true
+	}
+
+	switch r.Method {
+	case "GET", "HEAD":
+		if !exists {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		if r.Method == "GET" {
+			w.Write(s.files[p])
+		}
+	case "PUT":
+		if !s.dirs[path.Dir(p)+"/"] {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		if !precondition() {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		data, _ := ioutil.ReadAll(r.Body)
+		s.seq++
+		s.files[p], s.etags[p] = data, fmt.Sprintf(`"%d"`, s.seq)
+		w.Header().Set("ETag", s.etags[p])
+		w.WriteHeader(http.StatusCreated)
+	case "MKCOL":
+		if s.dirs[p] {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if !s.dirs[path.Dir(strings.TrimSuffix(p, "/"))+"/"] {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		s.dirs[p] = true
+		w.WriteHeader(http.StatusCreated)
+	case "DELETE":
+		if !exists {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if !precondition() {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		delete(s.files, p)
+		delete(s.etags, p)
+		w.WriteHeader(http.StatusNoContent)
+	case "PROPFIND":
+		if !s.dirs[p] {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		s.propfind(w, p)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// propfind responde con la carpeta dir, sus archivos y sus subcarpetas.
+func (s *fakeWebDAV) propfind(w http.ResponseWriter, dir string) {
+	type entry struct{ href, etag string }
+	entries := []entry{{href: dir}}
+	for name, etag := range s.etags {
+		if path.Dir(name)+"/" == dir {
+			entries = append(entries, entry{name, etag})
+		}
+	}
+	for name := range s.dirs {
+		if name != dir && path.Dir(strings.TrimSuffix(name, "/"))+"/" == dir {
+			entries = append(entries, entry{href: name})
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].href < entries[j].href })
+
+	var b strings.Builder
+	b.WriteString(`<?xml version="1.0" encoding="utf-8"?><d:multistatus xmlns:d="DAV:">`)
+	for _, e := range entries {
+		href := (&url.URL{Path: e.href}).EscapedPath()
+		prop := `<d:resourcetype><d:collection/></d:resourcetype>`
+		if e.etag != "" {
+			var escaped strings.Builder
+			xml.EscapeText(&escaped, []byte(e.etag))
+			prop = `<d:resourcetype/><d:getetag>` + escaped.String() + `</d:getetag>`
+		}
+		fmt.Fprintf(&b, `<d:response><d:href>%s</d:href><d:propstat><d:prop>%s</d:prop><d:status>HTTP/1.1 200 OK</d:status></d:propstat></d:response>`, href, prop)
+	}
+	b.WriteString(`</d:multistatus>`)
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(207)
+	w.Write([]byte(b.String()))
+}
+
+func newTestWebDAVBackend(t *testing.T) (*WebDAVBackend, *fakeWebDAV) {
+	fake := newFakeWebDAV("censo", "secreta")
+	srv := httptest.NewServer(fake)
+	t.Cleanup(srv.Close)
+	b := &WebDAVBackend{
+		Dir:      srv.URL + "/dav/",
+		User:     "censo",
+		Password: func() string { return "secreta" },
+		Client:   srv.Client(),
+	}
+	return b, fake
+}
+
+func TestWebDAVBackend(t *testing.T) {
+	b, _ := newTestWebDAVBackend(t)
+	testSyncBackend(t, b)
+}
+
+func TestWebDAVBackendWrongPassword(t *testing.T) {
+	b, _ := newTestWebDAVBackend(t)
+	b.Password = func() string { return "otra" }
+	_, _, err := b.Pull("history.json")
+	if !isWebDAVStatus(err, http.StatusUnauthorized) {
+		t.Fatalf("Pull con otra contraseña devolvió %v, se esperaba 401", err)
+	}
+}
+
+func TestWebDAVBackendPushCreatesFolder(t *testing.T) {
+	b, fake := newTestWebDAVBackend(t)
+	if _, err := b.Push("imagenes/foto.png", []byte("foto"), ""); err != nil {
+		t.Fatal(err)
+	}
+	if !fake.dirs["/dav/imagenes/"] {
+		t.Fatal("Push no creó la carpeta imagenes")
+	}
+	// La segunda foto encuentra la carpeta creada (MKCOL respondería 405)
+	if _, err := b.Push("imagenes/otra.png", []byte("otra"), ""); err != nil {
+		t.Fatal(err)
+	}
+}